@@ -0,0 +1,347 @@
+package auth
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+type Access byte
+
+const (
+	Read      Access = 0b01 // Subscribe to topics.
+	Write     Access = 0b10 // Publish to topics.
+	ReadWrite Access = Read | Write
+	Deny      Access = 0b00
+)
+
+var ErrInvalidACLFile = errors.New("invalid ACL file")
+
+type (
+	// Identity holds everything a client can be identified by in ACL rules.
+	Identity struct {
+		UserName   string
+		ClientID   string
+		CommonName string // Common name of the verified TLS client certificate.
+	}
+
+	aclSectionKind string
+
+	aclRule struct {
+		access  Access
+		filter  string
+		pattern bool // The filter contains %u and %c placeholders.
+	}
+
+	aclSection struct {
+		kind  aclSectionKind
+		name  string
+		rules []aclRule
+	}
+
+	// ACLFile authorizes publishing and subscribing using rules read from
+	// a file. Rules are grouped in sections that apply to a user name,
+	// client ID or certificate common name, rules before the first section
+	// apply to every client:
+	//
+	//	# Every client can read public topics and use its own topics.
+	//	topic read public/#
+	//	pattern readwrite clients/%c/#
+	//	pattern read users/%u/#
+	//
+	//	user alice
+	//	topic readwrite alice/#
+	//	topic deny alice/secret/#
+	//
+	//	client sensor-1
+	//	topic write sensors/1/#
+	//
+	//	cn gateway.example.com
+	//	topic readwrite gateways/#
+	//
+	// In patterns %u is replaced by the user name and %c by the client ID,
+	// which must not contain +, # or / for the pattern to apply.
+	// Access is read, write, readwrite or deny, a matching deny rule takes
+	// precedence over all other rules. Everything that is not allowed by a
+	// rule is denied.
+	//
+	// The file is reloaded when it changes on disk.
+	ACLFile struct {
+		mutex    sync.Mutex
+		file     watchedFile
+		sections []aclSection
+	}
+)
+
+const (
+	allSection    aclSectionKind = ""
+	userSection   aclSectionKind = "user"
+	clientSection aclSectionKind = "client"
+	cnSection     aclSectionKind = "cn"
+)
+
+// LoadACLFile reads the ACL file at path.
+func LoadACLFile(path string) (*ACLFile, error) {
+	acl := &ACLFile{file: watchedFile{path: path}}
+
+	acl.mutex.Lock()
+	defer acl.mutex.Unlock()
+
+	err := acl.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return acl, nil
+}
+
+// Allowed reports whether the client with identity is allowed access to
+// topic. For Read access topic is a subscription filter, a filter is only
+// allowed if every topic it matches is allowed. Shared subscriptions are
+// checked against the filter without the $share/<group>/ prefix.
+func (acl *ACLFile) Allowed(identity Identity, access Access, topic string) bool {
+	if access == Read {
+		topic = stripSharePrefix(topic)
+	}
+
+	allowed := false
+	for _, rule := range acl.rules(identity) {
+		filter := rule.filter
+		if rule.pattern {
+			// A pattern can not apply to a client that lacks the identity it refers to.
+			if (strings.Contains(filter, "%u") && identity.UserName == "") ||
+				(strings.Contains(filter, "%c") && identity.ClientID == "") {
+				continue
+			}
+			// A user name or client ID with wildcards or levels would widen
+			// the pattern to the topics of other clients. Such a pattern
+			// grants nothing, and if it denies it denies everything.
+			if (strings.Contains(filter, "%u") && !isPatternValue(identity.UserName)) ||
+				(strings.Contains(filter, "%c") && !isPatternValue(identity.ClientID)) {
+				if rule.access == Deny {
+					return false
+				}
+				continue
+			}
+			filter = strings.NewReplacer("%u", identity.UserName, "%c", identity.ClientID).Replace(filter)
+		}
+
+		if rule.access == Deny {
+			if filterOverlaps(filter, topic) {
+				return false
+			}
+			continue
+		}
+
+		if rule.access&access == access && filterCovers(filter, topic) {
+			allowed = true
+		}
+	}
+
+	return allowed
+}
+
+// isPatternValue reports whether value can be substituted into a pattern as
+// a single topic level.
+func isPatternValue(value string) bool {
+	return !strings.ContainsAny(value, "+#/\x00")
+}
+
+// SetLogger sets the logger that reloads of the file are logged to.
+func (acl *ACLFile) SetLogger(logger *slog.Logger) {
+	acl.mutex.Lock()
+	defer acl.mutex.Unlock()
+
+	acl.file.log = logger
+}
+
+// rules returns the rules that apply to identity.
+func (acl *ACLFile) rules(identity Identity) []aclRule {
+	acl.mutex.Lock()
+	defer acl.mutex.Unlock()
+
+	if acl.file.changed() {
+		// Keep using the previous rules if the new file is invalid.
+		err := acl.load()
+		acl.file.reloaded(err)
+	}
+
+	rules := []aclRule{}
+	for _, section := range acl.sections {
+		applies := false
+		switch section.kind {
+		case allSection:
+			applies = true
+		case userSection:
+			applies = identity.UserName != "" && section.name == identity.UserName
+		case clientSection:
+			applies = identity.ClientID != "" && section.name == identity.ClientID
+		case cnSection:
+			applies = identity.CommonName != "" && section.name == identity.CommonName
+		}
+		if applies {
+			rules = append(rules, section.rules...)
+		}
+	}
+
+	return rules
+}
+
+// load reads the file, the lock must be held.
+func (acl *ACLFile) load() error {
+	info, err := acl.file.stat()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(acl.file.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	sections, err := parseACL(bufio.NewScanner(file))
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrInvalidACLFile, acl.file.path, err)
+	}
+
+	acl.sections = sections
+	acl.file.loaded(info)
+
+	return nil
+}
+
+func parseACL(scanner *bufio.Scanner) ([]aclSection, error) {
+	sections := []aclSection{{kind: allSection}}
+
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		keyword, rest, _ := strings.Cut(line, " ")
+		rest = strings.TrimSpace(rest)
+
+		switch keyword {
+		case string(userSection), string(clientSection), string(cnSection):
+			if rest == "" {
+				return nil, fmt.Errorf("line %d: %s needs a name", lineNumber, keyword)
+			}
+			sections = append(sections, aclSection{kind: aclSectionKind(keyword), name: rest})
+
+		case "topic", "pattern":
+			rule, err := parseACLRule(rest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+			rule.pattern = keyword == "pattern"
+			section := &sections[len(sections)-1]
+			section.rules = append(section.rules, rule)
+
+		default:
+			return nil, fmt.Errorf("line %d: unknown keyword %q", lineNumber, keyword)
+		}
+	}
+
+	return sections, scanner.Err()
+}
+
+// parseACLRule parses "[access] <filter>", access defaults to readwrite.
+func parseACLRule(rule string) (aclRule, error) {
+	fields := strings.Fields(rule)
+
+	access := ReadWrite
+	switch len(fields) {
+	case 1:
+	case 2:
+		switch fields[0] {
+		case "read":
+			access = Read
+		case "write":
+			access = Write
+		case "readwrite":
+			access = ReadWrite
+		case "deny":
+			access = Deny
+		default:
+			return aclRule{}, fmt.Errorf("unknown access %q", fields[0])
+		}
+		fields = fields[1:]
+	default:
+		return aclRule{}, errors.New("expected [access] <filter>")
+	}
+
+	return aclRule{access: access, filter: fields[0]}, nil
+}
+
+// filterCovers reports whether every topic matched by filter is also
+// matched by rule. A topic name is a filter without wildcards.
+func filterCovers(rule, filter string) bool {
+	ruleLevels := strings.Split(rule, "/")
+	filterLevels := strings.Split(filter, "/")
+
+	for i, ruleLevel := range ruleLevels {
+		if ruleLevel == "#" {
+			// 4.7.2: Topics starting with $ are not matched by a leading wildcard.
+			return i > 0 || !strings.HasPrefix(filter, "$")
+		}
+		if i >= len(filterLevels) {
+			return false
+		}
+
+		filterLevel := filterLevels[i]
+		switch ruleLevel {
+		case "+":
+			if filterLevel == "#" || (i == 0 && strings.HasPrefix(filterLevel, "$")) {
+				return false
+			}
+		default:
+			if filterLevel != ruleLevel {
+				return false
+			}
+		}
+	}
+
+	return len(ruleLevels) == len(filterLevels)
+}
+
+// filterOverlaps reports whether there is a topic matched by both filters.
+func filterOverlaps(a, b string) bool {
+	aLevels := strings.Split(a, "/")
+	bLevels := strings.Split(b, "/")
+
+	for i := 0; i < len(aLevels) && i < len(bLevels); i++ {
+		if aLevels[i] == "#" || bLevels[i] == "#" {
+			return true
+		}
+		if aLevels[i] == "+" || bLevels[i] == "+" {
+			continue
+		}
+		if aLevels[i] != bLevels[i] {
+			return false
+		}
+	}
+
+	// A # at the end of a filter also matches its parent level.
+	switch len(aLevels) - len(bLevels) {
+	case 1:
+		return aLevels[len(aLevels)-1] == "#"
+	case -1:
+		return bLevels[len(bLevels)-1] == "#"
+	}
+
+	return len(aLevels) == len(bLevels)
+}
+
+func stripSharePrefix(filter string) string {
+	levels := strings.SplitN(filter, "/", 3)
+	if len(levels) == 3 && levels[0] == "$share" {
+		return levels[2]
+	}
+	return filter
+}
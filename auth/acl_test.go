@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testACL = `
+# Rules for all clients
+topic read public/#
+pattern readwrite clients/%c/#
+pattern read users/%u/inbox
+
+user alice
+topic alice/#
+topic deny alice/secret/#
+
+client sensor-1
+topic write sensors/1/+
+
+cn gateway.example.com
+topic readwrite gateways/#
+`
+
+func TestACLFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl")
+	err := os.WriteFile(path, []byte(testACL), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acl, err := LoadACLFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice := Identity{UserName: "alice", ClientID: "phone"}
+	sensor := Identity{ClientID: "sensor-1"}
+	gateway := Identity{ClientID: "gw", CommonName: "gateway.example.com"}
+	anonymous := Identity{ClientID: "anonymous"}
+
+	aclCases := []struct {
+		identity Identity
+		access   Access
+		topic    string
+		want     bool
+	}{
+		{anonymous, Read, "public/news", true},
+		{anonymous, Read, "public/#", true},
+		{anonymous, Read, "#", false},
+		{anonymous, Read, "+/news", false},
+		{anonymous, Write, "public/news", false},
+		{anonymous, Read, "$share/group/public/news", true},
+		{anonymous, Read, "$SYS/#", false},
+		{anonymous, Write, "clients/anonymous/status", true},
+		{anonymous, Write, "clients/phone/status", false},
+		{anonymous, Read, "users//inbox", false},
+		{alice, Write, "alice/photos", true},
+		{alice, Read, "alice/#", false},
+		{alice, Read, "alice/+/x", false},
+		{alice, Read, "alice/photos/x", true},
+		{alice, Write, "alice/secret/diary", false},
+		{alice, Write, "alice/secret", false},
+		{alice, Read, "alice/secret", false},
+		{alice, Read, "alice/+", false},
+		{alice, Read, "alice/+/diary", false},
+		{alice, Read, "+/secret", false},
+		{alice, Read, "users/alice/inbox", true},
+		{alice, Read, "users/bob/inbox", false},
+		{alice, Read, "clients/phone/+", true},
+		{sensor, Write, "sensors/1/temperature", true},
+		{sensor, Write, "sensors/1/temperature/x", false},
+		{sensor, Read, "sensors/1/temperature", false},
+		{sensor, Write, "sensors/2/temperature", false},
+		{gateway, Read, "gateways/#", true},
+		{Identity{ClientID: "gw"}, Read, "gateways/#", false},
+	}
+
+	for _, c := range aclCases {
+		got := acl.Allowed(c.identity, c.access, c.topic)
+		if got != c.want {
+			t.Fatalf("%+v access %d to %s: wanted %v but got %v",
+				c.identity, c.access, c.topic, c.want, got)
+		}
+	}
+}
+
+func TestACLFilePatternIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl")
+	err := os.WriteFile(path, []byte("topic read public/#\npattern readwrite devices/%c/#\npattern deny users/%u/private\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acl, err := LoadACLFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aclCases := []struct {
+		identity Identity
+		access   Access
+		topic    string
+		want     bool
+	}{
+		{Identity{ClientID: "lamp"}, Write, "devices/lamp/state", true},
+		{Identity{ClientID: "lamp"}, Read, "devices/other/#", false},
+		{Identity{ClientID: "#"}, Read, "devices/#/#", false},
+		{Identity{ClientID: "#"}, Write, "devices/other/state", false},
+		{Identity{ClientID: "+"}, Read, "devices/other/#", false},
+		{Identity{ClientID: "+"}, Read, "public/news", true},
+		{Identity{ClientID: "a/b"}, Write, "devices/a/b/state", false},
+		{Identity{ClientID: "a\x00"}, Write, "devices/a\x00/state", false},
+		{Identity{ClientID: "lamp", UserName: "alice"}, Read, "public/news", true},
+		{Identity{ClientID: "lamp", UserName: "+"}, Read, "public/news", false},
+	}
+
+	for _, c := range aclCases {
+		got := acl.Allowed(c.identity, c.access, c.topic)
+		if got != c.want {
+			t.Fatalf("%+v access %d to %s: wanted %v but got %v",
+				c.identity, c.access, c.topic, c.want, got)
+		}
+	}
+}
+
+func TestACLFileInvalid(t *testing.T) {
+	invalidCases := []string{
+		"topic",
+		"topic publish a/b",
+		"user",
+		"subscribe a/b",
+		"topic read a b",
+	}
+
+	for _, c := range invalidCases {
+		path := filepath.Join(t.TempDir(), "acl")
+		err := os.WriteFile(path, []byte(c), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = LoadACLFile(path)
+		if !errors.Is(err, ErrInvalidACLFile) {
+			t.Fatalf("%q: wanted %v but got %v", c, ErrInvalidACLFile, err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Files are checked for changes at most once per interval.
+const reloadCheckInterval = time.Second
+
+// watchedFile detects changes to a file that is loaded into memory.
+type watchedFile struct {
+	path      string
+	modTime   time.Time
+	lastCheck time.Time
+	log       *slog.Logger // Logs reloads, the default logger if nil.
+}
+
+// changed reports whether the file was modified since it was last loaded.
+func (file *watchedFile) changed() bool {
+	if time.Since(file.lastCheck) < reloadCheckInterval {
+		return false
+	}
+	file.lastCheck = time.Now()
+
+	info, err := os.Stat(file.path)
+	return err == nil && !info.ModTime().Equal(file.modTime)
+}
+
+// stat returns the file info to pass to loaded once the file has been read.
+// Taking the modification time before reading ensures that changes made
+// while reading are detected later on.
+func (file *watchedFile) stat() (os.FileInfo, error) {
+	return os.Stat(file.path)
+}
+
+func (file *watchedFile) loaded(info os.FileInfo) {
+	file.modTime = info.ModTime()
+	file.lastCheck = time.Now()
+}
+
+// reloaded logs the result of reloading a changed file.
+func (file *watchedFile) reloaded(err error) {
+	log := file.log
+	if log == nil {
+		log = slog.Default()
+	}
+
+	if err != nil {
+		log.Warn("failed to reload file, keeping the previous contents", "file", file.path, "error", err)
+	} else {
+		log.Info("reloaded file", "file", file.path)
+	}
+}
@@ -0,0 +1,549 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"log/slog"
+	"math/big"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWTMethod is the name of the enhanced authentication method that sends a
+// JWT as authentication data.
+const JWTMethod = "JWT"
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+	ErrInvalidJWKS  = errors.New("invalid JWKS file")
+)
+
+type (
+	// JWTClaimNames are the names of the claims that are mapped to the
+	// client, empty names get the default name.
+	JWTClaimNames struct {
+		ClientID  string // Defaults to client_id.
+		UserName  string // Defaults to sub.
+		Publish   string // Defaults to publish, a list of topic filters.
+		Subscribe string // Defaults to subscribe, a list of topic filters.
+	}
+
+	JWTVerifierConfig struct {
+		JWKSFile string        // JSON Web Key Set with the keys tokens are signed with.
+		Secret   []byte        // Shared secret for HMAC signed tokens.
+		Issuer   string        // Required iss claim if not empty.
+		Audience string        // Required aud claim if not empty.
+		Leeway   time.Duration // Allowed clock skew for exp and nbf.
+		Claims   JWTClaimNames
+	}
+
+	// Token holds the verified claims of a JWT.
+	Token struct {
+		ClientID string // Empty if the token does not bind a client ID.
+		UserName string
+		Expiry   time.Time
+		Grants   *Grants // Nil if the token does not grant topics.
+	}
+
+	// Grants are the topic filters a client may publish and subscribe to.
+	Grants struct {
+		Publish   []string
+		Subscribe []string
+	}
+
+	// JWTVerifier verifies JSON Web Tokens signed with a shared secret or
+	// one of the keys of a JWKS file. The JWKS file is reloaded when it
+	// changes on disk. Tokens must have an exp claim.
+	JWTVerifier struct {
+		config JWTVerifierConfig
+
+		mutex sync.Mutex
+		file  watchedFile
+		keys  []jsonWebKey
+	}
+
+	jsonWebKey struct {
+		id        string
+		algorithm string // Empty if the key does not restrict the algorithm.
+		key       any    // *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey.
+	}
+
+	jwtHeader struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+
+	jwtAuthenticator struct {
+		verifier *JWTVerifier
+		token    *Token
+	}
+)
+
+// NewJWTVerifier creates a verifier, the JWKS file is read if configured.
+func NewJWTVerifier(config JWTVerifierConfig) (*JWTVerifier, error) {
+	if config.JWKSFile == "" && len(config.Secret) == 0 {
+		return nil, errors.New("JWT verification needs a JWKS file or a secret")
+	}
+
+	claims := &config.Claims
+	for _, name := range []struct {
+		value        *string
+		defaultValue string
+	}{
+		{&claims.ClientID, "client_id"},
+		{&claims.UserName, "sub"},
+		{&claims.Publish, "publish"},
+		{&claims.Subscribe, "subscribe"},
+	} {
+		if *name.value == "" {
+			*name.value = name.defaultValue
+		}
+	}
+
+	verifier := &JWTVerifier{config: config, file: watchedFile{path: config.JWKSFile}}
+	if config.JWKSFile != "" {
+		verifier.mutex.Lock()
+		defer verifier.mutex.Unlock()
+
+		err := verifier.load()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return verifier, nil
+}
+
+// IsJWT reports whether a password looks like a JWT rather than a password.
+func IsJWT(password []byte) bool {
+	encodedHeader, _, ok := strings.Cut(string(password), ".")
+	if !ok || strings.Count(string(password), ".") != 2 {
+		return false
+	}
+
+	header := jwtHeader{}
+	err := decodeJWTPart(encodedHeader, &header)
+	return err == nil && header.Algorithm != ""
+}
+
+// Verify checks the signature and claims of a token.
+func (verifier *JWTVerifier) Verify(token string) (*Token, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: expected 3 parts", ErrInvalidToken)
+	}
+
+	header := jwtHeader{}
+	err := decodeJWTPart(parts[0], &header)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature encoding", ErrInvalidToken)
+	}
+
+	err = verifier.verifySignature(header, parts[0]+"."+parts[1], signature)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := map[string]any{}
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return verifier.verifyClaims(claims, time.Now())
+}
+
+func (verifier *JWTVerifier) verifySignature(header jwtHeader, signingInput string, signature []byte) error {
+	if strings.HasPrefix(header.Algorithm, "HS") {
+		if len(verifier.config.Secret) == 0 {
+			return fmt.Errorf("%w: no secret for algorithm %s", ErrInvalidToken, header.Algorithm)
+		}
+		newHash, err := jwtHash(header.Algorithm)
+		if err != nil {
+			return err
+		}
+		mac := hmac.New(newHash, verifier.config.Secret)
+		mac.Write([]byte(signingInput))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return fmt.Errorf("%w: signature mismatch", ErrInvalidToken)
+		}
+		return nil
+	}
+
+	for _, key := range verifier.jsonWebKeys() {
+		if header.KeyID != "" && key.id != header.KeyID {
+			continue
+		}
+		if key.algorithm != "" && key.algorithm != header.Algorithm {
+			continue
+		}
+		ok, err := verifyJWTSignature(header.Algorithm, key.key, signingInput, signature)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: no key verifies the signature", ErrInvalidToken)
+}
+
+// verifyJWTSignature reports whether signature is valid for an asymmetric
+// algorithm. Keys of another type than the algorithm never match.
+func verifyJWTSignature(algorithm string, key any, signingInput string, signature []byte) (bool, error) {
+	if algorithm == "EdDSA" {
+		publicKey, ok := key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(publicKey, []byte(signingInput), signature), nil
+	}
+
+	newHash, err := jwtHash(algorithm)
+	if err != nil {
+		return false, err
+	}
+	digest := newHash()
+	digest.Write([]byte(signingInput))
+	hashed := digest.Sum(nil)
+	hashType := map[int]crypto.Hash{32: crypto.SHA256, 48: crypto.SHA384, 64: crypto.SHA512}[len(hashed)]
+
+	switch algorithm[:2] {
+	case "RS":
+		publicKey, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(publicKey, hashType, hashed, signature) == nil, nil
+
+	case "PS":
+		publicKey, ok := key.(*rsa.PublicKey)
+		options := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}
+		return ok && rsa.VerifyPSS(publicKey, hashType, hashed, signature, options) == nil, nil
+
+	case "ES":
+		publicKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return false, nil
+		}
+		// The curve must match the hash, e.g. P-256 for ES256, and the
+		// signature holds r and s with the size of the curve.
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		if size != map[int]int{32: 32, 48: 48, 64: 66}[len(hashed)] || len(signature) != 2*size {
+			return false, nil
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(publicKey, hashed, r, s), nil
+
+	default:
+		return false, fmt.Errorf("%w: unsupported algorithm %s", ErrInvalidToken, algorithm)
+	}
+}
+
+func jwtHash(algorithm string) (func() hash.Hash, error) {
+	if len(algorithm) == 5 {
+		switch algorithm[2:] {
+		case "256":
+			return sha256.New, nil
+		case "384":
+			return sha512.New384, nil
+		case "512":
+			return sha512.New, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: unsupported algorithm %s", ErrInvalidToken, algorithm)
+}
+
+func (verifier *JWTVerifier) verifyClaims(claims map[string]any, now time.Time) (*Token, error) {
+	config := verifier.config
+	token := &Token{}
+
+	expiry, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("%w: no exp claim", ErrInvalidToken)
+	}
+	token.Expiry = time.Unix(int64(expiry), 0)
+	if now.After(token.Expiry.Add(config.Leeway)) {
+		return nil, ErrTokenExpired
+	}
+
+	if notBefore, ok := claims["nbf"].(float64); ok {
+		if now.Before(time.Unix(int64(notBefore), 0).Add(-config.Leeway)) {
+			return nil, fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+		}
+	}
+
+	if config.Issuer != "" && claims["iss"] != config.Issuer {
+		return nil, fmt.Errorf("%w: issuer", ErrInvalidToken)
+	}
+
+	if config.Audience != "" {
+		audiences := []string{}
+		switch audience := claims["aud"].(type) {
+		case string:
+			audiences = append(audiences, audience)
+		case []any:
+			for _, a := range audience {
+				if s, ok := a.(string); ok {
+					audiences = append(audiences, s)
+				}
+			}
+		}
+		if !slices.Contains(audiences, config.Audience) {
+			return nil, fmt.Errorf("%w: audience", ErrInvalidToken)
+		}
+	}
+
+	var err error
+	token.ClientID, err = stringClaim(claims, config.Claims.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	token.UserName, err = stringClaim(claims, config.Claims.UserName)
+	if err != nil {
+		return nil, err
+	}
+
+	_, hasPublish := claims[config.Claims.Publish]
+	_, hasSubscribe := claims[config.Claims.Subscribe]
+	if hasPublish || hasSubscribe {
+		token.Grants = &Grants{}
+		token.Grants.Publish, err = stringListClaim(claims, config.Claims.Publish)
+		if err != nil {
+			return nil, err
+		}
+		token.Grants.Subscribe, err = stringListClaim(claims, config.Claims.Subscribe)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return token, nil
+}
+
+func stringClaim(claims map[string]any, name string) (string, error) {
+	value, ok := claims[name]
+	if !ok {
+		return "", nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%w: claim %s is not a string", ErrInvalidToken, name)
+	}
+	return s, nil
+}
+
+// stringListClaim returns a claim that is a list of strings, or a string of
+// space separated values like the OAuth scope claim.
+func stringListClaim(claims map[string]any, name string) ([]string, error) {
+	switch value := claims[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return strings.Fields(value), nil
+	case []any:
+		list := make([]string, 0, len(value))
+		for _, v := range value {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%w: claim %s is not a list of strings", ErrInvalidToken, name)
+			}
+			list = append(list, s)
+		}
+		return list, nil
+	default:
+		return nil, fmt.Errorf("%w: claim %s is not a list of strings", ErrInvalidToken, name)
+	}
+}
+
+func decodeJWTPart(part string, v any) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("%w: encoding", ErrInvalidToken)
+	}
+	err = json.NewDecoder(bytes.NewReader(decoded)).Decode(v)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+	return nil
+}
+
+// Allowed reports whether the grants allow access to topic, for Read access
+// topic is a subscription filter.
+func (grants *Grants) Allowed(access Access, topic string) bool {
+	filters := grants.Publish
+	if access == Read {
+		filters = grants.Subscribe
+		topic = stripSharePrefix(topic)
+	}
+
+	for _, filter := range filters {
+		if filterCovers(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetLogger sets the logger that reloads of the JWKS file are logged to.
+func (verifier *JWTVerifier) SetLogger(logger *slog.Logger) {
+	verifier.mutex.Lock()
+	defer verifier.mutex.Unlock()
+
+	verifier.file.log = logger
+}
+
+// jsonWebKeys returns the keys of the JWKS file.
+func (verifier *JWTVerifier) jsonWebKeys() []jsonWebKey {
+	if verifier.config.JWKSFile == "" {
+		return nil
+	}
+
+	verifier.mutex.Lock()
+	defer verifier.mutex.Unlock()
+
+	if verifier.file.changed() {
+		// Keep using the previous keys if the new file is invalid.
+		err := verifier.load()
+		verifier.file.reloaded(err)
+	}
+
+	return verifier.keys
+}
+
+// load reads the JWKS file, the lock must be held.
+func (verifier *JWTVerifier) load() error {
+	info, err := verifier.file.stat()
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(verifier.file.path)
+	if err != nil {
+		return err
+	}
+
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrInvalidJWKS, verifier.file.path, err)
+	}
+
+	verifier.keys = keys
+	verifier.file.loaded(info)
+
+	return nil
+}
+
+// parseJWKS parses the public signing keys of a JSON Web Key Set (RFC 7517),
+// other keys are skipped.
+func parseJWKS(data []byte) ([]jsonWebKey, error) {
+	set := struct {
+		Keys []struct {
+			Type      string `json:"kty"`
+			ID        string `json:"kid"`
+			Algorithm string `json:"alg"`
+			Use       string `json:"use"`
+			N         string `json:"n"`
+			E         string `json:"e"`
+			Curve     string `json:"crv"`
+			X         string `json:"x"`
+			Y         string `json:"y"`
+		} `json:"keys"`
+	}{}
+	err := json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []jsonWebKey{}
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key := jsonWebKey{id: k.ID, algorithm: k.Algorithm}
+		switch {
+		case k.Type == "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			exponent := new(big.Int).SetBytes(e)
+			if err1 != nil || err2 != nil || len(n) == 0 || !exponent.IsInt64() || exponent.Int64() < 3 {
+				return nil, fmt.Errorf("key %d: invalid RSA key", i)
+			}
+			key.key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+
+		case k.Type == "EC":
+			curve, ok := map[string]elliptic.Curve{
+				"P-256": elliptic.P256(),
+				"P-384": elliptic.P384(),
+				"P-521": elliptic.P521(),
+			}[k.Curve]
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if !ok || err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("key %d: invalid EC key", i)
+			}
+			publicKey := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !curve.IsOnCurve(publicKey.X, publicKey.Y) {
+				return nil, fmt.Errorf("key %d: point is not on the curve", i)
+			}
+			key.key = publicKey
+
+		case k.Type == "OKP" && k.Curve == "Ed25519":
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if err != nil || len(x) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("key %d: invalid Ed25519 key", i)
+			}
+			key.key = ed25519.PublicKey(x)
+
+		default:
+			// Symmetric keys do not belong in a file of public keys, and
+			// other key types are not supported.
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// NewJWTAuthenticator creates the authenticator of the JWT enhanced
+// authentication method, the token is the authentication data.
+func NewJWTAuthenticator(verifier *JWTVerifier) Authenticator {
+	return &jwtAuthenticator{verifier: verifier}
+}
+
+func (authenticator *jwtAuthenticator) Step(data []byte) ([]byte, bool, error) {
+	token, err := authenticator.verifier.Verify(string(data))
+	if err != nil {
+		return nil, false, err
+	}
+	authenticator.token = token
+	return nil, true, nil
+}
+
+func (authenticator *jwtAuthenticator) UserName() string {
+	return authenticator.token.UserName
+}
+
+// Token returns the verified token.
+func (authenticator *jwtAuthenticator) Token() *Token {
+	return authenticator.token
+}
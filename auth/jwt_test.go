@@ -0,0 +1,240 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// signJWT creates a token signed with key, which is a shared secret for
+// HS256 or a private key for the other algorithms.
+func signJWT(t *testing.T, algorithm string, kid string, key any, claims map[string]any) string {
+	t.Helper()
+
+	header, err := json.Marshal(map[string]string{"alg": algorithm, "typ": "JWT", "kid": kid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	hashed := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+	switch algorithm {
+	case "HS256":
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(signingInput))
+		signature = mac.Sum(nil)
+	case "RS256":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, hashed[:])
+	case "PS256":
+		signature, err = rsa.SignPSS(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, hashed[:],
+			&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), hashed[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case "EdDSA":
+		signature = ed25519.Sign(key.(ed25519.PrivateKey), []byte(signingInput))
+	default:
+		t.Fatalf("unknown algorithm %s", algorithm)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTVerifier(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPublicKey, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRSAKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encode := base64.RawURLEncoding.EncodeToString
+	jwks, err := json.Marshal(map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "n": encode(rsaKey.N.Bytes()), "e": "AQAB"},
+		{"kty": "EC", "kid": "ec", "crv": "P-256",
+			"x": encode(ecKey.X.FillBytes(make([]byte, 32))), "y": encode(ecKey.Y.FillBytes(make([]byte, 32)))},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": encode(edPublicKey)},
+		{"kty": "RSA", "kid": "encryption", "use": "enc", "n": encode(otherRSAKey.N.Bytes()), "e": "AQAB"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	err = os.WriteFile(jwksFile, jwks, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := []byte("shared secret")
+	verifier, err := NewJWTVerifier(JWTVerifierConfig{
+		JWKSFile: jwksFile,
+		Secret:   secret,
+		Issuer:   "provisioning",
+		Audience: "broker",
+		Leeway:   5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	claims := func(changes map[string]any) map[string]any {
+		c := map[string]any{
+			"iss":       "provisioning",
+			"aud":       []string{"other", "broker"},
+			"sub":       "device-user",
+			"client_id": "device-1",
+			"exp":       now + 60,
+			"nbf":       now - 60,
+		}
+		for name, value := range changes {
+			if value == nil {
+				delete(c, name)
+			} else {
+				c[name] = value
+			}
+		}
+		return c
+	}
+
+	verifierCases := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"HS256", signJWT(t, "HS256", "", secret, claims(nil)), nil},
+		{"RS256", signJWT(t, "RS256", "rsa", rsaKey, claims(nil)), nil},
+		{"PS256", signJWT(t, "PS256", "rsa", rsaKey, claims(nil)), nil},
+		{"ES256", signJWT(t, "ES256", "ec", ecKey, claims(nil)), nil},
+		{"EdDSA without kid", signJWT(t, "EdDSA", "", edKey, claims(nil)), nil},
+		{"wrong secret", signJWT(t, "HS256", "", []byte("guess"), claims(nil)), ErrInvalidToken},
+		{"wrong key", signJWT(t, "RS256", "rsa", otherRSAKey, claims(nil)), ErrInvalidToken},
+		{"encryption key", signJWT(t, "RS256", "encryption", otherRSAKey, claims(nil)), ErrInvalidToken},
+		{"key of other type", signJWT(t, "RS256", "ec", rsaKey, claims(nil)), ErrInvalidToken},
+		{"expired", signJWT(t, "HS256", "", secret, claims(map[string]any{"exp": now - 10})), ErrTokenExpired},
+		{"expired within leeway", signJWT(t, "HS256", "", secret, claims(map[string]any{"exp": now - 2})), nil},
+		{"no expiry", signJWT(t, "HS256", "", secret, claims(map[string]any{"exp": nil})), ErrInvalidToken},
+		{"not valid yet", signJWT(t, "HS256", "", secret, claims(map[string]any{"nbf": now + 60})), ErrInvalidToken},
+		{"wrong issuer", signJWT(t, "HS256", "", secret, claims(map[string]any{"iss": "mallory"})), ErrInvalidToken},
+		{"wrong audience", signJWT(t, "HS256", "", secret, claims(map[string]any{"aud": "other"})), ErrInvalidToken},
+		{"none algorithm", "eyJhbGciOiJub25lIn0.e30.", ErrInvalidToken},
+		{"malformed", "not.a.token", ErrInvalidToken},
+	}
+
+	for _, c := range verifierCases {
+		token, err := verifier.Verify(c.token)
+		if !errors.Is(err, c.want) {
+			t.Fatalf("%s: wanted %v but got %v", c.name, c.want, err)
+		}
+		if err == nil && (token.UserName != "device-user" || token.ClientID != "device-1" || token.Grants != nil) {
+			t.Fatalf("%s: wrong claims: %+v", c.name, token)
+		}
+	}
+}
+
+func TestJWTClaims(t *testing.T) {
+	secret := []byte("shared secret")
+	verifier, err := NewJWTVerifier(JWTVerifierConfig{
+		Secret: secret,
+		Claims: JWTClaimNames{UserName: "name", Subscribe: "scope"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiry := time.Now().Add(time.Minute).Truncate(time.Second)
+	token, err := verifier.Verify(signJWT(t, "HS256", "", secret, map[string]any{
+		"exp":     expiry.Unix(),
+		"sub":     "ignored",
+		"name":    "alice",
+		"publish": []string{"devices/alice/#"},
+		"scope":   "public/# devices/+/status",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token.UserName != "alice" || token.ClientID != "" || !token.Expiry.Equal(expiry) {
+		t.Fatalf("wrong claims: %+v", token)
+	}
+
+	grantCases := []struct {
+		access Access
+		topic  string
+		want   bool
+	}{
+		{Write, "devices/alice/temperature", true},
+		{Write, "devices/bob/temperature", false},
+		{Read, "devices/alice/temperature", false},
+		{Read, "public/news", true},
+		{Read, "$share/group/devices/+/status", true},
+		{Read, "devices/#", false},
+	}
+
+	for _, c := range grantCases {
+		got := token.Grants.Allowed(c.access, c.topic)
+		if got != c.want {
+			t.Fatalf("access %d to %s: wanted %v but got %v", c.access, c.topic, c.want, got)
+		}
+	}
+
+	_, err = verifier.Verify(signJWT(t, "HS256", "", secret, map[string]any{
+		"exp":     expiry.Unix(),
+		"publish": []any{"a", 1},
+	}))
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("wanted %v for invalid grants but got %v", ErrInvalidToken, err)
+	}
+}
+
+func TestIsJWT(t *testing.T) {
+	isJWTCases := []struct {
+		password string
+		want     bool
+	}{
+		{"eyJhbGciOiJIUzI1NiJ9.e30.c2ln", true},
+		{"secret", false},
+		{"pass.word.with.dots", false},
+		{"a.b.c", false},
+	}
+
+	for _, c := range isJWTCases {
+		got := IsJWT([]byte(c.password))
+		if got != c.want {
+			t.Fatalf("%s: wanted %v but got %v", c.password, c.want, got)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package auth
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const DefaultCost = bcrypt.DefaultCost
+
+var (
+	ErrInvalidPasswordFile = errors.New("invalid password file")
+	ErrUnknownUser         = errors.New("unknown user")
+	ErrInvalidUserName     = errors.New("invalid user name")
+)
+
+type (
+	// PasswordEntry is a single line of a password file.
+	PasswordEntry struct {
+		UserName string
+		Hash     string
+	}
+
+	// PasswordFile verifies credentials against a file with a
+	// user name and hash per line, separated by a colon:
+	//
+	//	# Comment
+	//	alice:$2a$10$...
+	//	bob:SCRAM-SHA-256$4096:...
+	//
+	// Hashes are bcrypt hashes or SCRAM-SHA-256 credentials, only users with
+	// SCRAM credentials can authenticate with SCRAM.
+	//
+	// The file is reloaded when it changes on disk.
+	PasswordFile struct {
+		mutex  sync.Mutex
+		file   watchedFile
+		hashes map[string][]byte
+	}
+
+	// Hasher hashes a password for storage in a password file.
+	Hasher func(password []byte) (string, error)
+)
+
+// LoadPasswordFile reads the password file at path.
+func LoadPasswordFile(path string) (*PasswordFile, error) {
+	passwords := &PasswordFile{file: watchedFile{path: path}}
+
+	passwords.mutex.Lock()
+	defer passwords.mutex.Unlock()
+
+	err := passwords.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return passwords, nil
+}
+
+// Authenticate reports whether password is the password of the user.
+func (passwords *PasswordFile) Authenticate(userName string, password []byte) bool {
+	hash, ok := passwords.hash(userName)
+	if !ok {
+		// Compare against a dummy hash anyway so that the response time
+		// does not reveal whether the user exists.
+		bcrypt.CompareHashAndPassword(dummyHash, password)
+		return false
+	}
+
+	credentials, err := ParseSCRAMCredentials(string(hash))
+	if err == nil {
+		return credentials.verify(password)
+	}
+
+	return bcrypt.CompareHashAndPassword(hash, password) == nil
+}
+
+// SCRAMCredentials returns the SCRAM credentials of a user, it returns false
+// if the user is unknown or has a bcrypt hash.
+func (passwords *PasswordFile) SCRAMCredentials(userName string) (SCRAMCredentials, bool) {
+	hash, ok := passwords.hash(userName)
+	if !ok {
+		return SCRAMCredentials{}, false
+	}
+
+	credentials, err := ParseSCRAMCredentials(string(hash))
+	return credentials, err == nil
+}
+
+// SetLogger sets the logger that reloads of the file are logged to.
+func (passwords *PasswordFile) SetLogger(logger *slog.Logger) {
+	passwords.mutex.Lock()
+	defer passwords.mutex.Unlock()
+
+	passwords.file.log = logger
+}
+
+func (passwords *PasswordFile) hash(userName string) ([]byte, bool) {
+	passwords.mutex.Lock()
+	defer passwords.mutex.Unlock()
+
+	if passwords.file.changed() {
+		// Keep using the previous users if the new file is invalid.
+		err := passwords.load()
+		passwords.file.reloaded(err)
+	}
+
+	hash, ok := passwords.hashes[userName]
+	return hash, ok
+}
+
+// load reads the file, the lock must be held.
+func (passwords *PasswordFile) load() error {
+	info, err := passwords.file.stat()
+	if err != nil {
+		return err
+	}
+
+	entries, err := ReadPasswordEntries(passwords.file.path)
+	if err != nil {
+		return err
+	}
+
+	hashes := make(map[string][]byte, len(entries))
+	for _, entry := range entries {
+		if !isHash(entry.Hash) {
+			return fmt.Errorf("%w: user %s: not a bcrypt hash or SCRAM credentials",
+				ErrInvalidPasswordFile, entry.UserName)
+		}
+		hashes[entry.UserName] = []byte(entry.Hash)
+	}
+
+	passwords.hashes = hashes
+	passwords.file.loaded(info)
+
+	return nil
+}
+
+// ReadPasswordEntries reads all entries of a password file. The hashes are
+// not verified, so the entries may contain plain text passwords.
+func ReadPasswordEntries(path string) ([]PasswordEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := []PasswordEntry{}
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		userName, hash, ok := strings.Cut(line, ":")
+		if !ok || userName == "" || hash == "" {
+			return nil, fmt.Errorf("%w: %s:%d: expected user:hash",
+				ErrInvalidPasswordFile, path, lineNumber)
+		}
+		entries = append(entries, PasswordEntry{UserName: userName, Hash: hash})
+	}
+
+	return entries, scanner.Err()
+}
+
+// WritePasswordEntries replaces the password file with entries. The file is
+// written to a temporary file first so readers never see a partial file.
+func WritePasswordEntries(path string, entries []PasswordEntry) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	writer := bufio.NewWriter(temp)
+	for _, entry := range entries {
+		fmt.Fprintf(writer, "%s:%s\n", entry.UserName, entry.Hash)
+	}
+
+	err = errors.Join(writer.Flush(), temp.Chmod(0o600), temp.Close())
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), path)
+}
+
+// HashPassword hashes a password with bcrypt.
+func HashPassword(password []byte, cost int) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword(password, cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// BcryptHasher hashes passwords with bcrypt.
+func BcryptHasher(cost int) Hasher {
+	return func(password []byte) (string, error) {
+		return HashPassword(password, cost)
+	}
+}
+
+// SCRAMHasher derives SCRAM-SHA-256 credentials, which can be used with both
+// password and SCRAM authentication.
+func SCRAMHasher(iterations int) Hasher {
+	return func(password []byte) (string, error) {
+		return HashSCRAMPassword(password, iterations)
+	}
+}
+
+// SetPassword adds a user to entries or replaces the hash of an existing user.
+func SetPassword(entries []PasswordEntry, userName string, password []byte, hasher Hasher) ([]PasswordEntry, error) {
+	if userName == "" || strings.ContainsAny(userName, ":\n") {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidUserName, userName)
+	}
+
+	hash, err := hasher(password)
+	if err != nil {
+		return nil, err
+	}
+
+	i := slices.IndexFunc(entries, func(entry PasswordEntry) bool {
+		return entry.UserName == userName
+	})
+	if i == -1 {
+		return append(entries, PasswordEntry{UserName: userName, Hash: hash}), nil
+	}
+
+	entries[i].Hash = hash
+	return entries, nil
+}
+
+// RemoveUser removes a user from entries.
+func RemoveUser(entries []PasswordEntry, userName string) ([]PasswordEntry, error) {
+	i := slices.IndexFunc(entries, func(entry PasswordEntry) bool {
+		return entry.UserName == userName
+	})
+	if i == -1 {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownUser, userName)
+	}
+
+	return slices.Delete(entries, i, i+1), nil
+}
+
+// Rehash hashes the entries that contain a plain text password instead of a
+// hash. It returns the names of the users that were rehashed.
+func Rehash(entries []PasswordEntry, hasher Hasher) ([]string, error) {
+	rehashed := []string{}
+	for i, entry := range entries {
+		if isHash(entry.Hash) {
+			continue
+		}
+
+		hash, err := hasher([]byte(entry.Hash))
+		if err != nil {
+			return nil, err
+		}
+		entries[i].Hash = hash
+		rehashed = append(rehashed, entry.UserName)
+	}
+
+	return rehashed, nil
+}
+
+// isHash reports whether hash is a bcrypt hash or SCRAM credentials.
+func isHash(hash string) bool {
+	_, err := bcrypt.Cost([]byte(hash))
+	if err == nil {
+		return true
+	}
+	_, err = ParseSCRAMCredentials(hash)
+	return err == nil
+}
+
+// Hash of a random password, compared against for unknown users.
+var dummyHash = []byte("$2a$10$liv8featbHAKgn0Sn7T5X./4aHJo/ZIrbw82opui5VHVgoZ28q/Z6")
@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writePasswords(t *testing.T, path string, entries []PasswordEntry, modTime time.Time) {
+	t.Helper()
+
+	err := WritePasswordEntries(path, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(path, modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPasswordFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passwords")
+
+	entries, err := SetPassword(nil, "alice", []byte("secret"), BcryptHasher(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-time.Minute)
+	writePasswords(t, path, entries, modTime)
+
+	passwords, err := LoadPasswordFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !passwords.Authenticate("alice", []byte("secret")) {
+		t.Fatal("wanted alice to be authenticated")
+	}
+	if passwords.Authenticate("alice", []byte("guess")) {
+		t.Fatal("wanted wrong password to be rejected")
+	}
+	if passwords.Authenticate("bob", []byte("hunter2")) {
+		t.Fatal("wanted unknown user to be rejected")
+	}
+
+	// Changes on disk are picked up.
+	entries, err = SetPassword(entries, "bob", []byte("hunter2"), BcryptHasher(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err = RemoveUser(entries, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime = modTime.Add(time.Second)
+	writePasswords(t, path, entries, modTime)
+	passwords.file.lastCheck = time.Time{}
+
+	if !passwords.Authenticate("bob", []byte("hunter2")) {
+		t.Fatal("wanted bob to be authenticated after reload")
+	}
+	if passwords.Authenticate("alice", []byte("secret")) {
+		t.Fatal("wanted alice to be rejected after reload")
+	}
+
+	// An invalid file keeps the previous users.
+	err = os.WriteFile(path, []byte("garbage\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, modTime.Add(time.Second), modTime.Add(time.Second))
+	passwords.file.lastCheck = time.Time{}
+
+	if !passwords.Authenticate("bob", []byte("hunter2")) {
+		t.Fatal("wanted bob to still be authenticated after an invalid reload")
+	}
+}
+
+func TestPasswordEntries(t *testing.T) {
+	entries := []PasswordEntry{{UserName: "plain", Hash: "text"}}
+
+	entries, err := SetPassword(entries, "alice", []byte("secret"), BcryptHasher(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = SetPassword(entries, "in:valid", []byte("secret"), BcryptHasher(4))
+	if !errors.Is(err, ErrInvalidUserName) {
+		t.Fatalf("wanted %v but got %v", ErrInvalidUserName, err)
+	}
+	_, err = RemoveUser(entries, "bob")
+	if !errors.Is(err, ErrUnknownUser) {
+		t.Fatalf("wanted %v but got %v", ErrUnknownUser, err)
+	}
+
+	aliceHash := entries[1].Hash
+	rehashed, err := Rehash(entries, BcryptHasher(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rehashed) != 1 || rehashed[0] != "plain" {
+		t.Fatalf("wanted only the plain text entry rehashed but got %v", rehashed)
+	}
+	if entries[1].Hash != aliceHash {
+		t.Fatal("wanted the existing hash to be left alone")
+	}
+
+	path := filepath.Join(t.TempDir(), "passwords")
+	writePasswords(t, path, entries, time.Now())
+	passwords, err := LoadPasswordFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !passwords.Authenticate("plain", []byte("text")) {
+		t.Fatal("wanted rehashed password to be accepted")
+	}
+}
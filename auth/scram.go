@@ -0,0 +1,375 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// SCRAMSHA256 is the name of the SCRAM-SHA-256 authentication method (RFC 7677).
+	SCRAMSHA256 = "SCRAM-SHA-256"
+
+	DefaultSCRAMIterations = 4096
+
+	scramSaltSize  = 16
+	scramNonceSize = 18
+)
+
+var (
+	ErrAuthenticationFailed = errors.New("authentication failed")
+	ErrInvalidSCRAMMessage  = errors.New("invalid SCRAM message")
+)
+
+type (
+	// Authenticator is the server side of a challenge/response authentication
+	// method, as used by MQTT enhanced authentication (4.12).
+	Authenticator interface {
+		// Step processes authentication data from the client and returns the
+		// data to send back. Done is true once the client is authenticated.
+		Step(data []byte) (response []byte, done bool, err error)
+		// UserName returns the name of the authenticated user.
+		UserName() string
+	}
+
+	// SCRAMCredentials are the values a server stores to verify a password
+	// with SCRAM, the password itself can not be derived from them.
+	SCRAMCredentials struct {
+		Iterations int
+		Salt       []byte
+		StoredKey  []byte
+		ServerKey  []byte
+	}
+
+	// SCRAMCredentialStore looks up the SCRAM credentials of a user.
+	SCRAMCredentialStore interface {
+		SCRAMCredentials(userName string) (SCRAMCredentials, bool)
+	}
+
+	scramServer struct {
+		store           SCRAMCredentialStore
+		step            int
+		userName        string
+		gs2Header       string
+		clientFirstBare string
+		serverFirst     string
+		nonce           string
+		credentials     SCRAMCredentials
+		known           bool // False if the credentials are made up for an unknown user.
+	}
+
+	// SCRAMClient is the client side of SCRAM-SHA-256.
+	SCRAMClient struct {
+		userName        string
+		password        []byte
+		clientFirstBare string
+		nonce           string
+		serverSignature []byte
+	}
+)
+
+// Key for made up salts of unknown users, so that the salt of a user name is
+// the same in every attempt and does not reveal whether the user exists.
+var unknownUserSaltKey = randomBytes(32)
+
+// NewSCRAMServer starts a SCRAM-SHA-256 exchange that verifies users against store.
+func NewSCRAMServer(store SCRAMCredentialStore) Authenticator {
+	return &scramServer{store: store}
+}
+
+func (server *scramServer) UserName() string {
+	return server.userName
+}
+
+func (server *scramServer) Step(data []byte) ([]byte, bool, error) {
+	server.step++
+	switch server.step {
+	case 1:
+		response, err := server.clientFirst(string(data))
+		return response, false, err
+	case 2:
+		response, err := server.clientFinal(string(data))
+		return response, err == nil, err
+	default:
+		return nil, false, fmt.Errorf("%w: exchange already completed", ErrInvalidSCRAMMessage)
+	}
+}
+
+// clientFirst handles "n,,n=user,r=nonce" and returns the server-first message.
+func (server *scramServer) clientFirst(message string) ([]byte, error) {
+	parts := strings.SplitN(message, ",", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: client-first-message", ErrInvalidSCRAMMessage)
+	}
+
+	// Channel binding is not supported, so the flag must be n or y (RFC 5802 6).
+	if parts[0] != "n" && parts[0] != "y" {
+		return nil, fmt.Errorf("%w: channel binding is not supported", ErrInvalidSCRAMMessage)
+	}
+	if parts[1] != "" {
+		return nil, fmt.Errorf("%w: authorization identity is not supported", ErrInvalidSCRAMMessage)
+	}
+	server.gs2Header = parts[0] + "," + parts[1] + ","
+	server.clientFirstBare = parts[2]
+
+	attributes, err := scramAttributes(server.clientFirstBare, "n", "r")
+	if err != nil {
+		return nil, err
+	}
+	server.userName, err = scramUnescape(attributes["n"])
+	if err != nil {
+		return nil, err
+	}
+
+	server.credentials, server.known = server.store.SCRAMCredentials(server.userName)
+	if !server.known {
+		mac := hmac.New(sha256.New, unknownUserSaltKey)
+		mac.Write([]byte(server.userName))
+		server.credentials = SCRAMCredentials{
+			Iterations: DefaultSCRAMIterations,
+			Salt:       mac.Sum(nil)[:scramSaltSize],
+		}
+	}
+
+	server.nonce = attributes["r"] + base64.RawStdEncoding.EncodeToString(randomBytes(scramNonceSize))
+	server.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d",
+		server.nonce,
+		base64.StdEncoding.EncodeToString(server.credentials.Salt),
+		server.credentials.Iterations)
+
+	return []byte(server.serverFirst), nil
+}
+
+// clientFinal handles "c=biws,r=nonce,p=proof" and returns the server-final message.
+func (server *scramServer) clientFinal(message string) ([]byte, error) {
+	withoutProof, proof, ok := strings.Cut(message, ",p=")
+	if !ok {
+		return nil, fmt.Errorf("%w: client-final-message without proof", ErrInvalidSCRAMMessage)
+	}
+
+	attributes, err := scramAttributes(withoutProof, "c", "r")
+	if err != nil {
+		return nil, err
+	}
+	if attributes["c"] != base64.StdEncoding.EncodeToString([]byte(server.gs2Header)) ||
+		attributes["r"] != server.nonce {
+		return nil, fmt.Errorf("%w: channel binding or nonce mismatch", ErrInvalidSCRAMMessage)
+	}
+
+	clientProof, err := base64.StdEncoding.DecodeString(proof)
+	if err != nil || len(clientProof) != sha256.Size {
+		return nil, fmt.Errorf("%w: client proof", ErrInvalidSCRAMMessage)
+	}
+
+	authMessage := server.clientFirstBare + "," + server.serverFirst + "," + withoutProof
+	if !server.known {
+		return nil, ErrAuthenticationFailed
+	}
+
+	clientSignature := hmacSHA256(server.credentials.StoredKey, authMessage)
+	clientKey := make([]byte, sha256.Size)
+	subtle.XORBytes(clientKey, clientProof, clientSignature)
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], server.credentials.StoredKey) != 1 {
+		return nil, ErrAuthenticationFailed
+	}
+
+	serverSignature := hmacSHA256(server.credentials.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+// NewSCRAMClient creates the client side of a SCRAM-SHA-256 exchange.
+func NewSCRAMClient(userName string, password []byte) *SCRAMClient {
+	return &SCRAMClient{userName: userName, password: password}
+}
+
+// Start returns the client-first message, which is sent as the
+// authentication data of the CONNECT packet.
+func (client *SCRAMClient) Start() []byte {
+	client.nonce = base64.RawStdEncoding.EncodeToString(randomBytes(scramNonceSize))
+	client.clientFirstBare = "n=" + scramEscape(client.userName) + ",r=" + client.nonce
+	return []byte("n,," + client.clientFirstBare)
+}
+
+// Step answers the server-first message with the client-final message.
+// Given the server-final message it verifies the server and returns done.
+func (client *SCRAMClient) Step(data []byte) ([]byte, bool, error) {
+	message := string(data)
+
+	if client.serverSignature != nil {
+		attributes, err := scramAttributes(message, "v")
+		if err != nil {
+			return nil, false, err
+		}
+		signature, err := base64.StdEncoding.DecodeString(attributes["v"])
+		if err != nil || !hmac.Equal(signature, client.serverSignature) {
+			return nil, false, fmt.Errorf("%w: invalid server signature", ErrAuthenticationFailed)
+		}
+		return nil, true, nil
+	}
+
+	attributes, err := scramAttributes(message, "r", "s", "i")
+	if err != nil {
+		return nil, false, err
+	}
+	if !strings.HasPrefix(attributes["r"], client.nonce) {
+		return nil, false, fmt.Errorf("%w: server nonce", ErrInvalidSCRAMMessage)
+	}
+	salt, err := base64.StdEncoding.DecodeString(attributes["s"])
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: salt", ErrInvalidSCRAMMessage)
+	}
+	iterations, err := strconv.Atoi(attributes["i"])
+	if err != nil || iterations < 1 {
+		return nil, false, fmt.Errorf("%w: iteration count", ErrInvalidSCRAMMessage)
+	}
+
+	saltedPassword := pbkdf2.Key(client.password, salt, iterations, sha256.Size, sha256.New)
+	clientKey := hmacSHA256(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte("n,,")) + ",r=" + attributes["r"]
+	authMessage := client.clientFirstBare + "," + message + "," + withoutProof
+
+	clientSignature := hmacSHA256(storedKey[:], authMessage)
+	proof := make([]byte, sha256.Size)
+	subtle.XORBytes(proof, clientKey, clientSignature)
+
+	client.serverSignature = hmacSHA256(hmacSHA256(saltedPassword, "Server Key"), authMessage)
+
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), false, nil
+}
+
+// NewSCRAMCredentials derives the stored credentials for a password.
+func NewSCRAMCredentials(password []byte, salt []byte, iterations int) SCRAMCredentials {
+	saltedPassword := pbkdf2.Key(password, salt, iterations, sha256.Size, sha256.New)
+	storedKey := sha256.Sum256(hmacSHA256(saltedPassword, "Client Key"))
+
+	return SCRAMCredentials{
+		Iterations: iterations,
+		Salt:       salt,
+		StoredKey:  storedKey[:],
+		ServerKey:  hmacSHA256(saltedPassword, "Server Key"),
+	}
+}
+
+// HashSCRAMPassword derives SCRAM credentials with a random salt and
+// encodes them for a password file.
+func HashSCRAMPassword(password []byte, iterations int) (string, error) {
+	if iterations < 1 {
+		return "", fmt.Errorf("invalid iteration count: %d", iterations)
+	}
+	return NewSCRAMCredentials(password, randomBytes(scramSaltSize), iterations).String(), nil
+}
+
+// String encodes the credentials as SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>.
+func (credentials SCRAMCredentials) String() string {
+	encode := base64.StdEncoding.EncodeToString
+	return fmt.Sprintf("%s$%d:%s$%s:%s", SCRAMSHA256,
+		credentials.Iterations,
+		encode(credentials.Salt),
+		encode(credentials.StoredKey),
+		encode(credentials.ServerKey))
+}
+
+// verify reports whether password matches the credentials.
+func (credentials SCRAMCredentials) verify(password []byte) bool {
+	derived := NewSCRAMCredentials(password, credentials.Salt, credentials.Iterations)
+	return subtle.ConstantTimeCompare(derived.StoredKey, credentials.StoredKey) == 1
+}
+
+// ParseSCRAMCredentials decodes credentials encoded by SCRAMCredentials.String.
+func ParseSCRAMCredentials(encoded string) (SCRAMCredentials, error) {
+	invalid := fmt.Errorf("%w: not %s credentials", ErrInvalidPasswordFile, SCRAMSHA256)
+
+	method, rest, _ := strings.Cut(encoded, "$")
+	parameters, keys, _ := strings.Cut(rest, "$")
+	iterationsText, salt, _ := strings.Cut(parameters, ":")
+	storedKey, serverKey, _ := strings.Cut(keys, ":")
+	if method != SCRAMSHA256 {
+		return SCRAMCredentials{}, invalid
+	}
+
+	iterations, err := strconv.Atoi(iterationsText)
+	if err != nil || iterations < 1 {
+		return SCRAMCredentials{}, invalid
+	}
+
+	credentials := SCRAMCredentials{Iterations: iterations}
+	for _, field := range []struct {
+		encoded string
+		decoded *[]byte
+	}{
+		{salt, &credentials.Salt},
+		{storedKey, &credentials.StoredKey},
+		{serverKey, &credentials.ServerKey},
+	} {
+		*field.decoded, err = base64.StdEncoding.DecodeString(field.encoded)
+		if err != nil || len(*field.decoded) == 0 {
+			return SCRAMCredentials{}, invalid
+		}
+	}
+
+	return credentials, nil
+}
+
+// scramAttributes parses comma separated attributes like "n=user,r=nonce",
+// all required attributes must be present.
+func scramAttributes(message string, required ...string) (map[string]string, error) {
+	attributes := map[string]string{}
+	for _, attribute := range strings.Split(message, ",") {
+		name, value, ok := strings.Cut(attribute, "=")
+		if !ok || len(name) != 1 {
+			return nil, fmt.Errorf("%w: attribute %q", ErrInvalidSCRAMMessage, attribute)
+		}
+		// RFC 5802 5.1: m is reserved for mandatory extensions, which are not supported.
+		if name == "m" {
+			return nil, fmt.Errorf("%w: unsupported extension", ErrInvalidSCRAMMessage)
+		}
+		attributes[name] = value
+	}
+
+	for _, name := range required {
+		if attributes[name] == "" {
+			return nil, fmt.Errorf("%w: missing attribute %s", ErrInvalidSCRAMMessage, name)
+		}
+	}
+
+	return attributes, nil
+}
+
+// scramEscape escapes a user name as saslname (RFC 5802 5.1).
+func scramEscape(userName string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(userName)
+}
+
+func scramUnescape(saslName string) (string, error) {
+	unescaped := strings.NewReplacer("=2C", ",", "=3D", "=").Replace(saslName)
+	if strings.Count(unescaped, "=") != strings.Count(saslName, "=3D") {
+		return "", fmt.Errorf("%w: invalid user name encoding", ErrInvalidSCRAMMessage)
+	}
+	return unescaped, nil
+}
+
+func hmacSHA256(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+)
+
+type scramStore map[string]SCRAMCredentials
+
+func (store scramStore) SCRAMCredentials(userName string) (SCRAMCredentials, bool) {
+	credentials, ok := store[userName]
+	return credentials, ok
+}
+
+// The example exchange of RFC 7677 section 3.
+func TestSCRAMClientRFC7677(t *testing.T) {
+	client := NewSCRAMClient("user", []byte("pencil"))
+	client.Start()
+	client.nonce = "rOprNGfwEbeRWgbNEkqO"
+	client.clientFirstBare = "n=user,r=rOprNGfwEbeRWgbNEkqO"
+
+	response, done, err := client.Step([]byte(
+		"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	if err != nil || done {
+		t.Fatalf("wanted the exchange to continue but got %v", err)
+	}
+
+	want := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+		"p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	if string(response) != want {
+		t.Fatalf("wanted %s but got %s", want, response)
+	}
+
+	_, done, err = client.Step([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="))
+	if err != nil || !done {
+		t.Fatalf("wanted the server to be verified but got %v", err)
+	}
+}
+
+func TestSCRAMExchange(t *testing.T) {
+	hash, err := HashSCRAMPassword([]byte("p,a=ss"), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials, err := ParseSCRAMCredentials(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := scramStore{"a=b,c": credentials}
+
+	exchangeCases := []struct {
+		userName string
+		password string
+		want     error
+	}{
+		{userName: "a=b,c", password: "p,a=ss", want: nil},
+		{userName: "a=b,c", password: "pass", want: ErrAuthenticationFailed},
+		{userName: "unknown", password: "p,a=ss", want: ErrAuthenticationFailed},
+	}
+
+	for _, c := range exchangeCases {
+		client := NewSCRAMClient(c.userName, []byte(c.password))
+		server := NewSCRAMServer(store)
+
+		serverFirst, done, err := server.Step(client.Start())
+		if err != nil || done {
+			t.Fatalf("%s: wanted the exchange to continue but got %v", c.userName, err)
+		}
+		clientFinal, _, err := client.Step(serverFirst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverFinal, done, err := server.Step(clientFinal)
+		if !errors.Is(err, c.want) {
+			t.Fatalf("%s/%s: wanted %v but got %v", c.userName, c.password, c.want, err)
+		}
+		if err != nil {
+			continue
+		}
+
+		if !done || server.UserName() != c.userName {
+			t.Fatalf("wanted %s to be authenticated", c.userName)
+		}
+		_, done, err = client.Step(serverFinal)
+		if err != nil || !done {
+			t.Fatalf("wanted the server to be verified but got %v", err)
+		}
+	}
+}
+
+func TestSCRAMInvalidMessages(t *testing.T) {
+	invalidCases := []string{
+		"",
+		"p=tls-unique,,n=user,r=abc",
+		"n,a=admin,n=user,r=abc",
+		"n,,n=user",
+		"n,,m=ext,n=user,r=abc",
+		"n,,n=us=er,r=abc",
+	}
+
+	for _, c := range invalidCases {
+		_, _, err := NewSCRAMServer(scramStore{}).Step([]byte(c))
+		if !errors.Is(err, ErrInvalidSCRAMMessage) {
+			t.Fatalf("%q: wanted %v but got %v", c, ErrInvalidSCRAMMessage, err)
+		}
+	}
+}
+
+func TestSCRAMPasswordFile(t *testing.T) {
+	hash, err := HashSCRAMPassword([]byte("secret"), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isHash(hash) {
+		t.Fatalf("wanted %s to be accepted in a password file", hash)
+	}
+
+	credentials, err := ParseSCRAMCredentials(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credentials.String() != hash {
+		t.Fatalf("wanted %s but got %s", hash, credentials.String())
+	}
+	if !credentials.verify([]byte("secret")) || credentials.verify([]byte("guess")) {
+		t.Fatal("wanted only the right password to be verified")
+	}
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/client"
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+const benchUsage = `Usage: %s bench [flags]
+
+Measures the throughput and latency of a broker. The subscribers connect and subscribe first, then the
+publishers publish -rate messages per second each for -duration. Every payload starts with the time it was
+published, the subscribers measure the end-to-end latency with it.
+
+Publisher i publishes to <prefix>/<i mod topics> and subscriber j subscribes to <prefix>/<j mod topics>, or to
+<prefix>/+ with -wildcard. A message is therefore delivered to subscribers/topics subscribers, or to all
+subscribers with -wildcard. With -client-id the clients are named <id>-pub-<i> and <id>-sub-<j>, otherwise the
+broker assigns their identifiers.
+
+Flags:
+`
+
+// benchHeaderSize is the size of the header of the payloads: the time the
+// message was published in Unix nanoseconds, the index of the publisher and
+// the sequence number of the message of that publisher.
+const benchHeaderSize = 8 + 4 + 8
+
+type (
+	benchConfig struct {
+		options     client.Options
+		publishers  int
+		subscribers int
+		// rate is the number of messages per second of every publisher,
+		// zero publishes as fast as possible.
+		rate     float64
+		duration time.Duration
+		// drain is how long the subscribers may take to receive the
+		// messages after the publishers stopped.
+		drain    time.Duration
+		size     int
+		qos      types.QoS
+		topics   int
+		wildcard bool
+		prefix   string
+	}
+
+	benchPublisher struct {
+		index  int
+		client *client.Client
+		topic  string
+		sent   int
+		errors int
+	}
+
+	benchSubscriber struct {
+		index  int
+		client *client.Client
+		filter string
+
+		mutex        sync.Mutex
+		seen         map[uint64]struct{} // Publisher index and sequence number of the received messages.
+		latencies    []time.Duration
+		duplicates   int
+		lastReceived time.Time
+	}
+
+	// benchResult is the report of a benchmark run.
+	benchResult struct {
+		Publishers    int             `json:"publishers"`
+		Subscribers   int             `json:"subscribers"`
+		Duration      float64         `json:"duration_seconds"`
+		ConnectTime   durationSummary `json:"connect_time"`
+		Published     int             `json:"published"`
+		PublishErrors int             `json:"publish_errors"`
+		PublishRate   float64         `json:"publish_rate"` // Messages per second.
+		Expected      int             `json:"expected"`     // Deliveries to subscribers of the published messages.
+		Received      int             `json:"received"`     // Deliveries including duplicates.
+		ReceiveRate   float64         `json:"receive_rate"` // Messages per second.
+		Dropped       int             `json:"dropped"`
+		Duplicated    int             `json:"duplicated"`
+		Latency       durationSummary `json:"latency"`
+	}
+
+	// durationSummary summarizes a distribution of durations in
+	// milliseconds.
+	durationSummary struct {
+		Count int     `json:"count"`
+		Min   float64 `json:"min_ms"`
+		Mean  float64 `json:"mean_ms"`
+		P50   float64 `json:"p50_ms"`
+		P90   float64 `json:"p90_ms"`
+		P99   float64 `json:"p99_ms"`
+		Max   float64 `json:"max_ms"`
+	}
+)
+
+// runBench implements the bench subcommand and returns the exit code.
+func runBench(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	clientFlags := addClientFlags(flags)
+	config := benchConfig{}
+	flags.IntVar(&config.publishers, "publishers", 10, "`number` of publishing clients")
+	flags.IntVar(&config.subscribers, "subscribers", 10, "`number` of subscribing clients")
+	flags.Float64Var(&config.rate, "rate", 10, "messages per `second` of every publisher, 0 publishes as fast as possible")
+	flags.DurationVar(&config.duration, "duration", 10*time.Second, "`duration` of publishing")
+	flags.DurationVar(&config.drain, "drain", 5*time.Second, "`duration` to wait for messages after publishing")
+	flags.IntVar(&config.size, "size", 64, fmt.Sprintf("payload size in `bytes`, at least %d", benchHeaderSize))
+	flags.IntVar(&config.topics, "topics", 1, "`number` of topics")
+	flags.BoolVar(&config.wildcard, "wildcard", false, "subscribe to all topics with a single-level wildcard")
+	flags.StringVar(&config.prefix, "topic-prefix", "bench", "`prefix` of the topics")
+	jsonOutput := flags.Bool("json", false, "write the report as JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), benchUsage, os.Args[0])
+		flags.PrintDefaults()
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return 2
+	}
+
+	config.options, err = clientFlags.options()
+	if err == nil {
+		config.qos = types.QoS(*clientFlags.qos)
+		err = config.check()
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	result, err := bench(ctx, config)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(result)
+	} else {
+		err = result.write(stdout)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func (config *benchConfig) check() error {
+	switch {
+	case config.publishers < 1:
+		return errors.New("at least one publisher is needed")
+	case config.subscribers < 0:
+		return errors.New("negative number of subscribers")
+	case config.rate < 0:
+		return errors.New("negative rate")
+	case config.size < benchHeaderSize:
+		return fmt.Errorf("payload size must be at least %d bytes", benchHeaderSize)
+	case config.topics < 1:
+		return errors.New("at least one topic is needed")
+	}
+	return nil
+}
+
+// bench runs a benchmark. Publishing stops early when ctx is done.
+func bench(ctx context.Context, config benchConfig) (benchResult, error) {
+	clientID := config.options.ClientID
+	subscribers := make([]*benchSubscriber, config.subscribers)
+	subscriberClients, subscriberConnectTimes, err := connectClients(ctx, config.subscribers, func(i int) client.Options {
+		options := config.options
+		if clientID != "" {
+			options.ClientID = fmt.Sprintf("%s-sub-%d", clientID, i)
+		}
+		return options
+	})
+	if err != nil {
+		return benchResult{}, err
+	}
+	defer disconnectClients(subscriberClients)
+
+	for i, c := range subscriberClients {
+		subscriber := &benchSubscriber{
+			index:  i,
+			client: c,
+			filter: fmt.Sprintf("%s/%d", config.prefix, i%config.topics),
+			seen:   make(map[uint64]struct{}),
+		}
+		if config.wildcard {
+			subscriber.filter = config.prefix + "/+"
+		}
+		err = c.Subscribe(ctx, subscriber.filter, config.qos, subscriber.receive)
+		if err != nil {
+			return benchResult{}, fmt.Errorf("subscribe to %s: %w", subscriber.filter, err)
+		}
+		subscribers[i] = subscriber
+	}
+
+	publishers := make([]*benchPublisher, config.publishers)
+	publisherClients, publisherConnectTimes, err := connectClients(ctx, config.publishers, func(i int) client.Options {
+		options := config.options
+		if clientID != "" {
+			options.ClientID = fmt.Sprintf("%s-pub-%d", clientID, i)
+		}
+		return options
+	})
+	if err != nil {
+		return benchResult{}, err
+	}
+	defer disconnectClients(publisherClients)
+
+	for i, c := range publisherClients {
+		publishers[i] = &benchPublisher{
+			index:  i,
+			client: c,
+			topic:  fmt.Sprintf("%s/%d", config.prefix, i%config.topics),
+		}
+	}
+
+	start := time.Now()
+	publishCtx, cancel := context.WithTimeout(ctx, config.duration)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, publisher := range publishers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			publisher.run(publishCtx, &config)
+		}()
+	}
+	wg.Wait()
+	duration := time.Since(start)
+
+	result := benchResult{
+		Publishers:  config.publishers,
+		Subscribers: config.subscribers,
+		Duration:    duration.Seconds(),
+		ConnectTime: summarize(append(subscriberConnectTimes, publisherConnectTimes...)),
+	}
+	for _, publisher := range publishers {
+		result.Published += publisher.sent
+		result.PublishErrors += publisher.errors
+	}
+	result.PublishRate = float64(result.Published) / duration.Seconds()
+	for _, subscriber := range subscribers {
+		for _, publisher := range publishers {
+			if config.wildcard || publisher.index%config.topics == subscriber.index%config.topics {
+				result.Expected += publisher.sent
+			}
+		}
+	}
+
+	// Wait for the messages that are still on their way.
+	deadline := time.Now().Add(config.drain)
+	for distinctReceived(subscribers) < result.Expected && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	latencies := []time.Duration{}
+	lastReceived := start
+	unique := 0
+	for _, subscriber := range subscribers {
+		subscriber.mutex.Lock()
+		latencies = append(latencies, subscriber.latencies...)
+		unique += len(subscriber.seen)
+		result.Duplicated += subscriber.duplicates
+		if subscriber.lastReceived.After(lastReceived) {
+			lastReceived = subscriber.lastReceived
+		}
+		subscriber.mutex.Unlock()
+	}
+	result.Received = unique + result.Duplicated
+	result.Dropped = max(result.Expected-unique, 0)
+	if lastReceived.After(start) {
+		result.ReceiveRate = float64(result.Received) / lastReceived.Sub(start).Seconds()
+	}
+	result.Latency = summarize(latencies)
+
+	return result, nil
+}
+
+// distinctReceived returns the number of distinct messages the subscribers
+// received.
+func distinctReceived(subscribers []*benchSubscriber) int {
+	received := 0
+	for _, subscriber := range subscribers {
+		subscriber.mutex.Lock()
+		received += len(subscriber.seen)
+		subscriber.mutex.Unlock()
+	}
+	return received
+}
+
+// connectClients connects n clients concurrently with the options returned
+// by options, and returns the clients and the time it took to connect them.
+func connectClients(ctx context.Context, n int, options func(i int) client.Options) ([]*client.Client, []time.Duration, error) {
+	clients := make([]*client.Client, n)
+	connectTimes := make([]time.Duration, n)
+	errs := make([]error, n)
+
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			clients[i], errs[i] = connect(ctx, options(i))
+			connectTimes[i] = time.Since(start)
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			disconnectClients(clients)
+			return nil, nil, err
+		}
+	}
+	return clients, connectTimes, nil
+}
+
+// disconnectClients disconnects the clients that are not nil concurrently.
+func disconnectClients(clients []*client.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), client.DefaultConnectTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		if c == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Disconnect(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+// run publishes messages at the rate of config until ctx is done.
+func (publisher *benchPublisher) run(ctx context.Context, config *benchConfig) {
+	var tick <-chan time.Time
+	if config.rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / config.rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for sequence := uint64(0); ; sequence++ {
+		if tick != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick:
+			}
+		} else if ctx.Err() != nil {
+			return
+		}
+
+		// The client keeps the payload until the message is acknowledged,
+		// so every message gets its own.
+		payload := make([]byte, config.size)
+		binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+		binary.BigEndian.PutUint32(payload[8:], uint32(publisher.index))
+		binary.BigEndian.PutUint64(payload[12:], sequence)
+
+		// The last message is published completely, also when ctx is done
+		// in the meantime, so that it is counted as sent.
+		publishCtx, cancel := context.WithTimeout(context.Background(), client.DefaultConnectTimeout)
+		err := publisher.client.Publish(publishCtx, publisher.topic, payload, config.qos, false)
+		cancel()
+		if err != nil {
+			publisher.errors++
+			continue
+		}
+		publisher.sent++
+	}
+}
+
+// receive records the latency of a message, or counts it as a duplicate if
+// it was received before.
+func (subscriber *benchSubscriber) receive(message client.Message) {
+	received := time.Now()
+	if len(message.Payload) < benchHeaderSize {
+		return
+	}
+	published := time.Unix(0, int64(binary.BigEndian.Uint64(message.Payload)))
+	publisher := binary.BigEndian.Uint32(message.Payload[8:])
+	sequence := binary.BigEndian.Uint64(message.Payload[12:])
+	key := uint64(publisher)<<40 | sequence
+
+	subscriber.mutex.Lock()
+	defer subscriber.mutex.Unlock()
+
+	if _, seen := subscriber.seen[key]; seen {
+		subscriber.duplicates++
+		return
+	}
+	subscriber.seen[key] = struct{}{}
+	subscriber.latencies = append(subscriber.latencies, received.Sub(published))
+	subscriber.lastReceived = received
+}
+
+// summarize returns the summary of durations, which it sorts.
+func summarize(durations []time.Duration) durationSummary {
+	if len(durations) == 0 {
+		return durationSummary{}
+	}
+	slices.Sort(durations)
+
+	var total time.Duration
+	for _, duration := range durations {
+		total += duration
+	}
+	percentile := func(p float64) float64 {
+		index := int(math.Ceil(p*float64(len(durations)))) - 1
+		return milliseconds(durations[max(index, 0)])
+	}
+
+	return durationSummary{
+		Count: len(durations),
+		Min:   milliseconds(durations[0]),
+		Mean:  milliseconds(total / time.Duration(len(durations))),
+		P50:   percentile(0.5),
+		P90:   percentile(0.9),
+		P99:   percentile(0.99),
+		Max:   milliseconds(durations[len(durations)-1]),
+	}
+}
+
+func milliseconds(duration time.Duration) float64 {
+	return float64(duration) / float64(time.Millisecond)
+}
+
+func (summary durationSummary) String() string {
+	return fmt.Sprintf("min %.2fms, mean %.2fms, p50 %.2fms, p90 %.2fms, p99 %.2fms, max %.2fms",
+		summary.Min, summary.Mean, summary.P50, summary.P90, summary.P99, summary.Max)
+}
+
+// write writes the report as text.
+func (result *benchResult) write(w io.Writer) error {
+	dropped := 0.0
+	if result.Expected > 0 {
+		dropped = 100 * float64(result.Dropped) / float64(result.Expected)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "clients\t%d publishers, %d subscribers\n", result.Publishers, result.Subscribers)
+	fmt.Fprintf(tw, "connect time\t%s\n", result.ConnectTime)
+	fmt.Fprintf(tw, "published\t%d messages in %.1fs, %.1f msg/s, %d errors\n",
+		result.Published, result.Duration, result.PublishRate, result.PublishErrors)
+	fmt.Fprintf(tw, "received\t%d of %d messages, %.1f msg/s\n", result.Received, result.Expected, result.ReceiveRate)
+	fmt.Fprintf(tw, "dropped\t%d (%.2f%%)\n", result.Dropped, dropped)
+	fmt.Fprintf(tw, "duplicated\t%d\n", result.Duplicated)
+	fmt.Fprintf(tw, "latency\t%s\n", result.Latency)
+	return tw.Flush()
+}
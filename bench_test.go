@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/broker"
+)
+
+var benchCases = []struct {
+	name         string
+	listenerType broker.ListenerType
+	args         []string
+	fanOut       int // Subscribers that receive every message.
+}{
+	{"fan-out", broker.ListenerTCP, []string{"-qos", "1", "-publishers", "2", "-subscribers", "4", "-topics", "2"}, 2},
+	{"wildcard", broker.ListenerTCP, []string{"-qos", "2", "-publishers", "3", "-subscribers", "2", "-topics", "3", "-wildcard"}, 2},
+	{"websocket", broker.ListenerWebsocket, []string{"-websocket", "-publishers", "1", "-subscribers", "3"}, 3},
+}
+
+func TestBench(t *testing.T) {
+	for _, c := range benchCases {
+		t.Run(c.name, func(t *testing.T) {
+			_, host, port := startBroker(t, c.listenerType)
+			args := append([]string{
+				"-host", host, "-port", port, "-json",
+				"-rate", "100", "-duration", "200ms", "-drain", "2s", "-size", "100",
+			}, c.args...)
+
+			stdout := &bytes.Buffer{}
+			stderr := &bytes.Buffer{}
+			code := runBench(args, stdout, stderr)
+			if code != 0 {
+				t.Fatalf("wanted exit code 0 but got %d: %s", code, stderr)
+			}
+
+			result := benchResult{}
+			err := json.Unmarshal(stdout.Bytes(), &result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Published == 0 || result.PublishErrors != 0 {
+				t.Fatalf("wanted messages to be published without errors but got %+v", result)
+			}
+			if result.Expected != result.Published*c.fanOut {
+				t.Fatalf("wanted %d deliveries of %d messages but got %d", c.fanOut, result.Published, result.Expected)
+			}
+			if result.Received != result.Expected || result.Dropped != 0 || result.Duplicated != 0 {
+				t.Fatalf("wanted every message to be received once but got %+v", result)
+			}
+			if result.Latency.Count != result.Expected || result.ConnectTime.Count != result.Publishers+result.Subscribers {
+				t.Fatalf("wanted a latency per message and a connect time per client but got %+v", result)
+			}
+		})
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	durations := []time.Duration{}
+	for i := 100; i > 0; i-- {
+		durations = append(durations, time.Duration(i)*time.Millisecond)
+	}
+
+	summary := summarize(durations)
+	want := durationSummary{Count: 100, Min: 1, Mean: 50.5, P50: 50, P90: 90, P99: 99, Max: 100}
+	if summary != want {
+		t.Fatalf("wanted %+v but got %+v", want, summary)
+	}
+}
@@ -0,0 +1,374 @@
+// Package bridge connects a broker to a remote MQTT broker and forwards the
+// messages of configured topics between the two.
+//
+// The bridge is a client of the remote broker. Messages of the out topics
+// are received with an in-process subscription on the local broker and
+// published to the remote broker, messages of the in topics are received
+// with a subscription on the remote broker and published to the local
+// broker. While the remote broker is unreachable the bridge reconnects and
+// queues the messages for it.
+//
+// Forwarded messages carry the name of every bridge that forwarded them in
+// a user property, a bridge does not forward a message that carries its own
+// name. Together with the No Local option of the remote subscriptions this
+// prevents messages from going around in circles, also between brokers
+// that are bridged to each other.
+package bridge
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/broker"
+	"github.com/DvdSpijker/GoBroker/client"
+	"github.com/DvdSpijker/GoBroker/logging"
+)
+
+// PropertyName is the name of the user property that holds the names of the
+// bridges that forwarded a message.
+const PropertyName = "gobroker-bridge"
+
+// Delays between the attempts to connect to the remote broker the first
+// time, after that the client reconnects by itself.
+const (
+	minConnectDelay = time.Second
+	maxConnectDelay = 2 * time.Minute
+)
+
+type (
+	// Bridge forwards messages between a broker and a remote broker.
+	Bridge struct {
+		config broker.BridgeConfig
+		server *broker.Server
+		client *client.Client
+		log    *slog.Logger
+
+		// outgoing are the messages for the remote broker that wait to be
+		// published.
+		outgoing    chan client.Message
+		unsubscribe []func()
+
+		ctx    context.Context
+		cancel context.CancelFunc
+		done   sync.WaitGroup
+	}
+)
+
+// Start validates config and starts a bridge from server to the remote
+// broker of config. It connects in the background, Close stops it.
+func Start(server *broker.Server, config broker.BridgeConfig, logger *slog.Logger) (*Bridge, error) {
+	config.SetDefaults()
+	err := config.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("%w: bridge %s: %w", broker.ErrInvalidConfig, config.Name, err)
+	}
+	if logger == nil {
+		logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	log := logging.Subsystem(logger, "bridge").With("bridge", config.Name)
+
+	options, err := clientOptions(config, log)
+	if err != nil {
+		return nil, fmt.Errorf("bridge %s: %w", config.Name, err)
+	}
+
+	bridge := &Bridge{
+		config:   config,
+		server:   server,
+		client:   client.New(options),
+		log:      log,
+		outgoing: make(chan client.Message, config.QueueSize),
+	}
+	bridge.ctx, bridge.cancel = context.WithCancel(context.Background())
+
+	// The local subscriptions start right away, so that messages are
+	// queued while the bridge connects for the first time.
+	for _, topic := range config.Topics {
+		if topic.Direction == broker.BridgeOut || topic.Direction == broker.BridgeBoth {
+			bridge.unsubscribe = append(bridge.unsubscribe,
+				server.Subscribe(topic.LocalPrefix+topic.Filter, bridge.outHandler(topic)))
+		}
+	}
+
+	bridge.done.Add(1)
+	go bridge.run()
+	return bridge, nil
+}
+
+// clientOptions returns the options of the client that connects to the
+// remote broker.
+func clientOptions(config broker.BridgeConfig, log *slog.Logger) (client.Options, error) {
+	options := client.Options{
+		Server:                config.Address,
+		ClientID:              config.ClientID,
+		UserName:              config.UserName,
+		SessionExpiryInterval: time.Duration(config.SessionExpiryInterval) * time.Second,
+		KeepAlive:             time.Duration(config.KeepAlive) * time.Second,
+		AutoReconnect:         true,
+		Store:                 client.NewMemoryStore(config.QueueSize),
+		Logger:                log,
+		OnConnectionLost: func(err error) {
+			log.Warn("connection to remote broker lost", "error", err)
+		},
+	}
+
+	if config.PasswordFile != "" {
+		password, err := os.ReadFile(config.PasswordFile)
+		if err != nil {
+			return client.Options{}, err
+		}
+		options.Password = []byte(strings.TrimSpace(string(password)))
+	}
+
+	tlsConfig, err := makeTLSConfig(config.TLS)
+	if err != nil {
+		return client.Options{}, err
+	}
+	options.TLSConfig = tlsConfig
+	return options, nil
+}
+
+// makeTLSConfig returns the TLS config used for tls:// and wss:// addresses.
+func makeTLSConfig(config broker.BridgeTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", config.CAFile)
+		}
+	}
+
+	if config.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+// Connected reports whether the bridge is connected to the remote broker.
+func (bridge *Bridge) Connected() bool {
+	return bridge.client.Connected()
+}
+
+// Close stops forwarding and disconnects from the remote broker. Messages
+// that were not forwarded yet are dropped.
+func (bridge *Bridge) Close(ctx context.Context) error {
+	for _, unsubscribe := range bridge.unsubscribe {
+		unsubscribe()
+	}
+	bridge.cancel()
+	bridge.done.Wait()
+
+	err := bridge.client.Disconnect(ctx)
+	if errors.Is(err, client.ErrNotConnected) {
+		return nil
+	}
+	return err
+}
+
+// run connects to the remote broker and forwards the outgoing messages
+// until the bridge is closed.
+func (bridge *Bridge) run() {
+	defer bridge.done.Done()
+
+	if !bridge.connect() {
+		return
+	}
+	bridge.subscribe()
+
+	for {
+		select {
+		case message := <-bridge.outgoing:
+			bridge.publish(message)
+		case <-bridge.ctx.Done():
+			return
+		}
+	}
+}
+
+// connect connects to the remote broker for the first time, it retries
+// until it succeeds or the bridge is closed. It returns false in the latter
+// case.
+func (bridge *Bridge) connect() bool {
+	delay := minConnectDelay
+	for {
+		ctx, cancel := context.WithTimeout(bridge.ctx, client.DefaultConnectTimeout)
+		_, err := bridge.client.Connect(ctx)
+		cancel()
+		if err == nil {
+			bridge.log.Info("connected to remote broker", "address", bridge.config.Address)
+			return true
+		}
+		bridge.log.Warn("failed to connect to remote broker", "address", bridge.config.Address, "error", err)
+
+		timer := time.NewTimer(delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1)))
+		select {
+		case <-bridge.ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+		delay = min(2*delay, maxConnectDelay)
+	}
+}
+
+// subscribe subscribes to the in topics at the remote broker. The client
+// restores the subscriptions when it reconnects.
+func (bridge *Bridge) subscribe() {
+	for _, topic := range bridge.config.Topics {
+		if topic.Direction != broker.BridgeIn && topic.Direction != broker.BridgeBoth {
+			continue
+		}
+
+		filter := topic.RemotePrefix + topic.Filter
+		// The remote broker does not send the messages that the bridge
+		// forwarded to it back, and keeps the retain flag so that retained
+		// messages are retained by this broker as well.
+		options := client.SubscribeOptions{QoS: topic.QoS, NoLocal: true, RetainAsPublished: true}
+		err := bridge.client.SubscribeWithOptions(bridge.ctx, filter, options, bridge.inHandler(topic))
+		if err != nil {
+			bridge.log.Error("failed to subscribe at remote broker", "topic_filter", filter, "error", err)
+		}
+	}
+}
+
+// outHandler returns the handler of the local subscription of an out topic.
+// It is called by the publishing routine of the broker, so it only queues
+// the message.
+func (bridge *Bridge) outHandler(topic broker.BridgeTopicConfig) broker.MessageHandler {
+	return func(message broker.Message) {
+		if message.Properties != nil {
+			for _, property := range message.Properties.UserProperties {
+				if bridge.forwarded(property.Name, property.Value) {
+					return
+				}
+			}
+		}
+
+		remote := makeClientMessage(message, bridge.config.Name)
+		remote.Topic = topic.RemotePrefix + strings.TrimPrefix(message.Topic, topic.LocalPrefix)
+		remote.QoS = min(remote.QoS, topic.QoS)
+
+		select {
+		case bridge.outgoing <- remote:
+		default:
+			bridge.log.Warn("queue is full, dropped message", "topic", message.Topic)
+		}
+	}
+}
+
+// publish publishes a message to the remote broker. While the client is
+// reconnecting the message is stored by the client, a QoS 1 or 2 message
+// also stays stored when the connection is lost before it was
+// acknowledged.
+func (bridge *Bridge) publish(message client.Message) {
+	err := bridge.client.PublishMessage(bridge.ctx, message)
+	switch {
+	case err == nil:
+		bridge.log.Debug("forwarded message to remote broker", "topic", message.Topic)
+	case errors.Is(err, client.ErrConnectionLost) || errors.Is(err, context.Canceled):
+		bridge.log.Debug("message kept for the remote broker", "topic", message.Topic, "error", err)
+	default:
+		bridge.log.Warn("failed to forward message to remote broker, dropped it", "topic", message.Topic, "error", err)
+	}
+}
+
+// inHandler returns the handler of the remote subscription of an in topic.
+func (bridge *Bridge) inHandler(topic broker.BridgeTopicConfig) client.MessageHandler {
+	return func(message client.Message) {
+		for _, property := range message.Properties.UserProperties {
+			if bridge.forwarded(property.Name, property.Value) {
+				return
+			}
+		}
+
+		local := makeBrokerMessage(message, bridge.config.Name)
+		local.Topic = topic.LocalPrefix + strings.TrimPrefix(message.Topic, topic.RemotePrefix)
+		local.Qos = min(local.Qos, topic.QoS)
+
+		err := bridge.server.PublishMessage(local)
+		if err != nil {
+			bridge.log.Warn("failed to forward message from remote broker", "topic", message.Topic, "error", err)
+			return
+		}
+		bridge.log.Debug("forwarded message from remote broker", "topic", local.Topic)
+	}
+}
+
+// forwarded reports whether a message with the user property name and value
+// was forwarded by the bridge before.
+func (bridge *Bridge) forwarded(name string, value string) bool {
+	return name == PropertyName && value == bridge.config.Name
+}
+
+// makeClientMessage converts a message of the local broker to a message for
+// the remote broker, forwarded by the bridge with name.
+func makeClientMessage(message broker.Message, name string) client.Message {
+	remote := client.Message{
+		Payload: message.Payload,
+		QoS:     message.Qos,
+		Retain:  message.Retain,
+	}
+	if properties := message.Properties; properties != nil {
+		remote.Properties = client.Properties{
+			UTF8Payload:           properties.UTF8Payload,
+			MessageExpiryInterval: time.Duration(properties.MessageExpiryInterval) * time.Second,
+			ContentType:           properties.ContentType,
+			ResponseTopic:         properties.ResponseTopic,
+			CorrelationData:       properties.CorrelationData,
+		}
+		for _, property := range properties.UserProperties {
+			remote.Properties.UserProperties = append(remote.Properties.UserProperties,
+				client.UserProperty{Name: property.Name, Value: property.Value})
+		}
+	}
+	remote.Properties.UserProperties = append(remote.Properties.UserProperties,
+		client.UserProperty{Name: PropertyName, Value: name})
+	return remote
+}
+
+// makeBrokerMessage converts a message of the remote broker to a message for
+// the local broker, forwarded by the bridge with name.
+func makeBrokerMessage(message client.Message, name string) broker.Message {
+	properties := &message.Properties
+	local := broker.Message{
+		Payload: message.Payload,
+		Qos:     message.QoS,
+		Retain:  message.Retain,
+		Properties: &broker.MessageProperties{
+			UTF8Payload:           properties.UTF8Payload,
+			MessageExpiryInterval: uint32(properties.MessageExpiryInterval / time.Second),
+			ContentType:           properties.ContentType,
+			ResponseTopic:         properties.ResponseTopic,
+			CorrelationData:       properties.CorrelationData,
+		},
+	}
+	for _, property := range properties.UserProperties {
+		local.Properties.UserProperties = append(local.Properties.UserProperties,
+			broker.UserProperty{Name: property.Name, Value: property.Value})
+	}
+	local.Properties.UserProperties = append(local.Properties.UserProperties,
+		broker.UserProperty{Name: PropertyName, Value: name})
+	return local
+}
@@ -0,0 +1,184 @@
+package bridge
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/broker"
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+// startBroker serves a broker on address and returns the broker and its
+// address.
+func startBroker(t *testing.T, address string) (*broker.Server, string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := broker.NewServer(broker.Config{})
+	go server.Serve(ln)
+	t.Cleanup(func() { closeBroker(server) })
+	return server, ln.Addr().String()
+}
+
+func closeBroker(server *broker.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	server.Close(ctx)
+}
+
+// startBridge starts a bridge from server to the broker at address.
+func startBridge(t *testing.T, server *broker.Server, address string, topics ...broker.BridgeTopicConfig) *Bridge {
+	t.Helper()
+
+	bridge, err := Start(server, broker.BridgeConfig{Name: "test", Address: address, Topics: topics}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bridge.Close(context.Background()) })
+	return bridge
+}
+
+// waitForSubscriptions waits until the remote broker has count
+// subscriptions.
+func waitForSubscriptions(t *testing.T, remote *broker.Server, count int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(remote.Subscriptions("")) < count {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the bridge to subscribe")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// receive waits for a message on messages.
+func receive(t *testing.T, messages chan broker.Message, timeout time.Duration) broker.Message {
+	t.Helper()
+
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(timeout):
+		t.Fatal("timed out waiting for a message")
+	}
+	return broker.Message{}
+}
+
+func subscribe(server *broker.Server, filter string) chan broker.Message {
+	messages := make(chan broker.Message, 10)
+	server.Subscribe(filter, func(message broker.Message) { messages <- message })
+	return messages
+}
+
+func TestForward(t *testing.T) {
+	remote, address := startBroker(t, "127.0.0.1:0")
+	local, _ := startBroker(t, "127.0.0.1:0")
+	startBridge(t, local, address,
+		broker.BridgeTopicConfig{Filter: "sensors/#", Direction: broker.BridgeOut, QoS: types.QoS1, RemotePrefix: "site/"},
+		broker.BridgeTopicConfig{Filter: "commands/#", Direction: broker.BridgeIn, QoS: types.QoS1,
+			LocalPrefix: "remote/", RemotePrefix: "site/"},
+	)
+	waitForSubscriptions(t, remote, 1)
+
+	remoteMessages := subscribe(remote, "#")
+	localMessages := subscribe(local, "remote/#")
+
+	err := local.PublishMessage(broker.Message{
+		Topic:      "sensors/temperature",
+		Payload:    []byte("21.5"),
+		Qos:        types.QoS1,
+		Properties: &broker.MessageProperties{ContentType: "text/plain"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := receive(t, remoteMessages, time.Second)
+	if message.Topic != "site/sensors/temperature" || string(message.Payload) != "21.5" || message.Qos != types.QoS1 {
+		t.Fatalf("wanted the message on site/sensors/temperature but got %+v", message)
+	}
+	if message.Properties == nil || message.Properties.ContentType != "text/plain" ||
+		len(message.Properties.UserProperties) != 1 ||
+		message.Properties.UserProperties[0] != (broker.UserProperty{Name: PropertyName, Value: "test"}) {
+		t.Fatalf("wanted the properties of the message and the bridge but got %+v", message.Properties)
+	}
+
+	err = remote.Publish("site/commands/reboot", []byte("now"), types.QoS2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message = receive(t, localMessages, time.Second)
+	if message.Topic != "remote/commands/reboot" || message.Qos != types.QoS1 || !message.Retain {
+		t.Fatalf("wanted the retained message on remote/commands/reboot with QoS 1 but got %+v", message)
+	}
+}
+
+func TestNoLoop(t *testing.T) {
+	remote, address := startBroker(t, "127.0.0.1:0")
+	local, _ := startBroker(t, "127.0.0.1:0")
+	startBridge(t, local, address, broker.BridgeTopicConfig{Filter: "loop/#", Direction: broker.BridgeBoth, QoS: types.QoS1})
+	waitForSubscriptions(t, remote, 1)
+
+	remoteMessages := subscribe(remote, "loop/#")
+	localMessages := subscribe(local, "loop/#")
+
+	local.Publish("loop/local", []byte("once"), types.QoS1, false)
+	remote.Publish("loop/remote", []byte("once"), types.QoS1, false)
+
+	// Every broker sees both messages once: its own and the forwarded one.
+	time.Sleep(200 * time.Millisecond)
+	for name, messages := range map[string]chan broker.Message{"remote": remoteMessages, "local": localMessages} {
+		if len(messages) != 2 {
+			t.Fatalf("wanted 2 messages at the %s broker but got %d", name, len(messages))
+		}
+	}
+}
+
+func TestQueueWhileRemoteDown(t *testing.T) {
+	// Reserve an address for the remote broker, which is not running when
+	// the bridge starts.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := ln.Addr().String()
+	ln.Close()
+
+	local, _ := startBroker(t, "127.0.0.1:0")
+	bridge := startBridge(t, local, address, broker.BridgeTopicConfig{Filter: "queued/#", Direction: broker.BridgeOut, QoS: types.QoS1})
+	local.Publish("queued/before", []byte("1"), types.QoS1, false)
+
+	remote, _ := startBroker(t, address)
+	remoteMessages := subscribe(remote, "queued/#")
+	message := receive(t, remoteMessages, 5*time.Second)
+	if message.Topic != "queued/before" {
+		t.Fatalf("wanted the message published before the bridge connected but got %+v", message)
+	}
+
+	closeBroker(remote)
+	deadline := time.Now().Add(2 * time.Second)
+	for bridge.Connected() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the bridge to lose its connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	local.Publish("queued/while-down", []byte("2"), types.QoS1, false)
+
+	// The first message is sent again if its PUBACK was lost with the
+	// connection.
+	remote, _ = startBroker(t, address)
+	remoteMessages = subscribe(remote, "queued/#")
+	message = receive(t, remoteMessages, 5*time.Second)
+	if message.Topic == "queued/before" {
+		message = receive(t, remoteMessages, time.Second)
+	}
+	if message.Topic != "queued/while-down" {
+		t.Fatalf("wanted the message published while the remote broker was down but got %+v", message)
+	}
+}
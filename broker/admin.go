@@ -0,0 +1,532 @@
+package broker
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/packet"
+	"github.com/DvdSpijker/GoBroker/protocol"
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+// adminMaxBodySize is the largest payload that can be published or
+// retained through the admin API, which is the largest MQTT packet.
+const adminMaxBodySize = maxRemainingLength
+
+var (
+	ErrSessionNotFound    = errors.New("session not found")
+	ErrClientNotConnected = errors.New("client not connected")
+	ErrClientConnected    = errors.New("client connected")
+)
+
+type (
+	// SessionInfo describes the session of a client, connected or not.
+	SessionInfo struct {
+		ClientID   string `json:"client_id"`
+		UserName   string `json:"user_name,omitempty"`
+		Connected  bool   `json:"connected"`
+		RemoteAddr string `json:"remote_addr,omitempty"`
+		// Seconds the session is kept after the connection closed, -1 if it
+		// never expires.
+		SessionExpiryInterval int64              `json:"session_expiry_interval"`
+		Subscriptions         []SubscriptionInfo `json:"subscriptions"`
+		QueuedMessages        int                `json:"queued_messages"`    // Messages queued while offline.
+		InFlightMessages      int                `json:"inflight_messages"`  // Deliveries that were not acknowledged yet.
+		SendQueuePackets      int                `json:"send_queue_packets"` // Packets waiting to be written.
+	}
+
+	SubscriptionInfo struct {
+		ClientID string    `json:"client_id,omitempty"` // Only set when listing the subscriptions of all clients.
+		Filter   string    `json:"filter"`
+		QoS      types.QoS `json:"qos"`
+	}
+
+	// SessionFilter selects sessions, fields that are empty match all
+	// sessions.
+	SessionFilter struct {
+		Connected *bool
+		UserName  string
+		Prefix    string // Prefix of the client ID.
+	}
+
+	adminError struct {
+		Error string `json:"error"`
+	}
+)
+
+// Sessions returns the sessions that match filter ordered by client ID.
+func (server *Server) Sessions(filter SessionFilter) []SessionInfo {
+	server.clientsMutex.Lock()
+	defer server.clientsMutex.Unlock()
+
+	sessions := make([]SessionInfo, 0, len(server.clients))
+	for _, client := range server.clients {
+		session := client.info()
+		if filter.matches(session) {
+			sessions = append(sessions, session)
+		}
+	}
+	slices.SortFunc(sessions, func(a, b SessionInfo) int {
+		return strings.Compare(a.ClientID, b.ClientID)
+	})
+	return sessions
+}
+
+// Session returns the session of a client.
+func (server *Server) Session(clientID string) (SessionInfo, error) {
+	server.clientsMutex.Lock()
+	defer server.clientsMutex.Unlock()
+
+	client, ok := server.clients[clientID]
+	if !ok {
+		return SessionInfo{}, fmt.Errorf("%w: %s", ErrSessionNotFound, clientID)
+	}
+	return client.info(), nil
+}
+
+// Subscriptions returns the subscriptions of all clients whose filter
+// matches topic ordered by client ID, or all subscriptions if topic is
+// empty.
+func (server *Server) Subscriptions(topic string) []SubscriptionInfo {
+	subscriptions := make([]SubscriptionInfo, 0)
+	for _, session := range server.Sessions(SessionFilter{}) {
+		for _, subscription := range session.Subscriptions {
+			if topic == "" || topicMatches(subscription.Filter, topic) {
+				subscription.ClientID = session.ClientID
+				subscriptions = append(subscriptions, subscription)
+			}
+		}
+	}
+	return subscriptions
+}
+
+// Kick disconnects a client with reason code Administrative Action. The
+// queued packets are sent first, until ctx is done. The session is kept if
+// it outlives the connection and the will is published as for any
+// disconnect by the server.
+func (server *Server) Kick(ctx context.Context, clientID string) error {
+	return server.disconnectClient(ctx, clientID, packet.AdministrativeAction)
+}
+
+// disconnectClient disconnects a connected client with reasonCode and waits
+// until the connection is closed.
+func (server *Server) disconnectClient(ctx context.Context, clientID string, reasonCode packet.ReasonCode) error {
+	server.clientsMutex.Lock()
+	client, ok := server.clients[clientID]
+	var connCtx context.Context
+	connected := false
+	if ok {
+		connCtx = client.Ctx
+		client.Mutex.Lock()
+		connected = client.Conn != nil
+		client.Mutex.Unlock()
+	}
+	server.clientsMutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrSessionNotFound, clientID)
+	}
+	if !connected {
+		return fmt.Errorf("%w: %s", ErrClientNotConnected, clientID)
+	}
+
+	if reasonCode == packet.AdministrativeAction {
+		client.log.Info("kicked by administrator")
+	}
+	client.shutdown(ctx, reasonCode)
+
+	// The connection context is cancelled when the client is disconnected.
+	select {
+	case <-connCtx.Done():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// DeleteSession ends the session of a client, which is kicked first if it
+// is connected. Its subscriptions and queued messages are discarded and a
+// will that waits for its delay is not published.
+func (server *Server) DeleteSession(ctx context.Context, clientID string) error {
+	err := server.Kick(ctx, clientID)
+	if err != nil && !errors.Is(err, ErrClientNotConnected) {
+		return err
+	}
+	kicked := err == nil
+
+	server.clientsMutex.Lock()
+	client, ok := server.clients[clientID]
+	if !ok {
+		server.clientsMutex.Unlock()
+		// A session without expiry interval ended when the client was kicked.
+		if kicked {
+			return nil
+		}
+		return fmt.Errorf("%w: %s", ErrSessionNotFound, clientID)
+	}
+	client.Mutex.Lock()
+	connected := client.Conn != nil
+	client.Mutex.Unlock()
+	if connected {
+		server.clientsMutex.Unlock()
+		return fmt.Errorf("%w: %s reconnected", ErrClientConnected, clientID)
+	}
+	client.stopTimers()
+	delete(server.clients, clientID)
+	server.clientsMutex.Unlock()
+
+	client.endSession()
+	client.log.Info("session deleted by administrator")
+	server.onSessionExpired(client)
+	return nil
+}
+
+// RetainedMessages returns the retained messages of the topics that match
+// filter ordered by topic.
+func (server *Server) RetainedMessages(filter string) []Message {
+	server.retainedMessagesMutex.Lock()
+	defer server.retainedMessagesMutex.Unlock()
+
+	messages := make([]Message, 0)
+	for topic, p := range server.retainedMessages {
+		if p != nil && topicMatches(filter, topic) {
+			message := makeMessage(topic, p)
+			message.Retain = true
+			messages = append(messages, message)
+		}
+	}
+	slices.SortFunc(messages, func(a, b Message) int {
+		return strings.Compare(a.Topic, b.Topic)
+	})
+	return messages
+}
+
+// SetRetainedMessage replaces the retained message of topic without
+// publishing it, an empty payload removes it. The limits of the retained
+// messages apply.
+func (server *Server) SetRetainedMessage(topic string, payload []byte, qos types.QoS) error {
+	err := checkTopicName(topic)
+	if err != nil {
+		return err
+	}
+	if qos > types.QoS2 {
+		return fmt.Errorf("invalid QoS: %d", qos)
+	}
+
+	server.addRetainedMessage(topic, protocol.MakePublishPacket(topic, payload, qos, true))
+	return nil
+}
+
+// DeleteRetainedMessages removes the retained messages of the topics that
+// match filter and returns how many were removed.
+func (server *Server) DeleteRetainedMessages(filter string) int {
+	messages := server.RetainedMessages(filter)
+	for _, message := range messages {
+		server.addRetainedMessage(message.Topic, protocol.MakePublishPacket(message.Topic, nil, types.QoS0, true))
+	}
+	return len(messages)
+}
+
+// info returns the session info of the client, the clients lock of the
+// server must be held.
+func (client *Client) info() SessionInfo {
+	client.Mutex.Lock()
+	defer client.Mutex.Unlock()
+
+	session := SessionInfo{
+		ClientID:              client.ID,
+		UserName:              client.UserName,
+		Connected:             client.Conn != nil,
+		SessionExpiryInterval: int64(client.SessionExpiryInterval / time.Second),
+		Subscriptions:         make([]SubscriptionInfo, 0, len(client.Subscriptions)),
+		QueuedMessages:        len(client.queue),
+		InFlightMessages:      len(client.inFlight),
+		SendQueuePackets:      len(client.SendQueue),
+	}
+	if client.SessionExpiryInterval == SessionNeverExpires {
+		session.SessionExpiryInterval = -1
+	}
+	if client.Conn != nil {
+		session.RemoteAddr = client.Conn.RemoteAddr().String()
+	}
+	for _, filter := range client.Subscriptions {
+		session.Subscriptions = append(session.Subscriptions,
+			SubscriptionInfo{Filter: filter, QoS: client.subscriptionQoS[filter]})
+	}
+	return session
+}
+
+func (filter *SessionFilter) matches(session SessionInfo) bool {
+	if filter.Connected != nil && *filter.Connected != session.Connected {
+		return false
+	}
+	if filter.UserName != "" && filter.UserName != session.UserName {
+		return false
+	}
+	return strings.HasPrefix(session.ClientID, filter.Prefix)
+}
+
+// AdminHandler returns the handler of the admin API, for serving it on an
+// existing HTTP server. Requests must send token as bearer token.
+func (server *Server) AdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/clients", server.handleListClients)
+	mux.HandleFunc("GET /api/clients/{id}", server.handleGetClient)
+	mux.HandleFunc("GET /api/clients/{id}/subscriptions", server.handleGetSubscriptions)
+	mux.HandleFunc("POST /api/clients/{id}/kick", server.handleKick)
+	mux.HandleFunc("DELETE /api/clients/{id}", server.handleDeleteSession)
+	mux.HandleFunc("GET /api/subscriptions", server.handleListSubscriptions)
+	mux.HandleFunc("GET /api/retained", server.handleListRetained)
+	mux.HandleFunc("DELETE /api/retained", server.handleDeleteRetainedFilter)
+	mux.HandleFunc("GET /api/retained/{topic...}", server.handleGetRetained)
+	mux.HandleFunc("PUT /api/retained/{topic...}", server.handleSetRetained)
+	mux.HandleFunc("DELETE /api/retained/{topic...}", server.handleDeleteRetained)
+	mux.HandleFunc("POST /api/publish", server.handlePublish)
+	mux.HandleFunc("GET /api/stats", server.handleStats)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			server.logs.admin.Warn("unauthorized request", "remote_addr", r.RemoteAddr,
+				"method", r.Method, "path", r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gobroker"`)
+			writeAdminError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		server.logs.admin.Debug("request", "remote_addr", r.RemoteAddr, "method", r.Method, "path", r.URL.Path)
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// loadAdminToken reads the token of the admin API from a file.
+func loadAdminToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("%w: admin token file %s is empty", ErrInvalidConfig, path)
+	}
+	return token, nil
+}
+
+// serveAdmin serves the admin API on ln until the server is closed.
+func (server *Server) serveAdmin(ln net.Listener, token string) error {
+	server.logs.admin.Info("serving admin API", "address", ln.Addr().String())
+	return server.serveHTTP(ln, server.AdminHandler(token))
+}
+
+func (server *Server) handleListClients(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := SessionFilter{
+		UserName: query.Get("user_name"),
+		Prefix:   query.Get("prefix"),
+	}
+	connected := true
+	switch query.Get("state") {
+	case "":
+	case "connected":
+		filter.Connected = &connected
+	case "offline":
+		connected = false
+		filter.Connected = &connected
+	default:
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid state: %q", query.Get("state")))
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, server.Sessions(filter))
+}
+
+func (server *Server) handleGetClient(w http.ResponseWriter, r *http.Request) {
+	session, err := server.Session(r.PathValue("id"))
+	if err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, session)
+}
+
+func (server *Server) handleGetSubscriptions(w http.ResponseWriter, r *http.Request) {
+	session, err := server.Session(r.PathValue("id"))
+	if err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, session.Subscriptions)
+}
+
+func (server *Server) handleKick(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(server.config.ShutdownTimeout)*time.Second)
+	defer cancel()
+
+	err := server.Kick(ctx, r.PathValue("id"))
+	writeAdminResult(w, err)
+}
+
+func (server *Server) handleDeleteSession(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(server.config.ShutdownTimeout)*time.Second)
+	defer cancel()
+
+	err := server.DeleteSession(ctx, r.PathValue("id"))
+	writeAdminResult(w, err)
+}
+
+func (server *Server) handleListSubscriptions(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, http.StatusOK, server.Subscriptions(r.URL.Query().Get("topic")))
+}
+
+func (server *Server) handleListRetained(w http.ResponseWriter, r *http.Request) {
+	filter := r.URL.Query().Get("filter")
+	if filter == "" {
+		filter = "#"
+	}
+	writeAdminJSON(w, http.StatusOK, server.RetainedMessages(filter))
+}
+
+func (server *Server) handleDeleteRetainedFilter(w http.ResponseWriter, r *http.Request) {
+	filter := r.URL.Query().Get("filter")
+	if filter == "" {
+		writeAdminError(w, http.StatusBadRequest, errors.New("no filter"))
+		return
+	}
+
+	deleted := server.DeleteRetainedMessages(filter)
+	server.logs.admin.Info("deleted retained messages", "topic_filter", filter, "count", deleted)
+	writeAdminJSON(w, http.StatusOK, struct {
+		Deleted int `json:"deleted"`
+	}{Deleted: deleted})
+}
+
+func (server *Server) handleGetRetained(w http.ResponseWriter, r *http.Request) {
+	topic := r.PathValue("topic")
+	err := checkTopicName(topic)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	messages := server.RetainedMessages(topic)
+	if len(messages) == 0 {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("no retained message: %s", topic))
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, messages[0])
+}
+
+func (server *Server) handleSetRetained(w http.ResponseWriter, r *http.Request) {
+	topic := r.PathValue("topic")
+	qos, err := parseQoS(r.URL.Query().Get("qos"))
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, adminMaxBodySize))
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	err = server.SetRetainedMessage(topic, payload, qos)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	server.logs.admin.Info("set retained message", "topic", topic)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *Server) handleDeleteRetained(w http.ResponseWriter, r *http.Request) {
+	topic := r.PathValue("topic")
+	err := server.SetRetainedMessage(topic, nil, types.QoS0)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	server.logs.admin.Info("deleted retained message", "topic", topic)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *Server) handlePublish(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	qos, err := parseQoS(query.Get("qos"))
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	retain := false
+	if query.Has("retain") {
+		retain, err = strconv.ParseBool(query.Get("retain"))
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid retain: %q", query.Get("retain")))
+			return
+		}
+	}
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, adminMaxBodySize))
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	err = server.Publish(query.Get("topic"), payload, qos, retain)
+	writeAdminResult(w, err)
+}
+
+func (server *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	writeAdminJSON(w, http.StatusOK, server.Stats())
+}
+
+// parseQoS parses a QoS query parameter, which defaults to QoS 0.
+func parseQoS(value string) (types.QoS, error) {
+	if value == "" {
+		return types.QoS0, nil
+	}
+	qos, err := strconv.ParseUint(value, 10, 8)
+	if err != nil || types.QoS(qos) > types.QoS2 {
+		return 0, fmt.Errorf("invalid QoS: %q", value)
+	}
+	return types.QoS(qos), nil
+}
+
+// writeAdminResult writes No Content if err is nil, or the error with the
+// status code that matches it.
+func writeAdminResult(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, ErrSessionNotFound):
+		writeAdminError(w, http.StatusNotFound, err)
+	case errors.Is(err, ErrClientNotConnected), errors.Is(err, ErrClientConnected):
+		writeAdminError(w, http.StatusConflict, err)
+	case errors.Is(err, ErrInvalidTopicName):
+		writeAdminError(w, http.StatusBadRequest, err)
+	case errors.Is(err, ErrPublishRejected), errors.Is(err, ErrNotAuthorized):
+		writeAdminError(w, http.StatusForbidden, err)
+	case errors.Is(err, ErrServerClosed):
+		writeAdminError(w, http.StatusServiceUnavailable, err)
+	default:
+		writeAdminError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeAdminJSON(w, status, adminError{Error: err.Error()})
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,166 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DvdSpijker/GoBroker/packet"
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+const testAdminToken = "secret"
+
+// adminRequest sends a request to the admin API of server and decodes the
+// JSON response into v if it is not nil.
+func adminRequest(t *testing.T, server *Server, method string, path string, body string, v any) int {
+	t.Helper()
+
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	request.Header.Set("Authorization", "Bearer "+testAdminToken)
+	recorder := httptest.NewRecorder()
+	server.AdminHandler(testAdminToken).ServeHTTP(recorder, request)
+
+	if v != nil && recorder.Code < 300 {
+		err := json.Unmarshal(recorder.Body.Bytes(), v)
+		if err != nil {
+			t.Fatalf("%s %s: %v: %s", method, path, err, recorder.Body.String())
+		}
+	}
+	return recorder.Code
+}
+
+var adminAuthorizationCases = []struct {
+	header string
+	want   int
+}{
+	{header: "", want: http.StatusUnauthorized},
+	{header: "Bearer wrong", want: http.StatusUnauthorized},
+	{header: "Basic " + testAdminToken, want: http.StatusUnauthorized},
+	{header: "Bearer " + testAdminToken, want: http.StatusOK},
+}
+
+func TestAdminAuthorization(t *testing.T) {
+	server := NewServer(Config{})
+	for _, c := range adminAuthorizationCases {
+		request := httptest.NewRequest("GET", "/api/clients", nil)
+		if c.header != "" {
+			request.Header.Set("Authorization", c.header)
+		}
+		recorder := httptest.NewRecorder()
+		server.AdminHandler(testAdminToken).ServeHTTP(recorder, request)
+		if recorder.Code != c.want {
+			t.Fatalf("wanted %v for %q but got %v", c.want, c.header, recorder.Code)
+		}
+	}
+}
+
+func TestAdminClients(t *testing.T) {
+	server, address := startServer(t, Config{})
+	online := dialClient(t, address)
+	online.sessionConnect("online", true, 60)
+	online.subscribeQoS("admin/#", types.QoS1)
+	offline := dialClient(t, address)
+	offline.sessionConnect("offline", true, 60)
+	offline.conn.Close()
+	waitOffline(t, server, "offline")
+
+	var sessions []SessionInfo
+	adminRequest(t, server, "GET", "/api/clients?state=connected", "", &sessions)
+	if len(sessions) != 1 || sessions[0].ClientID != "online" || sessions[0].RemoteAddr == "" {
+		t.Fatalf("wanted only the online client but got %+v", sessions)
+	}
+	adminRequest(t, server, "GET", "/api/clients?state=offline", "", &sessions)
+	if len(sessions) != 1 || sessions[0].ClientID != "offline" {
+		t.Fatalf("wanted only the offline client but got %+v", sessions)
+	}
+
+	var subscriptions []SubscriptionInfo
+	adminRequest(t, server, "GET", "/api/clients/online/subscriptions", "", &subscriptions)
+	if len(subscriptions) != 1 || subscriptions[0] != (SubscriptionInfo{Filter: "admin/#", QoS: types.QoS1}) {
+		t.Fatalf("wanted the admin/# subscription but got %+v", subscriptions)
+	}
+
+	code := adminRequest(t, server, "POST", "/api/clients/online/kick", "", nil)
+	if code != http.StatusNoContent {
+		t.Fatalf("wanted %v but got %v", http.StatusNoContent, code)
+	}
+	fixedHeader, bytes := online.read()
+	if fixedHeader.PacketType != packet.DISCONNECT || packet.ReasonCode(bytes[2]) != packet.AdministrativeAction {
+		t.Fatalf("wanted DISCONNECT with administrative action but got %v %x", fixedHeader.PacketType, bytes)
+	}
+	code = adminRequest(t, server, "POST", "/api/clients/online/kick", "", nil)
+	if code != http.StatusConflict {
+		t.Fatalf("wanted %v for an offline client but got %v", http.StatusConflict, code)
+	}
+
+	// The session outlives the connection until it is deleted.
+	var session SessionInfo
+	adminRequest(t, server, "GET", "/api/clients/online", "", &session)
+	if session.Connected || len(session.Subscriptions) != 1 {
+		t.Fatalf("wanted the offline session with its subscription but got %+v", session)
+	}
+	code = adminRequest(t, server, "DELETE", "/api/clients/online", "", nil)
+	if code != http.StatusNoContent {
+		t.Fatalf("wanted %v but got %v", http.StatusNoContent, code)
+	}
+	code = adminRequest(t, server, "GET", "/api/clients/online", "", nil)
+	if code != http.StatusNotFound {
+		t.Fatalf("wanted %v after deleting the session but got %v", http.StatusNotFound, code)
+	}
+	if server.countSubscriptions() != 0 {
+		t.Fatalf("wanted no subscriptions after deleting the session but got %v", server.countSubscriptions())
+	}
+}
+
+func TestAdminRetainedMessages(t *testing.T) {
+	server, address := startServer(t, Config{})
+	for _, topic := range []string{"admin/a", "admin/b", "other"} {
+		code := adminRequest(t, server, "PUT", "/api/retained/"+topic+"?qos=1", "payload of "+topic, nil)
+		if code != http.StatusNoContent {
+			t.Fatalf("wanted %v but got %v", http.StatusNoContent, code)
+		}
+	}
+
+	var message Message
+	adminRequest(t, server, "GET", "/api/retained/admin/a", "", &message)
+	if message.Topic != "admin/a" || string(message.Payload) != "payload of admin/a" || message.Qos != types.QoS1 {
+		t.Fatalf("wanted the retained message of admin/a but got %+v", message)
+	}
+
+	var messages []Message
+	adminRequest(t, server, "GET", "/api/retained?filter=admin/%2B", "", &messages)
+	if len(messages) != 2 || messages[0].Topic != "admin/a" || messages[1].Topic != "admin/b" {
+		t.Fatalf("wanted the retained messages of admin/+ but got %+v", messages)
+	}
+
+	var deleted struct {
+		Deleted int `json:"deleted"`
+	}
+	adminRequest(t, server, "DELETE", "/api/retained?filter=admin/%23", "", &deleted)
+	if deleted.Deleted != 2 {
+		t.Fatalf("wanted 2 deleted messages but got %v", deleted.Deleted)
+	}
+	adminRequest(t, server, "DELETE", "/api/retained/other", "", nil)
+	adminRequest(t, server, "GET", "/api/retained", "", &messages)
+	if len(messages) != 0 {
+		t.Fatalf("wanted no retained messages but got %+v", messages)
+	}
+
+	subscriber := connectClient(t, address, "subscriber")
+	subscriber.subscribe("admin/#")
+	code := adminRequest(t, server, "POST", "/api/publish?topic=admin/published&retain=true", "hello", nil)
+	if code != http.StatusNoContent {
+		t.Fatalf("wanted %v but got %v", http.StatusNoContent, code)
+	}
+	p := subscriber.readPublish()
+	if p.VariableHeader.TopicName.String() != "admin/published" || string(p.Payload.Data) != "hello" {
+		t.Fatalf("wanted the published message but got %s %s", p.VariableHeader.TopicName.String(), p.Payload.Data)
+	}
+	code = adminRequest(t, server, "POST", "/api/publish?topic=admin/%23", "", nil)
+	if code != http.StatusBadRequest {
+		t.Fatalf("wanted %v for a wildcard topic but got %v", http.StatusBadRequest, code)
+	}
+}
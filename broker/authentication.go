@@ -0,0 +1,227 @@
+package broker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/auth"
+	"github.com/DvdSpijker/GoBroker/packet"
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+// newAuthenticator starts an enhanced authentication exchange (4.12). It
+// returns nil if the listener does not support the method.
+func (l *listener) newAuthenticator(method string) auth.Authenticator {
+	if !slices.Contains(l.config.Authentication.Methods, method) {
+		return nil
+	}
+
+	switch {
+	case method == auth.SCRAMSHA256 && l.passwords != nil:
+		return auth.NewSCRAMServer(l.passwords)
+	case method == auth.JWTMethod && l.jwt != nil:
+		return auth.NewJWTAuthenticator(l.jwt)
+	default:
+		return nil
+	}
+}
+
+// authenticatedToken returns the token verified by an authenticator, or nil
+// if the method does not use tokens.
+func authenticatedToken(authenticator auth.Authenticator) *auth.Token {
+	tokenAuthenticator, ok := authenticator.(interface{ Token() *auth.Token })
+	if !ok {
+		return nil
+	}
+	return tokenAuthenticator.Token()
+}
+
+// tokenClientID checks the client ID against the one bound by a token. A
+// client that connects without a client ID is assigned the one of the token.
+func tokenClientID(token *auth.Token, clientID string) (string, bool, packet.ReasonCode) {
+	if token.ClientID == "" || token.ClientID == clientID {
+		return clientID, false, packet.Success
+	}
+	if clientID == "" {
+		return token.ClientID, true, packet.Success
+	}
+
+	return "", false, packet.ClientIdentifierNotValid
+}
+
+// newClientID returns a client ID for a client that connected without one.
+func newClientID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "auto-" + hex.EncodeToString(b)
+}
+
+// setToken makes token the credentials of the client. The client is
+// disconnected when the token expires, unless it re-authenticates with a
+// new token before then.
+func (client *Client) setToken(token *auth.Token) {
+	client.Mutex.Lock()
+	defer client.Mutex.Unlock()
+
+	if client.tokenTimer != nil {
+		client.tokenTimer.Stop()
+	}
+	client.token = token
+	if token == nil {
+		return
+	}
+
+	conn := client.Conn
+	client.tokenTimer = time.AfterFunc(time.Until(token.Expiry), func() {
+		client.server.logs.auth.Info("token expired, disconnecting", "client_id", client.ID)
+		client.sendDisconnect(conn, packet.MaximumConnectTime)
+		// The connection handler disconnects the client when the read fails.
+		conn.Close()
+	})
+}
+
+// authenticateConnect runs the enhanced authentication exchange started by a
+// CONNECT packet. The client does not exist yet, so AUTH packets are
+// exchanged on the connection directly. It returns the authenticator of the
+// completed exchange and the authentication data for the CONNACK.
+func (l *listener) authenticateConnect(conn net.Conn, framer *framer, p *packet.ConnectPacket) (auth.Authenticator, []byte, packet.ReasonCode) {
+	method := p.VariableHeader.AuthenticationMethod.String()
+	log := l.server.logs.auth.With("remote_addr", conn.RemoteAddr().String(), "authentication_method", method)
+
+	authenticator := l.newAuthenticator(method)
+	if authenticator == nil {
+		log.Info("unsupported authentication method")
+		return nil, nil, packet.BadAuthenticationMethod
+	}
+
+	data := p.VariableHeader.AuthenticationData.Data
+	for {
+		response, done, err := authenticator.Step(data)
+		if err != nil {
+			log.Info("authentication failed", "error", err)
+			return nil, nil, packet.NotAuthorized
+		}
+		if done {
+			return authenticator, response, packet.Success
+		}
+
+		authPacket := makeAuthPacket(packet.ContinueAuthentication, method, response)
+		bin, err := authPacket.Encode()
+		if err != nil {
+			log.Error("failed to encode AUTH packet", "error", err)
+			return nil, nil, packet.UnspecifiedError
+		}
+		_, err = conn.Write(bin)
+		if err != nil {
+			log.Warn("failed to send AUTH packet", "error", err)
+			return nil, nil, packet.UnspecifiedError
+		}
+		l.server.metrics.sent(bin)
+
+		conn.SetReadDeadline(time.Now().Add(connectTimeout))
+		fixedHeader, bytes, err := framer.readPacket()
+		if err != nil {
+			log.Warn("failed to read AUTH packet", "error", err)
+			return nil, nil, packet.UnspecifiedError
+		}
+		l.server.metrics.received(fixedHeader.PacketType, len(bytes))
+		// MQTT-4.12.0-4: The client continues the exchange with AUTH packets
+		// using the same method.
+		if fixedHeader.PacketType != packet.AUTH {
+			return nil, nil, packet.ProtocolError
+		}
+		authPacket = &packet.AuthPacket{}
+		_, err = authPacket.Decode(bytes)
+		if err != nil {
+			log.Warn("invalid AUTH packet", "error", err)
+			return nil, nil, packet.MalformedPacket
+		}
+		if authPacket.VariableHeader.ReasonCode != packet.ContinueAuthentication ||
+			authPacket.VariableHeader.AuthenticationMethod.String() != method {
+			return nil, nil, packet.ProtocolError
+		}
+
+		data = authPacket.VariableHeader.AuthenticationData.Data
+	}
+}
+
+// onAuth handles an AUTH packet of a connected client, which re-authenticates
+// the client (4.12.1). It returns the reason code to disconnect the client
+// with, or Success if the client stays connected.
+func (client *Client) onAuth(p *packet.AuthPacket) packet.ReasonCode {
+	method := p.VariableHeader.AuthenticationMethod.String()
+	log := client.server.logs.auth.With("client_id", client.ID, "authentication_method", method)
+
+	// MQTT-4.12.0-7: A client that did not use enhanced authentication in the
+	// CONNECT must not send AUTH packets.
+	// MQTT-4.12.1-1: Re-authentication uses the method of the CONNECT.
+	if client.AuthenticationMethod == "" || method != client.AuthenticationMethod {
+		return packet.ProtocolError
+	}
+
+	switch p.VariableHeader.ReasonCode {
+	case packet.ReAuthenticate:
+		if client.reauthentication != nil {
+			return packet.ProtocolError
+		}
+		client.reauthentication = client.listener.newAuthenticator(method)
+		if client.reauthentication == nil {
+			return packet.BadAuthenticationMethod
+		}
+	case packet.ContinueAuthentication:
+		if client.reauthentication == nil {
+			return packet.ProtocolError
+		}
+	default:
+		return packet.ProtocolError
+	}
+
+	response, done, err := client.reauthentication.Step(p.VariableHeader.AuthenticationData.Data)
+	if err != nil {
+		log.Info("re-authentication failed", "error", err)
+		return packet.NotAuthorized
+	}
+
+	reasonCode := packet.ContinueAuthentication
+	if done {
+		// The session stays with the user that created it.
+		if client.reauthentication.UserName() != client.UserName {
+			log.Info("re-authenticated as a different user")
+			return packet.NotAuthorized
+		}
+		token := authenticatedToken(client.reauthentication)
+		if token != nil {
+			_, _, clientIDReasonCode := tokenClientID(token, client.ID)
+			if clientIDReasonCode != packet.Success {
+				return packet.NotAuthorized
+			}
+			client.setToken(token)
+		}
+		client.reauthentication = nil
+		reasonCode = packet.Success
+		log.Info("re-authenticated")
+	}
+
+	authPacket := makeAuthPacket(reasonCode, method, response)
+	bin, err := authPacket.Encode()
+	if err != nil {
+		log.Error("failed to encode AUTH packet", "error", err)
+		return packet.UnspecifiedError
+	}
+	client.Write(bin)
+
+	return packet.Success
+}
+
+func makeAuthPacket(reasonCode packet.ReasonCode, method string, data []byte) *packet.AuthPacket {
+	return &packet.AuthPacket{
+		VariableHeader: packet.AuthVariableHeader{
+			ReasonCode:           reasonCode,
+			AuthenticationMethod: types.UtfString{Str: method},
+			AuthenticationData:   types.BinaryData{Data: data},
+		},
+	}
+}
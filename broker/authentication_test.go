@@ -0,0 +1,369 @@
+package broker
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/auth"
+	"github.com/DvdSpijker/GoBroker/packet"
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+// authenticationProperties encodes the enhanced authentication properties.
+func authenticationProperties(method string, data []byte) []byte {
+	properties := append([]byte{byte(packet.AuthenticationMethodProperty)}, utfString(method)...)
+	properties = append(properties, byte(packet.AuthenticationDataProperty))
+	return append(properties, utfString(string(data))...)
+}
+
+// enhancedConnectPacket creates a CONNECT packet that starts enhanced authentication.
+func enhancedConnectPacket(clientID string, method string, data []byte) []byte {
+	properties := authenticationProperties(method, data)
+
+	propertyLength, _ := (&types.VariableByteInteger{Value: int32(len(properties))}).Encode()
+
+	body := utfString("MQTT")
+	body = append(body, 5, 0x02, 0, 60)
+	body = append(body, propertyLength...)
+	body = append(body, properties...)
+	body = append(body, utfString(clientID)...)
+
+	return withRemainingLength(byte(packet.CONNECT), body)
+}
+
+// authPacket sends an AUTH packet and returns the response, which is either
+// an AUTH, CONNACK or DISCONNECT packet.
+func (client *testClient) auth(reasonCode packet.ReasonCode, method string, data []byte) (packet.FixedHeader, []byte) {
+	client.t.Helper()
+
+	bin, err := makeAuthPacket(reasonCode, method, data).Encode()
+	if err != nil {
+		client.t.Fatal(err)
+	}
+	client.write(bin)
+
+	return client.read()
+}
+
+// conackAuthenticationData returns the Authentication Data property of a CONNACK.
+func conackAuthenticationData(t *testing.T, bytes []byte) []byte {
+	t.Helper()
+
+	properties := bytes[5:]
+	for len(properties) > 0 {
+		identifier := packet.PropertyIdentifier(properties[0])
+		properties = properties[1:]
+		switch identifier {
+		case packet.SharedSubscriptionAvailable:
+			properties = properties[1:]
+		case packet.ServerKeepAliveProperty:
+			properties = properties[2:]
+		case packet.AuthenticationMethodProperty, packet.AuthenticationDataProperty:
+			data := types.BinaryData{}
+			n, err := data.Decode(properties)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if identifier == packet.AuthenticationDataProperty {
+				return data.Data
+			}
+			properties = properties[n:]
+		default:
+			t.Fatalf("unexpected CONNACK property %x", identifier)
+		}
+	}
+	return nil
+}
+
+// scramConnect connects with SCRAM-SHA-256 and returns the CONNACK reason code.
+func (client *testClient) scramConnect(clientID string, userName string, password string) packet.ReasonCode {
+	client.t.Helper()
+
+	scram := auth.NewSCRAMClient(userName, []byte(password))
+	client.write(enhancedConnectPacket(clientID, auth.SCRAMSHA256, scram.Start()))
+
+	fixedHeader, bytes := client.read()
+	if fixedHeader.PacketType == packet.CONNACK {
+		return packet.ReasonCode(bytes[3])
+	}
+	if fixedHeader.PacketType != packet.AUTH {
+		client.t.Fatalf("wanted AUTH but got packet type %v", fixedHeader.PacketType)
+	}
+	challenge := packet.AuthPacket{}
+	_, err := challenge.Decode(bytes)
+	if err != nil {
+		client.t.Fatal(err)
+	}
+	if challenge.VariableHeader.ReasonCode != packet.ContinueAuthentication {
+		client.t.Fatalf("wanted reason code %x but got %x",
+			packet.ContinueAuthentication, challenge.VariableHeader.ReasonCode)
+	}
+
+	response, _, err := scram.Step(challenge.VariableHeader.AuthenticationData.Data)
+	if err != nil {
+		client.t.Fatal(err)
+	}
+	fixedHeader, bytes = client.auth(packet.ContinueAuthentication, auth.SCRAMSHA256, response)
+	if fixedHeader.PacketType != packet.CONNACK {
+		client.t.Fatalf("wanted CONNACK but got packet type %v", fixedHeader.PacketType)
+	}
+	reasonCode := packet.ReasonCode(bytes[3])
+
+	if reasonCode == packet.Success {
+		_, done, err := scram.Step(conackAuthenticationData(client.t, bytes))
+		if err != nil || !done {
+			client.t.Fatalf("wanted the server to be verified but got %v", err)
+		}
+	}
+	return reasonCode
+}
+
+func TestEnhancedAuthentication(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "passwords")
+	entries, err := auth.SetPassword(nil, "alice", []byte("secret"), auth.SCRAMHasher(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err = auth.SetPassword(entries, "bob", []byte("hunter2"), auth.SCRAMHasher(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = auth.WritePasswordEntries(passwordFile, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _ := startServer(t, Config{})
+	go server.ServeListener(ln, ListenerConfig{
+		Authentication: AuthenticationConfig{
+			PasswordFile:     passwordFile,
+			Methods:          []string{auth.SCRAMSHA256},
+			DisablePasswords: true,
+		},
+	})
+	address := ln.Addr().String()
+
+	t.Run("valid credentials", func(t *testing.T) {
+		client := dialClient(t, address)
+		got := client.scramConnect("scram-valid", "alice", "secret")
+		if got != packet.Success {
+			t.Fatalf("wanted reason code %x but got %x", packet.Success, got)
+		}
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		client := dialClient(t, address)
+		got := client.scramConnect("scram-wrong", "alice", "guess")
+		if got != packet.NotAuthorized {
+			t.Fatalf("wanted reason code %x but got %x", packet.NotAuthorized, got)
+		}
+	})
+
+	t.Run("unknown user", func(t *testing.T) {
+		client := dialClient(t, address)
+		got := client.scramConnect("scram-unknown", "mallory", "secret")
+		if got != packet.NotAuthorized {
+			t.Fatalf("wanted reason code %x but got %x", packet.NotAuthorized, got)
+		}
+	})
+
+	t.Run("unknown method", func(t *testing.T) {
+		client := dialClient(t, address)
+		client.write(enhancedConnectPacket("unknown-method", "SCRAM-SHA-1", []byte("n,,n=alice,r=abc")))
+		fixedHeader, bytes := client.read()
+		if fixedHeader.PacketType != packet.CONNACK || packet.ReasonCode(bytes[3]) != packet.BadAuthenticationMethod {
+			t.Fatalf("wanted CONNACK with reason code %x but got %x", packet.BadAuthenticationMethod, bytes)
+		}
+	})
+
+	t.Run("plain password", func(t *testing.T) {
+		client := dialClient(t, address)
+		got := client.connect("plain-password", "alice", "secret")
+		if got != packet.BadAuthenticationMethod {
+			t.Fatalf("wanted reason code %x but got %x", packet.BadAuthenticationMethod, got)
+		}
+	})
+
+	reauthenticationCases := []struct {
+		name     string
+		userName string
+		password string
+		want     packet.PacketType
+	}{
+		{name: "same user", userName: "alice", password: "secret", want: packet.AUTH},
+		{name: "wrong password", userName: "alice", password: "guess", want: packet.DISCONNECT},
+		{name: "other user", userName: "bob", password: "hunter2", want: packet.DISCONNECT},
+	}
+
+	for _, c := range reauthenticationCases {
+		t.Run("re-authenticate "+c.name, func(t *testing.T) {
+			client := dialClient(t, address)
+			got := client.scramConnect("reauth-"+c.name, "alice", "secret")
+			if got != packet.Success {
+				t.Fatalf("wanted reason code %x but got %x", packet.Success, got)
+			}
+
+			scram := auth.NewSCRAMClient(c.userName, []byte(c.password))
+			fixedHeader, bytes := client.auth(packet.ReAuthenticate, auth.SCRAMSHA256, scram.Start())
+			challenge := packet.AuthPacket{}
+			_, err := challenge.Decode(bytes)
+			if err != nil || fixedHeader.PacketType != packet.AUTH {
+				t.Fatalf("wanted an AUTH challenge but got %x: %v", bytes, err)
+			}
+
+			response, _, err := scram.Step(challenge.VariableHeader.AuthenticationData.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fixedHeader, bytes = client.auth(packet.ContinueAuthentication, auth.SCRAMSHA256, response)
+			if fixedHeader.PacketType != c.want {
+				t.Fatalf("wanted packet type %v but got %v", c.want, fixedHeader.PacketType)
+			}
+
+			if c.want == packet.DISCONNECT {
+				disconnectPacket := packet.DisconnectPacket{}
+				_, err := disconnectPacket.Decode(bytes)
+				if err != nil || disconnectPacket.VariableHeader.ReasonCode != packet.NotAuthorized {
+					t.Fatalf("wanted reason code %x but got %x", packet.NotAuthorized, bytes)
+				}
+				return
+			}
+
+			result := packet.AuthPacket{}
+			_, err = result.Decode(bytes)
+			if err != nil || result.VariableHeader.ReasonCode != packet.Success {
+				t.Fatalf("wanted reason code %x but got %x", packet.Success, bytes)
+			}
+			_, done, err := scram.Step(result.VariableHeader.AuthenticationData.Data)
+			if err != nil || !done {
+				t.Fatalf("wanted the server to be verified but got %v", err)
+			}
+		})
+	}
+}
+
+// signHS256 creates a JWT with claims signed with secret.
+func signHS256(t *testing.T, secret []byte, claims map[string]any) string {
+	t.Helper()
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTAuthentication(t *testing.T) {
+	secret := []byte("shared secret")
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	err := os.WriteFile(secretFile, append(secret, '\n'), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _ := startServer(t, Config{})
+	go server.ServeListener(ln, ListenerConfig{
+		Authentication: AuthenticationConfig{
+			Methods: []string{auth.JWTMethod},
+			JWT:     JWTConfig{SecretFile: secretFile},
+		},
+	})
+	address := ln.Addr().String()
+
+	token := func(clientID string, expiry time.Duration) string {
+		return signHS256(t, secret, map[string]any{
+			"sub":       "device",
+			"client_id": clientID,
+			"exp":       time.Now().Add(expiry).Unix(),
+			"subscribe": []string{"devices/+/status"},
+		})
+	}
+
+	connectCases := []struct {
+		name     string
+		clientID string
+		userName string
+		password string
+		want     packet.ReasonCode
+	}{
+		{name: "token", clientID: "device-1", password: token("device-1", time.Minute), want: packet.Success},
+		{name: "assigned client ID", password: token("device-2", time.Minute), want: packet.Success},
+		{name: "other client ID", clientID: "device-3", password: token("device-1", time.Minute),
+			want: packet.ClientIdentifierNotValid},
+		{name: "expired", clientID: "device-4", password: token("device-4", -time.Minute),
+			want: packet.BadUserNameOrPassword},
+		{name: "forged", clientID: "device-5", password: signHS256(t, []byte("guess"), map[string]any{
+			"exp": time.Now().Add(time.Minute).Unix()}), want: packet.BadUserNameOrPassword},
+		{name: "password", clientID: "device-6", userName: "device", password: "secret",
+			want: packet.BadUserNameOrPassword},
+		{name: "anonymous", clientID: "device-7", want: packet.NotAuthorized},
+	}
+
+	for _, c := range connectCases {
+		t.Run(c.name, func(t *testing.T) {
+			client := dialClient(t, address)
+			got := client.connect(c.clientID, c.userName, c.password)
+			if got != c.want {
+				t.Fatalf("wanted reason code %x but got %x", c.want, got)
+			}
+		})
+	}
+
+	t.Run("grants", func(t *testing.T) {
+		client := dialClient(t, address)
+		client.write(enhancedConnectPacket("device-8", auth.JWTMethod, []byte(token("device-8", time.Minute))))
+		fixedHeader, bytes := client.read()
+		if fixedHeader.PacketType != packet.CONNACK || packet.ReasonCode(bytes[3]) != packet.Success {
+			t.Fatalf("wanted successful CONNACK but got %x", bytes)
+		}
+
+		if got := client.subscribe("devices/8/status"); got != packet.GrantedQoS0 {
+			t.Fatalf("wanted reason code %x but got %x", packet.GrantedQoS0, got)
+		}
+		if got := client.subscribe("devices/#"); got != packet.NotAuthorized {
+			t.Fatalf("wanted reason code %x but got %x", packet.NotAuthorized, got)
+		}
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		client := dialClient(t, address)
+		got := client.connect("device-9", "", signHS256(t, secret, map[string]any{
+			"exp": time.Now().Add(time.Second).Unix(),
+		}))
+		if got != packet.Success {
+			t.Fatalf("wanted reason code %x but got %x", packet.Success, got)
+		}
+
+		client.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		fixedHeader, bytes, err := client.framer.readPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		disconnectPacket := packet.DisconnectPacket{}
+		_, err = disconnectPacket.Decode(bytes)
+		if err != nil || fixedHeader.PacketType != packet.DISCONNECT ||
+			disconnectPacket.VariableHeader.ReasonCode != packet.MaximumConnectTime {
+			t.Fatalf("wanted DISCONNECT with reason code %x but got %x", packet.MaximumConnectTime, bytes)
+		}
+	})
+}
@@ -0,0 +1,723 @@
+package broker
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/packet"
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+const (
+	// clusterDialInterval is the time between attempts to connect to a
+	// peer that is unreachable.
+	clusterDialInterval = time.Second
+	// clusterHandshakeTimeout bounds the exchange of hello messages.
+	clusterHandshakeTimeout = 5 * time.Second
+	// clusterWriteTimeout bounds writing a message to a peer.
+	clusterWriteTimeout = 10 * time.Second
+	// clusterTakeOverTimeout bounds the wait for the peers to hand over the
+	// session of a client that connects.
+	clusterTakeOverTimeout = 2 * time.Second
+	// clusterQueueSize is the number of messages queued for a peer, the
+	// link is closed and set up again when the queue is full.
+	clusterQueueSize = 1000
+)
+
+// Types of the messages between nodes.
+const (
+	clusterHello       = "hello"       // Node, Secret: the first message in both directions.
+	clusterInterest    = "interest"    // Filters: all filters with subscribers on the sender.
+	clusterSubscribe   = "subscribe"   // Filters: filters that got their first subscriber.
+	clusterUnsubscribe = "unsubscribe" // Filters: filters that lost their last subscriber.
+	clusterPublish     = "publish"     // Topic, Packet: a message for the subscribers of the receiver.
+	clusterRetain      = "retain"      // Topic, Packet: a retained message, an empty payload removes it.
+	clusterTakeOver    = "takeover"    // Request, ClientID, CleanStart: a client connected to the sender.
+	clusterSession     = "session"     // Request, ClientID, Session: the answer to a takeover.
+)
+
+var errClusterHandshake = errors.New("cluster handshake failed")
+
+type (
+	// cluster connects a node to the other nodes of the cluster. Every node
+	// dials every peer and only writes to the connections it dialed, so
+	// there are two connections between every pair of nodes, one for each
+	// direction.
+	//
+	// Nodes tell each other the filters their clients subscribed to and
+	// forward publishes only to the peers with a matching filter. Retained
+	// messages are replicated to all peers. A node that accepts a client
+	// asks its peers to hand over the session of the client, so that the
+	// session moves with the client.
+	//
+	// The methods of a nil cluster do nothing, so the server calls them
+	// whether clustering is enabled or not.
+	cluster struct {
+		server *Server
+		config ClusterConfig
+		log    *slog.Logger
+		secret string
+
+		mutex sync.Mutex // Protects the fields below.
+		// interest counts the subscriptions and in-process handlers of
+		// every filter of this node.
+		interest map[string]int
+		peers    map[string]*clusterPeer // By node name.
+		// requests are the takeovers waiting for answers by request ID.
+		requests    map[uint64]chan *clusterMessage
+		nextRequest uint64
+	}
+
+	clusterPeer struct {
+		// queue holds the messages for the peer, it is nil while the node
+		// is not connected to the peer.
+		queue chan *clusterMessage
+		conn  net.Conn // Connection that the queue is written to.
+		// interest are the filters with subscribers on the peer, received
+		// on the connection from the peer.
+		interest map[string]bool
+	}
+
+	clusterMessage struct {
+		Type       string        `json:"type"`
+		Node       string        `json:"node,omitempty"`
+		Secret     string        `json:"secret,omitempty"`
+		Filters    []string      `json:"filters,omitempty"`
+		Topic      string        `json:"topic,omitempty"`
+		Packet     []byte        `json:"packet,omitempty"` // Encoded PUBLISH packet.
+		Request    uint64        `json:"request,omitempty"`
+		ClientID   string        `json:"client_id,omitempty"`
+		CleanStart bool          `json:"clean_start,omitempty"`
+		Session    *movedSession `json:"session,omitempty"`
+	}
+
+	// movedSession is the state of a session that moves to another node.
+	movedSession struct {
+		Session  storedSession
+		Queue    [][]byte // Encoded PUBLISH packets in the order they were queued.
+		InFlight []movedInFlight
+		Received []uint16
+	}
+
+	movedInFlight struct {
+		PacketIdentifier uint16
+		Packet           []byte
+		Released         bool
+	}
+)
+
+func newCluster(server *Server, config ClusterConfig) *cluster {
+	if config.NodeName == "" {
+		return nil
+	}
+	return &cluster{
+		server:   server,
+		config:   config,
+		log:      server.logs.cluster.With("node", config.NodeName),
+		interest: make(map[string]int),
+		peers:    make(map[string]*clusterPeer),
+		requests: make(map[uint64]chan *clusterMessage),
+	}
+}
+
+// ServeCluster accepts the connections of the other nodes of the cluster on
+// ln and connects to the peers of the cluster config. It blocks until ln
+// fails or the server is closed, in which case ErrServerClosed is returned.
+func (server *Server) ServeCluster(ln net.Listener) error {
+	cluster := server.cluster
+	if cluster == nil {
+		ln.Close()
+		return fmt.Errorf("%w: cluster needs a node name", ErrInvalidConfig)
+	}
+	if cluster.config.SecretFile != "" {
+		data, err := os.ReadFile(cluster.config.SecretFile)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		cluster.secret = strings.TrimSpace(string(data))
+	}
+
+	if !server.trackListener(ln, true) {
+		ln.Close()
+		return ErrServerClosed
+	}
+	defer server.trackListener(ln, false)
+
+	cluster.log.Info("serving cluster", "address", ln.Addr().String(), "peers", len(cluster.config.Peers))
+	for _, address := range cluster.config.Peers {
+		go cluster.dial(address)
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if server.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go cluster.accept(conn)
+	}
+}
+
+// dial connects to the peer at address and writes the messages for it,
+// until the server is stopped. It connects again when the connection fails.
+func (cluster *cluster) dial(address string) {
+	log := cluster.log.With("peer_address", address)
+	for {
+		conn, name, err := cluster.handshake(address)
+		if err == nil {
+			log.Info("connected to peer", "peer", name)
+			err = cluster.write(name, conn)
+			log.Warn("connection to peer lost", "peer", name, "error", err)
+		} else {
+			log.Debug("failed to connect to peer", "error", err)
+		}
+
+		select {
+		case <-cluster.server.done:
+			return
+		case <-time.After(clusterDialInterval):
+		}
+	}
+}
+
+// handshake connects to the peer at address and returns the connection and
+// the name of the peer.
+func (cluster *cluster) handshake(address string) (net.Conn, string, error) {
+	conn, err := net.DialTimeout("tcp", address, clusterHandshakeTimeout)
+	if err != nil {
+		return nil, "", err
+	}
+	if !cluster.server.trackConn(conn, true) {
+		conn.Close()
+		return nil, "", ErrServerClosed
+	}
+
+	conn.SetDeadline(time.Now().Add(clusterHandshakeTimeout))
+	hello := &clusterMessage{Type: clusterHello, Node: cluster.config.NodeName, Secret: cluster.secret}
+	err = json.NewEncoder(conn).Encode(hello)
+	reply := &clusterMessage{}
+	if err == nil {
+		err = json.NewDecoder(conn).Decode(reply)
+	}
+	if err == nil && (reply.Type != clusterHello || reply.Node == "" || reply.Node == cluster.config.NodeName) {
+		err = fmt.Errorf("%w: unexpected reply %q from node %q", errClusterHandshake, reply.Type, reply.Node)
+	}
+	if err != nil {
+		cluster.closeConn(conn)
+		return nil, "", err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, reply.Node, nil
+}
+
+func (cluster *cluster) closeConn(conn net.Conn) {
+	conn.Close()
+	cluster.server.trackConn(conn, false)
+}
+
+// write sends the state of this node to the peer with name and then the
+// messages queued for it, until the connection fails.
+func (cluster *cluster) write(name string, conn net.Conn) error {
+	defer cluster.closeConn(conn)
+
+	// The snapshot of the state is taken and the queue is set up while
+	// holding the locks that changes to the state hold when they are
+	// queued, so no change is lost or sent before the snapshot.
+	cluster.server.retainedMessagesMutex.Lock()
+	cluster.mutex.Lock()
+	peer := cluster.peer(name)
+	if peer.queue != nil {
+		cluster.mutex.Unlock()
+		cluster.server.retainedMessagesMutex.Unlock()
+		return fmt.Errorf("already connected to %s", name)
+	}
+	queue := make(chan *clusterMessage, clusterQueueSize)
+	peer.queue = queue
+	peer.conn = conn
+	interest := &clusterMessage{Type: clusterInterest, Filters: make([]string, 0, len(cluster.interest))}
+	for filter := range cluster.interest {
+		interest.Filters = append(interest.Filters, filter)
+	}
+	retained := make(map[string]*packet.PublishPacket)
+	for topic, p := range cluster.server.retainedMessages {
+		if p != nil && !isSysTopic(topic) {
+			retained[topic] = p
+		}
+	}
+	cluster.mutex.Unlock()
+	cluster.server.retainedMessagesMutex.Unlock()
+
+	defer func() {
+		cluster.mutex.Lock()
+		if peer.queue == queue {
+			peer.queue = nil
+			peer.conn = nil
+		}
+		cluster.mutex.Unlock()
+	}()
+
+	// The peer does not write to the connection, reading detects that it
+	// is closed.
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(closed)
+	}()
+
+	encoder := json.NewEncoder(conn)
+	send := func(message *clusterMessage) error {
+		conn.SetWriteDeadline(time.Now().Add(clusterWriteTimeout))
+		return encoder.Encode(message)
+	}
+
+	err := send(interest)
+	if err != nil {
+		return err
+	}
+	for topic, p := range retained {
+		message, err := makeClusterPublish(clusterRetain, topic, p)
+		if err != nil {
+			cluster.log.Warn("failed to encode retained message", "topic", topic, "error", err)
+			continue
+		}
+		err = send(message)
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case message, ok := <-queue:
+			if !ok {
+				return errors.New("queue is full")
+			}
+			err := send(message)
+			if err != nil {
+				return err
+			}
+		case <-closed:
+			return errors.New("connection closed")
+		case <-cluster.server.done:
+			return ErrServerClosed
+		}
+	}
+}
+
+// peer returns the peer with name, the cluster mutex must be held.
+func (cluster *cluster) peer(name string) *clusterPeer {
+	peer, ok := cluster.peers[name]
+	if !ok {
+		peer = &clusterPeer{}
+		cluster.peers[name] = peer
+	}
+	return peer
+}
+
+// send queues message for the peer with name, the cluster mutex must be
+// held. When the queue of the peer is full the connection is closed, the
+// state is sent again when it is set up again.
+func (cluster *cluster) send(name string, message *clusterMessage) {
+	peer := cluster.peers[name]
+	if peer == nil || peer.queue == nil {
+		return
+	}
+	select {
+	case peer.queue <- message:
+	default:
+		cluster.log.Warn("queue of peer is full, reconnecting", "peer", name)
+		close(peer.queue)
+		peer.queue = nil
+		peer.conn = nil
+	}
+}
+
+// broadcast queues message for all peers, the cluster mutex must be held.
+func (cluster *cluster) broadcast(message *clusterMessage) {
+	for name := range cluster.peers {
+		cluster.send(name, message)
+	}
+}
+
+// accept reads the messages of a peer that connected, until the connection
+// fails or the server is closed.
+func (cluster *cluster) accept(conn net.Conn) {
+	if !cluster.server.trackConn(conn, true) {
+		conn.Close()
+		return
+	}
+	defer cluster.closeConn(conn)
+	log := cluster.log.With("remote_addr", conn.RemoteAddr().String())
+
+	conn.SetDeadline(time.Now().Add(clusterHandshakeTimeout))
+	decoder := json.NewDecoder(conn)
+	hello := &clusterMessage{}
+	err := decoder.Decode(hello)
+	if err != nil {
+		log.Warn("failed to read hello of peer", "error", err)
+		return
+	}
+	if hello.Type != clusterHello || hello.Node == "" {
+		log.Warn("peer did not send hello", "type", hello.Type)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(hello.Secret), []byte(cluster.secret)) != 1 {
+		log.Warn("peer sent the wrong secret", "peer", hello.Node)
+		return
+	}
+	err = json.NewEncoder(conn).Encode(&clusterMessage{Type: clusterHello, Node: cluster.config.NodeName})
+	if err != nil {
+		log.Warn("failed to send hello to peer", "error", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	name := hello.Node
+	log = log.With("peer", name)
+	log.Info("peer connected")
+	defer func() {
+		// The peer sends its interest again when it reconnects.
+		cluster.mutex.Lock()
+		cluster.peer(name).interest = nil
+		cluster.mutex.Unlock()
+		log.Info("peer disconnected")
+	}()
+
+	for {
+		message := &clusterMessage{}
+		err := decoder.Decode(message)
+		if err != nil {
+			if !cluster.server.isClosed() {
+				log.Warn("failed to read message of peer", "error", err)
+			}
+			return
+		}
+		cluster.handle(name, message)
+	}
+}
+
+// handle handles a message of the peer with name.
+func (cluster *cluster) handle(name string, message *clusterMessage) {
+	switch message.Type {
+	case clusterInterest, clusterSubscribe, clusterUnsubscribe:
+		cluster.mutex.Lock()
+		peer := cluster.peer(name)
+		if message.Type == clusterInterest || peer.interest == nil {
+			peer.interest = make(map[string]bool)
+		}
+		for _, filter := range message.Filters {
+			if message.Type == clusterUnsubscribe {
+				delete(peer.interest, filter)
+			} else {
+				peer.interest[filter] = true
+			}
+		}
+		cluster.mutex.Unlock()
+
+	case clusterPublish, clusterRetain:
+		p, err := decodePublishPacket(message.Packet)
+		if err != nil {
+			cluster.log.Warn("invalid message of peer", "peer", name, "error", err)
+			return
+		}
+		if message.Type == clusterRetain {
+			cluster.server.storeRetainedMessage(message.Topic, p, false)
+			return
+		}
+		cluster.server.publishLocal(p, message.Topic, "cluster node "+name)
+
+	case clusterTakeOver:
+		go cluster.handOver(name, message)
+
+	case clusterSession:
+		cluster.mutex.Lock()
+		reply, ok := cluster.requests[message.Request]
+		cluster.mutex.Unlock()
+		if ok {
+			reply <- message
+		}
+
+	default:
+		cluster.log.Warn("unknown message type of peer", "peer", name, "type", message.Type)
+	}
+}
+
+// forward queues a message for the peers with a subscription that matches
+// topic. The $SYS topics are local to every node.
+func (cluster *cluster) forward(p *packet.PublishPacket, topic string) {
+	if cluster == nil || isSysTopic(topic) {
+		return
+	}
+
+	var message *clusterMessage
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+	for name, peer := range cluster.peers {
+		if peer.queue == nil || !peer.interested(topic) {
+			continue
+		}
+		if message == nil {
+			var err error
+			message, err = makeClusterPublish(clusterPublish, topic, p)
+			if err != nil {
+				cluster.log.Warn("failed to encode message", "topic", topic, "error", err)
+				return
+			}
+		}
+		cluster.send(name, message)
+	}
+}
+
+func (peer *clusterPeer) interested(topic string) bool {
+	for filter := range peer.interest {
+		if topicMatches(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// replicate queues a change of the retained message of topic for all peers.
+// The lock of the retained messages must be held.
+func (cluster *cluster) replicate(topic string, p *packet.PublishPacket) {
+	if cluster == nil || isSysTopic(topic) {
+		return
+	}
+
+	message, err := makeClusterPublish(clusterRetain, topic, p)
+	if err != nil {
+		cluster.log.Warn("failed to encode retained message", "topic", topic, "error", err)
+		return
+	}
+	cluster.mutex.Lock()
+	cluster.broadcast(message)
+	cluster.mutex.Unlock()
+}
+
+// makeClusterPublish makes a message of messageType with a copy of p, since
+// encoding modifies the packet.
+func makeClusterPublish(messageType string, topic string, p *packet.PublishPacket) (*clusterMessage, error) {
+	copied := *p
+	bytes, err := copied.Encode()
+	if err != nil {
+		return nil, err
+	}
+	return &clusterMessage{Type: messageType, Topic: topic, Packet: bytes}, nil
+}
+
+// subscribe adds a subscriber of filter, the peers are told when it is the
+// first.
+func (cluster *cluster) subscribe(filter string) {
+	if cluster == nil {
+		return
+	}
+
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+	cluster.interest[filter]++
+	if cluster.interest[filter] == 1 {
+		cluster.broadcast(&clusterMessage{Type: clusterSubscribe, Filters: []string{filter}})
+	}
+}
+
+// unsubscribe removes a subscriber of filter, the peers are told when it was
+// the last.
+func (cluster *cluster) unsubscribe(filter string) {
+	if cluster == nil {
+		return
+	}
+
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+	cluster.interest[filter]--
+	if cluster.interest[filter] <= 0 {
+		delete(cluster.interest, filter)
+		cluster.broadcast(&clusterMessage{Type: clusterUnsubscribe, Filters: []string{filter}})
+	}
+}
+
+// takeOver asks the peers to disconnect the client with clientID and to
+// hand over its session, which is added to this node unless cleanStart is
+// set or the node has a session of the client already. It returns when all
+// peers answered or the takeover timeout passed.
+func (cluster *cluster) takeOver(clientID string, cleanStart bool) {
+	if cluster == nil {
+		return
+	}
+
+	reply := make(chan *clusterMessage, len(cluster.config.Peers)+1)
+	cluster.mutex.Lock()
+	cluster.nextRequest++
+	request := cluster.nextRequest
+	cluster.requests[request] = reply
+	peers := 0
+	for name, peer := range cluster.peers {
+		if peer.queue != nil && peer.interest != nil {
+			cluster.send(name, &clusterMessage{Type: clusterTakeOver, Request: request, ClientID: clientID, CleanStart: cleanStart})
+			peers++
+		}
+	}
+	cluster.mutex.Unlock()
+	defer func() {
+		cluster.mutex.Lock()
+		delete(cluster.requests, request)
+		cluster.mutex.Unlock()
+	}()
+
+	timeout := time.NewTimer(clusterTakeOverTimeout)
+	defer timeout.Stop()
+	for range peers {
+		select {
+		case message := <-reply:
+			if message.Session != nil {
+				cluster.server.importSession(clientID, message.Session)
+			}
+		case <-timeout.C:
+			cluster.log.Warn("peers did not answer takeover in time", "client_id", clientID)
+			return
+		}
+	}
+}
+
+// handOver disconnects the client of a takeover by the peer with name and
+// sends its session to the peer.
+func (cluster *cluster) handOver(name string, message *clusterMessage) {
+	ctx, cancel := context.WithTimeout(context.Background(), sessionTakeOverTimeout)
+	err := cluster.server.disconnectClient(ctx, message.ClientID, packet.SessionTakenOver)
+	cancel()
+	if err == nil {
+		cluster.log.Info("session taken over by peer", "peer", name, "client_id", message.ClientID)
+	}
+
+	reply := &clusterMessage{Type: clusterSession, Request: message.Request, ClientID: message.ClientID}
+	reply.Session = cluster.server.exportSession(message.ClientID, !message.CleanStart)
+	if reply.Session != nil {
+		cluster.log.Info("moved session to peer", "peer", name, "client_id", message.ClientID)
+	}
+
+	cluster.mutex.Lock()
+	cluster.send(name, reply)
+	cluster.mutex.Unlock()
+}
+
+// exportSession removes the session of an offline client and returns its
+// state if keep is set. It returns nil if there is no such session.
+func (server *Server) exportSession(clientID string, keep bool) *movedSession {
+	server.clientsMutex.Lock()
+	client, ok := server.clients[clientID]
+	if ok {
+		client.Mutex.Lock()
+		ok = client.Conn == nil
+		client.Mutex.Unlock()
+	}
+	if !ok {
+		server.clientsMutex.Unlock()
+		return nil
+	}
+	// The client connected to another node, so a delayed will is cancelled.
+	client.stopTimers()
+	delete(server.clients, clientID)
+	server.clientsMutex.Unlock()
+
+	var session *movedSession
+	if keep {
+		session = client.export()
+	}
+	client.endSession()
+	return session
+}
+
+// export returns the state of the session.
+func (client *Client) export() *movedSession {
+	client.Mutex.Lock()
+	defer client.Mutex.Unlock()
+
+	session := &movedSession{
+		Session: storedSession{
+			ExpiryInterval: client.SessionExpiryInterval,
+			Subscriptions:  make(map[string]types.QoS, len(client.subscriptionQoS)),
+		},
+	}
+	for filter, qos := range client.subscriptionQoS {
+		session.Session.Subscriptions[filter] = qos
+	}
+	for filter := range client.noLocal {
+		session.Session.NoLocal = append(session.Session.NoLocal, filter)
+	}
+
+	for _, message := range client.queue {
+		copied := *message.packet
+		bytes, err := copied.Encode()
+		if err != nil {
+			client.log.Warn("failed to encode queued message", "error", err)
+			continue
+		}
+		session.Queue = append(session.Queue, bytes)
+	}
+	for packetIdentifier, message := range client.inFlight {
+		copied := *message.packet
+		bytes, err := copied.Encode()
+		if err != nil {
+			client.log.Warn("failed to encode in-flight message", "error", err)
+			continue
+		}
+		session.InFlight = append(session.InFlight, movedInFlight{
+			PacketIdentifier: packetIdentifier,
+			Packet:           bytes,
+			Released:         message.released,
+		})
+	}
+	for packetIdentifier := range client.received {
+		session.Received = append(session.Received, packetIdentifier)
+	}
+	return session
+}
+
+// importSession adds a session that moved from another node while the
+// client connects, unless the node has a session of the client already.
+func (server *Server) importSession(clientID string, session *movedSession) {
+	restored := &restoredSession{
+		session:  session.Session,
+		inFlight: make(map[uint16]*inFlightMessage),
+		received: session.Received,
+	}
+	for i, bytes := range session.Queue {
+		p, err := decodePublishPacket(bytes)
+		if err != nil {
+			server.logs.cluster.Warn("invalid queued message of session", "client_id", clientID, "error", err)
+			continue
+		}
+		restored.queue = append(restored.queue, queuedMessage{sequence: uint64(i + 1), packet: p})
+	}
+	for _, message := range session.InFlight {
+		p, err := decodePublishPacket(message.Packet)
+		if err != nil {
+			server.logs.cluster.Warn("invalid in-flight message of session", "client_id", clientID, "error", err)
+			continue
+		}
+		restored.inFlight[message.PacketIdentifier] = &inFlightMessage{packet: p, released: message.Released}
+	}
+
+	server.clientsMutex.Lock()
+	defer server.clientsMutex.Unlock()
+	if _, ok := server.clients[clientID]; ok {
+		return
+	}
+	client := server.restoreSession(clientID, restored)
+	// The session is not in the store of this node yet, it is persisted
+	// when the client connects.
+	client.persisted = false
+}
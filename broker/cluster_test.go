@@ -0,0 +1,228 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/packet"
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+// startCluster serves a cluster of nodes on local ports and returns the
+// nodes and the addresses of their MQTT listeners.
+func startCluster(t *testing.T, nodes int) ([]*Server, []string) {
+	t.Helper()
+
+	clusterListeners := make([]net.Listener, nodes)
+	peers := make([]string, nodes)
+	for i := range nodes {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		clusterListeners[i] = ln
+		peers[i] = ln.Addr().String()
+	}
+
+	servers := make([]*Server, nodes)
+	addresses := make([]string, nodes)
+	for i := range nodes {
+		others := slices.Delete(slices.Clone(peers), i, i+1)
+		config := Config{Cluster: ClusterConfig{NodeName: fmt.Sprintf("node-%d", i), Peers: others}}
+		// Cleanups run in reverse order, so the server is closed before
+		// ServeCluster is waited for.
+		served := make(chan error, 1)
+		t.Cleanup(func() {
+			err := <-served
+			if !errors.Is(err, ErrServerClosed) {
+				t.Errorf("wanted %v from ServeCluster but got %v", ErrServerClosed, err)
+			}
+		})
+		servers[i], addresses[i] = startServer(t, config)
+		go func() { served <- servers[i].ServeCluster(clusterListeners[i]) }()
+	}
+
+	waitForCluster(t, func() bool {
+		for _, server := range servers {
+			server.cluster.mutex.Lock()
+			linked := 0
+			for _, peer := range server.cluster.peers {
+				if peer.queue != nil && peer.interest != nil {
+					linked++
+				}
+			}
+			server.cluster.mutex.Unlock()
+			if linked != nodes-1 {
+				return false
+			}
+		}
+		return true
+	})
+	return servers, addresses
+}
+
+// waitForCluster waits until condition is true.
+func waitForCluster(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the cluster")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForInterest waits until all peers of server know that it has a
+// subscriber of filter.
+func waitForInterest(t *testing.T, servers []*Server, server *Server, filter string) {
+	t.Helper()
+
+	name := server.cluster.config.NodeName
+	waitForCluster(t, func() bool {
+		for _, peer := range servers {
+			if peer == server {
+				continue
+			}
+			peer.cluster.mutex.Lock()
+			interested := peer.cluster.peers[name].interest[filter]
+			peer.cluster.mutex.Unlock()
+			if !interested {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestClusterPublish(t *testing.T) {
+	servers, addresses := startCluster(t, 3)
+
+	subscriber := connectClient(t, addresses[1], "subscriber")
+	subscriber.subscribe("cluster/+")
+	waitForInterest(t, servers, servers[1], "cluster/+")
+
+	publisher := connectClient(t, addresses[0], "publisher")
+	publisher.publish("cluster/a", "hello")
+	p := subscriber.readPublish()
+	if topic := p.VariableHeader.TopicName.String(); topic != "cluster/a" || string(p.Payload.Data) != "hello" {
+		t.Fatalf("wanted hello on cluster/a but got %q on %s", p.Payload.Data, topic)
+	}
+
+	// Node 2 has no subscriber of the topic, so nothing is forwarded to it.
+	received := make(chan Message, 1)
+	unsubscribe := servers[2].Subscribe("other", func(message Message) { received <- message })
+	waitForInterest(t, servers, servers[2], "other")
+	servers[0].Publish("cluster/b", []byte("only node 1"), types.QoS0, false)
+	subscriber.readPublish()
+	select {
+	case message := <-received:
+		t.Fatalf("wanted no message on node 2 but got %+v", message)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The peers forget the filter with its last subscriber.
+	unsubscribe()
+	waitForCluster(t, func() bool {
+		servers[0].cluster.mutex.Lock()
+		defer servers[0].cluster.mutex.Unlock()
+		return !servers[0].cluster.peers["node-2"].interest["other"]
+	})
+}
+
+func TestClusterRetainedMessages(t *testing.T) {
+	servers, addresses := startCluster(t, 2)
+
+	servers[0].Publish("retained/a", []byte("kept"), types.QoS1, true)
+	waitForCluster(t, func() bool { return len(servers[1].RetainedMessages("retained/#")) == 1 })
+
+	subscriber := connectClient(t, addresses[1], "subscriber")
+	subscriber.subscribe("retained/#")
+	p := subscriber.readPublish()
+	if string(p.Payload.Data) != "kept" || !p.FixedHeader.Retain {
+		t.Fatalf("wanted the retained message kept but got %q", p.Payload.Data)
+	}
+
+	// An empty payload removes the retained message on all nodes.
+	servers[1].Publish("retained/a", nil, types.QoS0, true)
+	waitForCluster(t, func() bool { return len(servers[0].RetainedMessages("retained/#")) == 0 })
+}
+
+func TestClusterSessionMoves(t *testing.T) {
+	servers, addresses := startCluster(t, 2)
+
+	client := dialClient(t, addresses[0])
+	client.sessionConnect("mobile", true, 3600)
+	client.subscribeQoS("moves/#", types.QoS1)
+	client.conn.Close()
+	waitOffline(t, servers[0], "mobile")
+	servers[0].Publish("moves/a", []byte("queued"), types.QoS1, false)
+
+	client = dialClient(t, addresses[1])
+	if !client.sessionConnect("mobile", false, 3600) {
+		t.Fatal("wanted the session to move to node 1")
+	}
+	p := client.readPublish()
+	if string(p.Payload.Data) != "queued" {
+		t.Fatalf("wanted the queued message but got %q", p.Payload.Data)
+	}
+	client.send(&packet.PubackPacket{VariableHeader: makeAcknowledgement(p.VariableHeader.PacketIdentifier)})
+
+	servers[0].clientsMutex.Lock()
+	_, ok := servers[0].clients["mobile"]
+	servers[0].clientsMutex.Unlock()
+	if ok {
+		t.Fatal("wanted the session to be removed from node 0")
+	}
+
+	// The subscription moved with the session.
+	waitForInterest(t, servers, servers[1], "moves/#")
+	servers[0].Publish("moves/b", []byte("forwarded"), types.QoS1, false)
+	p = client.readPublish()
+	if string(p.Payload.Data) != "forwarded" {
+		t.Fatalf("wanted the forwarded message but got %q", p.Payload.Data)
+	}
+}
+
+func TestClusterSessionTakeOver(t *testing.T) {
+	_, addresses := startCluster(t, 2)
+
+	first := dialClient(t, addresses[0])
+	first.sessionConnect("twice", true, 3600)
+
+	second := dialClient(t, addresses[1])
+	if !second.sessionConnect("twice", false, 3600) {
+		t.Fatal("wanted the session of the connected client to move")
+	}
+
+	fixedHeader, bytes := first.read()
+	if fixedHeader.PacketType != packet.DISCONNECT || packet.ReasonCode(bytes[2]) != packet.SessionTakenOver {
+		t.Fatalf("wanted DISCONNECT with Session Taken Over but got %v %x", fixedHeader.PacketType, bytes)
+	}
+}
+
+func TestClusterConfigValidate(t *testing.T) {
+	cases := []struct {
+		config ClusterConfig
+		valid  bool
+	}{
+		{config: ClusterConfig{}, valid: true},
+		{config: ClusterConfig{NodeName: "a", Address: ":7000", Peers: []string{"b:7000"}}, valid: true},
+		{config: ClusterConfig{NodeName: "a"}, valid: false},
+		{config: ClusterConfig{Address: ":7000"}, valid: false},
+		{config: ClusterConfig{Peers: []string{"b:7000"}}, valid: false},
+		{config: ClusterConfig{NodeName: "a", Address: ":7000", Peers: []string{":7000"}}, valid: false},
+	}
+
+	for _, c := range cases {
+		err := c.config.Validate()
+		if (err == nil) != c.valid {
+			t.Fatalf("%+v: wanted valid %v but got %v", c.config, c.valid, err)
+		}
+	}
+}
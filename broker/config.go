@@ -0,0 +1,534 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/DvdSpijker/GoBroker/auth"
+	"github.com/DvdSpijker/GoBroker/logging"
+	"github.com/DvdSpijker/GoBroker/types"
+	"gopkg.in/yaml.v3"
+)
+
+type ListenerType string
+
+const (
+	ListenerTCP       ListenerType = "tcp"
+	ListenerTLS       ListenerType = "tls"
+	ListenerWebsocket ListenerType = "ws"
+	ListenerWSS       ListenerType = "wss"
+	ListenerUnix      ListenerType = "unix"
+	ListenerHTTP      ListenerType = "http"  // Publishing and subscribing over HTTP, see http.go.
+	ListenerHTTPS     ListenerType = "https" // Publishing and subscribing over HTTP with TLS.
+)
+
+type BridgeDirection string
+
+const (
+	BridgeIn   BridgeDirection = "in"   // From the remote broker to this broker.
+	BridgeOut  BridgeDirection = "out"  // From this broker to the remote broker.
+	BridgeBoth BridgeDirection = "both" // In both directions.
+)
+
+// DefaultBridgeQueueSize is the default number of messages a bridge queues
+// while the remote broker is unreachable.
+const DefaultBridgeQueueSize = 1000
+
+// MQTT protocol versions (3.1.2.2) that the broker can handle.
+var supportedProtocolVersions = []byte{5}
+
+var ErrInvalidConfig = errors.New("invalid config")
+
+type (
+	TLSConfig struct {
+		CertFile     string         `yaml:"cert_file"`
+		KeyFile      string         `yaml:"key_file"`
+		ClientCAFile string         `yaml:"client_ca_file"`
+		ClientAuth   ClientAuthMode `yaml:"client_auth"`
+	}
+
+	AuthenticationConfig struct {
+		// Allow clients to connect without a user name, defaults to true
+		// unless a password file is configured.
+		AllowAnonymous *bool `yaml:"allow_anonymous"`
+		// File with bcrypt hashed passwords that user names and passwords
+		// are verified against. Credentials are not verified if empty.
+		PasswordFile string `yaml:"password_file"`
+		// Enhanced authentication methods (4.12) that clients can use, only
+		// SCRAM-SHA-256 is supported. Users are verified against the
+		// password file, so it must contain SCRAM credentials.
+		Methods []string `yaml:"methods"`
+		// Refuse clients that send a password in the CONNECT packet, so that
+		// passwords never travel over the network.
+		DisablePasswords bool `yaml:"disable_passwords"`
+		// Verify JSON Web Tokens sent as password or with the JWT method.
+		JWT JWTConfig `yaml:"jwt"`
+	}
+
+	JWTConfig struct {
+		JWKSFile   string          `yaml:"jwks_file"`   // Public keys of asymmetrically signed tokens.
+		SecretFile string          `yaml:"secret_file"` // Shared secret of HMAC signed tokens.
+		Issuer     string          `yaml:"issuer"`      // Required iss claim if set.
+		Audience   string          `yaml:"audience"`    // Required aud claim if set.
+		Leeway     int             `yaml:"leeway"`      // Seconds of clock skew allowed for exp and nbf.
+		Claims     JWTClaimsConfig `yaml:"claims"`
+	}
+
+	// JWTClaimsConfig names the claims that map to the client, see auth.JWTClaimNames.
+	JWTClaimsConfig struct {
+		ClientID  string `yaml:"client_id"`
+		UserName  string `yaml:"user_name"`
+		Publish   string `yaml:"publish"`
+		Subscribe string `yaml:"subscribe"`
+	}
+
+	AuthorizationConfig struct {
+		// File with topic access rules for publishing and subscribing.
+		// All clients may use all topics if empty.
+		ACLFile string `yaml:"acl_file"`
+	}
+
+	ListenerLimits struct {
+		MaxConnections int `yaml:"max_connections"` // 0 is unlimited.
+		MaxPacketSize  int `yaml:"max_packet_size"` // Bytes, 0 is the maximum allowed by the specification.
+	}
+
+	ListenerConfig struct {
+		Type             ListenerType         `yaml:"type"`
+		Address          string               `yaml:"address"` // Host and port, or path of a unix socket.
+		Path             string               `yaml:"path"`    // HTTP path of WebSocket listeners.
+		ProtocolVersions []byte               `yaml:"protocol_versions"`
+		TLS              TLSConfig            `yaml:"tls"`
+		Authentication   AuthenticationConfig `yaml:"authentication"`
+		Authorization    AuthorizationConfig  `yaml:"authorization"`
+		Limits           ListenerLimits       `yaml:"limits"`
+	}
+
+	KeepAliveConfig struct {
+		// Bounds in seconds for the keep-alive requested by clients,
+		// the broker overrides values outside the bounds (3.2.2.3.14).
+		// 0 means no bound.
+		Min uint16 `yaml:"min"`
+		Max uint16 `yaml:"max"`
+	}
+
+	RetainedConfig struct {
+		MaxMessages    int `yaml:"max_messages"`     // 0 is unlimited.
+		MaxPayloadSize int `yaml:"max_payload_size"` // Bytes, 0 is unlimited.
+	}
+
+	StorageConfig struct {
+		// File that sessions and retained messages are persisted in, the
+		// broker state is only kept in memory if empty.
+		Path string `yaml:"path"`
+		// Flush every change to disk, so that nothing is lost when the
+		// machine crashes instead of only the broker.
+		Sync bool `yaml:"sync"`
+	}
+
+	SessionsConfig struct {
+		// Messages queued for an offline client, further messages are
+		// dropped. 0 is unlimited.
+		MaxQueuedMessages int `yaml:"max_queued_messages"`
+	}
+
+	MetricsConfig struct {
+		// Host and port of the HTTP server that serves the metrics in the
+		// Prometheus text format. Metrics are not served if empty.
+		Address string `yaml:"address"`
+		Path    string `yaml:"path"` // Defaults to /metrics.
+	}
+
+	AdminConfig struct {
+		// Host and port of the HTTP server of the admin API, the API is
+		// not served if empty.
+		Address string `yaml:"address"`
+		// File with the token that requests must send as bearer token.
+		TokenFile string `yaml:"token_file"`
+	}
+
+	SysConfig struct {
+		// Seconds between updates of the statistics in the $SYS topics.
+		// 0 disables the $SYS topics and the client events.
+		Interval int `yaml:"interval"`
+	}
+
+	// ClusterConfig makes the broker a node of a cluster of brokers, the
+	// nodes forward publishes to each other's subscribers, replicate the
+	// retained messages and move sessions between them.
+	ClusterConfig struct {
+		// Name of the node, unique in the cluster. Clustering is disabled
+		// if empty.
+		NodeName string `yaml:"node_name"`
+		// Host and port that the other nodes connect to.
+		Address string `yaml:"address"`
+		// Host and port of the other nodes.
+		Peers []string `yaml:"peers"`
+		// File with a secret shared by all nodes, that the nodes send when
+		// they connect. Nodes connect without a secret if empty.
+		SecretFile string `yaml:"secret_file"`
+	}
+
+	// BridgeConfig connects the broker to a remote broker as a client and
+	// forwards the messages of its topics between the brokers.
+	BridgeConfig struct {
+		// Name of the bridge, forwarded messages carry it in a user
+		// property so that they are not forwarded back.
+		Name string `yaml:"name"`
+		// Address of the remote broker as tcp://host:port, tls://host:port,
+		// ws://host:port/path or wss://host:port/path.
+		Address string `yaml:"address"`
+		// Client identifier at the remote broker, defaults to
+		// gobroker-bridge-<name>.
+		ClientID     string          `yaml:"client_id"`
+		UserName     string          `yaml:"user_name"`
+		PasswordFile string          `yaml:"password_file"` // File with the password of the user.
+		TLS          BridgeTLSConfig `yaml:"tls"`
+		KeepAlive    int             `yaml:"keep_alive"` // Seconds, 0 is the client default.
+		// Seconds the remote broker keeps the session of the bridge after
+		// the connection is lost, so that it queues the messages of the
+		// in topics. 0 ends the session with the connection.
+		SessionExpiryInterval int `yaml:"session_expiry_interval"`
+		// Messages queued for the remote broker while it is unreachable,
+		// further messages are dropped.
+		QueueSize int                 `yaml:"queue_size"`
+		Topics    []BridgeTopicConfig `yaml:"topics"`
+	}
+
+	BridgeTLSConfig struct {
+		CAFile             string `yaml:"ca_file"`   // Verifies the remote broker, the system roots by default.
+		CertFile           string `yaml:"cert_file"` // Client certificate.
+		KeyFile            string `yaml:"key_file"`
+		ServerName         string `yaml:"server_name"` // Defaults to the host of the address.
+		InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	}
+
+	// BridgeTopicConfig forwards the messages of the topics matching a
+	// filter. The filter is relative to the prefixes: a message to
+	// <local_prefix><topic> is forwarded to <remote_prefix><topic> and
+	// the other way around.
+	BridgeTopicConfig struct {
+		Filter       string          `yaml:"filter"`
+		Direction    BridgeDirection `yaml:"direction"`
+		QoS          types.QoS       `yaml:"qos"` // Maximum QoS of forwarded messages.
+		LocalPrefix  string          `yaml:"local_prefix"`
+		RemotePrefix string          `yaml:"remote_prefix"`
+	}
+
+	Config struct {
+		Listeners     []ListenerConfig `yaml:"listeners"`
+		KeepAlive     KeepAliveConfig  `yaml:"keep_alive"`
+		SendQueueSize int              `yaml:"send_queue_size"` // Packets queued per client.
+		Retained      RetainedConfig   `yaml:"retained"`
+		Sessions      SessionsConfig   `yaml:"sessions"`
+		Storage       StorageConfig    `yaml:"storage"`
+		Metrics       MetricsConfig    `yaml:"metrics"`
+		Sys           SysConfig        `yaml:"sys"`
+		Admin         AdminConfig      `yaml:"admin"`
+		Bridges       []BridgeConfig   `yaml:"bridges"`
+		Cluster       ClusterConfig    `yaml:"cluster"`
+		// Seconds allowed for sending queued packets to clients when the
+		// broker shuts down, connections are closed after it passes.
+		ShutdownTimeout int `yaml:"shutdown_timeout"`
+		// Levels and format of the log, see the subsystems in logging.go.
+		Log logging.Config `yaml:"log"`
+		// Logger that the broker logs to instead of creating one from Log,
+		// for embedding the broker in a program that has its own logger.
+		Logger *slog.Logger `yaml:"-"`
+	}
+)
+
+// DefaultConfig returns the config used when no config file is given.
+func DefaultConfig() Config {
+	return Config{
+		Listeners: []ListenerConfig{
+			{Type: ListenerTCP, Address: ":8888"},
+			{Type: ListenerWebsocket, Address: ":8887"},
+		},
+		SendQueueSize: DefaultSendQueueSize,
+		Sessions:      SessionsConfig{MaxQueuedMessages: DefaultMaxQueuedMessages},
+		Sys:           SysConfig{Interval: DefaultSysInterval},
+	}
+}
+
+// LoadConfig reads a YAML config file. Values that are not set in the file
+// keep their default value.
+func LoadConfig(path string) (Config, error) {
+	config := DefaultConfig()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return Config{}, err
+	}
+	defer file.Close()
+
+	config.Listeners = nil
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	err = decoder.Decode(&config)
+	if err != nil {
+		return Config{}, fmt.Errorf("%w: %s: %w", ErrInvalidConfig, path, err)
+	}
+
+	return config, nil
+}
+
+// SetDefaults fills in the values that were left empty.
+func (config *Config) SetDefaults() {
+	if config.SendQueueSize <= 0 {
+		config.SendQueueSize = DefaultSendQueueSize
+	}
+	if config.ShutdownTimeout <= 0 {
+		config.ShutdownTimeout = DefaultShutdownTimeout
+	}
+	if config.Metrics.Path == "" {
+		config.Metrics.Path = DefaultMetricsPath
+	}
+
+	for i := range config.Listeners {
+		config.Listeners[i].SetDefaults()
+	}
+	for i := range config.Bridges {
+		config.Bridges[i].SetDefaults()
+	}
+}
+
+// SetDefaults fills in the values of the listener that were left empty.
+func (listener *ListenerConfig) SetDefaults() {
+	if listener.Type == "" {
+		listener.Type = ListenerTCP
+	}
+	if len(listener.ProtocolVersions) == 0 {
+		listener.ProtocolVersions = supportedProtocolVersions
+	}
+	if listener.Path == "" && listener.IsWebsocket() {
+		listener.Path = "/mqtt"
+	}
+	if listener.TLS.ClientAuth == "" {
+		listener.TLS.ClientAuth = ClientAuthNone
+	}
+	if listener.Authentication.AllowAnonymous == nil {
+		allow := listener.Authentication.PasswordFile == "" && !listener.Authentication.JWT.Enabled()
+		listener.Authentication.AllowAnonymous = &allow
+	}
+}
+
+// SetDefaults fills in the values of the bridge that were left empty.
+func (bridge *BridgeConfig) SetDefaults() {
+	if bridge.ClientID == "" {
+		bridge.ClientID = "gobroker-bridge-" + bridge.Name
+	}
+	if bridge.QueueSize <= 0 {
+		bridge.QueueSize = DefaultBridgeQueueSize
+	}
+	for i := range bridge.Topics {
+		if bridge.Topics[i].Direction == "" {
+			bridge.Topics[i].Direction = BridgeBoth
+		}
+	}
+}
+
+// Validate checks the config for invalid and conflicting values.
+func (config *Config) Validate() error {
+	if len(config.Listeners) == 0 {
+		return fmt.Errorf("%w: no listeners", ErrInvalidConfig)
+	}
+
+	if config.Sys.Interval < 0 {
+		return fmt.Errorf("%w: $SYS interval must not be negative", ErrInvalidConfig)
+	}
+
+	if config.Admin.Address != "" && config.Admin.TokenFile == "" {
+		return fmt.Errorf("%w: admin API needs a token file", ErrInvalidConfig)
+	}
+
+	if config.Sessions.MaxQueuedMessages < 0 {
+		return fmt.Errorf("%w: max queued messages must not be negative", ErrInvalidConfig)
+	}
+
+	err := config.Log.Validate()
+	if err != nil {
+		return fmt.Errorf("%w: log: %w", ErrInvalidConfig, err)
+	}
+	for subsystem := range config.Log.Subsystems {
+		if !slices.Contains(subsystems, subsystem) {
+			return fmt.Errorf("%w: log: unknown subsystem: %q", ErrInvalidConfig, subsystem)
+		}
+	}
+
+	if config.KeepAlive.Max > 0 && config.KeepAlive.Min > config.KeepAlive.Max {
+		return fmt.Errorf("%w: keep-alive min %d is larger than max %d",
+			ErrInvalidConfig, config.KeepAlive.Min, config.KeepAlive.Max)
+	}
+
+	for i, listener := range config.Listeners {
+		err := listener.Validate()
+		if err != nil {
+			return fmt.Errorf("%w: listener %d (%s %s): %w",
+				ErrInvalidConfig, i, listener.Type, listener.Address, err)
+		}
+	}
+
+	names := map[string]bool{}
+	for i, bridge := range config.Bridges {
+		err := bridge.Validate()
+		if err != nil {
+			return fmt.Errorf("%w: bridge %d (%s): %w", ErrInvalidConfig, i, bridge.Name, err)
+		}
+		if names[bridge.Name] {
+			return fmt.Errorf("%w: bridge %d: duplicate name %q", ErrInvalidConfig, i, bridge.Name)
+		}
+		names[bridge.Name] = true
+	}
+
+	err = config.Cluster.Validate()
+	if err != nil {
+		return fmt.Errorf("%w: cluster: %w", ErrInvalidConfig, err)
+	}
+
+	return nil
+}
+
+// Validate checks the cluster config for missing values.
+func (cluster *ClusterConfig) Validate() error {
+	if cluster.NodeName == "" {
+		if cluster.Address != "" || len(cluster.Peers) > 0 || cluster.SecretFile != "" {
+			return errors.New("no node name")
+		}
+		return nil
+	}
+	if cluster.Address == "" {
+		return errors.New("no address")
+	}
+	for _, peer := range cluster.Peers {
+		if peer == "" || peer == cluster.Address {
+			return fmt.Errorf("invalid peer: %q", peer)
+		}
+	}
+	return nil
+}
+
+// Validate checks the bridge config for invalid and conflicting values.
+func (bridge *BridgeConfig) Validate() error {
+	if bridge.Name == "" {
+		return errors.New("no name")
+	}
+	if bridge.Address == "" {
+		return errors.New("no address")
+	}
+	if bridge.PasswordFile != "" && bridge.UserName == "" {
+		return errors.New("password file without user name")
+	}
+	if (bridge.TLS.CertFile == "") != (bridge.TLS.KeyFile == "") {
+		return errors.New("TLS needs both a certificate and key file")
+	}
+	if bridge.KeepAlive < 0 || bridge.SessionExpiryInterval < 0 || bridge.QueueSize < 0 {
+		return errors.New("keep-alive, session expiry interval and queue size must not be negative")
+	}
+	if len(bridge.Topics) == 0 {
+		return errors.New("no topics")
+	}
+
+	for i, topic := range bridge.Topics {
+		err := topic.Validate()
+		if err != nil {
+			return fmt.Errorf("topic %d (%s): %w", i, topic.Filter, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks the topic config of a bridge for invalid values.
+func (topic *BridgeTopicConfig) Validate() error {
+	switch topic.Direction {
+	case BridgeIn, BridgeOut, BridgeBoth:
+	default:
+		return fmt.Errorf("unknown direction: %q", topic.Direction)
+	}
+
+	if topic.QoS > types.QoS2 {
+		return fmt.Errorf("invalid QoS: %d", topic.QoS)
+	}
+	if strings.ContainsAny(topic.LocalPrefix+topic.RemotePrefix, "+#") {
+		return errors.New("prefixes must not contain wildcards")
+	}
+	for _, filter := range []string{topic.LocalPrefix + topic.Filter, topic.RemotePrefix + topic.Filter} {
+		if !isValidTopicFilter(filter) || isSharedSubscription(filter) {
+			return fmt.Errorf("invalid filter: %q", filter)
+		}
+	}
+	return nil
+}
+
+// Validate checks the listener config for invalid and conflicting values.
+func (listener *ListenerConfig) Validate() error {
+	switch listener.Type {
+	case ListenerTCP, ListenerTLS, ListenerWebsocket, ListenerWSS, ListenerUnix, ListenerHTTP, ListenerHTTPS:
+	default:
+		return fmt.Errorf("unknown listener type: %q", listener.Type)
+	}
+
+	if listener.Address == "" {
+		return errors.New("no address")
+	}
+
+	for _, version := range listener.ProtocolVersions {
+		if !slices.Contains(supportedProtocolVersions, version) {
+			return fmt.Errorf("unsupported protocol version: %d", version)
+		}
+	}
+
+	if listener.IsTLS() && (listener.TLS.CertFile == "" || listener.TLS.KeyFile == "") {
+		return errors.New("TLS listener needs a certificate and key file")
+	}
+
+	for _, method := range listener.Authentication.Methods {
+		switch method {
+		case auth.SCRAMSHA256:
+			if listener.Authentication.PasswordFile == "" {
+				return fmt.Errorf("authentication method %s needs a password file", method)
+			}
+		case auth.JWTMethod:
+			if !listener.Authentication.JWT.Enabled() {
+				return fmt.Errorf("authentication method %s needs a JWKS or secret file", method)
+			}
+		default:
+			return fmt.Errorf("unsupported authentication method: %q", method)
+		}
+	}
+
+	if listener.Authentication.JWT.Leeway < 0 {
+		return errors.New("JWT leeway must not be negative")
+	}
+
+	if listener.Limits.MaxConnections < 0 || listener.Limits.MaxPacketSize < 0 {
+		return errors.New("limits must not be negative")
+	}
+
+	return nil
+}
+
+// Enabled reports whether tokens are verified.
+func (jwt *JWTConfig) Enabled() bool {
+	return jwt.JWKSFile != "" || jwt.SecretFile != ""
+}
+
+// IsTLS reports whether connections on the listener use TLS.
+func (listener *ListenerConfig) IsTLS() bool {
+	return listener.Type == ListenerTLS || listener.Type == ListenerWSS || listener.Type == ListenerHTTPS
+}
+
+// IsWebsocket reports whether connections on the listener use WebSocket.
+func (listener *ListenerConfig) IsWebsocket() bool {
+	return listener.Type == ListenerWebsocket || listener.Type == ListenerWSS
+}
+
+// IsHTTP reports whether the listener serves the HTTP endpoints instead of
+// MQTT.
+func (listener *ListenerConfig) IsHTTP() bool {
+	return listener.Type == ListenerHTTP || listener.Type == ListenerHTTPS
+}
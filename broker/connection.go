@@ -0,0 +1,516 @@
+package broker
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/auth"
+	"github.com/DvdSpijker/GoBroker/packet"
+	"github.com/DvdSpijker/GoBroker/protocol"
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+const (
+	connectTimeout = time.Second * 5
+	// sessionTakeOverTimeout bounds the write of the DISCONNECT to a client
+	// whose session is taken over.
+	sessionTakeOverTimeout = time.Second * 5
+)
+
+func (server *Server) handleConnection(conn net.Conn, l *listener) {
+	if !server.trackConn(conn, true) {
+		conn.Close()
+		return
+	}
+	defer server.trackConn(conn, false)
+	defer conn.Close()
+
+	log := server.logs.connection.With("remote_addr", conn.RemoteAddr().String())
+	framer := newFramer(conn, l.config.Limits.MaxPacketSize)
+
+	var client *Client
+	var readTimeout time.Duration // The keep-alive of the client.
+	for {
+		// Use the client to control the keep-alive deadline for the connection
+		// if the client exists (which is created upon connect).
+		// Use a fixed amount of time allowed between the client opening a connection and
+		// sending a connect message if there is no client.
+		// The specification is unclear about what that amount of time should be,
+		// it mentions 'reasonable'.
+		if client != nil {
+			// Reset keep-alive after receiving a control packet.
+			setKeepAliveDeadline(conn, readTimeout)
+		} else {
+			conn.SetReadDeadline(time.Now().Add(connectTimeout))
+		}
+
+		fixedHeader, bytes, err := framer.readPacket()
+		if errors.Is(err, io.EOF) {
+			if client != nil {
+				log.Info("client closed the connection")
+				client.disconnect(conn)
+			}
+			return
+		} else if errors.Is(err, os.ErrDeadlineExceeded) {
+			if client != nil {
+				log.Info("no control packet received within the keep-alive", "keep_alive", readTimeout)
+				client.disconnect(conn)
+			} else {
+				log.Info("no CONNECT received after the connection was opened")
+			}
+			return
+		}
+		if err != nil {
+			log.Warn("failed to read packet", "error", err)
+			if client != nil {
+				client.disconnect(conn)
+			}
+			return
+		}
+		log.Debug("received packet", "packet_type", fixedHeader.PacketType.String())
+		server.metrics.received(fixedHeader.PacketType, len(bytes))
+
+		switch fixedHeader.PacketType {
+
+		case packet.CONNECT:
+			if client != nil {
+				// MQTT-3.1.0-2: A second CONNECT is a protocol error.
+				log.Warn("second CONNECT on a connection")
+				client.sendDisconnect(conn, packet.ProtocolError)
+				client.disconnect(conn)
+				return
+			}
+			connectPacket := packet.ConnectPacket{}
+			_, err := connectPacket.Decode(bytes)
+			if err != nil {
+				log.Warn("invalid CONNECT packet", "error", err)
+				server.refuseConnect(log, conn, packet.MalformedPacket)
+				return
+			}
+
+			if server.isClosed() {
+				log.Info("server is shutting down")
+				server.refuseConnect(log, conn, packet.ServerUnavailable)
+				return
+			}
+
+			token, reasonCode := l.checkConnect(&connectPacket)
+			if reasonCode != packet.Success {
+				server.refuseConnect(log, conn, reasonCode)
+				return
+			}
+
+			userName := connectPacket.Payload.UserName.String()
+			method := connectPacket.VariableHeader.AuthenticationMethod.String()
+			var authenticationData []byte
+			if method != "" {
+				var authenticator auth.Authenticator
+				authenticator, authenticationData, reasonCode = l.authenticateConnect(conn, framer, &connectPacket)
+				if reasonCode != packet.Success {
+					server.refuseConnect(log, conn, reasonCode)
+					return
+				}
+				userName = authenticator.UserName()
+				token = authenticatedToken(authenticator)
+			}
+
+			clientID := connectPacket.Payload.ClientId.String()
+			assignedClientID := false
+			if token != nil {
+				// The user name of a token is verified, the one in the CONNECT is not.
+				userName = token.UserName
+				clientID, assignedClientID, reasonCode = tokenClientID(token, clientID)
+				if reasonCode != packet.Success {
+					server.refuseConnect(log, conn, reasonCode)
+					return
+				}
+			}
+
+			// MQTT-3.1.3-6: A client that connects without a client ID is
+			// assigned a unique one.
+			if clientID == "" {
+				clientID = newClientID()
+				assignedClientID = true
+			}
+
+			reasonCode = server.onConnectAuthenticate(conn, &connectPacket)
+			if reasonCode != packet.Success {
+				log.Info("connect rejected by hook")
+				server.refuseConnect(log, conn, reasonCode)
+				return
+			}
+
+			keepAlive, overridden := server.boundKeepAlive(uint16(connectPacket.VariableHeader.KeepAlive.Value))
+			connectPacket.VariableHeader.KeepAlive.Value = uint32(keepAlive)
+
+			// The session moves to this node if the client was connected
+			// to another node of the cluster.
+			server.cluster.takeOver(clientID, connectPacket.VariableHeader.CleanStart)
+
+			certificate := verifiedCertificate(conn)
+			if certificate != nil {
+				log.Debug("verified client certificate", "subject", certificate.Subject.String(), "client_id", clientID)
+			}
+
+			// The client is set up and the CONNACK queued while the
+			// connection is attached, before another connection with the
+			// same client ID can take over.
+			var sessionPresent bool
+			var takeOver func()
+			client, sessionPresent, takeOver = server.connect(clientID, conn, &connectPacket, func(client *Client, sessionPresent bool) {
+				readTimeout = client.KeepAlive
+				client.UserName = userName
+				client.AuthenticationMethod = method
+				client.listener = l
+				client.Certificate = certificate
+				client.setToken(token)
+
+				conackPacket := packet.ConackPacket{}
+				conackPacket.VariableHeader.ConnectReasonCode = packet.Success
+				if sessionPresent {
+					conackPacket.VariableHeader.ConnectAcknowledgeFlags = byte(packet.SessionPresent)
+				}
+				if overridden {
+					conackPacket.VariableHeader.ServerKeepAlive = types.UnsignedInt{
+						Value: uint32(keepAlive),
+						Size:  2,
+					}
+				}
+				if assignedClientID {
+					conackPacket.VariableHeader.AssignedClientIdentifier = types.UtfString{Str: clientID}
+				}
+				conackPacket.VariableHeader.AuthenticationMethod = types.UtfString{Str: method}
+				conackPacket.VariableHeader.AuthenticationData = types.BinaryData{Data: authenticationData}
+				bin, err := conackPacket.Encode()
+				if err != nil {
+					log.Error("failed to encode CONNACK packet", "error", err)
+					// The connection handler disconnects the client when the read fails.
+					conn.Close()
+					return
+				}
+				client.Write(bin)
+			})
+			log = log.With("client_id", clientID)
+			if takeOver != nil {
+				log.Info("session taken over")
+				takeOver()
+			}
+			server.metrics.connectAttempt(packet.Success)
+			log.Info("client connected", "session_present", sessionPresent, "user_name", userName,
+				"keep_alive", keepAlive, "authentication_method", method)
+
+			server.onConnect(client, &connectPacket)
+			server.publishClientEvent(clientID, "connected", clientEvent{
+				ClientID:   clientID,
+				UserName:   userName,
+				RemoteAddr: conn.RemoteAddr().String(),
+				KeepAlive:  int(keepAlive),
+				CleanStart: connectPacket.VariableHeader.CleanStart,
+				Time:       time.Now(),
+			})
+
+			// MQTT-4.4.0-1: Unacknowledged messages are sent again when a
+			// session is resumed.
+			client.resumeSession()
+
+		case packet.AUTH:
+			if client == nil {
+				log.Warn("AUTH before CONNECT")
+				return
+			}
+			authPacket := packet.AuthPacket{}
+			_, err := authPacket.Decode(bytes)
+			if err != nil {
+				log.Warn("invalid AUTH packet", "error", err)
+				client.sendDisconnect(conn, packet.MalformedPacket)
+				client.disconnect(conn)
+				return
+			}
+			reasonCode := client.onAuth(&authPacket)
+			if reasonCode != packet.Success {
+				client.sendDisconnect(conn, reasonCode)
+				client.disconnect(conn)
+				return
+			}
+
+		case packet.DISCONNECT:
+			if client == nil {
+				log.Warn("DISCONNECT before CONNECT")
+				return
+			}
+			disconnectPacket := packet.DisconnectPacket{}
+			_, err := disconnectPacket.Decode(bytes)
+			if err != nil {
+				log.Warn("invalid DISCONNECT packet", "error", err)
+				client.sendDisconnect(conn, packet.MalformedPacket)
+				client.disconnect(conn)
+				return
+			}
+			log.Info("client sent DISCONNECT", reasonCodeAttr(disconnectPacket.VariableHeader.ReasonCode))
+			reasonCode := client.handleDisconnect(&disconnectPacket)
+			if reasonCode != packet.Success {
+				client.sendDisconnect(conn, reasonCode)
+			}
+			client.disconnect(conn)
+			return
+
+		case packet.PUBLISH:
+			if client == nil {
+				log.Warn("PUBLISH before CONNECT")
+				return
+			}
+			publishPacket := packet.PublishPacket{}
+			_, err := publishPacket.Decode(bytes)
+			if err != nil {
+				log.Warn("invalid PUBLISH packet", "error", err)
+				client.sendDisconnect(conn, packet.MalformedPacket)
+				client.disconnect(conn)
+				return
+			}
+			reasonCode := client.onPublish(&publishPacket)
+			if reasonCode != packet.Success {
+				client.sendDisconnect(conn, reasonCode)
+				client.disconnect(conn)
+				return
+			}
+
+		case packet.PUBACK:
+			if client == nil {
+				log.Warn("PUBACK before CONNECT")
+				return
+			}
+			pubackPacket := packet.PubackPacket{}
+			_, err := pubackPacket.Decode(bytes)
+			if err != nil {
+				log.Warn("invalid PUBACK packet", "error", err)
+				client.sendDisconnect(conn, packet.MalformedPacket)
+				client.disconnect(conn)
+				return
+			}
+			client.puback(&pubackPacket)
+
+		case packet.PUBREC:
+			if client == nil {
+				log.Warn("PUBREC before CONNECT")
+				return
+			}
+			pubrecPacket := packet.PubrecPacket{}
+			_, err := pubrecPacket.Decode(bytes)
+			if err != nil {
+				log.Warn("invalid PUBREC packet", "error", err)
+				client.sendDisconnect(conn, packet.MalformedPacket)
+				client.disconnect(conn)
+				return
+			}
+			client.pubrec(&pubrecPacket)
+
+		case packet.PUBREL:
+			if client == nil {
+				log.Warn("PUBREL before CONNECT")
+				return
+			}
+			pubrelPacket := packet.PubrelPacket{}
+			_, err := pubrelPacket.Decode(bytes)
+			if err != nil {
+				log.Warn("invalid PUBREL packet", "error", err)
+				client.sendDisconnect(conn, packet.MalformedPacket)
+				client.disconnect(conn)
+				return
+			}
+			client.pubrel(&pubrelPacket)
+
+		case packet.PUBCOMP:
+			if client == nil {
+				log.Warn("PUBCOMP before CONNECT")
+				return
+			}
+			pubcompPacket := packet.PubcompPacket{}
+			_, err := pubcompPacket.Decode(bytes)
+			if err != nil {
+				log.Warn("invalid PUBCOMP packet", "error", err)
+				client.sendDisconnect(conn, packet.MalformedPacket)
+				client.disconnect(conn)
+				return
+			}
+			client.pubcomp(&pubcompPacket)
+
+		case packet.SUBSCRIBE:
+			if client == nil {
+				log.Warn("SUBSCRIBE before CONNECT")
+				return
+			}
+			subscribePacket := packet.SubscribePacket{}
+			_, err := subscribePacket.Decode(bytes)
+			if err != nil {
+				log.Warn("invalid SUBSCRIBE packet", "error", err)
+				client.sendDisconnect(conn, packet.MalformedPacket)
+				client.disconnect(conn)
+				return
+			}
+			reasonCodes := make([]packet.ReasonCode, 0, len(subscribePacket.Payload.Filters))
+			for _, filter := range subscribePacket.Payload.Filters {
+				reasonCodes = append(reasonCodes, client.subscribe(filter.TopicFilter.String(), filter.SubscriptionOptions))
+			}
+
+			subackPacket := protocol.MakeSuback(&subscribePacket, reasonCodes)
+			bin, err := subackPacket.Encode()
+			if err != nil {
+				log.Error("failed to encode SUBACK packet", "error", err)
+				client.disconnect(conn)
+				return
+			}
+			client.Write(bin)
+
+			for i, filter := range subscribePacket.Payload.Filters {
+				if reasonCodes[i] < packet.UnspecifiedError {
+					client.sendRetainedMessages(filter.TopicFilter.String())
+				}
+			}
+
+		case packet.PINGREQ:
+			if client == nil {
+				log.Warn("PINGREQ before CONNECT")
+				return
+			}
+			pingRespPacket := packet.PingRespPacket{}
+			bin, err := pingRespPacket.Encode()
+			if err != nil {
+				log.Error("failed to encode PINGRESP packet", "error", err)
+				client.disconnect(conn)
+				return
+			}
+			client.Write(bin)
+
+		case packet.UNSUBSCRIBE:
+			if client == nil {
+				log.Warn("UNSUBSCRIBE before CONNECT")
+				return
+			}
+			unsubscribePacket := packet.UnsubscribePacket{}
+			_, err := unsubscribePacket.Decode(bytes)
+			if err != nil || len(unsubscribePacket.Payload.Filters) == 0 {
+				log.Warn("invalid UNSUBSCRIBE packet", "error", err)
+				client.sendDisconnect(conn, packet.MalformedPacket)
+				client.disconnect(conn)
+				return
+			}
+			reasonCodes := make([]packet.ReasonCode, 0, len(unsubscribePacket.Payload.Filters))
+			for _, filter := range unsubscribePacket.Payload.Filters {
+				reasonCodes = append(reasonCodes, client.unsubscribe(filter.TopicFilter.String()))
+			}
+
+			unsubackPacket := protocol.MakeUnsuback(&unsubscribePacket, reasonCodes)
+			bin, err := unsubackPacket.Encode()
+			if err != nil {
+				log.Error("failed to encode UNSUBACK packet", "error", err)
+				client.disconnect(conn)
+				return
+			}
+			client.Write(bin)
+		default:
+			log.Warn("unknown packet type", "packet_type", fixedHeader.PacketType.String())
+			if client != nil {
+				client.sendDisconnect(conn, packet.ProtocolError)
+				client.disconnect(conn)
+			}
+			return
+		}
+
+	}
+}
+
+// checkConnect verifies that a client is allowed to connect on a listener.
+// It returns the verified token if the password is a JWT.
+func (l *listener) checkConnect(p *packet.ConnectPacket) (*auth.Token, packet.ReasonCode) {
+	if !slices.Contains(l.config.ProtocolVersions, p.VariableHeader.Version) {
+		return nil, packet.UnsupportedProtocolVersion
+	}
+
+	// MQTT-1.5.4-2: Strings do not contain U+0000, which separates the
+	// client ID from the rest of the keys of persisted sessions.
+	if strings.Contains(p.Payload.ClientId.String(), "\x00") {
+		return nil, packet.ClientIdentifierNotValid
+	}
+
+	// Credentials are verified by the exchange of the authentication method.
+	if p.VariableHeader.AuthenticationMethod.Str != "" {
+		return nil, packet.Success
+	}
+
+	if p.VariableHeader.PasswordFlag && l.jwt != nil && auth.IsJWT(p.Payload.Password.Data) {
+		token, err := l.jwt.Verify(string(p.Payload.Password.Data))
+		if err != nil {
+			l.server.logs.auth.Info("token verification failed", "error", err)
+			return nil, packet.BadUserNameOrPassword
+		}
+		return token, packet.Success
+	}
+
+	if p.VariableHeader.PasswordFlag && l.config.Authentication.DisablePasswords {
+		return nil, packet.BadAuthenticationMethod
+	}
+
+	if !p.VariableHeader.UserNameFlag {
+		if !*l.config.Authentication.AllowAnonymous {
+			return nil, packet.NotAuthorized
+		}
+		return nil, packet.Success
+	}
+
+	if l.passwords != nil {
+		if !p.VariableHeader.PasswordFlag ||
+			!l.passwords.Authenticate(p.Payload.UserName.String(), p.Payload.Password.Data) {
+			return nil, packet.BadUserNameOrPassword
+		}
+	} else if l.jwt != nil {
+		// Only tokens are accepted as credentials.
+		return nil, packet.BadUserNameOrPassword
+	}
+
+	return nil, packet.Success
+}
+
+// refuseConnect sends a CONNACK with a failure reason code. The packet is
+// written to the connection directly because no client exists yet.
+func (server *Server) refuseConnect(log *slog.Logger, conn net.Conn, reasonCode packet.ReasonCode) {
+	log.Info("refused connect", reasonCodeAttr(reasonCode))
+	server.metrics.connectAttempt(reasonCode)
+
+	conackPacket := packet.ConackPacket{}
+	conackPacket.VariableHeader.ConnectReasonCode = reasonCode
+	bin, err := conackPacket.Encode()
+	if err != nil {
+		log.Error("failed to encode CONNACK packet", "error", err)
+		return
+	}
+	_, err = conn.Write(bin)
+	if err != nil {
+		log.Warn("failed to send CONNACK packet", "error", err)
+		return
+	}
+	server.metrics.sent(bin)
+}
+
+// boundKeepAlive applies the configured keep-alive bounds to the keep-alive
+// requested by a client. It reports whether the requested value was overridden,
+// in which case the client is informed using the Server Keep Alive property.
+func (server *Server) boundKeepAlive(requested uint16) (uint16, bool) {
+	keepAlive := requested
+	bounds := server.config.KeepAlive
+
+	// A keep-alive of 0 disables the mechanism, which exceeds any maximum.
+	if bounds.Max > 0 && (keepAlive == 0 || keepAlive > bounds.Max) {
+		keepAlive = bounds.Max
+	}
+	if keepAlive > 0 && keepAlive < bounds.Min {
+		keepAlive = bounds.Min
+	}
+
+	return keepAlive, keepAlive != requested
+}
@@ -0,0 +1,149 @@
+package broker
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/auth"
+	"github.com/DvdSpijker/GoBroker/packet"
+)
+
+func TestConnectAuthentication(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "passwords")
+	entries, err := auth.SetPassword(nil, "alice", []byte("secret"), auth.BcryptHasher(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = auth.WritePasswordEntries(passwordFile, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _ := startServer(t, Config{})
+	go server.ServeListener(ln, ListenerConfig{
+		Authentication: AuthenticationConfig{PasswordFile: passwordFile},
+	})
+
+	authenticationCases := []struct {
+		name     string
+		userName string
+		password string
+		want     packet.ReasonCode
+	}{
+		{name: "valid credentials", userName: "alice", password: "secret", want: packet.Success},
+		{name: "wrong password", userName: "alice", password: "guess", want: packet.BadUserNameOrPassword},
+		{name: "unknown user", userName: "mallory", password: "secret", want: packet.BadUserNameOrPassword},
+		{name: "no password", userName: "alice", want: packet.BadUserNameOrPassword},
+		{name: "anonymous", want: packet.NotAuthorized},
+	}
+
+	for _, c := range authenticationCases {
+		t.Run(c.name, func(t *testing.T) {
+			client := dialClient(t, ln.Addr().String())
+			got := client.connect("client-"+c.name, c.userName, c.password)
+			if got != c.want {
+				t.Fatalf("wanted reason code %x but got %x", c.want, got)
+			}
+		})
+	}
+
+}
+
+func TestConnectClientIDWithNull(t *testing.T) {
+	_, address := startServer(t, Config{})
+
+	client := dialClient(t, address)
+	got := client.connect("a\x00b", "", "")
+	if got != packet.ClientIdentifierNotValid {
+		t.Fatalf("wanted reason code %x but got %x", packet.ClientIdentifierNotValid, got)
+	}
+}
+
+func TestAssignedClientID(t *testing.T) {
+	server, address := startServer(t, Config{})
+
+	assigned := map[string]bool{}
+	for range 2 {
+		client := dialClient(t, address)
+		client.write(connectPacket("", "", ""))
+		fixedHeader, conack := client.read()
+		if fixedHeader.PacketType != packet.CONNACK || packet.ReasonCode(conack[3]) != packet.Success {
+			t.Fatalf("wanted successful CONNACK but got %x", conack)
+		}
+
+		for _, session := range server.Sessions(SessionFilter{}) {
+			if assigned[session.ClientID] {
+				continue
+			}
+			if !strings.HasPrefix(session.ClientID, "auto-") || !bytes.Contains(conack, []byte(session.ClientID)) {
+				t.Fatalf("wanted the assigned client ID %s in the CONNACK but got %x", session.ClientID, conack)
+			}
+			assigned[session.ClientID] = true
+		}
+	}
+	if len(assigned) != 2 {
+		t.Fatalf("wanted 2 different client IDs but got %v", assigned)
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	aclFile := filepath.Join(t.TempDir(), "acl")
+	err := os.WriteFile(aclFile, []byte("topic read public/#\nclient writer\ntopic write public/#\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _ := startServer(t, Config{})
+	go server.ServeListener(ln, ListenerConfig{
+		Authorization: AuthorizationConfig{ACLFile: aclFile},
+	})
+
+	received := make(chan Message, 10)
+	server.Subscribe("#", func(m Message) { received <- m })
+
+	reader := connectClient(t, ln.Addr().String(), "reader")
+	if got := reader.subscribe("public/#"); got != packet.GrantedQoS0 {
+		t.Fatalf("wanted reason code %x but got %x", packet.GrantedQoS0, got)
+	}
+	if got := reader.subscribe("private/#"); got != packet.NotAuthorized {
+		t.Fatalf("wanted reason code %x but got %x", packet.NotAuthorized, got)
+	}
+	if got := reader.publishQoS1("public/news", "denied"); got != packet.NotAuthorized {
+		t.Fatalf("wanted reason code %x but got %x", packet.NotAuthorized, got)
+	}
+	// Denied QoS 0 messages are dropped silently.
+	reader.publish("public/news", "dropped")
+
+	writer := connectClient(t, ln.Addr().String(), "writer")
+	if got := writer.publishQoS1("public/news", "allowed"); got != packet.Success {
+		t.Fatalf("wanted reason code %x but got %x", packet.Success, got)
+	}
+
+	select {
+	case m := <-received:
+		if string(m.Payload) != "allowed" {
+			t.Fatalf("wanted only the allowed message but got %s", m.Payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("allowed message not published")
+	}
+
+	// The reader receives the allowed message on its subscription.
+	fixedHeader, _ := reader.read()
+	if fixedHeader.PacketType != packet.PUBLISH {
+		t.Fatalf("wanted PUBLISH but got packet type %v", fixedHeader.PacketType)
+	}
+}
@@ -0,0 +1,113 @@
+package broker
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/DvdSpijker/GoBroker/packet"
+)
+
+const (
+	// Largest value that fits in a four byte Variable Byte Integer (1.5.5).
+	maxRemainingLength = 268435455
+	// At most four bytes are used to encode the remaining length.
+	maxRemainingLengthBytes = 4
+)
+
+var (
+	ErrMalformedRemainingLength = errors.New("malformed remaining length")
+	ErrPacketTooLarge           = errors.New("packet too large")
+)
+
+// framer splits a stream of bytes into complete MQTT control packets.
+//
+// The stream is buffered, so packets split over multiple reads and
+// multiple packets arriving in a single read are both handled.
+type framer struct {
+	reader        *bufio.Reader
+	maxPacketSize int
+}
+
+// newFramer creates a framer that reads from r.
+// Packets with a total size larger than maxPacketSize are rejected,
+// a maxPacketSize <= 0 allows the maximum size defined by the specification.
+func newFramer(r io.Reader, maxPacketSize int) *framer {
+	if maxPacketSize <= 0 {
+		maxPacketSize = maxRemainingLength + 1 + maxRemainingLengthBytes
+	}
+	return &framer{
+		reader:        bufio.NewReader(r),
+		maxPacketSize: maxPacketSize,
+	}
+}
+
+// readPacket blocks until a complete packet has been read.
+// The returned bytes contain the whole packet including the fixed header,
+// which is what the packet decoders expect.
+func (f *framer) readPacket() (packet.FixedHeader, []byte, error) {
+	first, err := f.reader.ReadByte()
+	if err != nil {
+		return packet.FixedHeader{}, nil, err
+	}
+
+	header := make([]byte, 1, 1+maxRemainingLengthBytes)
+	header[0] = first
+
+	// Decode the remaining length one byte at a time, the continuation
+	// bit tells whether another byte follows.
+	remainingLength := 0
+	multiplier := 1
+	for i := 0; ; i++ {
+		if i == maxRemainingLengthBytes {
+			return packet.FixedHeader{}, nil, ErrMalformedRemainingLength
+		}
+
+		b, err := f.reader.ReadByte()
+		if err != nil {
+			return packet.FixedHeader{}, nil, unexpectedEOF(err)
+		}
+		header = append(header, b)
+
+		remainingLength += int(b&127) * multiplier
+		multiplier *= 128
+
+		if b&128 == 0 {
+			break
+		}
+	}
+
+	if len(header)+remainingLength > f.maxPacketSize {
+		return packet.FixedHeader{}, nil, fmt.Errorf(
+			"%w: %d bytes exceeds maximum of %d",
+			ErrPacketTooLarge,
+			len(header)+remainingLength,
+			f.maxPacketSize,
+		)
+	}
+
+	fixedHeader := packet.FixedHeader{}
+	_, err = fixedHeader.Decode(header)
+	if err != nil {
+		return packet.FixedHeader{}, nil, err
+	}
+
+	bytes := make([]byte, len(header)+remainingLength)
+	copy(bytes, header)
+	_, err = io.ReadFull(f.reader, bytes[len(header):])
+	if err != nil {
+		return packet.FixedHeader{}, nil, unexpectedEOF(err)
+	}
+
+	return fixedHeader, bytes, nil
+}
+
+// unexpectedEOF converts io.EOF to io.ErrUnexpectedEOF. Reaching the end of
+// the stream halfway through a packet means the packet was truncated.
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,144 @@
+package broker
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/DvdSpijker/GoBroker/packet"
+)
+
+var (
+	pingreqBytes = []byte{byte(packet.PINGREQ), 0x00}
+	publishBytes = []byte{
+		byte(packet.PUBLISH), 10,
+		0, 3, 'a', '/', 'b', // Topic name
+		0,                  // Properties length
+		't', 'e', 's', 't', // Payload
+	}
+)
+
+// publishWithPayload creates a PUBLISH packet with a payload of the given size
+// so that the remaining length needs multiple bytes.
+func publishWithPayload(size int) []byte {
+	remaining := 2 + 3 + 1 + size
+	header := []byte{byte(packet.PUBLISH)}
+	for {
+		b := byte(remaining % 128)
+		remaining /= 128
+		if remaining > 0 {
+			b |= 128
+		}
+		header = append(header, b)
+		if remaining == 0 {
+			break
+		}
+	}
+	header = append(header, 0, 3, 'a', '/', 'b', 0)
+	return append(header, bytes.Repeat([]byte{'x'}, size)...)
+}
+
+func TestFramerReadsPackets(t *testing.T) {
+	large := publishWithPayload(20000)
+
+	framerCases := []struct {
+		name    string
+		reader  func(io.Reader) io.Reader
+		packets [][]byte
+	}{
+		{
+			name:    "single packet",
+			packets: [][]byte{publishBytes},
+		},
+		{
+			name:    "packet shorter than five bytes",
+			packets: [][]byte{pingreqBytes},
+		},
+		{
+			name:    "coalesced packets",
+			packets: [][]byte{pingreqBytes, publishBytes, pingreqBytes, large},
+		},
+		{
+			name:    "fragmented packets",
+			reader:  iotest.OneByteReader,
+			packets: [][]byte{publishBytes, pingreqBytes, large},
+		},
+		{
+			name:    "fragments spanning packets",
+			reader:  iotest.HalfReader,
+			packets: [][]byte{large, publishBytes, pingreqBytes, publishBytes},
+		},
+	}
+
+	for _, c := range framerCases {
+		t.Run(c.name, func(t *testing.T) {
+			var r io.Reader = bytes.NewReader(bytes.Join(c.packets, nil))
+			if c.reader != nil {
+				r = c.reader(r)
+			}
+			f := newFramer(r, 0)
+
+			for i, want := range c.packets {
+				fixedHeader, got, err := f.readPacket()
+				if err != nil {
+					t.Fatalf("packet %d: unexpected error: %v", i, err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Fatalf("packet %d: wanted %x but got %x", i, want, got)
+				}
+				if fixedHeader.PacketType != packet.PacketType(want[0]&0xF0) {
+					t.Fatalf("packet %d: wanted packet type %v but got %v",
+						i, packet.PacketType(want[0]&0xF0), fixedHeader.PacketType)
+				}
+			}
+
+			_, _, err := f.readPacket()
+			if !errors.Is(err, io.EOF) {
+				t.Fatalf("wanted io.EOF after last packet but got %v", err)
+			}
+		})
+	}
+}
+
+func TestFramerErrors(t *testing.T) {
+	framerCases := []struct {
+		name          string
+		input         []byte
+		maxPacketSize int
+		want          error
+	}{
+		{
+			name:  "truncated remaining length",
+			input: []byte{byte(packet.PUBLISH), 0x80},
+			want:  io.ErrUnexpectedEOF,
+		},
+		{
+			name:  "truncated body",
+			input: publishBytes[:len(publishBytes)-1],
+			want:  io.ErrUnexpectedEOF,
+		},
+		{
+			name:  "remaining length longer than four bytes",
+			input: []byte{byte(packet.PUBLISH), 0xFF, 0xFF, 0xFF, 0xFF, 0x01},
+			want:  ErrMalformedRemainingLength,
+		},
+		{
+			name:          "packet too large",
+			input:         publishBytes,
+			maxPacketSize: len(publishBytes) - 1,
+			want:          ErrPacketTooLarge,
+		},
+	}
+
+	for _, c := range framerCases {
+		t.Run(c.name, func(t *testing.T) {
+			f := newFramer(bytes.NewReader(c.input), c.maxPacketSize)
+			_, _, err := f.readPacket()
+			if !errors.Is(err, c.want) {
+				t.Fatalf("wanted %v but got %v", c.want, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,1095 @@
+package broker
+
+import (
+	"context"
+	"crypto/x509"
+	"log/slog"
+	"math"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/auth"
+	"github.com/DvdSpijker/GoBroker/codec"
+	"github.com/DvdSpijker/GoBroker/packet"
+	"github.com/DvdSpijker/GoBroker/protocol"
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+const DefaultSendQueueSize = 100
+
+const DefaultMaxQueuedMessages = 1000
+
+// SessionNeverExpires is the session expiry interval of a session that is
+// kept until the client starts a clean session (3.1.2.11.2).
+const SessionNeverExpires time.Duration = math.MaxInt64
+
+type (
+	SharedSubscriptionKey struct {
+		Topic string
+		Group string
+	}
+
+	Subscription struct {
+		clients      []*Client
+		publishIndex int
+		shared       bool
+	}
+
+	Client struct {
+		Mutex sync.Mutex
+
+		ID             string
+		UserName       string   // Empty if the client connected without a user name.
+		Conn           net.Conn // If Conn is nil the client is offline
+		Subscriptions  []string
+		SendQueue      chan []byte
+		KeepAlive      time.Duration
+		LastWill       protocol.LastWill
+		WillDelayTimer *time.Timer
+		Ctx            context.Context
+		Cancel         context.CancelFunc
+		Certificate    *x509.Certificate // Verified TLS client certificate, nil if there is none.
+		// Enhanced authentication method used in the CONNECT, empty if the
+		// client did not use enhanced authentication.
+		AuthenticationMethod string
+		// Time the session is kept after the connection closed.
+		SessionExpiryInterval time.Duration
+
+		server           *Server
+		log              *slog.Logger          // Session logger with the client ID.
+		listener         *listener             // Listener the client connected on.
+		reauthentication auth.Authenticator    // Re-authentication in progress, if any.
+		token            *auth.Token           // Token the client authenticated with, if any, protected by Mutex.
+		tokenTimer       *time.Timer           // Disconnects the client when the token expires, protected by Mutex.
+		sessionTimer     *time.Timer           // Ends the session when it expires.
+		delayedWill      *packet.PublishPacket // Will that waits for its delay or the session end.
+		writeMutex       sync.Mutex            // Serializes writes to Conn.
+		flushed          chan struct{}         // Signalled by the writer when a flush is done.
+		writerDone       chan struct{}         // Closed when the writer of the connection exits.
+
+		// Session state (4.1), protected by Mutex.
+		subscriptionQoS  map[string]types.QoS        // Maximum QoS of every subscription.
+		noLocal          map[string]bool             // Subscriptions that skip the client's own messages.
+		packetIdentifier uint16                      // Last packet identifier used for a delivery.
+		inFlight         map[uint16]*inFlightMessage // Deliveries that were not acknowledged yet.
+		received         map[uint16]struct{}         // QoS 2 messages that were not released yet.
+		queue            []queuedMessage             // Messages for the client while it is offline.
+		queueSequence    uint64                      // Sequence number of the last queued message.
+		persisted        bool                        // The session is in the store.
+	}
+
+	clientSubscriptionMap map[string]Subscription
+	retainedMessageMap    map[string]*packet.PublishPacket
+)
+
+func (server *Server) deleteSubscription(topic string, client *Client) {
+	server.subscriptionsMutex.Lock()
+	defer server.subscriptionsMutex.Unlock()
+
+	sub, ok := server.subscriptions[topic]
+	index := slices.Index(sub.clients, client)
+	if !ok || index == -1 {
+		return
+	}
+
+	if len(sub.clients) == 1 {
+		delete(server.subscriptions, topic)
+		server.cluster.unsubscribe(topic)
+	} else {
+		// Current publish index is about to be removed.
+		if sub.shared && sub.publishIndex == index {
+			incPublishIndex(&sub)
+		}
+
+		clients := slices.Delete(slices.Clone(sub.clients), index, index+1)
+		// Indexes after the removed client have shifted.
+		if sub.publishIndex > index {
+			sub.publishIndex--
+		}
+		if sub.publishIndex >= len(clients) {
+			sub.publishIndex = 0
+		}
+		server.subscriptions[topic] = Subscription{
+			clients:      clients,
+			publishIndex: sub.publishIndex,
+			shared:       sub.shared,
+		}
+	}
+}
+
+func incPublishIndex(sharedSubscription *Subscription) Subscription {
+	sharedSubscription.publishIndex++
+	if sharedSubscription.publishIndex >= len(sharedSubscription.clients) {
+		sharedSubscription.publishIndex = 0
+	}
+	return *sharedSubscription
+}
+
+func (server *Server) addSubscription(topic string, client *Client) {
+	server.subscriptionsMutex.Lock()
+	defer server.subscriptionsMutex.Unlock()
+
+	sub, ok := server.subscriptions[topic]
+	if !ok {
+		server.subscriptions[topic] = Subscription{
+			clients: make([]*Client, 0, 10),
+			shared:  isSharedSubscription(topic),
+		}
+		sub = server.subscriptions[topic]
+		server.cluster.subscribe(topic)
+	}
+
+	server.subscriptions[topic] = Subscription{
+		clients:      append(sub.clients, client),
+		publishIndex: sub.publishIndex,
+		shared:       sub.shared,
+	}
+
+	client.log.Debug("added subscription", "topic_filter", topic, "shared", isSharedSubscription(topic),
+		"subscribers", len(server.subscriptions[topic].clients))
+}
+
+func (server *Server) addRetainedMessage(topic string, p *packet.PublishPacket) {
+	if !server.storeRetainedMessage(topic, p, true) {
+		return
+	}
+
+	if len(p.Payload.Data) == 0 {
+		p = nil
+	}
+	server.onRetain(topic, p)
+}
+
+// storeRetainedMessage replaces the retained message of topic and replicates
+// the change to the cluster if replicate is set. It returns false if the
+// retained messages did not change.
+func (server *Server) storeRetainedMessage(topic string, p *packet.PublishPacket, replicate bool) bool {
+	server.retainedMessagesMutex.Lock()
+	defer server.retainedMessagesMutex.Unlock()
+
+	retained := server.retainedMessages
+
+	if len(p.Payload.Data) == 0 {
+		// MQTT-3.3.1-6: If the payload if empty the retained message for a topic is removed.
+		if retained[topic] == nil {
+			return false
+		}
+		retained[topic] = nil
+		server.persistRetainedMessage(topic, nil)
+		server.logs.session.Debug("removed retained message", "topic", topic)
+		if replicate {
+			server.cluster.replicate(topic, p)
+		}
+		return true
+	}
+
+	limits := server.config.Retained
+	if limits.MaxPayloadSize > 0 && len(p.Payload.Data) > limits.MaxPayloadSize {
+		server.logs.session.Warn("retained message payload too large", "topic", topic,
+			"payload_size", len(p.Payload.Data))
+		server.metrics.drop(dropRetainedPayloadTooLarge)
+		return false
+	}
+	if limits.MaxMessages > 0 && retained[topic] == nil && retained.count() >= limits.MaxMessages {
+		server.logs.session.Warn("maximum number of retained messages reached, dropped message", "topic", topic)
+		server.metrics.drop(dropRetainedLimit)
+		return false
+	}
+
+	// MQTT-3.3.1-5: New retained message on a topic replaces old.
+	server.logs.session.Debug("added retained message", "topic", topic, server.payload(p))
+	retained[topic] = p
+	server.persistRetainedMessage(topic, p)
+	if replicate {
+		server.cluster.replicate(topic, p)
+	}
+	return true
+}
+
+// count returns the number of stored retained messages, the lock must be held.
+func (retained retainedMessageMap) count() int {
+	count := 0
+	for _, message := range retained {
+		if message != nil {
+			count++
+		}
+	}
+	return count
+}
+
+// getRetainedMessages returns the retained messages of all topics that match filter.
+func (server *Server) getRetainedMessages(filter string) []*packet.PublishPacket {
+	server.retainedMessagesMutex.Lock()
+	defer server.retainedMessagesMutex.Unlock()
+
+	var messages []*packet.PublishPacket
+	for topic, message := range server.retainedMessages {
+		if message != nil && topicMatches(filter, topic) {
+			messages = append(messages, message)
+		}
+	}
+
+	return messages
+}
+
+func newClient(id string, server *Server) *Client {
+	return &Client{
+		ID:              id,
+		server:          server,
+		log:             server.logs.session.With("client_id", id),
+		subscriptionQoS: make(map[string]types.QoS),
+		noLocal:         make(map[string]bool),
+		inFlight:        make(map[uint16]*inFlightMessage),
+		received:        make(map[uint16]struct{}),
+	}
+}
+
+// connect creates the client of a new connection, or resumes its existing
+// session. It reports whether an existing session was resumed. The client is
+// passed to attach while the lock is held, once the connection is attached.
+// If a client with the same ID is connected, its connection is detached and
+// the returned function closes it, which must be called without the lock.
+func (server *Server) connect(id string, conn net.Conn, p *packet.ConnectPacket, attach func(*Client, bool)) (*Client, bool, func()) {
+	closed := server.isClosed()
+	server.clientsMutex.Lock()
+	defer server.clientsMutex.Unlock()
+
+	var client *Client
+	var takeOver func()
+	c, ok := server.clients[id]
+	if ok && c.Conn != nil {
+		// MQTT-3.1.4-3: A client that connects with the ID of a connected
+		// client takes over its session. The existing connection is
+		// detached under the lock, so that concurrent connects with the
+		// same ID take over from each other in turn.
+		takenOver, queue, writerDone := c.Conn, c.SendQueue, c.writerDone
+		disconnected := c.detach(closed)
+		// The writer of the connection is waited for after the lock is
+		// released, it writes the packet it is busy with before it exits.
+		c.writerDone = nil
+		takeOver = func() {
+			takenOver.SetWriteDeadline(time.Now().Add(sessionTakeOverTimeout))
+			<-writerDone
+			// MQTT-3.14.0-1: The packets that are still queued, like the
+			// CONNACK, are sent before the DISCONNECT.
+			c.drain(takenOver, queue)
+			c.sendDisconnect(takenOver, packet.SessionTakenOver)
+			takenOver.Close()
+			disconnected()
+		}
+		// A session that ends with the connection is gone now.
+		c, ok = server.clients[id]
+	}
+	if ok {
+		if c.sessionTimer != nil {
+			c.sessionTimer.Stop()
+		}
+		// Cancel a delayed Last Will publish when the client
+		// has reconnected.
+		if c.WillDelayTimer != nil {
+			c.WillDelayTimer.Stop()
+		}
+		c.delayedWill = nil
+	}
+
+	sessionPresent := ok && !p.VariableHeader.CleanStart
+	if sessionPresent {
+		client = c
+		client.log.Debug("resumed session")
+	} else {
+		// MQTT-3.1.2-4: A clean start discards the existing session.
+		if ok {
+			c.endSession()
+		}
+		client = newClient(id, server)
+		server.clients[id] = client
+		client.log.Debug("started session")
+	}
+	// The writer of a previous connection of the session uses its context
+	// and queue until it exits.
+	if client.writerDone != nil {
+		client.Cancel()
+		<-client.writerDone
+	}
+	client.Mutex.Lock()
+	client.Conn = conn
+	client.Ctx, client.Cancel = context.WithCancel(context.Background())
+	client.SendQueue = make(chan []byte, server.config.SendQueueSize)
+	client.flushed = make(chan struct{}, 1)
+	client.Mutex.Unlock()
+	client.writerDone = make(chan struct{})
+	go client.writer(client.Ctx, conn, client.SendQueue, client.flushed, client.writerDone)
+	// 3.1.2-22: The server allows 1.5x the keep-alive period between control packets.
+	// A factor of 1.5 resulted in connections being lost due to 'missed' keep-alive packets.
+	// Changing the factor to 1.7 resulted in stable connections.
+	client.KeepAlive = time.Second * time.Duration(
+		math.Round(float64(p.VariableHeader.KeepAlive.Value)*float64(1.7)))
+
+	client.LastWill = copyLastWill(p)
+	client.reauthentication = nil
+
+	client.SessionExpiryInterval = time.Second * time.Duration(p.VariableHeader.SessionExpiryInterval.Value)
+	if p.VariableHeader.SessionExpiryInterval.Value == math.MaxUint32 {
+		client.SessionExpiryInterval = SessionNeverExpires
+	}
+
+	// Only sessions that outlive the connection are persisted.
+	client.Mutex.Lock()
+	if client.SessionExpiryInterval > 0 {
+		server.persistSession(client, time.Time{})
+	} else {
+		server.deletePersistedSession(client)
+	}
+	client.Mutex.Unlock()
+
+	attach(client, sessionPresent)
+	return client, sessionPresent, takeOver
+}
+
+// setKeepAliveDeadline sets the read deadline of conn for a client with
+// keepAlive, the KeepAlive of the client when conn was attached.
+func setKeepAliveDeadline(conn net.Conn, keepAlive time.Duration) {
+	// 3.1.2.10: A Keep-Alive value of 0 has the effect of turning
+	// of the Keep-Alive mechanism.
+	if keepAlive > 0 {
+		conn.SetReadDeadline(time.Now().Add(keepAlive))
+	}
+}
+
+// disconnect ends conn, the connection of the client. It does nothing if
+// the session was taken over by another connection in the meantime.
+func (client *Client) disconnect(conn net.Conn) {
+	server := client.server
+	closed := server.isClosed()
+	server.clientsMutex.Lock()
+	if client.Conn != conn {
+		server.clientsMutex.Unlock()
+		return
+	}
+	disconnected := client.detach(closed)
+	server.clientsMutex.Unlock()
+
+	disconnected()
+}
+
+// detach removes the connection of a connected client from its session and
+// ends the session if it does not outlive the connection. The clients lock
+// of the server must be held, the returned function runs the hooks and
+// publishes the will and must be called once the lock is released.
+func (client *Client) detach(closed bool) func() {
+	server := client.server
+
+	var lastWill *packet.PublishPacket
+	if client.LastWill.WillFlag && client.authorized(auth.Write, client.LastWill.Topic.String()) {
+		lastWill = protocol.MakeLastWillPublishPacket(&client.LastWill)
+
+		// 3.1.3.2.2: The will is published when the delay has passed or
+		// when the session ends, whichever happens first.
+		delay := client.LastWill.Properties.DelayInterval
+		if delay > 0 && client.SessionExpiryInterval > 0 {
+			// A delayed will is cancelled when the server is closed, like
+			// all other timers of the session.
+			if !closed {
+				client.delayedWill = lastWill
+				if delay < client.SessionExpiryInterval {
+					client.WillDelayTimer = time.AfterFunc(delay, client.publishDelayedWill)
+				}
+			}
+			lastWill = nil
+		}
+	}
+
+	client.Cancel()
+	client.Mutex.Lock()
+	client.Conn = nil
+	if client.tokenTimer != nil {
+		client.tokenTimer.Stop()
+	}
+	client.Mutex.Unlock()
+
+	sessionExpired := client.SessionExpiryInterval == 0
+	if sessionExpired {
+		delete(server.clients, client.ID)
+	} else {
+		if client.SessionExpiryInterval != SessionNeverExpires && !closed {
+			client.sessionTimer = time.AfterFunc(client.SessionExpiryInterval, client.expireSession)
+		}
+		client.Mutex.Lock()
+		server.persistSession(client, time.Now())
+		client.Mutex.Unlock()
+	}
+
+	willTopic := client.LastWill.Topic.String()
+	return func() {
+		server.onDisconnect(client)
+		server.publishClientEvent(client.ID, "disconnected", clientEvent{ClientID: client.ID, Time: time.Now()})
+		if sessionExpired {
+			client.endSession()
+		}
+		if lastWill != nil {
+			client.log.Info("publishing will", "topic", willTopic)
+			client.publishWill(lastWill)
+		}
+		if sessionExpired {
+			client.log.Debug("session ended")
+			server.onSessionExpired(client)
+		}
+	}
+}
+
+// handleDisconnect applies a DISCONNECT of the client before its connection
+// is closed. It returns Protocol Error if the packet is not allowed.
+func (client *Client) handleDisconnect(p *packet.DisconnectPacket) packet.ReasonCode {
+	server := client.server
+	server.clientsMutex.Lock()
+	defer server.clientsMutex.Unlock()
+
+	expiryInterval := p.VariableHeader.SessionExpiryInterval
+	if expiryInterval.Size != 0 {
+		// MQTT-3.14.2-2: A session that ends with the connection can not be
+		// extended on disconnect.
+		if client.SessionExpiryInterval == 0 && expiryInterval.Value != 0 {
+			return packet.ProtocolError
+		}
+		client.SessionExpiryInterval = time.Second * time.Duration(expiryInterval.Value)
+		if expiryInterval.Value == math.MaxUint32 {
+			client.SessionExpiryInterval = SessionNeverExpires
+		}
+	}
+
+	// MQTT-3.14.4-3: The will is discarded on a normal disconnection. It is
+	// published for Disconnect with Will Message and other reason codes.
+	if p.VariableHeader.ReasonCode == packet.NormalDisconnection {
+		client.LastWill = protocol.LastWill{}
+	}
+	return packet.Success
+}
+
+// stopTimers cancels the timers of the session and a will that waits for
+// its delay. The clients lock of the server must be held.
+func (client *Client) stopTimers() {
+	client.Mutex.Lock()
+	tokenTimer := client.tokenTimer
+	client.Mutex.Unlock()
+
+	for _, timer := range []*time.Timer{client.sessionTimer, client.WillDelayTimer, tokenTimer} {
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	client.delayedWill = nil
+}
+
+// expireSession ends the session of a client that did not reconnect within
+// the session expiry interval.
+func (client *Client) expireSession() {
+	server := client.server
+	server.clientsMutex.Lock()
+	// The client reconnected or started a new session in the meantime.
+	if client.Conn != nil || server.clients[client.ID] != client {
+		server.clientsMutex.Unlock()
+		return
+	}
+	delete(server.clients, client.ID)
+	server.clientsMutex.Unlock()
+
+	client.endSession()
+	// A will that is still delayed is published when the session ends.
+	client.publishDelayedWill()
+
+	client.log.Info("session expired")
+	server.onSessionExpired(client)
+}
+
+// publishDelayedWill publishes the will of a disconnected client if it was
+// not published or cancelled yet.
+func (client *Client) publishDelayedWill() {
+	client.server.clientsMutex.Lock()
+	lastWill := client.delayedWill
+	client.delayedWill = nil
+	client.server.clientsMutex.Unlock()
+
+	if lastWill != nil {
+		client.log.Info("publishing delayed will", "topic", client.LastWill.Topic.String())
+		client.publishWill(lastWill)
+	}
+}
+
+// publishWill publishes the will message of a client.
+func (client *Client) publishWill(p *packet.PublishPacket) {
+	if !client.server.onWillPublish(client, p) {
+		client.log.Info("will dropped by hook")
+		client.server.metrics.drop(dropRejectedByHook)
+		return
+	}
+
+	topic := p.VariableHeader.TopicName.String()
+	// MQTT-3.1.2-15: The will is only retained if the will retain flag is set.
+	if p.FixedHeader.Retain {
+		client.server.addRetainedMessage(topic, p)
+	}
+	client.server.publish(p, topic, client.ID)
+}
+
+// endSession removes the subscriptions and the persisted state of the
+// session, the client must not be connected.
+func (client *Client) endSession() {
+	client.unsubscribeAll()
+
+	client.Mutex.Lock()
+	defer client.Mutex.Unlock()
+
+	client.server.deletePersistedSession(client)
+	client.Subscriptions = nil
+	clear(client.subscriptionQoS)
+	clear(client.noLocal)
+	clear(client.inFlight)
+	clear(client.received)
+	client.queue = nil
+}
+
+func (client *Client) unsubscribeAll() {
+	for _, topic := range client.Subscriptions {
+		client.unsubscribeTopic(topic)
+	}
+}
+
+func (client *Client) unsubscribeTopic(topic string) {
+	client.server.deleteSubscription(topic, client)
+}
+
+// onPublish handles a PUBLISH packet of the client. It returns the reason
+// code to disconnect the client with, or Success if the client stays
+// connected.
+func (client *Client) onPublish(p *packet.PublishPacket) packet.ReasonCode {
+	topic := p.VariableHeader.TopicName.String()
+	client.log.Debug("published", "topic", topic, "qos", p.FixedHeader.Qos,
+		"retain", p.FixedHeader.Retain, client.server.payload(p))
+
+	// MQTT-3.3.2-2: The topic name must not contain wildcard characters.
+	err := checkTopicName(topic)
+	if err != nil {
+		client.log.Info("invalid topic name", "error", err)
+		return packet.TopicNameInvalid
+	}
+
+	// MQTT-4.3.3-10: A QoS 2 message is published once, a resent message
+	// that was not released yet is only acknowledged again.
+	if p.FixedHeader.Qos == types.QoS2 && client.hasReceived(p) {
+		client.acknowledge(p, packet.Success)
+		return packet.Success
+	}
+
+	// Only the broker publishes to its $SYS topics, whatever the ACL allows.
+	if isSysTopic(topic) || !client.authorized(auth.Write, topic) {
+		client.log.Info("not authorized to publish", "topic", topic)
+		client.server.metrics.drop(dropNotAuthorized)
+		// A denied QoS 0 message is dropped without informing the client.
+		client.acknowledge(p, packet.NotAuthorized)
+		return packet.Success
+	}
+
+	reasonCode := client.server.onPublish(client, p)
+	if reasonCode != packet.Success {
+		client.log.Info("publish rejected by hook", "topic", topic, reasonCodeAttr(reasonCode))
+		client.server.metrics.drop(dropRejectedByHook)
+		client.acknowledge(p, reasonCode)
+		return packet.Success
+	}
+	// A topic that was changed by a hook is checked again.
+	if rewritten := p.VariableHeader.TopicName.String(); rewritten != topic {
+		topic = rewritten
+		err = checkTopicName(topic)
+		if err != nil {
+			client.log.Info("hook changed the topic name to an invalid one", "error", err)
+			client.acknowledge(p, packet.TopicNameInvalid)
+			return packet.Success
+		}
+		if isSysTopic(topic) || !client.authorized(auth.Write, topic) {
+			client.log.Info("not authorized to publish", "topic", topic)
+			client.server.metrics.drop(dropNotAuthorized)
+			client.acknowledge(p, packet.NotAuthorized)
+			return packet.Success
+		}
+	}
+
+	// MQTT-3.3.1-8: If the retained flag is not set the message should not be stored.
+	if p.FixedHeader.Retain {
+		client.server.addRetainedMessage(topic, p)
+	}
+
+	if p.FixedHeader.Qos == types.QoS2 {
+		client.receive(p)
+	}
+	client.acknowledge(p, packet.Success)
+
+	client.server.publish(p, topic, client.ID)
+	return packet.Success
+}
+
+// acknowledge sends a PUBACK for a QoS 1 message or a PUBREC for a QoS 2
+// message, QoS 0 messages are not acknowledged.
+func (client *Client) acknowledge(p *packet.PublishPacket, reasonCode packet.ReasonCode) {
+	switch p.FixedHeader.Qos {
+	case types.QoS1:
+		client.sendAcknowledgement(protocol.MakePuback(p, reasonCode))
+	case types.QoS2:
+		client.sendAcknowledgement(protocol.MakePubrec(p, reasonCode))
+	}
+}
+
+func (client *Client) sendAcknowledgement(p codec.Encoder) {
+	bytes, err := p.Encode()
+	if err != nil {
+		client.log.Error("failed to encode acknowledgement", "error", err)
+		return
+	}
+	go func(client *Client, bytes []byte) {
+		client.Write(bytes)
+	}(client, bytes)
+}
+
+// authorized reports whether the client is allowed access to topic. The
+// grants of the client's token take precedence over the ACL of the listener.
+// Everything is allowed if there are neither grants nor an ACL.
+func (client *Client) authorized(access auth.Access, topic string) bool {
+	client.Mutex.Lock()
+	token := client.token
+	client.Mutex.Unlock()
+
+	if token != nil && token.Grants != nil {
+		return token.Grants.Allowed(access, topic)
+	}
+
+	if client.listener == nil || client.listener.acl == nil {
+		return true
+	}
+
+	identity := auth.Identity{UserName: client.UserName, ClientID: client.ID}
+	if client.Certificate != nil {
+		identity.CommonName = client.Certificate.Subject.CommonName
+	}
+
+	return client.listener.acl.Allowed(identity, access, topic)
+}
+
+// publish forwards a packet to all clients and in-process handlers with a
+// matching subscription, on this node and the other nodes of the cluster.
+// The sender is the ID of the publishing client, whose No Local
+// subscriptions skip the packet, or a name for logging.
+func (server *Server) publish(p *packet.PublishPacket, topic string, sender string) {
+	server.cluster.forward(p, topic)
+	server.publishLocal(p, topic, sender)
+}
+
+// publishLocal forwards a packet to the subscribers on this node.
+func (server *Server) publishLocal(p *packet.PublishPacket, topic string, sender string) {
+	start := time.Now()
+	log := server.logs.session.With("sender", sender, "topic", topic)
+
+	server.publishToHandlers(p, topic)
+
+	server.subscriptionsMutex.Lock()
+	defer server.subscriptionsMutex.Unlock()
+
+	// The fan-out is complete when the message is handed to all subscribers.
+	var deliveries sync.WaitGroup
+	defer func() {
+		go func() {
+			deliveries.Wait()
+			server.metrics.publishFanout.Observe(time.Since(start).Seconds())
+		}()
+	}()
+
+	pub := func(c *Client, filter string) {
+		defer deliveries.Done()
+		// MQTT-3.8.3-3: Messages are not forwarded to the publisher on a
+		// subscription with No Local.
+		if c.ID == sender && c.isNoLocal(filter) {
+			return
+		}
+		log.Debug("delivering message", "client_id", c.ID)
+		c.deliver(p, filter)
+	}
+
+	// Loop over client subscriptions instead of clients because
+	// it is more efficient when the larger part of the connected
+	// clients have few subscriptions.
+	for t, subscription := range server.subscriptions {
+		if topicMatches(t, topic) {
+			if subscription.shared {
+				server.subscriptions[t] = incPublishIndex(&subscription) // Pre-increment to avoid out of bounds issues.
+				log.Debug("shared subscription", "topic_filter", t, "publish_index", subscription.publishIndex)
+				c := subscription.clients[subscription.publishIndex]
+				deliveries.Add(1)
+				go pub(c, t)
+			} else {
+				deliveries.Add(len(subscription.clients))
+				for _, c := range subscription.clients {
+					go pub(c, t)
+				}
+			}
+		}
+	}
+}
+
+// subscribe adds a subscription with the maximum QoS of the subscription
+// options. It returns the reason code for the SUBACK.
+func (client *Client) subscribe(topic string, options byte) packet.ReasonCode {
+	qos := types.QoS(options & 0b11)
+	// MQTT-3.8.3-4: QoS 3 is a protocol error.
+	if qos > types.QoS2 {
+		return packet.UnspecifiedError
+	}
+	noLocal := options&0b100 > 0
+	// MQTT-3.8.3-4: No Local on a shared subscription is a protocol error.
+	if noLocal && isSharedSubscription(topic) {
+		return packet.UnspecifiedError
+	}
+
+	if !client.authorized(auth.Read, topic) {
+		client.log.Info("not authorized to subscribe", "topic_filter", topic)
+		return packet.NotAuthorized
+	}
+
+	reasonCode := client.server.onSubscribe(client, topic)
+	if reasonCode != packet.Success {
+		client.log.Info("subscription rejected by hook", "topic_filter", topic, reasonCodeAttr(reasonCode))
+		return reasonCode
+	}
+
+	client.Mutex.Lock()
+	// MQTT-3.8.4-3: A subscription to the same filter replaces the existing one.
+	_, subscribed := client.subscriptionQoS[topic]
+	client.subscriptionQoS[topic] = qos
+	if noLocal {
+		client.noLocal[topic] = true
+	} else {
+		delete(client.noLocal, topic)
+	}
+	if !subscribed {
+		client.Subscriptions = append(client.Subscriptions, topic)
+		client.server.addSubscription(topic, client)
+	}
+	client.server.persistSession(client, time.Time{})
+	client.Mutex.Unlock()
+	client.log.Debug("subscribed", "topic_filter", topic, "qos", qos)
+
+	// The reason codes of granted subscriptions are the granted QoS.
+	return packet.ReasonCode(qos)
+}
+
+func (client *Client) isNoLocal(filter string) bool {
+	client.Mutex.Lock()
+	defer client.Mutex.Unlock()
+	return client.noLocal[filter]
+}
+
+// sendRetainedMessages delivers the retained messages matching a new
+// subscription, after the SUBACK was sent.
+func (client *Client) sendRetainedMessages(topic string) {
+	// New subscribers to a shared subscription do not received rainted messages.
+	if isSharedSubscription(topic) {
+		return
+	}
+
+	for _, retainedMessage := range client.server.getRetainedMessages(topic) {
+		client.log.Debug("sending retained message", "topic", retainedMessage.VariableHeader.TopicName.String())
+		client.deliver(retainedMessage, topic)
+	}
+}
+
+// unsubscribe removes a subscription of the client and returns the reason
+// code for the UNSUBACK.
+func (client *Client) unsubscribe(topic string) packet.ReasonCode {
+	if !client.removeSubscription(topic) {
+		return packet.NoSubscriptionExisted
+	}
+	client.server.onUnsubscribe(client, topic)
+	return packet.Success
+}
+
+// removeSubscription removes a subscription of the client, it returns false
+// if the client has no such subscription.
+func (client *Client) removeSubscription(topic string) bool {
+	client.Mutex.Lock()
+	defer client.Mutex.Unlock()
+
+	i := slices.Index(client.Subscriptions, topic)
+	if i == -1 {
+		client.log.Debug("no subscription to unsubscribe", "topic_filter", topic)
+		return false
+	}
+
+	if len(client.Subscriptions) == 1 {
+		client.Subscriptions = []string{}
+	} else {
+		client.Subscriptions = slices.Delete(client.Subscriptions, i, i+1)
+	}
+	delete(client.subscriptionQoS, topic)
+	delete(client.noLocal, topic)
+	client.server.deleteSubscription(topic, client)
+	client.server.persistSession(client, time.Time{})
+	client.log.Debug("unsubscribed", "topic_filter", topic)
+	return true
+}
+
+// isValidTopicFilter reports whether the wildcards of filter are used
+// correctly (4.7.1).
+func isValidTopicFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		// MQTT-4.7.1-1: The multi-level wildcard must be the last level.
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+		// MQTT-4.7.1-2: The single-level wildcard must occupy a whole level.
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+	return true
+}
+
+// TODO: not very efficient probably
+func topicMatches(filter, name string) bool {
+	if filter == name {
+		return true
+	}
+
+	filterParts := strings.Split(filter, "/")
+	if filterParts[0] == "$share" && len(filterParts) > 3 {
+		filterParts = filterParts[2:]
+	}
+	nameParts := strings.Split(name, "/")
+
+	// MQTT-4.7.2-1: Topic names starting with $ are not matched by a
+	// wildcard at the first level.
+	if strings.HasPrefix(name, "$") && (filterParts[0] == "+" || filterParts[0] == "#") {
+		return false
+	}
+
+	for i := range filterParts {
+		if filterParts[i] == "+" && len(nameParts) > i {
+			nameParts[i] = "+"
+		}
+
+		if filterParts[i] == "#" && len(nameParts) > i {
+			nameParts[i] = "#"
+			nameParts = nameParts[:i+1]
+		}
+	}
+
+	if len(nameParts) != len(filterParts) {
+		return false
+	}
+
+	for i := range filterParts {
+		if nameParts[i] != filterParts[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Implements io.Writer
+// Write puts the packet bytes in a queue to be handled by
+// the client's writer routine. The packet is dropped if the
+// connection ends before it is queued, messages with QoS 1
+// and 2 are kept in the session until they are acknowledged.
+func (client *Client) Write(p []byte) (n int, err error) {
+	queue, ctx := client.sendQueue()
+	if queue == nil {
+		return 0, net.ErrClosed
+	}
+
+	select {
+	case queue <- p:
+		return len(p), nil
+	case <-ctx.Done():
+		return 0, net.ErrClosed
+	}
+}
+
+// sendQueue returns the send queue of the current connection of the client
+// and its context.
+func (client *Client) sendQueue() (chan []byte, context.Context) {
+	client.Mutex.Lock()
+	defer client.Mutex.Unlock()
+
+	return client.SendQueue, client.Ctx
+}
+
+// writer takes packets that have to be sent by this
+// client from a queue and writes them to conn.
+// It exits when ctx, the context of the connection, is cancelled
+// and closes done.
+//
+// Writing to a client is done like this to avoid mulitple
+// handlers accessing the connection and scrambling packets
+// that way. The connection, queue and context are those of one
+// connection, a session that is resumed gets a new writer.
+func (client *Client) writer(ctx context.Context, conn net.Conn, queue chan []byte, flushed chan struct{}, done chan struct{}) {
+	defer close(done)
+	for {
+		select {
+		case bytes, ok := <-queue:
+			if !ok {
+				return
+			}
+			// Queued by flush, all packets before it are written.
+			if bytes == nil {
+				select {
+				case flushed <- struct{}{}:
+				default:
+				}
+				break
+			}
+			client.writeMutex.Lock()
+			n, err := conn.Write(bytes)
+			client.writeMutex.Unlock()
+			if err != nil {
+				client.log.Warn("failed to write packet", "error", err)
+			} else if n != len(bytes) {
+				client.log.Warn("short write", "written", n, "size", len(bytes))
+			} else {
+				client.server.metrics.sent(bytes)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// drain writes the packets left in queue to conn, once the writer of the
+// connection has exited.
+func (client *Client) drain(conn net.Conn, queue chan []byte) {
+	client.writeMutex.Lock()
+	defer client.writeMutex.Unlock()
+
+	for {
+		select {
+		case bytes := <-queue:
+			if bytes == nil {
+				continue
+			}
+			_, err := conn.Write(bytes)
+			if err != nil {
+				client.log.Warn("failed to write packet", "error", err)
+				return
+			}
+			client.server.metrics.sent(bytes)
+		default:
+			return
+		}
+	}
+}
+
+// flush waits until the writer wrote all packets that are queued.
+func (client *Client) flush(ctx context.Context) error {
+	client.Mutex.Lock()
+	queue, connectionCtx, flushed := client.SendQueue, client.Ctx, client.flushed
+	client.Mutex.Unlock()
+
+	select {
+	case queue <- nil:
+	case <-connectionCtx.Done():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-flushed:
+		return nil
+	case <-connectionCtx.Done():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shutdown sends the queued packets and a DISCONNECT with reasonCode before
+// closing the connection. Writes are abandoned when ctx is done.
+func (client *Client) shutdown(ctx context.Context, reasonCode packet.ReasonCode) {
+	client.Mutex.Lock()
+	conn := client.Conn
+	client.Mutex.Unlock()
+	if conn == nil {
+		return
+	}
+
+	deadline, ok := ctx.Deadline()
+	if ok {
+		conn.SetWriteDeadline(deadline)
+	}
+
+	err := client.flush(ctx)
+	if err != nil {
+		client.log.Warn("failed to flush queued packets", "error", err)
+	}
+	client.sendDisconnect(conn, reasonCode)
+	// The connection handler disconnects the client when the connection closes.
+	conn.Close()
+}
+
+// sendDisconnect sends a DISCONNECT with reasonCode to the client on conn.
+// It is written to the connection directly, bypassing the send queue, so
+// that it is sent before the connection is closed.
+func (client *Client) sendDisconnect(conn net.Conn, reasonCode packet.ReasonCode) {
+	disconnectPacket := packet.DisconnectPacket{}
+	disconnectPacket.VariableHeader.ReasonCode = reasonCode
+	bytes, err := disconnectPacket.Encode()
+	if err != nil {
+		client.log.Error("failed to encode DISCONNECT packet", "error", err)
+		return
+	}
+
+	client.writeMutex.Lock()
+	defer client.writeMutex.Unlock()
+
+	_, err = conn.Write(bytes)
+	if err != nil {
+		client.log.Warn("failed to send DISCONNECT packet", "error", err)
+		return
+	}
+	client.server.metrics.sent(bytes)
+}
+
+func copyLastWill(p *packet.ConnectPacket) protocol.LastWill {
+	lastWill := protocol.LastWill{}
+	lastWill.WillFlag = p.VariableHeader.WillFlag
+	if lastWill.WillFlag {
+		lastWill.Properties.DelayInterval = time.Second *
+			time.Duration(p.Payload.WillProperties.DelayInterval.Value)
+		lastWill.Properties.CorrelationData = p.Payload.WillProperties.CorrelationData
+		lastWill.Properties.ContentType = p.Payload.WillProperties.ContentType
+		lastWill.Properties.MessageExpiryInterval = time.Second *
+			time.Duration(p.Payload.WillProperties.MessageExpiryInterval.Value)
+		lastWill.Properties.ReponseTopic = p.Payload.WillProperties.ResponseTopic
+		lastWill.Qos = p.VariableHeader.WillQos
+		lastWill.Payload = p.Payload.WillPayload
+		lastWill.Topic = p.Payload.WillTopic
+		lastWill.Retain = p.VariableHeader.WillRetain
+	}
+	return lastWill
+}
+
+func isSharedSubscription(topic string) bool {
+	parts := strings.Split(topic, "/")
+
+	if len(parts) < 3 {
+		return false
+	} else if parts[0] != "$share" {
+		return false
+	}
+
+	return true
+}
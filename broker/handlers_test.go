@@ -1,4 +1,4 @@
-package main
+package broker
 
 import "testing"
 
@@ -72,6 +72,26 @@ var cases = []struct {
 		name:   "foo/baz/bar/qux",
 		want:   true,
 	},
+	{
+		filter: "#",
+		name:   "$SYS/broker/uptime",
+		want:   false,
+	},
+	{
+		filter: "+/broker/uptime",
+		name:   "$SYS/broker/uptime",
+		want:   false,
+	},
+	{
+		filter: "$SYS/#",
+		name:   "$SYS/broker/uptime",
+		want:   true,
+	},
+	{
+		filter: "$SYS/+/uptime",
+		name:   "$SYS/broker/uptime",
+		want:   true,
+	},
 }
 
 func TestTopicMatching(t *testing.T) {
@@ -0,0 +1,190 @@
+package broker
+
+import (
+	"net"
+
+	"github.com/DvdSpijker/GoBroker/packet"
+)
+
+type (
+	// Hook is notified of broker events and can change how the broker handles
+	// some of them. Hooks are called in the order they were added with
+	// AddHook. A hook that rejects an event stops the hooks after it from
+	// being called for that event.
+	//
+	// Hooks are called synchronously from the connection handlers and must not
+	// block. Embed HookBase to only implement the callbacks that are needed.
+	Hook interface {
+		// OnConnectAuthenticate is called for a CONNECT that passed the
+		// authentication of the listener. Returning anything but Success
+		// refuses the connection with that reason code.
+		OnConnectAuthenticate(conn net.Conn, p *packet.ConnectPacket) packet.ReasonCode
+		// OnConnect is called when a client has connected.
+		OnConnect(client *Client, p *packet.ConnectPacket)
+		// OnDisconnect is called when the connection of a client closed.
+		OnDisconnect(client *Client)
+		// OnSubscribe is called for every filter of a SUBSCRIBE that the
+		// client is authorized for. Returning anything but Success refuses
+		// the subscription with that reason code.
+		OnSubscribe(client *Client, filter string) packet.ReasonCode
+		// OnUnsubscribe is called when a client removed a subscription.
+		OnUnsubscribe(client *Client, filter string)
+		// OnPublish is called for a message before it is retained and
+		// forwarded to subscribers, client is nil for messages published with
+		// Server.Publish. The topic name and payload of p can be changed.
+		// Returning anything but Success drops the message, the reason code
+		// is sent in the PUBACK of a QoS 1 message.
+		OnPublish(client *Client, p *packet.PublishPacket) packet.ReasonCode
+		// OnDeliver is called before a message is sent to a subscribed
+		// client, p is a copy for that client that can be changed.
+		// Returning false skips the client.
+		OnDeliver(client *Client, p *packet.PublishPacket) bool
+		// OnRetain is called when the retained message of a topic was
+		// replaced, p is nil if the retained message was removed.
+		OnRetain(topic string, p *packet.PublishPacket)
+		// OnWillPublish is called before the will message of a client is
+		// published. Returning false drops the will message.
+		OnWillPublish(client *Client, p *packet.PublishPacket) bool
+		// OnSessionExpired is called when the session of a client ended,
+		// which is when the connection closes unless the client set a
+		// session expiry interval.
+		OnSessionExpired(client *Client)
+	}
+
+	// HookBase implements Hook without doing anything, it is meant to be
+	// embedded in hooks.
+	HookBase struct{}
+)
+
+func (HookBase) OnConnectAuthenticate(conn net.Conn, p *packet.ConnectPacket) packet.ReasonCode {
+	return packet.Success
+}
+
+func (HookBase) OnConnect(client *Client, p *packet.ConnectPacket) {}
+
+func (HookBase) OnDisconnect(client *Client) {}
+
+func (HookBase) OnSubscribe(client *Client, filter string) packet.ReasonCode {
+	return packet.Success
+}
+
+func (HookBase) OnUnsubscribe(client *Client, filter string) {}
+
+func (HookBase) OnPublish(client *Client, p *packet.PublishPacket) packet.ReasonCode {
+	return packet.Success
+}
+
+func (HookBase) OnDeliver(client *Client, p *packet.PublishPacket) bool {
+	return true
+}
+
+func (HookBase) OnRetain(topic string, p *packet.PublishPacket) {}
+
+func (HookBase) OnWillPublish(client *Client, p *packet.PublishPacket) bool {
+	return true
+}
+
+func (HookBase) OnSessionExpired(client *Client) {}
+
+// AddHook adds a hook that is called after the hooks that were added before.
+func (server *Server) AddHook(hook Hook) {
+	server.hooksMutex.Lock()
+	defer server.hooksMutex.Unlock()
+
+	// Copy on write, so the slice can be iterated without holding the lock.
+	server.hooks = append(server.hooks[:len(server.hooks):len(server.hooks)], hook)
+}
+
+func (server *Server) getHooks() []Hook {
+	server.hooksMutex.Lock()
+	defer server.hooksMutex.Unlock()
+	return server.hooks
+}
+
+func (server *Server) onConnectAuthenticate(conn net.Conn, p *packet.ConnectPacket) packet.ReasonCode {
+	for _, hook := range server.getHooks() {
+		reasonCode := hook.OnConnectAuthenticate(conn, p)
+		if reasonCode != packet.Success {
+			return reasonCode
+		}
+	}
+	return packet.Success
+}
+
+func (server *Server) onConnect(client *Client, p *packet.ConnectPacket) {
+	for _, hook := range server.getHooks() {
+		hook.OnConnect(client, p)
+	}
+}
+
+func (server *Server) onDisconnect(client *Client) {
+	for _, hook := range server.getHooks() {
+		hook.OnDisconnect(client)
+	}
+}
+
+func (server *Server) onSubscribe(client *Client, filter string) packet.ReasonCode {
+	for _, hook := range server.getHooks() {
+		reasonCode := hook.OnSubscribe(client, filter)
+		if reasonCode != packet.Success {
+			return reasonCode
+		}
+	}
+	return packet.Success
+}
+
+func (server *Server) onUnsubscribe(client *Client, filter string) {
+	for _, hook := range server.getHooks() {
+		hook.OnUnsubscribe(client, filter)
+	}
+}
+
+func (server *Server) onPublish(client *Client, p *packet.PublishPacket) packet.ReasonCode {
+	for _, hook := range server.getHooks() {
+		reasonCode := hook.OnPublish(client, p)
+		if reasonCode != packet.Success {
+			return reasonCode
+		}
+	}
+	return packet.Success
+}
+
+// onDeliver returns the packet to deliver to client, or false if a hook
+// skips the client.
+func (server *Server) onDeliver(client *Client, p *packet.PublishPacket) (*packet.PublishPacket, bool) {
+	hooks := server.getHooks()
+	if len(hooks) == 0 {
+		return p, true
+	}
+
+	// The subscribers are delivered to concurrently, every delivery gets its
+	// own copy so that a hook can change it for one subscriber only.
+	p = copyPublishPacket(p)
+	for _, hook := range hooks {
+		if !hook.OnDeliver(client, p) {
+			return nil, false
+		}
+	}
+	return p, true
+}
+
+func (server *Server) onRetain(topic string, p *packet.PublishPacket) {
+	for _, hook := range server.getHooks() {
+		hook.OnRetain(topic, p)
+	}
+}
+
+func (server *Server) onWillPublish(client *Client, p *packet.PublishPacket) bool {
+	for _, hook := range server.getHooks() {
+		if !hook.OnWillPublish(client, p) {
+			return false
+		}
+	}
+	return true
+}
+
+func (server *Server) onSessionExpired(client *Client) {
+	for _, hook := range server.getHooks() {
+		hook.OnSessionExpired(client)
+	}
+}
@@ -0,0 +1,309 @@
+package broker
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/packet"
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+// recordingHook sends the events it is called for to a channel.
+type recordingHook struct {
+	HookBase
+	name   string
+	events chan string
+}
+
+func (hook *recordingHook) record(event string, detail string) {
+	hook.events <- hook.name + " " + event + " " + detail
+}
+
+func (hook *recordingHook) OnConnect(client *Client, p *packet.ConnectPacket) {
+	hook.record("connect", client.ID)
+}
+
+func (hook *recordingHook) OnDisconnect(client *Client) {
+	hook.record("disconnect", client.ID)
+}
+
+func (hook *recordingHook) OnSubscribe(client *Client, filter string) packet.ReasonCode {
+	hook.record("subscribe", filter)
+	return packet.Success
+}
+
+func (hook *recordingHook) OnUnsubscribe(client *Client, filter string) {
+	hook.record("unsubscribe", filter)
+}
+
+func (hook *recordingHook) OnPublish(client *Client, p *packet.PublishPacket) packet.ReasonCode {
+	hook.record("publish", string(p.Payload.Data))
+	return packet.Success
+}
+
+func (hook *recordingHook) OnDeliver(client *Client, p *packet.PublishPacket) bool {
+	hook.record("deliver", client.ID)
+	return true
+}
+
+func (hook *recordingHook) OnRetain(topic string, p *packet.PublishPacket) {
+	hook.record("retain", topic+" "+fmtBool(p != nil))
+}
+
+func (hook *recordingHook) OnWillPublish(client *Client, p *packet.PublishPacket) bool {
+	hook.record("will", client.ID)
+	return true
+}
+
+func (hook *recordingHook) OnSessionExpired(client *Client) {
+	hook.record("expired", client.ID)
+}
+
+func fmtBool(b bool) string {
+	if b {
+		return "stored"
+	}
+	return "removed"
+}
+
+// policyHook rejects and modifies events.
+type policyHook struct {
+	HookBase
+}
+
+func (policyHook) OnConnectAuthenticate(conn net.Conn, p *packet.ConnectPacket) packet.ReasonCode {
+	if p.Payload.ClientId.String() == "banned" {
+		return packet.Banned
+	}
+	return packet.Success
+}
+
+func (policyHook) OnSubscribe(client *Client, filter string) packet.ReasonCode {
+	if strings.HasPrefix(filter, "private/") {
+		return packet.NotAuthorized
+	}
+	return packet.Success
+}
+
+func (policyHook) OnPublish(client *Client, p *packet.PublishPacket) packet.ReasonCode {
+	switch p.VariableHeader.TopicName.String() {
+	case "quota":
+		return packet.QuotaExceeded
+	case "wildcard":
+		p.VariableHeader.TopicName = types.UtfString{Str: "wildcard/#"}
+	case "sys":
+		p.VariableHeader.TopicName = types.UtfString{Str: "$SYS/broker/version"}
+	}
+	p.Payload.Data = bytes.ToUpper(p.Payload.Data)
+	return packet.Success
+}
+
+func (policyHook) OnDeliver(client *Client, p *packet.PublishPacket) bool {
+	if client.ID == "quiet" {
+		copy(p.Payload.Data, bytes.ToLower(p.Payload.Data))
+	}
+	return client.ID != "deaf"
+}
+
+func (policyHook) OnWillPublish(client *Client, p *packet.PublishPacket) bool {
+	return client.ID != "silent"
+}
+
+// expectEvents reads events until the wanted events were received in order,
+// other events are skipped.
+func expectEvents(t *testing.T, events chan string, want ...string) {
+	t.Helper()
+
+	for _, event := range want {
+	wait:
+		for {
+			select {
+			case got := <-events:
+				if got == event {
+					break wait
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("event %q not received", event)
+			}
+		}
+	}
+}
+
+// fourByteProperty encodes a property with a four byte integer value.
+func fourByteProperty(identifier packet.PropertyIdentifier, value uint32) []byte {
+	return []byte{byte(identifier), byte(value >> 24), byte(value >> 16), byte(value >> 8), byte(value)}
+}
+
+// willConnectPacket creates a CONNECT packet with a will message. The will
+// delay and session expiry interval are in seconds.
+func willConnectPacket(clientID string, topic string, payload string, willDelay uint32, sessionExpiry uint32) []byte {
+	properties := fourByteProperty(packet.SessionExpiryIntervalProperty, sessionExpiry)
+	willProperties := fourByteProperty(packet.WillDelayIntervalProperty, willDelay)
+
+	body := utfString("MQTT")
+	body = append(body, 5, 0x02|0x04, 0, 60, byte(len(properties)))
+	body = append(body, properties...)
+	body = append(body, utfString(clientID)...)
+	body = append(body, byte(len(willProperties)))
+	body = append(body, willProperties...)
+	body = append(body, utfString(topic)...)
+	body = append(body, utfString(payload)...)
+
+	return withRemainingLength(byte(packet.CONNECT), body)
+}
+
+func TestHookOrder(t *testing.T) {
+	server, address := startServer(t, Config{})
+	events := make(chan string, 100)
+	server.AddHook(&recordingHook{name: "first", events: events})
+	server.AddHook(&recordingHook{name: "second", events: events})
+
+	client := connectClient(t, address, "hooked")
+	expectEvents(t, events, "first connect hooked", "second connect hooked")
+
+	client.subscribe("a/+")
+	expectEvents(t, events, "first subscribe a/+", "second subscribe a/+")
+
+	client.publish("a/b", "hello")
+	expectEvents(t, events, "first publish hello", "second publish hello",
+		"first deliver hooked", "second deliver hooked")
+
+	err := server.Publish("r", []byte("retained"), types.QoS0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.Publish("r", nil, types.QoS0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEvents(t, events, "first retain r stored", "second retain r stored",
+		"first retain r removed", "second retain r removed")
+
+	client.write(withRemainingLength(byte(packet.UNSUBSCRIBE)|0x02, append([]byte{0, 2, 0}, utfString("a/+")...)))
+	expectEvents(t, events, "first unsubscribe a/+", "second unsubscribe a/+")
+
+	client.conn.Close()
+	expectEvents(t, events, "first disconnect hooked", "second disconnect hooked",
+		"first expired hooked", "second expired hooked")
+}
+
+func TestHookPolicy(t *testing.T) {
+	server, address := startServer(t, Config{})
+	server.AddHook(policyHook{})
+
+	t.Run("connect", func(t *testing.T) {
+		client := dialClient(t, address)
+		if got := client.connect("banned", "", ""); got != packet.Banned {
+			t.Fatalf("wanted reason code %x but got %x", packet.Banned, got)
+		}
+	})
+
+	t.Run("subscribe", func(t *testing.T) {
+		client := connectClient(t, address, "subscriber")
+		if got := client.subscribe("private/a"); got != packet.NotAuthorized {
+			t.Fatalf("wanted reason code %x but got %x", packet.NotAuthorized, got)
+		}
+	})
+
+	t.Run("publish", func(t *testing.T) {
+		received := make(chan Message, 10)
+		unsubscribe := server.Subscribe("#", func(m Message) { received <- m })
+		defer unsubscribe()
+
+		deaf := connectClient(t, address, "deaf")
+		deaf.subscribe("quota")
+		deaf.subscribe("loud")
+		quiet := connectClient(t, address, "quiet")
+		quiet.subscribe("loud")
+		listener := connectClient(t, address, "listener")
+		listener.subscribe("loud")
+
+		publisher := connectClient(t, address, "publisher")
+		if got := publisher.publishQoS1("quota", "dropped"); got != packet.QuotaExceeded {
+			t.Fatalf("wanted reason code %x but got %x", packet.QuotaExceeded, got)
+		}
+		// The topic a hook changes to is checked like the topic of the client.
+		if got := publisher.publishQoS1("wildcard", "dropped"); got != packet.TopicNameInvalid {
+			t.Fatalf("wanted reason code %x but got %x", packet.TopicNameInvalid, got)
+		}
+		if got := publisher.publishQoS1("sys", "dropped"); got != packet.NotAuthorized {
+			t.Fatalf("wanted reason code %x but got %x", packet.NotAuthorized, got)
+		}
+		if err := server.Publish("wildcard", []byte("dropped"), types.QoS0, false); !errors.Is(err, ErrInvalidTopicName) {
+			t.Fatalf("wanted %v but got %v", ErrInvalidTopicName, err)
+		}
+		if got := publisher.publishQoS1("loud", "hello"); got != packet.Success {
+			t.Fatalf("wanted reason code %x but got %x", packet.Success, got)
+		}
+
+		select {
+		case m := <-received:
+			if m.Topic != "loud" || string(m.Payload) != "HELLO" {
+				t.Fatalf("wanted the modified message but got %s on %s", m.Payload, m.Topic)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("message not published")
+		}
+
+		// A change by OnDeliver only affects the delivery to one client.
+		if got := string(quiet.readPublish().Payload.Data); got != "hello" {
+			t.Fatalf("wanted the message changed for quiet but got %s", got)
+		}
+		if got := string(listener.readPublish().Payload.Data); got != "HELLO" {
+			t.Fatalf("wanted the unchanged message but got %s", got)
+		}
+
+		deaf.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, _, err := deaf.framer.readPacket()
+		if err == nil {
+			t.Fatal("wanted no message to be delivered to the deaf client")
+		}
+	})
+
+	t.Run("will", func(t *testing.T) {
+		received := make(chan Message, 10)
+		unsubscribe := server.Subscribe("wills/#", func(m Message) { received <- m })
+		defer unsubscribe()
+
+		for _, clientID := range []string{"silent", "loud"} {
+			client := dialClient(t, address)
+			client.write(willConnectPacket(clientID, "wills/"+clientID, "gone", 0, 0))
+			client.read()
+			client.conn.Close()
+		}
+
+		select {
+		case m := <-received:
+			if m.Topic != "wills/loud" {
+				t.Fatalf("wanted only the will of loud but got %s", m.Topic)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("will not published")
+		}
+	})
+}
+
+func TestHookSessionExpiry(t *testing.T) {
+	server, address := startServer(t, Config{})
+	events := make(chan string, 100)
+	server.AddHook(&recordingHook{name: "hook", events: events})
+
+	client := dialClient(t, address)
+	client.write(willConnectPacket("kept", "wills/kept", "gone", 60, 1))
+	client.read()
+	client.conn.Close()
+
+	// The will is delayed longer than the session is kept, so it is
+	// published when the session ends.
+	expectEvents(t, events, "hook disconnect kept")
+	select {
+	case event := <-events:
+		t.Fatalf("wanted the session to be kept but got %q", event)
+	case <-time.After(500 * time.Millisecond):
+	}
+	expectEvents(t, events, "hook will kept", "hook expired kept")
+}
@@ -0,0 +1,401 @@
+package broker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/DvdSpijker/GoBroker/auth"
+	"github.com/DvdSpijker/GoBroker/packet"
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+// Headers of the HTTP endpoints, every header can also be sent as the query
+// parameter in the comment, which takes precedence.
+const (
+	headerClientID     = "MQTT-Client-ID"     // client_id: client ID for authorization and hooks.
+	headerQoS          = "MQTT-QoS"           // qos: 0, 1 or 2.
+	headerRetain       = "MQTT-Retain"        // retain: true or false.
+	headerUTF8Payload  = "MQTT-UTF8-Payload"  // utf8: true sets the payload format indicator.
+	headerUserProperty = "MQTT-User-Property" // user_property: name=value, repeated for every property.
+	headerContentType  = "Content-Type"       // content_type
+)
+
+// Formats of the messages streamed to HTTP subscribers.
+const (
+	streamSSE    = "sse"    // Server-Sent Events, the default for requests that accept text/event-stream.
+	streamNDJSON = "ndjson" // A JSON object per line, the default otherwise.
+)
+
+// streamKeepAliveInterval is the time between comments sent to idle
+// Server-Sent Events streams, so that proxies keep them open.
+const streamKeepAliveInterval = 30 * time.Second
+
+// streamMessage is a message as streamed to HTTP subscribers. The payload is
+// a string if the payload format indicator marks it as UTF-8, and base64
+// encoded otherwise.
+type streamMessage struct {
+	Topic      string             `json:"topic"`
+	Payload    string             `json:"payload"`
+	Encoding   string             `json:"encoding"` // utf8 or base64
+	QoS        types.QoS          `json:"qos"`
+	Retain     bool               `json:"retain"`
+	Properties *MessageProperties `json:"properties,omitempty"`
+}
+
+// httpHandler returns the handler of HTTP listeners. Requests authenticate
+// with the credentials of an MQTT client: the user name and password as
+// basic authentication, or a JSON Web Token as bearer token or as the
+// access_token query parameter, which browsers can send with EventSource.
+func (l *listener) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /topics/{topic...}", l.handleHTTPPublish)
+	mux.HandleFunc("GET /topics/{topic...}", l.handleHTTPRetained)
+	mux.HandleFunc("GET /subscribe", l.handleHTTPSubscribe)
+	return mux
+}
+
+// authenticateHTTP verifies the credentials of a request as those of a
+// CONNECT packet and returns the client that the request acts as. The
+// client has no session and is only used to authorize the request and to
+// pass to hooks. An error response is written if it returns false.
+func (l *listener) authenticateHTTP(w http.ResponseWriter, r *http.Request) (*Client, bool) {
+	connectPacket := packet.ConnectPacket{}
+	connectPacket.VariableHeader.Version = 5
+	if userName, password, ok := r.BasicAuth(); ok {
+		connectPacket.VariableHeader.UserNameFlag = true
+		connectPacket.Payload.UserName.Str = userName
+		connectPacket.VariableHeader.PasswordFlag = true
+		connectPacket.Payload.Password.Data = []byte(password)
+	} else if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		connectPacket.VariableHeader.PasswordFlag = true
+		connectPacket.Payload.Password.Data = []byte(bearer)
+	} else if r.URL.Query().Has("access_token") {
+		connectPacket.VariableHeader.PasswordFlag = true
+		connectPacket.Payload.Password.Data = []byte(r.URL.Query().Get("access_token"))
+	}
+
+	log := l.server.logs.auth.With("remote_addr", r.RemoteAddr, "method", r.Method, "path", r.URL.Path)
+	token, reasonCode := l.checkConnect(&connectPacket)
+	if reasonCode != packet.Success {
+		log.Info("refused HTTP request", reasonCodeAttr(reasonCode))
+		w.Header().Set("WWW-Authenticate", `Basic realm="gobroker"`)
+		writeAdminError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return nil, false
+	}
+
+	userName := connectPacket.Payload.UserName.String()
+	clientID := httpParameter(r, "client_id", headerClientID)
+	if token != nil {
+		userName = token.UserName
+		clientID, _, reasonCode = tokenClientID(token, clientID)
+		if reasonCode != packet.Success {
+			log.Info("client ID does not match the token", "client_id", clientID)
+			writeAdminError(w, http.StatusForbidden, errors.New("client ID does not match the token"))
+			return nil, false
+		}
+	}
+	if clientID == "" {
+		clientID = newClientID()
+	}
+
+	client := newClient(clientID, l.server)
+	client.UserName = userName
+	client.listener = l
+	client.token = token
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		client.Certificate = r.TLS.VerifiedChains[0][0]
+	}
+	return client, true
+}
+
+// handleHTTPPublish publishes the body of the request to the topic of the
+// path, as if the client of the request published it.
+func (l *listener) handleHTTPPublish(w http.ResponseWriter, r *http.Request) {
+	client, ok := l.authenticateHTTP(w, r)
+	if !ok {
+		return
+	}
+
+	message, err := parseHTTPMessage(r)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	limit := int64(maxRemainingLength)
+	if l.config.Limits.MaxPacketSize > 0 {
+		limit = int64(l.config.Limits.MaxPacketSize)
+	}
+	message.Payload, err = io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	var maxBytesError *http.MaxBytesError
+	if errors.As(err, &maxBytesError) {
+		writeAdminError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// MQTT-3.3.2-4: A payload with the UTF-8 format indicator is UTF-8.
+	if message.Properties != nil && message.Properties.UTF8Payload && !utf8.Valid(message.Payload) {
+		writeAdminError(w, http.StatusBadRequest, errors.New("payload is not valid UTF-8"))
+		return
+	}
+
+	err = l.server.publishMessage(client, message)
+	if err != nil {
+		client.log.Info("HTTP publish failed", "topic", message.Topic, "error", err)
+	} else {
+		client.log.Debug("published over HTTP", "topic", message.Topic, "qos", message.Qos,
+			"retain", message.Retain, "remote_addr", r.RemoteAddr)
+	}
+	writeAdminResult(w, err)
+}
+
+// handleHTTPRetained writes the retained message of the topic of the path,
+// with the payload as body and the properties as headers.
+func (l *listener) handleHTTPRetained(w http.ResponseWriter, r *http.Request) {
+	client, ok := l.authenticateHTTP(w, r)
+	if !ok {
+		return
+	}
+
+	topic := r.PathValue("topic")
+	err := checkTopicName(topic)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !client.authorized(auth.Read, topic) {
+		client.log.Info("not authorized to read retained message", "topic", topic)
+		writeAdminError(w, http.StatusForbidden, fmt.Errorf("%w: %s", ErrNotAuthorized, topic))
+		return
+	}
+
+	messages := l.server.RetainedMessages(topic)
+	if len(messages) == 0 {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("no retained message: %s", topic))
+		return
+	}
+	message := messages[0]
+
+	header := w.Header()
+	header.Set(headerContentType, "application/octet-stream")
+	header.Set(headerQoS, strconv.Itoa(int(message.Qos)))
+	header.Set(headerRetain, "true")
+	if properties := message.Properties; properties != nil {
+		if properties.ContentType != "" {
+			header.Set(headerContentType, properties.ContentType)
+		}
+		if properties.UTF8Payload {
+			header.Set(headerUTF8Payload, "true")
+		}
+		for _, userProperty := range properties.UserProperties {
+			header.Add(headerUserProperty, userProperty.Name+"="+userProperty.Value)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(message.Payload)
+}
+
+// handleHTTPSubscribe streams the messages of the topics matching the filter
+// query parameters, which can be repeated, until the request is cancelled or
+// the server closes. The retained messages of the filters are sent first.
+func (l *listener) handleHTTPSubscribe(w http.ResponseWriter, r *http.Request) {
+	client, ok := l.authenticateHTTP(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	filters := query["filter"]
+	if len(filters) == 0 {
+		writeAdminError(w, http.StatusBadRequest, errors.New("no filter"))
+		return
+	}
+	format := query.Get("format")
+	if format == "" {
+		format = streamNDJSON
+		if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			format = streamSSE
+		}
+	}
+	if format != streamSSE && format != streamNDJSON {
+		writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid format: %q", format))
+		return
+	}
+	for _, filter := range filters {
+		if !isValidTopicFilter(filter) || isSharedSubscription(filter) {
+			writeAdminError(w, http.StatusBadRequest, fmt.Errorf("invalid filter: %q", filter))
+			return
+		}
+		if !client.authorized(auth.Read, filter) {
+			client.log.Info("not authorized to subscribe", "topic_filter", filter)
+			writeAdminError(w, http.StatusForbidden, fmt.Errorf("%w: %s", ErrNotAuthorized, filter))
+			return
+		}
+		reasonCode := l.server.onSubscribe(client, filter)
+		if reasonCode != packet.Success {
+			client.log.Info("subscription rejected by hook", "topic_filter", filter, reasonCodeAttr(reasonCode))
+			writeAdminError(w, http.StatusForbidden, fmt.Errorf("subscription rejected: %s", filter))
+			return
+		}
+	}
+
+	// Messages are queued by the publishing routines, which must not
+	// block, and dropped when the subscriber does not keep up.
+	messages := make(chan Message, l.server.config.SendQueueSize)
+	for _, filter := range filters {
+		unsubscribe := l.server.Subscribe(filter, func(message Message) {
+			// Like a subscription without Retain As Published.
+			message.Retain = false
+			select {
+			case messages <- message:
+			default:
+				client.log.Warn("HTTP subscriber does not keep up, dropped message", "topic", message.Topic)
+				l.server.metrics.drop(dropStreamFull)
+			}
+		})
+		defer unsubscribe()
+	}
+
+	header := w.Header()
+	header.Set("Cache-Control", "no-cache")
+	if format == streamSSE {
+		header.Set(headerContentType, "text/event-stream")
+	} else {
+		header.Set(headerContentType, "application/x-ndjson")
+	}
+	w.WriteHeader(http.StatusOK)
+	controller := http.NewResponseController(w)
+	client.log.Debug("HTTP subscriber connected", "topic_filters", filters, "format", format,
+		"remote_addr", r.RemoteAddr)
+
+	send := func(message Message) error {
+		data, err := json.Marshal(makeStreamMessage(message))
+		if err != nil {
+			return err
+		}
+		if format == streamSSE {
+			_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+		} else {
+			_, err = fmt.Fprintf(w, "%s\n", data)
+		}
+		if err != nil {
+			return err
+		}
+		return controller.Flush()
+	}
+
+	var err error
+	for _, filter := range filters {
+		for _, message := range l.server.RetainedMessages(filter) {
+			if err == nil {
+				err = send(message)
+			}
+		}
+	}
+	if err == nil {
+		err = controller.Flush()
+	}
+
+	keepAlive := time.NewTicker(streamKeepAliveInterval)
+	defer keepAlive.Stop()
+	for err == nil {
+		select {
+		case message := <-messages:
+			err = send(message)
+		case <-keepAlive.C:
+			if format == streamSSE {
+				_, err = io.WriteString(w, ": keep-alive\n\n")
+				if err == nil {
+					err = controller.Flush()
+				}
+			}
+		case <-r.Context().Done():
+			err = r.Context().Err()
+		case <-l.server.done:
+			err = ErrServerClosed
+		}
+	}
+	client.log.Debug("HTTP subscriber disconnected", "error", err)
+}
+
+// makeStreamMessage makes the streamed form of message.
+func makeStreamMessage(message Message) streamMessage {
+	streamed := streamMessage{
+		Topic:      message.Topic,
+		QoS:        message.Qos,
+		Retain:     message.Retain,
+		Properties: message.Properties,
+	}
+	if message.Properties != nil && message.Properties.UTF8Payload {
+		streamed.Payload = string(message.Payload)
+		streamed.Encoding = "utf8"
+	} else {
+		streamed.Payload = base64.StdEncoding.EncodeToString(message.Payload)
+		streamed.Encoding = "base64"
+	}
+	return streamed
+}
+
+// parseHTTPMessage returns the message of a publish request without its
+// payload.
+func parseHTTPMessage(r *http.Request) (Message, error) {
+	message := Message{Topic: r.PathValue("topic")}
+
+	var err error
+	message.Qos, err = parseQoS(httpParameter(r, "qos", headerQoS))
+	if err != nil {
+		return Message{}, err
+	}
+	message.Retain, err = parseHTTPBool(httpParameter(r, "retain", headerRetain))
+	if err != nil {
+		return Message{}, fmt.Errorf("invalid retain: %w", err)
+	}
+
+	properties := &MessageProperties{ContentType: httpParameter(r, "content_type", headerContentType)}
+	properties.UTF8Payload, err = parseHTTPBool(httpParameter(r, "utf8", headerUTF8Payload))
+	if err != nil {
+		return Message{}, fmt.Errorf("invalid utf8: %w", err)
+	}
+	userProperties := slices.Concat(r.Header.Values(headerUserProperty), r.URL.Query()["user_property"])
+	for _, userProperty := range userProperties {
+		name, value, ok := strings.Cut(userProperty, "=")
+		if !ok || name == "" {
+			return Message{}, fmt.Errorf("invalid user property, wanted name=value: %q", userProperty)
+		}
+		properties.UserProperties = append(properties.UserProperties, UserProperty{Name: name, Value: value})
+	}
+	if properties.ContentType != "" || properties.UTF8Payload || len(properties.UserProperties) > 0 {
+		message.Properties = properties
+	}
+	return message, nil
+}
+
+// httpParameter returns the query parameter query, or the header if the
+// query parameter is not set.
+func httpParameter(r *http.Request, query string, header string) string {
+	values := r.URL.Query()
+	if values.Has(query) {
+		return values.Get(query)
+	}
+	return r.Header.Get(header)
+}
+
+// parseHTTPBool parses a boolean parameter, which defaults to false.
+func parseHTTPBool(value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
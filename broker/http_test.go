@@ -0,0 +1,377 @@
+package broker
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/auth"
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+// startHTTPListener serves an HTTP listener with config on a local port and
+// returns its base URL.
+func startHTTPListener(t *testing.T, server *Server, config ListenerConfig) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Type = ListenerHTTP
+	go server.ServeListener(ln, config)
+	return "http://" + ln.Addr().String()
+}
+
+// httpRequest sends a request with headers and returns the status code and
+// body of the response.
+func httpRequest(t *testing.T, method string, url string, body string, headers map[string]string) (int, string) {
+	t.Helper()
+
+	r, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	response, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	bytes, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response.StatusCode, string(bytes)
+}
+
+func receiveMessage(t *testing.T, received chan Message) Message {
+	t.Helper()
+
+	select {
+	case message := <-received:
+		return message
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the message")
+	}
+	return Message{}
+}
+
+func TestHTTPPublish(t *testing.T) {
+	server, _ := startServer(t, Config{})
+	url := startHTTPListener(t, server, ListenerConfig{})
+	received := make(chan Message, 1)
+	server.Subscribe("http/#", func(message Message) { received <- message })
+
+	status, body := httpRequest(t, http.MethodPost, url+"/topics/http/headers", `{"on":true}`, map[string]string{
+		"Content-Type":       "application/json",
+		"MQTT-QoS":           "1",
+		"MQTT-User-Property": "source=test",
+	})
+	if status != http.StatusNoContent {
+		t.Fatalf("wanted status %d but got %d: %s", http.StatusNoContent, status, body)
+	}
+	message := receiveMessage(t, received)
+	if message.Topic != "http/headers" || string(message.Payload) != `{"on":true}` || message.Qos != types.QoS1 {
+		t.Fatalf("wanted the message on http/headers with QoS 1 but got %+v", message)
+	}
+	if message.Properties == nil || message.Properties.ContentType != "application/json" ||
+		len(message.Properties.UserProperties) != 1 ||
+		message.Properties.UserProperties[0] != (UserProperty{Name: "source", Value: "test"}) {
+		t.Fatalf("wanted the properties of the headers but got %+v", message.Properties)
+	}
+
+	// Query parameters take precedence over headers.
+	status, body = httpRequest(t, http.MethodPost, url+"/topics/http/query?qos=2&retain=true&utf8=true&user_property=a=b",
+		"21.5", map[string]string{"MQTT-QoS": "0"})
+	if status != http.StatusNoContent {
+		t.Fatalf("wanted status %d but got %d: %s", http.StatusNoContent, status, body)
+	}
+	message = receiveMessage(t, received)
+	if message.Qos != types.QoS2 || !message.Retain || message.Properties == nil || !message.Properties.UTF8Payload {
+		t.Fatalf("wanted a retained UTF-8 message with QoS 2 but got %+v", message)
+	}
+
+	request, err := http.NewRequest(http.MethodGet, url+"/topics/http/query", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	payload, _ := io.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK || string(payload) != "21.5" {
+		t.Fatalf("wanted the retained message but got %d: %s", response.StatusCode, payload)
+	}
+	if response.Header.Get("MQTT-QoS") != "2" || response.Header.Get("MQTT-UTF8-Payload") != "true" ||
+		response.Header.Get("MQTT-User-Property") != "a=b" {
+		t.Fatalf("wanted the properties as headers but got %v", response.Header)
+	}
+}
+
+var httpPublishErrorCases = []struct {
+	name    string
+	method  string
+	path    string
+	body    string
+	headers map[string]string
+	want    int
+}{
+	{name: "invalid QoS", method: http.MethodPost, path: "/topics/a?qos=3", want: http.StatusBadRequest},
+	{name: "invalid retain", method: http.MethodPost, path: "/topics/a?retain=maybe", want: http.StatusBadRequest},
+	{name: "invalid user property", method: http.MethodPost, path: "/topics/a?user_property=name", want: http.StatusBadRequest},
+	{name: "wildcard topic", method: http.MethodPost, path: "/topics/a/%23", want: http.StatusBadRequest},
+	{name: "invalid UTF-8", method: http.MethodPost, path: "/topics/a?utf8=true", body: "\xff", want: http.StatusBadRequest},
+	{name: "$SYS topic", method: http.MethodPost, path: "/topics/$SYS/broker/version", want: http.StatusForbidden},
+	{name: "rejected by hook", method: http.MethodPost, path: "/topics/quota", want: http.StatusForbidden},
+	{name: "no retained message", method: http.MethodGet, path: "/topics/none", want: http.StatusNotFound},
+	{name: "unknown path", method: http.MethodPost, path: "/publish", want: http.StatusNotFound},
+}
+
+func TestHTTPPublishErrors(t *testing.T) {
+	server, _ := startServer(t, Config{})
+	server.AddHook(policyHook{})
+	url := startHTTPListener(t, server, ListenerConfig{})
+
+	for _, c := range httpPublishErrorCases {
+		t.Run(c.name, func(t *testing.T) {
+			status, body := httpRequest(t, c.method, url+c.path, c.body, c.headers)
+			if status != c.want {
+				t.Fatalf("wanted status %d but got %d: %s", c.want, status, body)
+			}
+		})
+	}
+}
+
+func TestHTTPAuthentication(t *testing.T) {
+	directory := t.TempDir()
+	passwordFile := filepath.Join(directory, "passwords")
+	entries, err := auth.SetPassword(nil, "alice", []byte("secret"), auth.BcryptHasher(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = auth.WritePasswordEntries(passwordFile, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aclFile := filepath.Join(directory, "acl")
+	err = os.WriteFile(aclFile, []byte("user alice\ntopic write public/#\ntopic read status\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, _ := startServer(t, Config{})
+	url := startHTTPListener(t, server, ListenerConfig{
+		Authentication: AuthenticationConfig{PasswordFile: passwordFile},
+		Authorization:  AuthorizationConfig{ACLFile: aclFile},
+	})
+	server.SetRetainedMessage("status", []byte("up"), types.QoS0)
+	server.SetRetainedMessage("secret", []byte("hidden"), types.QoS0)
+
+	publish := func(topic string, userName string, password string) int {
+		r, err := http.NewRequest(http.MethodPost, url+"/topics/"+topic, strings.NewReader("x"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if userName != "" {
+			r.SetBasicAuth(userName, password)
+		}
+		response, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		return response.StatusCode
+	}
+
+	authenticationCases := []struct {
+		name     string
+		topic    string
+		userName string
+		password string
+		want     int
+	}{
+		{name: "valid credentials", topic: "public/a", userName: "alice", password: "secret", want: http.StatusNoContent},
+		{name: "wrong password", topic: "public/a", userName: "alice", password: "guess", want: http.StatusUnauthorized},
+		{name: "anonymous", topic: "public/a", want: http.StatusUnauthorized},
+		{name: "not authorized", topic: "private/a", userName: "alice", password: "secret", want: http.StatusForbidden},
+	}
+	for _, c := range authenticationCases {
+		if got := publish(c.topic, c.userName, c.password); got != c.want {
+			t.Fatalf("%s: wanted status %d but got %d", c.name, c.want, got)
+		}
+	}
+
+	for topic, want := range map[string]int{"status": http.StatusOK, "secret": http.StatusForbidden} {
+		r, err := http.NewRequest(http.MethodGet, url+"/topics/"+topic, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.SetBasicAuth("alice", "secret")
+		response, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		if response.StatusCode != want {
+			t.Fatalf("%s: wanted status %d but got %d", topic, want, response.StatusCode)
+		}
+	}
+}
+
+// openStream starts a subscription request and returns a reader of the
+// streamed lines.
+func openStream(t *testing.T, url string, headers map[string]string) (*http.Response, *bufio.Reader) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	response, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { response.Body.Close() })
+	return response, bufio.NewReader(response.Body)
+}
+
+// readStreamMessage reads the next message of an NDJSON stream, or of a
+// Server-Sent Events stream if sse is set.
+func readStreamMessage(t *testing.T, reader *bufio.Reader, sse bool) streamMessage {
+	t.Helper()
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sse {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			t.Fatalf("wanted a data field but got %q", line)
+		}
+		line = data
+		if blank, _ := reader.ReadString('\n'); blank != "\n" {
+			t.Fatalf("wanted a blank line after the event but got %q", blank)
+		}
+	}
+	message := streamMessage{}
+	err = json.Unmarshal([]byte(line), &message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+func TestHTTPSubscribe(t *testing.T) {
+	server, _ := startServer(t, Config{})
+	url := startHTTPListener(t, server, ListenerConfig{})
+	server.SetRetainedMessage("stream/retained", []byte{0xff, 0x00}, types.QoS1)
+
+	response, reader := openStream(t, url+"/subscribe?filter=stream/%2B&filter=other", nil)
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("wanted an NDJSON stream but got %d %s", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+
+	// The retained message is sent first and was subscribed before.
+	message := readStreamMessage(t, reader, false)
+	if message.Topic != "stream/retained" || !message.Retain || message.QoS != types.QoS1 ||
+		message.Encoding != "base64" || message.Payload != base64.StdEncoding.EncodeToString([]byte{0xff, 0x00}) {
+		t.Fatalf("wanted the retained message in base64 but got %+v", message)
+	}
+
+	err := server.PublishMessage(Message{
+		Topic:      "stream/live",
+		Payload:    []byte("héllo"),
+		Retain:     true,
+		Properties: &MessageProperties{UTF8Payload: true, ContentType: "text/plain"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Publish("ignored", []byte("not subscribed"), types.QoS0, false)
+	server.Publish("other", []byte("second filter"), types.QoS0, false)
+
+	message = readStreamMessage(t, reader, false)
+	if message.Topic != "stream/live" || message.Retain || message.Encoding != "utf8" || message.Payload != "héllo" ||
+		message.Properties == nil || message.Properties.ContentType != "text/plain" {
+		t.Fatalf("wanted the live message in UTF-8 but got %+v", message)
+	}
+	message = readStreamMessage(t, reader, false)
+	if message.Topic != "other" {
+		t.Fatalf("wanted the message of the second filter but got %+v", message)
+	}
+}
+
+func TestHTTPSubscribeSSE(t *testing.T) {
+	secret := []byte("shared secret")
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	err := os.WriteFile(secretFile, secret, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, _ := startServer(t, Config{})
+	url := startHTTPListener(t, server, ListenerConfig{
+		Authentication: AuthenticationConfig{JWT: JWTConfig{SecretFile: secretFile}},
+	})
+	token := signHS256(t, secret, map[string]any{
+		"sub":       "dashboard",
+		"exp":       time.Now().Add(time.Hour).Unix(),
+		"subscribe": []string{"devices/+/status"},
+	})
+
+	subscribeCases := []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{name: "no token", query: "filter=devices/%2B/status", want: http.StatusUnauthorized},
+		{name: "not authorized", query: "filter=devices/%23&access_token=" + token, want: http.StatusForbidden},
+		{name: "no filter", query: "access_token=" + token, want: http.StatusBadRequest},
+		{name: "invalid filter", query: "filter=a/%23/b&access_token=" + token, want: http.StatusBadRequest},
+		{name: "invalid format", query: "filter=a&format=xml&access_token=" + token, want: http.StatusBadRequest},
+	}
+	for _, c := range subscribeCases {
+		status, body := httpRequest(t, http.MethodGet, url+"/subscribe?"+c.query, "", nil)
+		if status != c.want {
+			t.Fatalf("%s: wanted status %d but got %d: %s", c.name, c.want, status, body)
+		}
+	}
+
+	response, reader := openStream(t, url+"/subscribe?filter=devices/%2B/status&access_token="+token,
+		map[string]string{"Accept": "text/event-stream"})
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("wanted an event stream but got %d %s", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+	waitForCluster(t, func() bool {
+		server.handlersMutex.Lock()
+		defer server.handlersMutex.Unlock()
+		return len(server.handlers) == 1
+	})
+
+	server.Publish("devices/1/status", []byte("online"), types.QoS0, false)
+	message := readStreamMessage(t, reader, true)
+	if message.Topic != "devices/1/status" || message.Encoding != "base64" ||
+		message.Payload != base64.StdEncoding.EncodeToString([]byte("online")) {
+		t.Fatalf("wanted the status message but got %+v", message)
+	}
+}
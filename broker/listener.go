@@ -0,0 +1,177 @@
+package broker
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/auth"
+)
+
+// listener accepts connections as described by its config.
+type listener struct {
+	config      ListenerConfig
+	server      *Server
+	log         *slog.Logger       // Listener logger with the address.
+	connections atomic.Int32       // Number of open connections.
+	passwords   *auth.PasswordFile // Nil if credentials are not verified.
+	acl         *auth.ACLFile      // Nil if all clients may use all topics.
+	jwt         *auth.JWTVerifier  // Nil if tokens are not accepted.
+}
+
+func newListener(server *Server, config ListenerConfig) (*listener, error) {
+	l := &listener{
+		config: config,
+		server: server,
+		log:    server.logs.listener.With("listener_type", string(config.Type), "address", config.Address),
+	}
+
+	if config.Authentication.PasswordFile != "" {
+		passwords, err := auth.LoadPasswordFile(config.Authentication.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		passwords.SetLogger(server.logs.auth)
+		l.passwords = passwords
+	}
+
+	if config.Authentication.JWT.Enabled() {
+		jwt, err := newJWTVerifier(config.Authentication.JWT)
+		if err != nil {
+			return nil, err
+		}
+		jwt.SetLogger(server.logs.auth)
+		l.jwt = jwt
+	}
+
+	if config.Authorization.ACLFile != "" {
+		acl, err := auth.LoadACLFile(config.Authorization.ACLFile)
+		if err != nil {
+			return nil, err
+		}
+		acl.SetLogger(server.logs.auth)
+		l.acl = acl
+	}
+
+	return l, nil
+}
+
+func newJWTVerifier(config JWTConfig) (*auth.JWTVerifier, error) {
+	verifierConfig := auth.JWTVerifierConfig{
+		JWKSFile: config.JWKSFile,
+		Issuer:   config.Issuer,
+		Audience: config.Audience,
+		Leeway:   time.Duration(config.Leeway) * time.Second,
+		Claims:   auth.JWTClaimNames(config.Claims),
+	}
+
+	if config.SecretFile != "" {
+		secret, err := os.ReadFile(config.SecretFile)
+		if err != nil {
+			return nil, err
+		}
+		verifierConfig.Secret = bytes.TrimRight(secret, "\r\n")
+	}
+
+	return auth.NewJWTVerifier(verifierConfig)
+}
+
+// serveHTTP serves HTTP requests on ln until the server is closed, for the
+// HTTP servers next to the MQTT listeners.
+func (server *Server) serveHTTP(ln net.Listener, handler http.Handler) error {
+	if !server.trackListener(ln, true) {
+		ln.Close()
+		return ErrServerClosed
+	}
+	defer server.trackListener(ln, false)
+
+	httpServer := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	err := httpServer.Serve(ln)
+	if server.isClosed() || errors.Is(err, http.ErrServerClosed) {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// Listen opens a network listener for config, TLS listeners are wrapped so
+// that connections are handshaked with the configured certificate. TLS file
+// reloads are logged to the default logger.
+func Listen(config ListenerConfig) (net.Listener, error) {
+	return listen(config, slog.Default())
+}
+
+func listen(config ListenerConfig, log *slog.Logger) (net.Listener, error) {
+	network := "tcp"
+	if config.Type == ListenerUnix {
+		network = "unix"
+		// Remove a socket file left behind by a previous run.
+		err := os.Remove(config.Address)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen(network, config.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.IsTLS() {
+		loader, err := newTLSLoader(
+			config.TLS.CertFile,
+			config.TLS.KeyFile,
+			config.TLS.ClientCAFile,
+			config.TLS.ClientAuth)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		loader.log = log
+		ln = tls.NewListener(ln, loader.Config())
+	}
+
+	return ln, nil
+}
+
+func (l *listener) serve(ln net.Listener) error {
+	if l.config.IsHTTP() {
+		httpServer := &http.Server{Handler: l.httpHandler(), ReadHeaderTimeout: 10 * time.Second}
+		return httpServer.Serve(ln)
+	}
+
+	if l.config.IsWebsocket() {
+		mux := http.NewServeMux()
+		mux.Handle(l.config.Path, websocketHandler(l.handle, l.log))
+		return http.Serve(ln, mux)
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		l.log.Debug("accepted connection", "remote_addr", conn.RemoteAddr().String())
+		go l.handle(conn)
+	}
+}
+
+func (l *listener) handle(conn net.Conn) {
+	connections := l.connections.Add(1)
+	defer l.connections.Add(-1)
+
+	if l.config.Limits.MaxConnections > 0 && int(connections) > l.config.Limits.MaxConnections {
+		l.log.Warn("maximum number of connections reached", "max_connections", l.config.Limits.MaxConnections,
+			"remote_addr", conn.RemoteAddr().String())
+		conn.Close()
+		return
+	}
+
+	l.server.handleConnection(conn, l)
+}
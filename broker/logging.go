@@ -0,0 +1,80 @@
+package broker
+
+import (
+	"log/slog"
+	"os"
+
+	"github.com/DvdSpijker/GoBroker/logging"
+	"github.com/DvdSpijker/GoBroker/packet"
+)
+
+// Subsystems of the broker, the level of every subsystem can be configured
+// separately.
+const (
+	subsystemServer     = "server"     // Starting, stopping and hooks.
+	subsystemListener   = "listener"   // Accepting connections and TLS.
+	subsystemConnection = "connection" // Packets received from and sent to clients.
+	subsystemSession    = "session"    // Subscriptions, publishes and deliveries.
+	subsystemAuth       = "auth"       // Authentication and authorization.
+	subsystemStorage    = "storage"    // Persistence of the broker state.
+	subsystemAdmin      = "admin"      // Requests to the admin API.
+	subsystemBridge     = "bridge"     // Connections to remote brokers, see the bridge package.
+	subsystemCluster    = "cluster"    // Connections to the other nodes of the cluster.
+)
+
+var subsystems = []string{
+	subsystemServer,
+	subsystemListener,
+	subsystemConnection,
+	subsystemSession,
+	subsystemAuth,
+	subsystemStorage,
+	subsystemAdmin,
+	subsystemBridge,
+	subsystemCluster,
+}
+
+type loggers struct {
+	server     *slog.Logger
+	listener   *slog.Logger
+	connection *slog.Logger
+	session    *slog.Logger
+	auth       *slog.Logger
+	storage    *slog.Logger
+	admin      *slog.Logger
+	cluster    *slog.Logger
+}
+
+// newLoggers creates the subsystem loggers, logger is created from the log
+// config if it is nil.
+func newLoggers(logger *slog.Logger, config logging.Config) loggers {
+	if logger == nil {
+		var err error
+		logger, err = logging.New(os.Stderr, config)
+		if err != nil {
+			// Validate reports the invalid config when the server starts.
+			logger, _ = logging.New(os.Stderr, logging.Config{})
+		}
+	}
+
+	return loggers{
+		server:     logging.Subsystem(logger, subsystemServer),
+		listener:   logging.Subsystem(logger, subsystemListener),
+		connection: logging.Subsystem(logger, subsystemConnection),
+		session:    logging.Subsystem(logger, subsystemSession),
+		auth:       logging.Subsystem(logger, subsystemAuth),
+		storage:    logging.Subsystem(logger, subsystemStorage),
+		admin:      logging.Subsystem(logger, subsystemAdmin),
+		cluster:    logging.Subsystem(logger, subsystemCluster),
+	}
+}
+
+// payload returns the payload of a message as log attribute, redacted
+// unless payload logging is enabled.
+func (server *Server) payload(p *packet.PublishPacket) slog.Attr {
+	return logging.Payload(p.Payload.Data, server.config.Log.Payloads)
+}
+
+func reasonCodeAttr(reasonCode packet.ReasonCode) slog.Attr {
+	return slog.String("reason_code", reasonCodeString(reasonCode))
+}
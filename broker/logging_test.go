@@ -0,0 +1,69 @@
+package broker
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/DvdSpijker/GoBroker/logging"
+)
+
+// logBuffer collects the output of a logger that is used concurrently.
+type logBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (buffer *logBuffer) Write(p []byte) (int, error) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	return buffer.buffer.Write(p)
+}
+
+func (buffer *logBuffer) String() string {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	return buffer.buffer.String()
+}
+
+var payloadLogCases = []struct {
+	payloads bool
+	want     string
+	hidden   string
+}{
+	{payloads: false, want: `payload="[6 bytes redacted]"`, hidden: "secret"},
+	{payloads: true, want: "payload=secret", hidden: "redacted"},
+}
+
+func TestPayloadLogging(t *testing.T) {
+	for _, c := range payloadLogCases {
+		var output logBuffer
+		logConfig := logging.Config{Level: "debug", Payloads: c.payloads}
+		logger, err := logging.New(&output, logConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, address := startServer(t, Config{Log: logConfig, Logger: logger})
+		subscriber := connectClient(t, address, "subscriber")
+		subscriber.subscribe("payload")
+		publisher := connectClient(t, address, "publisher")
+		publisher.publish("payload", "secret")
+		// The publish is logged before it is delivered.
+		subscriber.read()
+
+		var published string
+		for _, line := range strings.Split(output.String(), "\n") {
+			if strings.Contains(line, "msg=published") {
+				published = line
+			}
+		}
+		if !strings.Contains(published, "client_id=publisher") || !strings.Contains(published, "subsystem=session") {
+			t.Fatalf("wanted the publish of the publisher to be logged but got %q", published)
+		}
+		if !strings.Contains(published, c.want) || strings.Contains(published, c.hidden) {
+			t.Fatalf("wanted %s but got %q", c.want, published)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package broker
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/DvdSpijker/GoBroker/metrics"
+	"github.com/DvdSpijker/GoBroker/packet"
+)
+
+// DefaultMetricsPath is the HTTP path metrics are served on.
+const DefaultMetricsPath = "/metrics"
+
+// Causes of dropped messages.
+const (
+	dropQueueFull               = "queue_full"                 // The offline queue of the client is full.
+	dropClientOffline           = "client_offline"             // QoS 0 message for an offline client.
+	dropNotAuthorized           = "not_authorized"             // The publisher may not publish to the topic.
+	dropRejectedByHook          = "rejected_by_hook"           // A hook rejected the publish or delivery.
+	dropRetainedLimit           = "retained_limit"             // The maximum number of retained messages is reached.
+	dropRetainedPayloadTooLarge = "retained_payload_too_large" // The payload exceeds the retained payload limit.
+	dropStreamFull              = "stream_full"                // An HTTP subscriber does not keep up with its messages.
+)
+
+type serverMetrics struct {
+	registry        *metrics.Registry
+	connectAttempts *metrics.CounterVec
+	packetsReceived *metrics.CounterVec
+	packetsSent     *metrics.CounterVec
+	bytesReceived   *metrics.CounterVec
+	bytesSent       *metrics.CounterVec
+	dropped         *metrics.CounterVec
+	publishFanout   *metrics.Histogram
+}
+
+func newServerMetrics(server *Server) serverMetrics {
+	registry := metrics.NewRegistry()
+
+	m := serverMetrics{
+		registry: registry,
+		connectAttempts: registry.Counter("gobroker_connect_attempts_total",
+			"Connection attempts by CONNACK reason code.", "reason_code"),
+		packetsReceived: registry.Counter("gobroker_packets_received_total",
+			"Control packets received from clients by packet type.", "type"),
+		packetsSent: registry.Counter("gobroker_packets_sent_total",
+			"Control packets sent to clients by packet type.", "type"),
+		bytesReceived: registry.Counter("gobroker_bytes_received_total",
+			"Bytes of control packets received from clients by packet type.", "type"),
+		bytesSent: registry.Counter("gobroker_bytes_sent_total",
+			"Bytes of control packets sent to clients by packet type.", "type"),
+		dropped: registry.Counter("gobroker_messages_dropped_total",
+			"Messages that were not published, delivered or retained by cause.", "cause"),
+		publishFanout: registry.Histogram("gobroker_publish_fanout_seconds",
+			"Time from receiving a publish until it is handed to all subscribers.", metrics.DefaultBuckets),
+	}
+
+	registry.GaugeFunc("gobroker_clients_connected", "Clients that are connected.", func() float64 {
+		return float64(server.countClients(func(client *Client) int {
+			if client.Conn == nil {
+				return 0
+			}
+			return 1
+		}))
+	})
+	registry.GaugeFunc("gobroker_clients", "Clients with a session, connected or not.", func() float64 {
+		return float64(server.countClients(func(client *Client) int { return 1 }))
+	})
+	registry.GaugeFunc("gobroker_subscriptions", "Subscriptions of all clients.", func() float64 {
+		return float64(server.countSubscriptions())
+	})
+	registry.GaugeFunc("gobroker_retained_messages", "Retained messages.", func() float64 {
+		count, _ := server.retainedStats()
+		return float64(count)
+	})
+	registry.GaugeFunc("gobroker_retained_bytes", "Payload bytes of retained messages.", func() float64 {
+		_, size := server.retainedStats()
+		return float64(size)
+	})
+	registry.GaugeFunc("gobroker_queued_messages", "Messages queued for offline clients.", func() float64 {
+		return float64(server.countClients(func(client *Client) int { return len(client.queue) }))
+	})
+	registry.GaugeFunc("gobroker_send_queue_packets", "Packets waiting in the send queues of connected clients.", func() float64 {
+		return float64(server.countClients(func(client *Client) int { return len(client.SendQueue) }))
+	})
+	registry.GaugeFunc("gobroker_inflight_messages", "QoS 1 and 2 messages sent to clients that were not acknowledged yet.", func() float64 {
+		return float64(server.countClients(func(client *Client) int { return len(client.inFlight) }))
+	})
+
+	return m
+}
+
+// MetricsHandler returns the handler that serves the metrics of the server
+// in the Prometheus text format, for serving them on an existing HTTP server.
+func (server *Server) MetricsHandler() http.Handler {
+	return server.metrics.registry
+}
+
+// serveMetrics serves the metrics on ln until the server is closed.
+func (server *Server) serveMetrics(ln net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle(server.config.Metrics.Path, server.MetricsHandler())
+	server.logs.server.Info("serving metrics", "address", ln.Addr().String(), "path", server.config.Metrics.Path)
+	return server.serveHTTP(ln, mux)
+}
+
+// countClients sums count over all clients, count is called with the lock
+// of the client held.
+func (server *Server) countClients(count func(client *Client) int) int {
+	server.clientsMutex.Lock()
+	defer server.clientsMutex.Unlock()
+
+	total := 0
+	for _, client := range server.clients {
+		client.Mutex.Lock()
+		total += count(client)
+		client.Mutex.Unlock()
+	}
+	return total
+}
+
+func (server *Server) countSubscriptions() int {
+	server.subscriptionsMutex.Lock()
+	defer server.subscriptionsMutex.Unlock()
+
+	total := 0
+	for _, subscription := range server.subscriptions {
+		total += len(subscription.clients)
+	}
+	return total
+}
+
+// retainedStats returns the number of retained messages and the total size
+// of their payloads.
+func (server *Server) retainedStats() (int, int) {
+	server.retainedMessagesMutex.Lock()
+	defer server.retainedMessagesMutex.Unlock()
+
+	count, size := 0, 0
+	for _, message := range server.retainedMessages {
+		if message != nil {
+			count++
+			size += len(message.Payload.Data)
+		}
+	}
+	return count, size
+}
+
+func (m *serverMetrics) connectAttempt(reasonCode packet.ReasonCode) {
+	m.connectAttempts.With(reasonCodeString(reasonCode)).Inc()
+}
+
+func (m *serverMetrics) received(packetType packet.PacketType, size int) {
+	m.packetsReceived.With(packetType.String()).Inc()
+	m.bytesReceived.With(packetType.String()).Add(uint64(size))
+}
+
+// sent counts an encoded packet that was written to a connection.
+func (m *serverMetrics) sent(bytes []byte) {
+	if len(bytes) == 0 {
+		return
+	}
+	packetType := packet.PacketType(bytes[0] & 0xF0).String()
+	m.packetsSent.With(packetType).Inc()
+	m.bytesSent.With(packetType).Add(uint64(len(bytes)))
+}
+
+func (m *serverMetrics) drop(cause string) {
+	m.dropped.With(cause).Inc()
+}
+
+func reasonCodeString(reasonCode packet.ReasonCode) string {
+	return fmt.Sprintf("0x%02x", byte(reasonCode))
+}
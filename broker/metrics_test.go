@@ -0,0 +1,111 @@
+package broker
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+// scrapeMetrics returns the metrics of server in the Prometheus text format.
+func scrapeMetrics(server *Server) string {
+	recorder := httptest.NewRecorder()
+	server.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	return recorder.Body.String()
+}
+
+func TestMetrics(t *testing.T) {
+	server, address := startServer(t, Config{})
+	subscriber := connectClient(t, address, "subscriber")
+	subscriber.subscribe("metrics/#")
+	publisher := connectClient(t, address, "publisher")
+	publisher.publish("metrics/a", "hello")
+	subscriber.read()
+
+	connectClient(t, address, "third")
+	refused := dialClient(t, address)
+	connect := connectPacket("refused", "", "")
+	connect[8] = 4 // MQTT 3.1.1
+	refused.write(connect)
+	refused.read()
+	server.Publish("metrics/retained", []byte("retained"), types.QoS0, true)
+
+	want := []string{
+		`gobroker_connect_attempts_total{reason_code="0x00"} 3`,
+		`gobroker_connect_attempts_total{reason_code="0x84"} 1`,
+		`gobroker_packets_received_total{type="CONNECT"} 4`,
+		`gobroker_packets_received_total{type="SUBSCRIBE"} 1`,
+		`gobroker_bytes_received_total{type="PUBLISH"} 19`,
+		`gobroker_packets_sent_total{type="CONNACK"} 4`,
+		`gobroker_packets_sent_total{type="SUBACK"} 1`,
+		"gobroker_clients_connected 3",
+		"gobroker_clients 3",
+		"gobroker_subscriptions 1",
+		"gobroker_retained_messages 1",
+		"gobroker_retained_bytes 8",
+		"gobroker_inflight_messages 0",
+		"# TYPE gobroker_publish_fanout_seconds histogram",
+	}
+
+	// Packets are counted after they are written, which can be after they
+	// were read by the client.
+	var metrics string
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		metrics = scrapeMetrics(server)
+		if containsAll(metrics, want) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, line := range want {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Fatalf("wanted %v in the metrics but got:\n%v", line, metrics)
+		}
+	}
+}
+
+func TestDroppedMessageMetrics(t *testing.T) {
+	server, address := startServer(t, Config{Sessions: SessionsConfig{MaxQueuedMessages: 1}})
+	subscriber := dialClient(t, address)
+	subscriber.sessionConnect("subscriber", true, 60)
+	subscriber.subscribeQoS("dropped", types.QoS1)
+	subscriber.conn.Close()
+	waitOffline(t, server, "subscriber")
+
+	server.Publish("dropped", []byte("queued"), types.QoS1, false)
+	server.Publish("dropped", []byte("full"), types.QoS1, false)
+	server.Publish("dropped", []byte("offline"), types.QoS0, false)
+
+	want := []string{
+		`gobroker_messages_dropped_total{cause="client_offline"} 1`,
+		`gobroker_messages_dropped_total{cause="queue_full"} 1`,
+		"gobroker_queued_messages 1",
+		"gobroker_clients_connected 0",
+	}
+	var metrics string
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		metrics = scrapeMetrics(server)
+		if containsAll(metrics, want) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, line := range want {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Fatalf("wanted %v in the metrics but got:\n%v", line, metrics)
+		}
+	}
+}
+
+func containsAll(s string, lines []string) bool {
+	for _, line := range lines {
+		if !strings.Contains(s, line+"\n") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,397 @@
+package broker
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/packet"
+	"github.com/DvdSpijker/GoBroker/storage"
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+// Buckets of the records in the store. The keys of the queue, in-flight and
+// received buckets start with the client ID followed by a NUL byte, which
+// cannot be part of a client ID (MQTT-1.5.4-2).
+const (
+	retainedBucket = "retained" // Topic: PUBLISH packet.
+	sessionsBucket = "sessions" // Client ID: storedSession.
+	queueBucket    = "queue"    // Client ID, sequence number: PUBLISH packet.
+	inFlightBucket = "inflight" // Client ID, packet identifier: storedInFlight.
+	receivedBucket = "received" // Client ID, packet identifier: empty.
+)
+
+type (
+	storedSession struct {
+		ExpiryInterval time.Duration
+		// Zero while the client is connected.
+		DisconnectedAt time.Time
+		Subscriptions  map[string]types.QoS
+		NoLocal        []string `json:",omitempty"` // Subscriptions with No Local.
+	}
+
+	storedInFlight struct {
+		Packet   []byte
+		Released bool
+	}
+
+	// restoredSession collects the records of a session while loading.
+	restoredSession struct {
+		session  storedSession
+		queue    []queuedMessage
+		inFlight map[uint16]*inFlightMessage
+		received []uint16
+	}
+)
+
+// UseStore restores the retained messages and sessions from store, and
+// persists all changes to them from then on. It must be called before the
+// server starts serving. The store is closed when the server closes.
+func (server *Server) UseStore(store storage.Store) error {
+	sessions := make(map[string]*restoredSession)
+	session := func(clientID string) *restoredSession {
+		s, ok := sessions[clientID]
+		if !ok {
+			s = &restoredSession{inFlight: make(map[uint16]*inFlightMessage)}
+			sessions[clientID] = s
+		}
+		return s
+	}
+
+	retained := 0
+	err := store.Load(func(bucket string, key string, value []byte) error {
+		switch bucket {
+		case retainedBucket:
+			p, err := decodePublishPacket(value)
+			if err != nil {
+				return fmt.Errorf("retained message %s: %w", key, err)
+			}
+			server.retainedMessages[key] = p
+			retained++
+
+		case sessionsBucket:
+			s := session(key)
+			err := json.Unmarshal(value, &s.session)
+			if err != nil {
+				return fmt.Errorf("session %s: %w", key, err)
+			}
+
+		case queueBucket:
+			clientID, sequence, err := splitSessionKey(key, 64)
+			if err != nil {
+				return err
+			}
+			p, err := decodePublishPacket(value)
+			if err != nil {
+				return fmt.Errorf("queued message %s: %w", key, err)
+			}
+			s := session(clientID)
+			s.queue = append(s.queue, queuedMessage{sequence: sequence, packet: p})
+
+		case inFlightBucket:
+			clientID, packetIdentifier, err := splitSessionKey(key, 16)
+			if err != nil {
+				return err
+			}
+			var stored storedInFlight
+			err = json.Unmarshal(value, &stored)
+			if err != nil {
+				return fmt.Errorf("in-flight message %s: %w", key, err)
+			}
+			p, err := decodePublishPacket(stored.Packet)
+			if err != nil {
+				return fmt.Errorf("in-flight message %s: %w", key, err)
+			}
+			session(clientID).inFlight[uint16(packetIdentifier)] = &inFlightMessage{packet: p, released: stored.Released}
+
+		case receivedBucket:
+			clientID, packetIdentifier, err := splitSessionKey(key, 16)
+			if err != nil {
+				return err
+			}
+			s := session(clientID)
+			s.received = append(s.received, uint16(packetIdentifier))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The time the broker was stopped is unknown, sessions of clients that
+	// were connected are treated as if they disconnected now.
+	now := time.Now()
+	for clientID, s := range sessions {
+		if s.session.ExpiryInterval == 0 {
+			// Left behind records of a session that was not found.
+			deleteSessionRecords(store, clientID, s.queue, s.inFlight, s.received)
+			continue
+		}
+		disconnectedAt := s.session.DisconnectedAt
+		if disconnectedAt.IsZero() {
+			disconnectedAt = now
+		}
+		remaining := s.session.ExpiryInterval - now.Sub(disconnectedAt)
+		if s.session.ExpiryInterval != SessionNeverExpires && remaining <= 0 {
+			server.logs.storage.Debug("stored session expired", "client_id", clientID)
+			store.Delete(sessionsBucket, clientID)
+			deleteSessionRecords(store, clientID, s.queue, s.inFlight, s.received)
+			continue
+		}
+
+		client := server.restoreSession(clientID, s)
+		if s.session.ExpiryInterval != SessionNeverExpires {
+			client.sessionTimer = time.AfterFunc(remaining, client.expireSession)
+		}
+	}
+
+	server.logs.storage.Info("restored state", "retained_messages", retained, "sessions", len(server.clients))
+	server.store = store
+	return nil
+}
+
+// restoreSession adds the client of a stored session while it is offline.
+func (server *Server) restoreSession(clientID string, s *restoredSession) *Client {
+	client := newClient(clientID, server)
+	client.SessionExpiryInterval = s.session.ExpiryInterval
+	client.persisted = true
+
+	for filter, qos := range s.session.Subscriptions {
+		client.Subscriptions = append(client.Subscriptions, filter)
+		client.subscriptionQoS[filter] = qos
+		server.addSubscription(filter, client)
+	}
+	for _, filter := range s.session.NoLocal {
+		client.noLocal[filter] = true
+	}
+
+	slices.SortFunc(s.queue, func(a, b queuedMessage) int {
+		return cmp.Compare(a.sequence, b.sequence)
+	})
+	client.queue = s.queue
+	if len(s.queue) > 0 {
+		client.queueSequence = s.queue[len(s.queue)-1].sequence
+	}
+
+	client.inFlight = s.inFlight
+	for packetIdentifier := range s.inFlight {
+		client.packetIdentifier = max(client.packetIdentifier, packetIdentifier)
+	}
+	for _, packetIdentifier := range s.received {
+		client.received[packetIdentifier] = struct{}{}
+	}
+
+	server.clients[clientID] = client
+	return client
+}
+
+func deleteSessionRecords(store storage.Store, clientID string, queue []queuedMessage,
+	inFlight map[uint16]*inFlightMessage, received []uint16) {
+	for _, message := range queue {
+		store.Delete(queueBucket, queueKey(clientID, message.sequence))
+	}
+	for packetIdentifier := range inFlight {
+		store.Delete(inFlightBucket, packetIdentifierKey(clientID, packetIdentifier))
+	}
+	for _, packetIdentifier := range received {
+		store.Delete(receivedBucket, packetIdentifierKey(clientID, packetIdentifier))
+	}
+}
+
+// persistRetainedMessage stores the retained message of topic, or deletes it
+// if p is nil.
+func (server *Server) persistRetainedMessage(topic string, p *packet.PublishPacket) {
+	// The $SYS topics are published again when the broker starts.
+	if server.store == nil || isSysTopic(topic) {
+		return
+	}
+
+	var err error
+	if p == nil {
+		err = server.store.Delete(retainedBucket, topic)
+	} else {
+		// Encoding modifies the packet, which is shared with deliveries.
+		copied := *p
+		var bytes []byte
+		bytes, err = copied.Encode()
+		if err == nil {
+			err = server.store.Put(retainedBucket, topic, bytes)
+		}
+	}
+	if err != nil {
+		server.logs.storage.Error("failed to persist retained message", "topic", topic, "error", err)
+	}
+}
+
+// persistSession stores the subscriptions of a session that outlives its
+// connection. disconnectedAt is zero while the client is connected. The
+// lock of the client must be held.
+func (server *Server) persistSession(client *Client, disconnectedAt time.Time) {
+	if server.store == nil || client.SessionExpiryInterval == 0 {
+		return
+	}
+
+	noLocal := make([]string, 0, len(client.noLocal))
+	for filter := range client.noLocal {
+		noLocal = append(noLocal, filter)
+	}
+	bytes, err := json.Marshal(storedSession{
+		ExpiryInterval: client.SessionExpiryInterval,
+		DisconnectedAt: disconnectedAt,
+		Subscriptions:  client.subscriptionQoS,
+		NoLocal:        noLocal,
+	})
+	if err == nil {
+		err = server.store.Put(sessionsBucket, client.ID, bytes)
+	}
+	if err != nil {
+		server.logs.storage.Error("failed to persist session", "client_id", client.ID, "error", err)
+		return
+	}
+
+	if !client.persisted {
+		// The state of a session that was not persistent before.
+		client.persisted = true
+		for _, message := range client.queue {
+			server.persistQueuedMessage(client, message)
+		}
+		for packetIdentifier, message := range client.inFlight {
+			server.persistInFlightMessage(client, packetIdentifier, message)
+		}
+		for packetIdentifier := range client.received {
+			server.persistReceived(client, packetIdentifier)
+		}
+	}
+}
+
+// deletePersistedSession removes all records of a session, the lock of the
+// client must be held.
+func (server *Server) deletePersistedSession(client *Client) {
+	if server.store == nil || !client.persisted {
+		return
+	}
+
+	err := server.store.Delete(sessionsBucket, client.ID)
+	if err != nil {
+		server.logs.storage.Error("failed to delete session", "client_id", client.ID, "error", err)
+	}
+	received := make([]uint16, 0, len(client.received))
+	for packetIdentifier := range client.received {
+		received = append(received, packetIdentifier)
+	}
+	deleteSessionRecords(server.store, client.ID, client.queue, client.inFlight, received)
+	client.persisted = false
+}
+
+func (server *Server) persistQueuedMessage(client *Client, message queuedMessage) {
+	if server.store == nil || !client.persisted {
+		return
+	}
+
+	bytes, err := message.packet.Encode()
+	if err == nil {
+		err = server.store.Put(queueBucket, queueKey(client.ID, message.sequence), bytes)
+	}
+	if err != nil {
+		server.logs.storage.Error("failed to persist queued message", "client_id", client.ID, "error", err)
+	}
+}
+
+func (server *Server) deletePersistedQueuedMessage(client *Client, message queuedMessage) {
+	if server.store == nil || !client.persisted {
+		return
+	}
+
+	err := server.store.Delete(queueBucket, queueKey(client.ID, message.sequence))
+	if err != nil {
+		server.logs.storage.Error("failed to delete queued message", "client_id", client.ID, "error", err)
+	}
+}
+
+func (server *Server) persistInFlightMessage(client *Client, packetIdentifier uint16, message *inFlightMessage) {
+	if server.store == nil || !client.persisted {
+		return
+	}
+
+	bytes, err := message.packet.Encode()
+	if err == nil {
+		bytes, err = json.Marshal(storedInFlight{Packet: bytes, Released: message.released})
+	}
+	if err == nil {
+		err = server.store.Put(inFlightBucket, packetIdentifierKey(client.ID, packetIdentifier), bytes)
+	}
+	if err != nil {
+		server.logs.storage.Error("failed to persist in-flight message", "client_id", client.ID, "error", err)
+	}
+}
+
+func (server *Server) deletePersistedInFlightMessage(client *Client, packetIdentifier uint16) {
+	if server.store == nil || !client.persisted {
+		return
+	}
+
+	err := server.store.Delete(inFlightBucket, packetIdentifierKey(client.ID, packetIdentifier))
+	if err != nil {
+		server.logs.storage.Error("failed to delete in-flight message", "client_id", client.ID, "error", err)
+	}
+}
+
+func (server *Server) persistReceived(client *Client, packetIdentifier uint16) {
+	if server.store == nil || !client.persisted {
+		return
+	}
+
+	err := server.store.Put(receivedBucket, packetIdentifierKey(client.ID, packetIdentifier), nil)
+	if err != nil {
+		server.logs.storage.Error("failed to persist received message", "client_id", client.ID, "error", err)
+	}
+}
+
+func (server *Server) deletePersistedReceived(client *Client, packetIdentifier uint16) {
+	if server.store == nil || !client.persisted {
+		return
+	}
+
+	err := server.store.Delete(receivedBucket, packetIdentifierKey(client.ID, packetIdentifier))
+	if err != nil {
+		server.logs.storage.Error("failed to delete received message", "client_id", client.ID, "error", err)
+	}
+}
+
+// queueKey orders the queued messages of a client by sequence number.
+func queueKey(clientID string, sequence uint64) string {
+	return fmt.Sprintf("%s\x00%016x", clientID, sequence)
+}
+
+func packetIdentifierKey(clientID string, packetIdentifier uint16) string {
+	return fmt.Sprintf("%s\x00%04x", clientID, packetIdentifier)
+}
+
+// splitSessionKey splits a key into the client ID and the hexadecimal number
+// after it.
+func splitSessionKey(key string, bitSize int) (string, uint64, error) {
+	clientID, number, ok := strings.Cut(key, "\x00")
+	if !ok {
+		return "", 0, fmt.Errorf("invalid key: %q", key)
+	}
+	n, err := strconv.ParseUint(number, 16, bitSize)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid key: %q: %w", key, err)
+	}
+	return clientID, n, nil
+}
+
+// decodePublishPacket decodes a stored packet. The packet refers to its
+// input, so the input is copied first.
+func decodePublishPacket(bytes []byte) (*packet.PublishPacket, error) {
+	p := &packet.PublishPacket{}
+	_, err := p.Decode(slices.Clone(bytes))
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,145 @@
+package broker
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/packet"
+	"github.com/DvdSpijker/GoBroker/storage"
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+// startPersistentServer starts a server that persists its state in the log
+// at path. The returned function stops the server.
+func startPersistentServer(t *testing.T, path string) (*Server, string, func()) {
+	t.Helper()
+
+	store, err := storage.OpenFileStore(path, storage.FileStoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(Config{})
+	err = server.UseStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(ln) }()
+
+	stopped := false
+	stop := func() {
+		if stopped {
+			return
+		}
+		stopped = true
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		err := server.Close(ctx)
+		if err != nil {
+			t.Errorf("close: %v", err)
+		}
+		<-served
+	}
+	t.Cleanup(stop)
+
+	return server, ln.Addr().String(), stop
+}
+
+func TestPersistenceRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broker.log")
+	server, address, stop := startPersistentServer(t, path)
+
+	server.Publish("retained/a", []byte("kept"), types.QoS0, true)
+	server.Publish("retained/b", []byte("removed"), types.QoS0, true)
+	server.Publish("retained/b", nil, types.QoS0, true)
+
+	// A session with a message that was not acknowledged and a queued message.
+	subscriber := dialClient(t, address)
+	subscriber.sessionConnect("persistent", true, 3600)
+	subscriber.subscribeQoS("data/#", types.QoS2)
+	server.Publish("data/1", []byte("in-flight"), types.QoS1, false)
+	inFlight := subscriber.readPublish()
+	subscriber.conn.Close()
+	waitOffline(t, server, "persistent")
+	server.Publish("data/2", []byte("queued"), types.QoS2, false)
+
+	// A session that ends with the connection is not restored.
+	temporary := dialClient(t, address)
+	temporary.sessionConnect("temporary", true, 0)
+	temporary.subscribeQoS("data/#", types.QoS1)
+	temporary.conn.Close()
+
+	stop()
+
+	server, address, _ = startPersistentServer(t, path)
+	if _, ok := server.clients["temporary"]; ok {
+		t.Fatalf("wanted the temporary session to be discarded")
+	}
+
+	subscriber = dialClient(t, address)
+	if !subscriber.sessionConnect("persistent", false, 3600) {
+		t.Fatalf("wanted the session to be present after a restart")
+	}
+
+	p := subscriber.readPublish()
+	if !p.FixedHeader.Dup || p.VariableHeader.PacketIdentifier.Value != inFlight.VariableHeader.PacketIdentifier.Value ||
+		string(p.Payload.Data) != "in-flight" {
+		t.Fatalf("wanted the in-flight message to be sent again but got %s", p.String())
+	}
+	subscriber.send(&packet.PubackPacket{VariableHeader: makeAcknowledgement(p.VariableHeader.PacketIdentifier)})
+
+	p = subscriber.readPublish()
+	if string(p.Payload.Data) != "queued" || p.FixedHeader.Qos != types.QoS2 {
+		t.Fatalf("wanted the queued message but got %s", p.String())
+	}
+
+	// The subscription is restored as well.
+	server.Publish("data/3", []byte("live"), types.QoS0, false)
+	p = subscriber.readPublish()
+	if string(p.Payload.Data) != "live" {
+		t.Fatalf("wanted live but got %s", p.Payload.Data)
+	}
+
+	other := connectClient(t, address, "other")
+	other.subscribe("retained/#")
+	p = other.readPublish()
+	if p.VariableHeader.TopicName.String() != "retained/a" || string(p.Payload.Data) != "kept" {
+		t.Fatalf("wanted the retained message of retained/a but got %s", p.String())
+	}
+	other.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err := other.framer.readPacket()
+	if err == nil {
+		t.Fatalf("wanted only one retained message")
+	}
+}
+
+func TestPersistedSessionExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broker.log")
+	server, address, stop := startPersistentServer(t, path)
+
+	subscriber := dialClient(t, address)
+	subscriber.sessionConnect("short", true, 1)
+	subscriber.subscribeQoS("data", types.QoS1)
+	subscriber.conn.Close()
+	waitOffline(t, server, "short")
+	stop()
+
+	time.Sleep(1100 * time.Millisecond)
+
+	server, address, _ = startPersistentServer(t, path)
+	if _, ok := server.clients["short"]; ok {
+		t.Fatalf("wanted the expired session to be discarded")
+	}
+	subscriber = dialClient(t, address)
+	if subscriber.sessionConnect("short", false, 1) {
+		t.Fatalf("wanted no session present after it expired")
+	}
+}
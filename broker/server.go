@@ -0,0 +1,633 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/auth"
+	"github.com/DvdSpijker/GoBroker/packet"
+	"github.com/DvdSpijker/GoBroker/protocol"
+	"github.com/DvdSpijker/GoBroker/storage"
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+// DefaultShutdownTimeout is the default number of seconds a graceful
+// shutdown may take.
+const DefaultShutdownTimeout = 10
+
+var (
+	ErrServerClosed     = errors.New("server closed")
+	ErrInvalidTopicName = errors.New("invalid topic name")
+	ErrPublishRejected  = errors.New("publish rejected")
+	ErrNotAuthorized    = errors.New("not authorized")
+)
+
+type (
+	// Message is a published application message as seen by
+	// in-process subscribers.
+	Message struct {
+		Topic   string    `json:"topic"`
+		Payload []byte    `json:"payload"` // Base64 encoded in JSON.
+		Qos     types.QoS `json:"qos"`
+		Retain  bool      `json:"retain"`
+		// Properties is nil if the message has no properties.
+		Properties *MessageProperties `json:"properties,omitempty"`
+	}
+
+	// MessageProperties are the properties of a PUBLISH packet that are
+	// forwarded to subscribers (3.3.2.3).
+	MessageProperties struct {
+		// UTF8Payload is set by the payload format indicator.
+		UTF8Payload           bool           `json:"utf8_payload,omitempty"`
+		MessageExpiryInterval uint32         `json:"message_expiry_interval,omitempty"` // Seconds, 0 does not expire.
+		ContentType           string         `json:"content_type,omitempty"`
+		ResponseTopic         string         `json:"response_topic,omitempty"`
+		CorrelationData       []byte         `json:"correlation_data,omitempty"`
+		UserProperties        []UserProperty `json:"user_properties,omitempty"`
+	}
+
+	// UserProperty is a name and value pair of a message, names may occur
+	// more than once.
+	UserProperty struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+
+	// MessageHandler is called for every message matching the filter
+	// it was subscribed with. Handlers are called synchronously from the
+	// publishing routine and must not block.
+	MessageHandler func(Message)
+
+	messageHandler struct {
+		filter  string
+		handler MessageHandler
+	}
+
+	// Server is an MQTT broker. All broker state is owned by the server,
+	// multiple servers can run side by side in one process.
+	Server struct {
+		config Config
+
+		clientsMutex sync.Mutex
+		clients      map[string]*Client
+
+		subscriptionsMutex sync.Mutex
+		subscriptions      clientSubscriptionMap
+
+		retainedMessagesMutex sync.Mutex
+		retainedMessages      retainedMessageMap
+
+		handlersMutex sync.Mutex
+		handlers      map[int]messageHandler
+		nextHandlerID int
+
+		hooksMutex sync.Mutex
+		hooks      []Hook
+
+		store   storage.Store // Persists the broker state, nil if it is not persisted.
+		cluster *cluster      // Links to the other nodes, nil if clustering is disabled.
+		logs    loggers
+		metrics serverMetrics
+
+		mutex       sync.Mutex // Protects the fields below.
+		closed      bool
+		stopped     bool          // Timers are cancelled and the store is closed.
+		done        chan struct{} // Closed when the server is stopped.
+		ready       chan struct{} // Closed when ListenAndServe opened the store and listeners.
+		started     time.Time
+		listeners   map[net.Listener]struct{}
+		conns       map[net.Conn]struct{}
+		connections sync.WaitGroup
+	}
+)
+
+// NewServer creates a server with the given config, values that are not set
+// in the config get their default value.
+func NewServer(config Config) *Server {
+	config.SetDefaults()
+
+	server := &Server{
+		config:           config,
+		clients:          make(map[string]*Client),
+		subscriptions:    make(clientSubscriptionMap),
+		retainedMessages: make(retainedMessageMap),
+		handlers:         make(map[int]messageHandler),
+		listeners:        make(map[net.Listener]struct{}),
+		conns:            make(map[net.Conn]struct{}),
+		logs:             newLoggers(config.Logger, config.Log),
+		done:             make(chan struct{}),
+		ready:            make(chan struct{}),
+		started:          time.Now(),
+	}
+	server.metrics = newServerMetrics(server)
+	server.cluster = newCluster(server, config.Cluster)
+	if config.Sys.Interval > 0 {
+		go server.publishSysTopics(time.Duration(config.Sys.Interval) * time.Second)
+	}
+	return server
+}
+
+// ListenAndServe opens all listeners of the config and serves connections on
+// them. It blocks until a listener fails or the server is closed, in which
+// case ErrServerClosed is returned.
+func (server *Server) ListenAndServe() error {
+	err := server.config.Validate()
+	if err != nil {
+		return err
+	}
+
+	if server.config.Storage.Path != "" && server.store == nil {
+		store, err := storage.OpenFileStore(server.config.Storage.Path,
+			storage.FileStoreOptions{Sync: server.config.Storage.Sync})
+		if err != nil {
+			return err
+		}
+		err = server.UseStore(store)
+		if err != nil {
+			store.Close()
+			return err
+		}
+	}
+
+	var adminToken string
+	if server.config.Admin.Address != "" {
+		adminToken, err = loadAdminToken(server.config.Admin.TokenFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	lns := make([]net.Listener, 0, len(server.config.Listeners))
+	for _, listenerConfig := range server.config.Listeners {
+		ln, err := listen(listenerConfig, server.logs.listener)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return err
+		}
+		lns = append(lns, ln)
+	}
+
+	var metricsListener net.Listener
+	if server.config.Metrics.Address != "" {
+		metricsListener, err = net.Listen("tcp", server.config.Metrics.Address)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return err
+		}
+	}
+
+	var adminListener net.Listener
+	if server.config.Admin.Address != "" {
+		adminListener, err = net.Listen("tcp", server.config.Admin.Address)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			if metricsListener != nil {
+				metricsListener.Close()
+			}
+			return err
+		}
+	}
+
+	var clusterListener net.Listener
+	if server.config.Cluster.Address != "" {
+		clusterListener, err = net.Listen("tcp", server.config.Cluster.Address)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			if metricsListener != nil {
+				metricsListener.Close()
+			}
+			if adminListener != nil {
+				adminListener.Close()
+			}
+			return err
+		}
+	}
+
+	select {
+	case <-server.ready:
+	default:
+		close(server.ready)
+	}
+
+	errs := make(chan error, len(lns)+3)
+	for i, ln := range lns {
+		go func() {
+			errs <- server.ServeListener(ln, server.config.Listeners[i])
+		}()
+	}
+	if metricsListener != nil {
+		go func() {
+			errs <- server.serveMetrics(metricsListener)
+		}()
+	}
+	if adminListener != nil {
+		go func() {
+			errs <- server.serveAdmin(adminListener, adminToken)
+		}()
+	}
+	if clusterListener != nil {
+		go func() {
+			errs <- server.ServeCluster(clusterListener)
+		}()
+	}
+
+	return <-errs
+}
+
+// Ready returns a channel that is closed once ListenAndServe opened the store
+// and all listeners of the config.
+func (server *Server) Ready() <-chan struct{} {
+	return server.ready
+}
+
+// Serve accepts plain MQTT connections on ln with the default listener settings.
+func (server *Server) Serve(ln net.Listener) error {
+	return server.ServeListener(ln, ListenerConfig{Type: ListenerTCP})
+}
+
+// ServeListener accepts connections on ln using the settings of config.
+// Connections are expected to be WebSocket upgrade requests if config is a
+// WebSocket listener. TLS is not set up by ServeListener, use Listen for that.
+func (server *Server) ServeListener(ln net.Listener, config ListenerConfig) error {
+	config.SetDefaults()
+
+	l, err := newListener(server, config)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+
+	if !server.trackListener(ln, true) {
+		ln.Close()
+		return ErrServerClosed
+	}
+	defer server.trackListener(ln, false)
+
+	l.log.Info("listening", "local_addr", ln.Addr().String())
+	err = l.serve(ln)
+	if server.isClosed() {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// Close stops all listeners and closes all connections. It waits for the
+// connection handlers to finish until ctx is done, after which the store is
+// closed.
+func (server *Server) Close(ctx context.Context) error {
+	err := server.stopListening()
+	server.closeConns()
+	err = errors.Join(err, server.waitForConnections(ctx))
+	return errors.Join(err, server.stop())
+}
+
+// Shutdown gracefully stops the server. It stops accepting connections,
+// sends the packets that are queued for every client followed by a
+// DISCONNECT with Server Shutting Down, and closes the connections.
+// Connections that are not closed when ctx is done are closed immediately.
+//
+// Sessions are kept as they would be after a lost connection, but wills that
+// wait for their delay and sessions that wait to expire are cancelled.
+func (server *Server) Shutdown(ctx context.Context) error {
+	err := server.stopListening()
+	server.disconnectClients(ctx, packet.ServerShuttingDown)
+	server.closeConns()
+	err = errors.Join(err, server.waitForConnections(ctx))
+	return errors.Join(err, server.stop())
+}
+
+func (server *Server) stopListening() error {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.closed = true
+	var err error
+	for ln := range server.listeners {
+		err = errors.Join(err, ln.Close())
+	}
+	return err
+}
+
+func (server *Server) closeConns() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	for conn := range server.conns {
+		conn.Close()
+	}
+}
+
+// disconnectClients shuts down the connections of all connected clients
+// concurrently, it returns when they are closed or ctx is done.
+func (server *Server) disconnectClients(ctx context.Context, reasonCode packet.ReasonCode) {
+	server.clientsMutex.Lock()
+	clients := make([]*Client, 0, len(server.clients))
+	for _, client := range server.clients {
+		client.Mutex.Lock()
+		if client.Conn != nil {
+			clients = append(clients, client)
+		}
+		client.Mutex.Unlock()
+	}
+	server.clientsMutex.Unlock()
+
+	server.logs.server.Info("disconnecting clients", "clients", len(clients), reasonCodeAttr(reasonCode))
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.shutdown(ctx, reasonCode)
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+func (server *Server) waitForConnections(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		server.connections.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		server.logs.server.Warn("connections did not close in time", "error", ctx.Err())
+		// Closing the connections again unblocks handlers that are writing.
+		server.closeConns()
+		return ctx.Err()
+	}
+}
+
+// stop cancels the timers of all sessions, so that nothing happens after
+// the server is closed, and closes the store.
+func (server *Server) stop() error {
+	server.clientsMutex.Lock()
+	for _, client := range server.clients {
+		client.stopTimers()
+	}
+	server.clientsMutex.Unlock()
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if server.stopped {
+		return nil
+	}
+	server.stopped = true
+	close(server.done)
+	if server.store == nil {
+		return nil
+	}
+	err := server.store.Close()
+	if err != nil {
+		server.logs.storage.Error("failed to close store", "error", err)
+	}
+	return err
+}
+
+// Publish publishes a message to all subscribers as if it was published by
+// a client.
+func (server *Server) Publish(topic string, payload []byte, qos types.QoS, retain bool) error {
+	return server.PublishMessage(Message{Topic: topic, Payload: payload, Qos: qos, Retain: retain})
+}
+
+// PublishMessage publishes message with its properties, like Publish.
+func (server *Server) PublishMessage(message Message) error {
+	return server.publishMessage(nil, message)
+}
+
+// publishMessage publishes message for client, which must be authorized to
+// publish to the topic, or for the server if client is nil.
+func (server *Server) publishMessage(client *Client, message Message) error {
+	topic := message.Topic
+	err := checkTopicName(topic)
+	if err != nil {
+		return err
+	}
+	if message.Qos > types.QoS2 {
+		return fmt.Errorf("invalid QoS: %d", message.Qos)
+	}
+	if server.isClosed() {
+		return ErrServerClosed
+	}
+
+	p, err := makePublishPacket(message)
+	if err != nil {
+		return err
+	}
+
+	sender := "server"
+	if client != nil {
+		sender = client.ID
+		// Only the broker publishes to its $SYS topics, whatever the ACL allows.
+		if isSysTopic(topic) || !client.authorized(auth.Write, topic) {
+			server.metrics.drop(dropNotAuthorized)
+			return fmt.Errorf("%w: %s", ErrNotAuthorized, topic)
+		}
+	}
+
+	reasonCode := server.onPublish(client, p)
+	if reasonCode != packet.Success {
+		if client != nil {
+			server.metrics.drop(dropRejectedByHook)
+		}
+		return fmt.Errorf("%w: reason code %x", ErrPublishRejected, reasonCode)
+	}
+	// A topic that was changed by a hook is checked again.
+	if rewritten := p.VariableHeader.TopicName.String(); rewritten != topic {
+		topic = rewritten
+		err = checkTopicName(topic)
+		if err != nil {
+			return err
+		}
+		if client != nil && (isSysTopic(topic) || !client.authorized(auth.Write, topic)) {
+			server.metrics.drop(dropNotAuthorized)
+			return fmt.Errorf("%w: %s", ErrNotAuthorized, topic)
+		}
+	}
+
+	// MQTT-3.3.1-8: If the retained flag is not set the message should not be stored.
+	if message.Retain {
+		server.addRetainedMessage(topic, p)
+	}
+
+	server.publish(p, topic, sender)
+	return nil
+}
+
+// checkTopicName returns an error if topic cannot be published to.
+func checkTopicName(topic string) error {
+	if topic == "" || strings.ContainsAny(topic, "+#") {
+		return fmt.Errorf("%w: %q", ErrInvalidTopicName, topic)
+	}
+	return nil
+}
+
+// Subscribe calls handler for every message published to a topic matching
+// filter. The returned function removes the subscription.
+func (server *Server) Subscribe(filter string, handler MessageHandler) (unsubscribe func()) {
+	server.handlersMutex.Lock()
+	defer server.handlersMutex.Unlock()
+
+	id := server.nextHandlerID
+	server.nextHandlerID++
+	server.handlers[id] = messageHandler{filter: filter, handler: handler}
+	server.cluster.subscribe(filter)
+
+	return func() {
+		server.handlersMutex.Lock()
+		defer server.handlersMutex.Unlock()
+		if _, ok := server.handlers[id]; ok {
+			delete(server.handlers, id)
+			server.cluster.unsubscribe(filter)
+		}
+	}
+}
+
+func (server *Server) publishToHandlers(p *packet.PublishPacket, topic string) {
+	server.handlersMutex.Lock()
+	handlers := make([]MessageHandler, 0, len(server.handlers))
+	for _, h := range server.handlers {
+		if topicMatches(h.filter, topic) {
+			handlers = append(handlers, h.handler)
+		}
+	}
+	server.handlersMutex.Unlock()
+
+	if len(handlers) == 0 {
+		return
+	}
+
+	message := makeMessage(topic, p)
+	for _, handler := range handlers {
+		handler(message)
+	}
+}
+
+// makePublishPacket makes the PUBLISH packet of message.
+func makePublishPacket(message Message) (*packet.PublishPacket, error) {
+	p := protocol.MakePublishPacket(message.Topic, message.Payload, message.Qos, message.Retain)
+	properties := message.Properties
+	if properties == nil {
+		return p, nil
+	}
+
+	header := &p.VariableHeader
+	if properties.UTF8Payload {
+		header.PayloadFormatIndicator = packet.UtfCharacterData
+	}
+	header.MessageExpiryInterval.Value = properties.MessageExpiryInterval
+	header.ContentType.Str = properties.ContentType
+	header.ResponseTopic.Str = properties.ResponseTopic
+	header.CorrelationData.Data = properties.CorrelationData
+	for _, userProperty := range properties.UserProperties {
+		header.UserProperties = append(header.UserProperties, types.UtfStringPair{
+			Name:  types.UtfString{Str: userProperty.Name},
+			Value: types.UtfString{Str: userProperty.Value},
+		})
+	}
+
+	err := header.EncodeProperties()
+	if err != nil {
+		return nil, fmt.Errorf("properties: %w", err)
+	}
+	return p, nil
+}
+
+// makeMessage makes the message of a PUBLISH packet to topic.
+func makeMessage(topic string, p *packet.PublishPacket) Message {
+	message := Message{
+		Topic:   topic,
+		Payload: p.Payload.Data,
+		Qos:     p.FixedHeader.Qos,
+		Retain:  p.FixedHeader.Retain,
+	}
+	if len(p.VariableHeader.PropertiesRaw) == 0 {
+		return message
+	}
+
+	header := &p.VariableHeader
+	message.Properties = &MessageProperties{
+		UTF8Payload:           header.PayloadFormatIndicator == packet.UtfCharacterData,
+		MessageExpiryInterval: header.MessageExpiryInterval.Value,
+		ContentType:           header.ContentType.Str,
+		ResponseTopic:         header.ResponseTopic.Str,
+		CorrelationData:       header.CorrelationData.Data,
+	}
+	for _, userProperty := range header.UserProperties {
+		message.Properties.UserProperties = append(message.Properties.UserProperties, UserProperty{
+			Name:  userProperty.Name.Str,
+			Value: userProperty.Value.Str,
+		})
+	}
+	return message
+}
+
+func (server *Server) isClosed() bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.closed
+}
+
+// trackListener adds or removes a listener from the set of listeners that
+// are closed when the server closes. It returns false if the server is
+// already closed.
+func (server *Server) trackListener(ln net.Listener, add bool) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if add {
+		if server.closed {
+			return false
+		}
+		server.listeners[ln] = struct{}{}
+	} else {
+		delete(server.listeners, ln)
+	}
+	return true
+}
+
+// trackConn is like trackListener but for connections, it also keeps
+// track of the number of running connection handlers.
+func (server *Server) trackConn(conn net.Conn, add bool) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if add {
+		if server.closed {
+			return false
+		}
+		server.conns[conn] = struct{}{}
+		server.connections.Add(1)
+	} else {
+		delete(server.conns, conn)
+		server.connections.Done()
+	}
+	return true
+}
@@ -0,0 +1,446 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/packet"
+	"github.com/DvdSpijker/GoBroker/protocol"
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+// startServer starts a server on a random local port and returns its address.
+func startServer(t *testing.T, config Config) (*Server, string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewServer(config)
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(ln) }()
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		err := server.Close(ctx)
+		if err != nil {
+			t.Errorf("close: %v", err)
+		}
+		err = <-served
+		if !errors.Is(err, ErrServerClosed) {
+			t.Errorf("wanted %v from Serve but got %v", ErrServerClosed, err)
+		}
+	})
+
+	return server, ln.Addr().String()
+}
+
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	framer *framer
+}
+
+// utfString encodes s as a length prefixed string.
+func utfString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+// withRemainingLength prefixes body with a fixed header.
+func withRemainingLength(firstByte byte, body []byte) []byte {
+	remainingLength, _ := (&types.VariableByteInteger{Value: int32(len(body))}).Encode()
+	return append(append([]byte{firstByte}, remainingLength...), body...)
+}
+
+// dialClient opens a connection without connecting.
+func dialClient(t *testing.T, address string) *testClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &testClient{t: t, conn: conn, framer: newFramer(conn, 0)}
+}
+
+// connectPacket creates an MQTT 5 CONNECT packet, the user name and
+// password are left out if they are empty.
+func connectPacket(clientID string, userName string, password string) []byte {
+	var flags byte = 0x02 // Clean start
+	if userName != "" {
+		flags |= 0x80
+	}
+	if password != "" {
+		flags |= 0x40
+	}
+
+	body := utfString("MQTT")
+	body = append(body,
+		5,     // Version
+		flags, // Connect flags
+		0, 60, // Keep alive
+		0, // Properties length
+	)
+	body = append(body, utfString(clientID)...)
+	if userName != "" {
+		body = append(body, utfString(userName)...)
+	}
+	if password != "" {
+		body = append(body, utfString(password)...)
+	}
+
+	return withRemainingLength(byte(packet.CONNECT), body)
+}
+
+// connect sends a CONNECT packet and returns the reason code of the CONNACK.
+func (client *testClient) connect(clientID string, userName string, password string) packet.ReasonCode {
+	client.t.Helper()
+
+	client.write(connectPacket(clientID, userName, password))
+
+	fixedHeader, bytes := client.read()
+	if fixedHeader.PacketType != packet.CONNACK {
+		client.t.Fatalf("wanted CONNACK but got packet type %v", fixedHeader.PacketType)
+	}
+	return packet.ReasonCode(bytes[3])
+}
+
+// connectClient opens a connection and connects anonymously.
+func connectClient(t *testing.T, address string, clientID string) *testClient {
+	t.Helper()
+
+	client := dialClient(t, address)
+	reasonCode := client.connect(clientID, "", "")
+	if reasonCode != packet.Success {
+		t.Fatalf("wanted successful CONNACK but got reason code %x", reasonCode)
+	}
+
+	return client
+}
+
+func (client *testClient) write(bytes []byte) {
+	client.t.Helper()
+
+	_, err := client.conn.Write(bytes)
+	if err != nil {
+		client.t.Fatal(err)
+	}
+}
+
+func (client *testClient) read() (packet.FixedHeader, []byte) {
+	client.t.Helper()
+
+	client.conn.SetReadDeadline(time.Now().Add(time.Second))
+	fixedHeader, bytes, err := client.framer.readPacket()
+	if err != nil {
+		client.t.Fatal(err)
+	}
+	return fixedHeader, bytes
+}
+
+// subscribe sends a SUBSCRIBE packet and returns the reason code of the SUBACK.
+func (client *testClient) subscribe(filter string) packet.ReasonCode {
+	client.t.Helper()
+
+	body := []byte{0, 1, 0} // Packet identifier and properties length
+	body = append(body, utfString(filter)...)
+	body = append(body, 0) // Subscription options
+	client.write(withRemainingLength(byte(packet.SUBSCRIBE)|byte(packet.SUBSCRIBEFLAGS), body))
+
+	fixedHeader, bytes := client.read()
+	if fixedHeader.PacketType != packet.SUBACK {
+		client.t.Fatalf("wanted SUBACK but got packet type %v", fixedHeader.PacketType)
+	}
+	return packet.ReasonCode(bytes[5])
+}
+
+// unsubscribe sends an UNSUBSCRIBE packet and returns the reason codes of
+// the UNSUBACK.
+func (client *testClient) unsubscribe(filters ...string) []packet.ReasonCode {
+	client.t.Helper()
+
+	body := []byte{0, 2, 0} // Packet identifier and properties length
+	for _, filter := range filters {
+		body = append(body, utfString(filter)...)
+	}
+	client.write(withRemainingLength(byte(packet.UNSUBSCRIBE)|byte(packet.UNSUBSCRIBEFLAGS), body))
+
+	fixedHeader, bytes := client.read()
+	if fixedHeader.PacketType != packet.UNSUBACK {
+		client.t.Fatalf("wanted UNSUBACK but got packet type %v", fixedHeader.PacketType)
+	}
+	unsubackPacket := packet.UnsubackPacket{}
+	_, err := unsubackPacket.Decode(bytes)
+	if err != nil {
+		client.t.Fatal(err)
+	}
+	return unsubackPacket.Payload.ReasonCodes
+}
+
+func (client *testClient) publish(topic string, payload string) {
+	client.t.Helper()
+
+	bytes, err := protocol.MakePublishPacket(topic, []byte(payload), types.QoS0, false).Encode()
+	if err != nil {
+		client.t.Fatal(err)
+	}
+	client.write(bytes)
+}
+
+// publishQoS1 publishes with QoS 1 and returns the reason code of the PUBACK.
+func (client *testClient) publishQoS1(topic string, payload string) packet.ReasonCode {
+	client.t.Helper()
+
+	bytes, err := protocol.MakePublishPacket(topic, []byte(payload), types.QoS1, false).Encode()
+	if err != nil {
+		client.t.Fatal(err)
+	}
+	client.write(bytes)
+
+	fixedHeader, bytes := client.read()
+	if fixedHeader.PacketType != packet.PUBACK {
+		client.t.Fatalf("wanted PUBACK but got packet type %v", fixedHeader.PacketType)
+	}
+	if len(bytes) < 5 {
+		return packet.Success
+	}
+	return packet.ReasonCode(bytes[4])
+}
+
+func TestPublishInvalidTopicName(t *testing.T) {
+	_, address := startServer(t, Config{})
+
+	for _, topic := range []string{"a/+", "a/#", ""} {
+		client := connectClient(t, address, "publisher")
+		client.publish(topic, "message")
+
+		// MQTT-3.3.2-2: A topic name with wildcards is a protocol error.
+		fixedHeader, bytes := client.read()
+		if fixedHeader.PacketType != packet.DISCONNECT || packet.ReasonCode(bytes[2]) != packet.TopicNameInvalid {
+			t.Fatalf("%q: wanted DISCONNECT %x but got %x", topic, packet.TopicNameInvalid, bytes)
+		}
+	}
+}
+
+func TestListenAndServeReady(t *testing.T) {
+	server := NewServer(Config{
+		Listeners: []ListenerConfig{{Address: "127.0.0.1:0"}},
+		Storage:   StorageConfig{Path: filepath.Join(t.TempDir(), "broker.log")},
+	})
+	served := make(chan error, 1)
+	go func() { served <- server.ListenAndServe() }()
+
+	select {
+	case <-server.Ready():
+	case err := <-served:
+		t.Fatal(err)
+	case <-time.After(time.Second):
+		t.Fatal("server not ready")
+	}
+	if server.store == nil {
+		t.Fatal("wanted the store to be open once the server is ready")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := server.Close(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-served
+	if !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("wanted %v from ListenAndServe but got %v", ErrServerClosed, err)
+	}
+}
+
+func TestServersAreIndependent(t *testing.T) {
+	serverA, addressA := startServer(t, Config{})
+	serverB, _ := startServer(t, Config{})
+
+	receivedA := make(chan Message, 1)
+	receivedB := make(chan Message, 1)
+	serverA.Subscribe("a/#", func(m Message) { receivedA <- m })
+	serverB.Subscribe("a/#", func(m Message) { receivedB <- m })
+
+	client := connectClient(t, addressA, "publisher")
+	client.publish("a/b", "hello")
+
+	select {
+	case m := <-receivedA:
+		if m.Topic != "a/b" || string(m.Payload) != "hello" {
+			t.Fatalf("wanted hello on a/b but got %s on %s", m.Payload, m.Topic)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not received on server A")
+	}
+
+	select {
+	case m := <-receivedB:
+		t.Fatalf("server B received a message published on server A: %v", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestServerPublish(t *testing.T) {
+	server, address := startServer(t, Config{})
+
+	client := connectClient(t, address, "subscriber")
+	client.subscribe("x/+")
+
+	err := server.Publish("x/y", []byte("from server"), types.QoS0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fixedHeader, bytes := client.read()
+	if fixedHeader.PacketType != packet.PUBLISH {
+		t.Fatalf("wanted PUBLISH but got packet type %v", fixedHeader.PacketType)
+	}
+	p := packet.PublishPacket{}
+	_, err = p.Decode(bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.VariableHeader.TopicName.String() != "x/y" || string(p.Payload.Data) != "from server" {
+		t.Fatalf("wanted 'from server' on x/y but got %q on %s",
+			p.Payload.Data, p.VariableHeader.TopicName.String())
+	}
+
+	err = server.Publish("x/#", nil, types.QoS0, false)
+	if !errors.Is(err, ErrInvalidTopicName) {
+		t.Fatalf("wanted %v but got %v", ErrInvalidTopicName, err)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	server, address := startServer(t, Config{})
+
+	client := connectClient(t, address, "subscriber")
+	client.subscribe("a/+")
+	client.subscribe("b/+")
+
+	reasonCodes := client.unsubscribe("a/+", "b/+", "c/+")
+	want := []packet.ReasonCode{packet.Success, packet.Success, packet.NoSubscriptionExisted}
+	if !slices.Equal(reasonCodes, want) {
+		t.Fatalf("wanted %v but got %v", want, reasonCodes)
+	}
+
+	server.Publish("a/b", []byte("unsubscribed"), types.QoS0, false)
+	server.Publish("b/b", []byte("unsubscribed"), types.QoS0, false)
+	client.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, _, err := client.framer.readPacket()
+	if err == nil {
+		t.Fatal("wanted no message after unsubscribing")
+	}
+}
+
+func TestServerSubscribeUnsubscribe(t *testing.T) {
+	server := NewServer(Config{})
+
+	received := 0
+	unsubscribe := server.Subscribe("a/+", func(Message) { received++ })
+
+	server.Publish("a/b", []byte("1"), types.QoS0, false)
+	server.Publish("b/b", []byte("2"), types.QoS0, false)
+	unsubscribe()
+	server.Publish("a/b", []byte("3"), types.QoS0, false)
+
+	if received != 1 {
+		t.Fatalf("wanted 1 message but got %d", received)
+	}
+}
+
+func TestBoundKeepAlive(t *testing.T) {
+	server := NewServer(Config{KeepAlive: KeepAliveConfig{Min: 10, Max: 600}})
+
+	keepAliveCases := []struct {
+		requested  uint16
+		want       uint16
+		overridden bool
+	}{
+		{requested: 60, want: 60},
+		{requested: 5, want: 10, overridden: true},
+		{requested: 1000, want: 600, overridden: true},
+		{requested: 0, want: 600, overridden: true},
+	}
+
+	for _, c := range keepAliveCases {
+		got, overridden := server.boundKeepAlive(c.requested)
+		if got != c.want || overridden != c.overridden {
+			t.Fatalf("requested %d: wanted %d (%t) but got %d (%t)",
+				c.requested, c.want, c.overridden, got, overridden)
+		}
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	server, address := startServer(t, Config{})
+	events := make(chan string, 100)
+	server.AddHook(&recordingHook{name: "hook", events: events})
+
+	subscriber := connectClient(t, address, "subscriber")
+	subscriber.subscribe("news")
+
+	// A will that waits for its delay is cancelled by the shutdown.
+	delayed := dialClient(t, address)
+	delayed.write(willConnectPacket("delayed", "wills/delayed", "gone", 1, 60))
+	delayed.read()
+
+	for _, payload := range []string{"1", "2", "3"} {
+		server.Publish("news", []byte(payload), types.QoS0, false)
+	}
+	expectEvents(t, events, "hook deliver subscriber", "hook deliver subscriber", "hook deliver subscriber")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The queued messages are sent before the DISCONNECT.
+	received := 0
+	for {
+		fixedHeader, bytes := subscriber.read()
+		if fixedHeader.PacketType == packet.DISCONNECT {
+			if packet.ReasonCode(bytes[2]) != packet.ServerShuttingDown {
+				t.Fatalf("wanted %x but got %x", packet.ServerShuttingDown, bytes[2])
+			}
+			break
+		}
+		if fixedHeader.PacketType == packet.PUBLISH {
+			received++
+		}
+	}
+	if received != 3 {
+		t.Fatalf("wanted 3 messages before the DISCONNECT but got %d", received)
+	}
+
+	_, err = net.DialTimeout("tcp", address, 100*time.Millisecond)
+	if err == nil {
+		t.Fatal("wanted no new connections to be accepted")
+	}
+
+	timeout := time.After(1500 * time.Millisecond)
+	for {
+		select {
+		case event := <-events:
+			if event == "hook will delayed" {
+				t.Fatal("wanted the delayed will to be cancelled")
+			}
+			continue
+		case <-timeout:
+		}
+		break
+	}
+}
@@ -0,0 +1,305 @@
+package broker
+
+import (
+	"math"
+	"slices"
+
+	"github.com/DvdSpijker/GoBroker/codec"
+	"github.com/DvdSpijker/GoBroker/packet"
+	"github.com/DvdSpijker/GoBroker/protocol"
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+type (
+	// inFlightMessage is a QoS 1 or 2 message sent to a client that was
+	// not acknowledged yet (4.3).
+	inFlightMessage struct {
+		packet *packet.PublishPacket
+		// The client sent a PUBREC and was sent a PUBREL, the delivery
+		// completes with a PUBCOMP.
+		released bool
+	}
+
+	// queuedMessage is a message for a client that is offline.
+	queuedMessage struct {
+		sequence uint64
+		packet   *packet.PublishPacket
+	}
+)
+
+// deliver sends a message that matched filter to the client. The message is
+// sent with at most the QoS of the subscription. QoS 1 and 2 messages are
+// queued while the client is offline, QoS 0 messages are dropped.
+func (client *Client) deliver(p *packet.PublishPacket, filter string) {
+	p, ok := client.server.onDeliver(client, p)
+	if !ok {
+		client.server.metrics.drop(dropRejectedByHook)
+		return
+	}
+
+	client.Mutex.Lock()
+	maximumQoS, ok := client.subscriptionQoS[filter]
+	if !ok {
+		// Unsubscribed in the meantime.
+		client.Mutex.Unlock()
+		return
+	}
+	qos := min(p.FixedHeader.Qos, maximumQoS)
+
+	if client.Conn == nil {
+		if qos > types.QoS0 {
+			client.enqueue(makeDelivery(p, qos, 0, false))
+		} else {
+			client.server.metrics.drop(dropClientOffline)
+		}
+		client.Mutex.Unlock()
+		return
+	}
+	delivery := client.startDelivery(p, qos)
+	client.Mutex.Unlock()
+
+	if delivery != nil {
+		client.send(delivery)
+	}
+}
+
+// startDelivery assigns a packet identifier to a QoS 1 or 2 message and
+// keeps it until it is acknowledged. It returns the packet to send, or nil
+// if the message was queued because all packet identifiers are in use. The
+// lock must be held.
+func (client *Client) startDelivery(p *packet.PublishPacket, qos types.QoS) *packet.PublishPacket {
+	if qos == types.QoS0 {
+		return makeDelivery(p, qos, 0, false)
+	}
+
+	packetIdentifier := client.newPacketIdentifier()
+	if packetIdentifier == 0 {
+		client.enqueue(makeDelivery(p, qos, 0, false))
+		return nil
+	}
+
+	delivery := makeDelivery(p, qos, packetIdentifier, false)
+	message := &inFlightMessage{packet: delivery}
+	client.inFlight[packetIdentifier] = message
+	client.server.persistInFlightMessage(client, packetIdentifier, message)
+
+	return delivery
+}
+
+// makeDelivery copies a PUBLISH packet to send it with another QoS and
+// packet identifier.
+func makeDelivery(p *packet.PublishPacket, qos types.QoS, packetIdentifier uint16, dup bool) *packet.PublishPacket {
+	delivery := *p
+	delivery.FixedHeader.Qos = qos
+	delivery.FixedHeader.Dup = dup
+	delivery.FixedHeader.CommonFixedHeader.Flags = packet.PublishPacketFlags(qos, dup, p.FixedHeader.Retain)
+	delivery.VariableHeader.PacketIdentifier = types.UnsignedInt{Value: uint32(packetIdentifier), Size: 2}
+	return &delivery
+}
+
+// copyPublishPacket copies a PUBLISH packet including its payload and
+// properties.
+func copyPublishPacket(p *packet.PublishPacket) *packet.PublishPacket {
+	c := *p
+	c.VariableHeader.PropertiesRaw = slices.Clone(p.VariableHeader.PropertiesRaw)
+	c.VariableHeader.CorrelationData.Data = slices.Clone(p.VariableHeader.CorrelationData.Data)
+	c.VariableHeader.UserProperties = slices.Clone(p.VariableHeader.UserProperties)
+	c.Payload.Data = slices.Clone(p.Payload.Data)
+	return &c
+}
+
+// newPacketIdentifier returns a packet identifier that is not used by an
+// in-flight message, or 0 if all are in use. The lock must be held.
+func (client *Client) newPacketIdentifier() uint16 {
+	for range math.MaxUint16 {
+		client.packetIdentifier++
+		// MQTT-2.2.1-3: Packet identifiers are non-zero.
+		if client.packetIdentifier == 0 {
+			client.packetIdentifier = 1
+		}
+		if _, used := client.inFlight[client.packetIdentifier]; !used {
+			return client.packetIdentifier
+		}
+	}
+	return 0
+}
+
+// enqueue adds a message to the offline queue, the lock must be held.
+func (client *Client) enqueue(p *packet.PublishPacket) {
+	maxQueued := client.server.config.Sessions.MaxQueuedMessages
+	if maxQueued > 0 && len(client.queue) >= maxQueued {
+		client.log.Warn("offline queue is full, dropped message", "topic", p.VariableHeader.TopicName.String())
+		client.server.metrics.drop(dropQueueFull)
+		return
+	}
+
+	client.queueSequence++
+	message := queuedMessage{sequence: client.queueSequence, packet: p}
+	client.queue = append(client.queue, message)
+	client.server.persistQueuedMessage(client, message)
+}
+
+// resumeSession sends the messages of a resumed session that were not
+// acknowledged (4.4), followed by the messages that were queued while the
+// client was offline.
+func (client *Client) resumeSession() {
+	client.Mutex.Lock()
+
+	var packets []codec.Encoder
+	packetIdentifiers := make([]uint16, 0, len(client.inFlight))
+	for packetIdentifier := range client.inFlight {
+		packetIdentifiers = append(packetIdentifiers, packetIdentifier)
+	}
+	slices.Sort(packetIdentifiers)
+
+	for _, packetIdentifier := range packetIdentifiers {
+		message := client.inFlight[packetIdentifier]
+		if message.released {
+			packets = append(packets, protocol.MakePubrel(packetIdentifier, packet.Success))
+			continue
+		}
+		// MQTT-3.3.1-1: The DUP flag is set on messages that are sent again.
+		message.packet = makeDelivery(message.packet, message.packet.FixedHeader.Qos, packetIdentifier, true)
+		packets = append(packets, message.packet)
+	}
+
+	queue := client.queue
+	client.queue = nil
+	for i, message := range queue {
+		delivery := client.startDelivery(message.packet, message.packet.FixedHeader.Qos)
+		if delivery == nil {
+			// startDelivery queued the message again, so must the rest.
+			client.queue = append(client.queue, queue[i+1:]...)
+			break
+		}
+		client.server.deletePersistedQueuedMessage(client, message)
+		packets = append(packets, delivery)
+	}
+
+	client.Mutex.Unlock()
+
+	if len(packets) > 0 {
+		client.log.Debug("resuming session", "messages", len(packets))
+	}
+	for _, p := range packets {
+		client.send(p)
+	}
+}
+
+func (client *Client) send(p codec.Encoder) {
+	bytes, err := p.Encode()
+	if err != nil {
+		client.log.Error("failed to encode packet", "error", err)
+		return
+	}
+	_, err = client.Write(bytes)
+	if err != nil {
+		client.log.Warn("failed to send packet", "error", err)
+	}
+}
+
+// puback completes the delivery of a QoS 1 message.
+func (client *Client) puback(p *packet.PubackPacket) {
+	packetIdentifier := uint16(p.VariableHeader.PacketIdentifer.Value)
+	client.log.Debug("received PUBACK", "packet_identifier", packetIdentifier)
+
+	client.Mutex.Lock()
+	defer client.Mutex.Unlock()
+
+	message, ok := client.inFlight[packetIdentifier]
+	if !ok || message.packet.FixedHeader.Qos != types.QoS1 {
+		client.log.Debug("PUBACK for unknown packet identifier", "packet_identifier", packetIdentifier)
+		return
+	}
+	delete(client.inFlight, packetIdentifier)
+	client.server.deletePersistedInFlightMessage(client, packetIdentifier)
+}
+
+// pubrec acknowledges the receipt of a QoS 2 message, the client is sent a
+// PUBREL to release it.
+func (client *Client) pubrec(p *packet.PubrecPacket) {
+	packetIdentifier := uint16(p.VariableHeader.PacketIdentifer.Value)
+	client.log.Debug("received PUBREC", "packet_identifier", packetIdentifier)
+
+	client.Mutex.Lock()
+	message, ok := client.inFlight[packetIdentifier]
+	if !ok || message.packet.FixedHeader.Qos != types.QoS2 {
+		client.Mutex.Unlock()
+		client.log.Debug("PUBREC for unknown packet identifier", "packet_identifier", packetIdentifier)
+		client.send(protocol.MakePubrel(packetIdentifier, packet.PacketIdentifierNotFound))
+		return
+	}
+
+	// 4.3.3: A PUBREC with an error reason code ends the delivery.
+	if p.VariableHeader.ReasonCode >= packet.UnspecifiedError {
+		delete(client.inFlight, packetIdentifier)
+		client.server.deletePersistedInFlightMessage(client, packetIdentifier)
+		client.Mutex.Unlock()
+		return
+	}
+
+	message.released = true
+	client.server.persistInFlightMessage(client, packetIdentifier, message)
+	client.Mutex.Unlock()
+
+	client.send(protocol.MakePubrel(packetIdentifier, packet.Success))
+}
+
+// pubcomp completes the delivery of a QoS 2 message.
+func (client *Client) pubcomp(p *packet.PubcompPacket) {
+	packetIdentifier := uint16(p.VariableHeader.PacketIdentifer.Value)
+	client.log.Debug("received PUBCOMP", "packet_identifier", packetIdentifier)
+
+	client.Mutex.Lock()
+	defer client.Mutex.Unlock()
+
+	message, ok := client.inFlight[packetIdentifier]
+	if !ok || !message.released {
+		client.log.Debug("PUBCOMP for unknown packet identifier", "packet_identifier", packetIdentifier)
+		return
+	}
+	delete(client.inFlight, packetIdentifier)
+	client.server.deletePersistedInFlightMessage(client, packetIdentifier)
+}
+
+// receive keeps the packet identifier of a QoS 2 message from the client
+// until the client releases it.
+func (client *Client) receive(p *packet.PublishPacket) {
+	packetIdentifier := uint16(p.VariableHeader.PacketIdentifier.Value)
+
+	client.Mutex.Lock()
+	defer client.Mutex.Unlock()
+
+	client.received[packetIdentifier] = struct{}{}
+	client.server.persistReceived(client, packetIdentifier)
+}
+
+// hasReceived reports whether a QoS 2 message with the packet identifier of
+// p was received and not released yet.
+func (client *Client) hasReceived(p *packet.PublishPacket) bool {
+	client.Mutex.Lock()
+	defer client.Mutex.Unlock()
+
+	_, ok := client.received[uint16(p.VariableHeader.PacketIdentifier.Value)]
+	return ok
+}
+
+// pubrel releases the packet identifier of a QoS 2 message from the client.
+func (client *Client) pubrel(p *packet.PubrelPacket) {
+	packetIdentifier := uint16(p.VariableHeader.PacketIdentifer.Value)
+	client.log.Debug("received PUBREL", "packet_identifier", packetIdentifier)
+
+	client.Mutex.Lock()
+	_, ok := client.received[packetIdentifier]
+	if ok {
+		delete(client.received, packetIdentifier)
+		client.server.deletePersistedReceived(client, packetIdentifier)
+	}
+	client.Mutex.Unlock()
+
+	reasonCode := packet.Success
+	if !ok {
+		reasonCode = packet.PacketIdentifierNotFound
+	}
+	client.send(protocol.MakePubcomp(packetIdentifier, reasonCode))
+}
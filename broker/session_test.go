@@ -0,0 +1,534 @@
+package broker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/codec"
+	"github.com/DvdSpijker/GoBroker/packet"
+	"github.com/DvdSpijker/GoBroker/protocol"
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+// sessionConnectPacket creates a CONNECT packet with a session expiry
+// interval in seconds.
+func sessionConnectPacket(clientID string, cleanStart bool, sessionExpiry uint32) []byte {
+	var flags byte
+	if cleanStart {
+		flags = 0x02
+	}
+	properties := fourByteProperty(packet.SessionExpiryIntervalProperty, sessionExpiry)
+
+	body := utfString("MQTT")
+	body = append(body, 5, flags, 0, 60, byte(len(properties)))
+	body = append(body, properties...)
+	body = append(body, utfString(clientID)...)
+
+	return withRemainingLength(byte(packet.CONNECT), body)
+}
+
+// sessionConnect connects with a session expiry interval in seconds and
+// returns whether the CONNACK has the session present flag.
+func (client *testClient) sessionConnect(clientID string, cleanStart bool, sessionExpiry uint32) bool {
+	client.t.Helper()
+
+	client.write(sessionConnectPacket(clientID, cleanStart, sessionExpiry))
+
+	fixedHeader, bytes := client.read()
+	if fixedHeader.PacketType != packet.CONNACK {
+		client.t.Fatalf("wanted CONNACK but got packet type %v", fixedHeader.PacketType)
+	}
+	if reasonCode := packet.ReasonCode(bytes[3]); reasonCode != packet.Success {
+		client.t.Fatalf("wanted successful CONNACK but got reason code %x", reasonCode)
+	}
+	return bytes[2]&byte(packet.SessionPresent) != 0
+}
+
+// subscribeQoS subscribes with a maximum QoS and returns the reason code of
+// the SUBACK.
+func (client *testClient) subscribeQoS(filter string, qos types.QoS) packet.ReasonCode {
+	client.t.Helper()
+
+	body := []byte{0, 1, 0} // Packet identifier and properties length
+	body = append(body, utfString(filter)...)
+	body = append(body, byte(qos))
+	client.write(withRemainingLength(byte(packet.SUBSCRIBE)|byte(packet.SUBSCRIBEFLAGS), body))
+
+	fixedHeader, bytes := client.read()
+	if fixedHeader.PacketType != packet.SUBACK {
+		client.t.Fatalf("wanted SUBACK but got packet type %v", fixedHeader.PacketType)
+	}
+	return packet.ReasonCode(bytes[5])
+}
+
+func (client *testClient) readPublish() *packet.PublishPacket {
+	client.t.Helper()
+
+	fixedHeader, bytes := client.read()
+	if fixedHeader.PacketType != packet.PUBLISH {
+		client.t.Fatalf("wanted PUBLISH but got packet type %v", fixedHeader.PacketType)
+	}
+	p := &packet.PublishPacket{}
+	_, err := p.Decode(bytes)
+	if err != nil {
+		client.t.Fatal(err)
+	}
+	return p
+}
+
+// readAcknowledgement reads a PUBACK, PUBREC, PUBREL or PUBCOMP packet.
+func (client *testClient) readAcknowledgement(packetType packet.PacketType) packet.PubackVariableHeader {
+	client.t.Helper()
+
+	fixedHeader, bytes := client.read()
+	if fixedHeader.PacketType != packetType {
+		client.t.Fatalf("wanted packet type %v but got %v", packetType, fixedHeader.PacketType)
+	}
+	p := &packet.PubrecPacket{}
+	_, err := p.Decode(bytes)
+	if err != nil {
+		client.t.Fatal(err)
+	}
+	return p.VariableHeader
+}
+
+func (client *testClient) send(p codec.Encoder) {
+	client.t.Helper()
+
+	bytes, err := p.Encode()
+	if err != nil {
+		client.t.Fatal(err)
+	}
+	client.write(bytes)
+}
+
+func makeAcknowledgement(packetIdentifier types.UnsignedInt) packet.PubackVariableHeader {
+	return packet.PubackVariableHeader{PacketIdentifer: types.UnsignedInt{Value: packetIdentifier.Value, Size: 2}}
+}
+
+// waitOffline waits until the server handled the disconnect of a client.
+func waitOffline(t *testing.T, server *Server, clientID string) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		server.clientsMutex.Lock()
+		client := server.clients[clientID]
+		server.clientsMutex.Unlock()
+		if client != nil {
+			client.Mutex.Lock()
+			offline := client.Conn == nil
+			client.Mutex.Unlock()
+			if offline {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s did not go offline", clientID)
+}
+
+var deliveryQoSCases = []struct {
+	publish   types.QoS
+	subscribe types.QoS
+	want      types.QoS
+}{
+	{publish: types.QoS0, subscribe: types.QoS2, want: types.QoS0},
+	{publish: types.QoS1, subscribe: types.QoS2, want: types.QoS1},
+	{publish: types.QoS2, subscribe: types.QoS2, want: types.QoS2},
+	{publish: types.QoS2, subscribe: types.QoS1, want: types.QoS1},
+	{publish: types.QoS2, subscribe: types.QoS0, want: types.QoS0},
+}
+
+func TestDeliveryQoS(t *testing.T) {
+	for _, c := range deliveryQoSCases {
+		server, address := startServer(t, Config{})
+		subscriber := connectClient(t, address, "subscriber")
+		reasonCode := subscriber.subscribeQoS("qos", c.subscribe)
+		if reasonCode != packet.ReasonCode(c.subscribe) {
+			t.Fatalf("wanted %v but got %v", c.subscribe, reasonCode)
+		}
+
+		err := server.Publish("qos", []byte("message"), c.publish, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := subscriber.readPublish()
+		if p.FixedHeader.Qos != c.want {
+			t.Fatalf("wanted %v but got %v", c.want, p.FixedHeader.Qos)
+		}
+		if c.want > types.QoS0 && p.VariableHeader.PacketIdentifier.Value == 0 {
+			t.Fatalf("wanted a packet identifier but got 0")
+		}
+	}
+}
+
+func TestQoS1Delivery(t *testing.T) {
+	server, address := startServer(t, Config{})
+	subscriber := connectClient(t, address, "subscriber")
+	subscriber.subscribeQoS("qos1", types.QoS1)
+
+	server.Publish("qos1", []byte("first"), types.QoS1, false)
+	first := subscriber.readPublish()
+	subscriber.send(&packet.PubackPacket{VariableHeader: makeAcknowledgement(first.VariableHeader.PacketIdentifier)})
+
+	server.Publish("qos1", []byte("second"), types.QoS1, false)
+	second := subscriber.readPublish()
+	if second.VariableHeader.PacketIdentifier.Value == first.VariableHeader.PacketIdentifier.Value {
+		t.Fatalf("wanted a new packet identifier but got %d again", second.VariableHeader.PacketIdentifier.Value)
+	}
+
+	client := server.clients["subscriber"]
+	deadline := time.Now().Add(time.Second)
+	for {
+		client.Mutex.Lock()
+		inFlight := len(client.inFlight)
+		client.Mutex.Unlock()
+		if inFlight == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("wanted 1 in-flight message but got %d", inFlight)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestQoS2Delivery(t *testing.T) {
+	server, address := startServer(t, Config{})
+	subscriber := connectClient(t, address, "subscriber")
+	subscriber.subscribeQoS("qos2", types.QoS2)
+
+	server.Publish("qos2", []byte("message"), types.QoS2, false)
+	p := subscriber.readPublish()
+	if p.FixedHeader.Qos != types.QoS2 {
+		t.Fatalf("wanted %v but got %v", types.QoS2, p.FixedHeader.Qos)
+	}
+
+	subscriber.send(&packet.PubrecPacket{VariableHeader: makeAcknowledgement(p.VariableHeader.PacketIdentifier)})
+	pubrel := subscriber.readAcknowledgement(packet.PUBREL)
+	if pubrel.PacketIdentifer.Value != p.VariableHeader.PacketIdentifier.Value || pubrel.ReasonCode != packet.Success {
+		t.Fatalf("wanted PUBREL for %d but got %+v", p.VariableHeader.PacketIdentifier.Value, pubrel)
+	}
+	subscriber.send(&packet.PubcompPacket{VariableHeader: makeAcknowledgement(p.VariableHeader.PacketIdentifier)})
+
+	// A PUBREC for a completed delivery is answered with an error.
+	subscriber.send(&packet.PubrecPacket{VariableHeader: makeAcknowledgement(p.VariableHeader.PacketIdentifier)})
+	pubrel = subscriber.readAcknowledgement(packet.PUBREL)
+	if pubrel.ReasonCode != packet.PacketIdentifierNotFound {
+		t.Fatalf("wanted %x but got %x", packet.PacketIdentifierNotFound, pubrel.ReasonCode)
+	}
+}
+
+func TestQoS2Receive(t *testing.T) {
+	server, address := startServer(t, Config{})
+	received := make(chan Message, 10)
+	server.Subscribe("qos2", func(message Message) { received <- message })
+
+	publisher := connectClient(t, address, "publisher")
+	p := protocol.MakePublishPacket("qos2", []byte("once"), types.QoS2, false)
+	p.VariableHeader.PacketIdentifier = types.UnsignedInt{Value: 7, Size: 2}
+
+	publisher.send(p)
+	pubrec := publisher.readAcknowledgement(packet.PUBREC)
+	if pubrec.PacketIdentifer.Value != 7 || pubrec.ReasonCode != packet.Success {
+		t.Fatalf("wanted PUBREC for 7 but got %+v", pubrec)
+	}
+
+	// MQTT-4.3.3-10: A resent message is not published again.
+	p.FixedHeader.Dup = true
+	p.FixedHeader.CommonFixedHeader.Flags = packet.PublishPacketFlags(types.QoS2, true, false)
+	publisher.send(p)
+	publisher.readAcknowledgement(packet.PUBREC)
+
+	publisher.send(protocol.MakePubrel(7, packet.Success))
+	pubcomp := publisher.readAcknowledgement(packet.PUBCOMP)
+	if pubcomp.PacketIdentifer.Value != 7 || pubcomp.ReasonCode != packet.Success {
+		t.Fatalf("wanted PUBCOMP for 7 but got %+v", pubcomp)
+	}
+
+	publisher.send(protocol.MakePubrel(7, packet.Success))
+	pubcomp = publisher.readAcknowledgement(packet.PUBCOMP)
+	if pubcomp.ReasonCode != packet.PacketIdentifierNotFound {
+		t.Fatalf("wanted %x but got %x", packet.PacketIdentifierNotFound, pubcomp.ReasonCode)
+	}
+
+	<-received
+	select {
+	case message := <-received:
+		t.Fatalf("wanted one message but also got %+v", message)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestOfflineQueue(t *testing.T) {
+	server, address := startServer(t, Config{})
+
+	subscriber := dialClient(t, address)
+	if subscriber.sessionConnect("offline", true, 3600) {
+		t.Fatalf("wanted no session present on a clean start")
+	}
+	subscriber.subscribeQoS("queue/#", types.QoS1)
+	subscriber.conn.Close()
+	waitOffline(t, server, "offline")
+
+	server.Publish("queue/a", []byte("first"), types.QoS1, false)
+	server.Publish("queue/b", []byte("dropped"), types.QoS0, false)
+	server.Publish("queue/c", []byte("second"), types.QoS2, false)
+
+	subscriber = dialClient(t, address)
+	if !subscriber.sessionConnect("offline", false, 3600) {
+		t.Fatalf("wanted the session to be present")
+	}
+	// Deliveries happen concurrently, so the order of the topics is undefined.
+	got := make(map[string]bool)
+	for range 2 {
+		p := subscriber.readPublish()
+		if p.FixedHeader.Qos != types.QoS1 {
+			t.Fatalf("wanted QoS 1 but got QoS %d", p.FixedHeader.Qos)
+		}
+		got[string(p.Payload.Data)] = true
+	}
+	if !got["first"] || !got["second"] {
+		t.Fatalf("wanted first and second but got %v", got)
+	}
+
+	// A clean start discards the session.
+	subscriber.conn.Close()
+	waitOffline(t, server, "offline")
+	subscriber = dialClient(t, address)
+	if subscriber.sessionConnect("offline", true, 0) {
+		t.Fatalf("wanted no session present on a clean start")
+	}
+}
+
+func TestOfflineQueueLimit(t *testing.T) {
+	server, address := startServer(t, Config{Sessions: SessionsConfig{MaxQueuedMessages: 2}})
+
+	subscriber := dialClient(t, address)
+	subscriber.sessionConnect("limited", true, 3600)
+	subscriber.subscribeQoS("queue", types.QoS1)
+	subscriber.conn.Close()
+	waitOffline(t, server, "limited")
+
+	for _, payload := range []string{"1", "2", "3"} {
+		server.Publish("queue", []byte(payload), types.QoS1, false)
+	}
+
+	// Deliveries happen concurrently, so which message is dropped is undefined.
+	deadline := time.Now().Add(time.Second)
+	client := server.clients["limited"]
+	for {
+		client.Mutex.Lock()
+		queued := len(client.queue)
+		client.Mutex.Unlock()
+		if queued == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("wanted 2 queued messages but got %d", queued)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	client.Mutex.Lock()
+	queued := len(client.queue)
+	client.Mutex.Unlock()
+	if queued != 2 {
+		t.Fatalf("wanted 2 queued messages but got %d", queued)
+	}
+}
+
+func TestSessionTakeOver(t *testing.T) {
+	server, address := startServer(t, Config{})
+
+	first := dialClient(t, address)
+	first.sessionConnect("twice", true, 3600)
+	first.subscribeQoS("takeover/#", types.QoS1)
+
+	second := dialClient(t, address)
+	if !second.sessionConnect("twice", false, 3600) {
+		t.Fatal("wanted the session of the connected client to be present")
+	}
+
+	// MQTT-3.1.4-3: The existing connection is closed with Session Taken Over.
+	fixedHeader, bytes := first.read()
+	if fixedHeader.PacketType != packet.DISCONNECT || packet.ReasonCode(bytes[2]) != packet.SessionTakenOver {
+		t.Fatalf("wanted DISCONNECT with Session Taken Over but got %v %x", fixedHeader.PacketType, bytes)
+	}
+
+	// The subscription is part of the session that moved to the new connection.
+	server.Publish("takeover/a", []byte("moved"), types.QoS0, false)
+	p := second.readPublish()
+	if string(p.Payload.Data) != "moved" {
+		t.Fatalf("wanted moved but got %q", p.Payload.Data)
+	}
+}
+
+func TestConcurrentSessionTakeOver(t *testing.T) {
+	server, address := startServer(t, Config{})
+
+	clients := make([]*testClient, 20)
+	for i := range clients {
+		clients[i] = dialClient(t, address)
+	}
+
+	// Every connect takes over the session from the previous one, in
+	// whatever order they arrive.
+	errs := make(chan error, len(clients))
+	for i, client := range clients {
+		go func() {
+			_, err := client.conn.Write(sessionConnectPacket("dup", i%2 == 0, 60))
+			if err != nil {
+				errs <- err
+				return
+			}
+			client.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			fixedHeader, bytes, err := client.framer.readPacket()
+			if err == nil && (fixedHeader.PacketType != packet.CONNACK || packet.ReasonCode(bytes[3]) != packet.Success) {
+				err = fmt.Errorf("wanted successful CONNACK but got %v %x", fixedHeader.PacketType, bytes)
+			}
+			errs <- err
+		}()
+	}
+	for range clients {
+		err := <-errs
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	session, err := server.Session("dup")
+	if err != nil || !session.Connected {
+		t.Fatalf("wanted the session to be connected but got %+v, %v", session, err)
+	}
+
+	// The connection that took over last is the only one that is not
+	// closed with Session Taken Over.
+	var connected *testClient
+	for _, client := range clients {
+		client.conn.SetReadDeadline(time.Now().Add(time.Second))
+		fixedHeader, bytes, err := client.framer.readPacket()
+		if err != nil {
+			if connected != nil {
+				t.Fatalf("wanted one connected client but got more: %v", err)
+			}
+			connected = client
+			continue
+		}
+		if fixedHeader.PacketType != packet.DISCONNECT || packet.ReasonCode(bytes[2]) != packet.SessionTakenOver {
+			t.Fatalf("wanted DISCONNECT with Session Taken Over but got %v %x", fixedHeader.PacketType, bytes)
+		}
+	}
+	if connected == nil {
+		t.Fatal("wanted one connected client but got none")
+	}
+
+	connected.subscribe("dup/#")
+	server.Publish("dup/a", []byte("last"), types.QoS0, false)
+	p := connected.readPublish()
+	if string(p.Payload.Data) != "last" {
+		t.Fatalf("wanted last but got %q", p.Payload.Data)
+	}
+}
+
+func TestDisconnectWill(t *testing.T) {
+	server, address := startServer(t, Config{})
+
+	subscriber := connectClient(t, address, "subscriber")
+	subscriber.subscribe("wills/+")
+
+	disconnectCases := []struct {
+		name          string
+		sessionExpiry uint32
+		disconnect    []byte // Closes the connection without DISCONNECT if nil.
+		will          bool
+		session       bool
+		reasonCode    packet.ReasonCode // DISCONNECT sent by the server, if any.
+	}{
+		{name: "normal", disconnect: []byte{0xe0, 0}, will: false},
+		{name: "normal with reason code", disconnect: []byte{0xe0, 1, 0x00}, will: false},
+		{name: "with will", disconnect: []byte{0xe0, 1, 0x04}, will: true},
+		{name: "error", disconnect: []byte{0xe0, 1, 0x80}, will: true},
+		{name: "closed", will: true},
+		{name: "session kept", sessionExpiry: 60, disconnect: []byte{0xe0, 0}, session: true},
+		{name: "session ended", sessionExpiry: 60,
+			disconnect: append([]byte{0xe0, 7, 0x00, 5}, fourByteProperty(packet.SessionExpiryIntervalProperty, 0)...)},
+		{name: "session extended", sessionExpiry: 0,
+			disconnect: append([]byte{0xe0, 7, 0x00, 5}, fourByteProperty(packet.SessionExpiryIntervalProperty, 60)...),
+			will:       true, reasonCode: packet.ProtocolError},
+	}
+
+	for i, c := range disconnectCases {
+		clientID := fmt.Sprintf("client-%d", i)
+		client := dialClient(t, address)
+		client.write(willConnectPacket(clientID, "wills/"+clientID, "gone", 0, c.sessionExpiry))
+		client.read()
+
+		if c.disconnect != nil {
+			client.write(c.disconnect)
+		}
+		if c.reasonCode != 0 {
+			fixedHeader, bytes := client.read()
+			if fixedHeader.PacketType != packet.DISCONNECT || packet.ReasonCode(bytes[2]) != c.reasonCode {
+				t.Fatalf("%s: wanted DISCONNECT with reason code %x but got %v %x",
+					c.name, c.reasonCode, fixedHeader.PacketType, bytes)
+			}
+		}
+		client.conn.Close()
+		waitForCluster(t, func() bool {
+			session, err := server.Session(clientID)
+			return err != nil || !session.Connected
+		})
+
+		// The will of the next case is published after this one, if any.
+		subscriber.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		fixedHeader, bytes, err := subscriber.framer.readPacket()
+		if c.will {
+			if err != nil || fixedHeader.PacketType != packet.PUBLISH {
+				t.Fatalf("%s: wanted the will but got %v", c.name, err)
+			}
+			p := packet.PublishPacket{}
+			p.Decode(bytes)
+			if topic := p.VariableHeader.TopicName.String(); topic != "wills/"+clientID {
+				t.Fatalf("%s: wanted the will on wills/%s but got %s", c.name, clientID, topic)
+			}
+		} else if err == nil {
+			t.Fatalf("%s: wanted no will but got packet type %v", c.name, fixedHeader.PacketType)
+		}
+
+		_, err = server.Session(clientID)
+		if (err == nil) != c.session {
+			t.Fatalf("%s: wanted session %v but got %v", c.name, c.session, err)
+		}
+	}
+}
+
+func TestWriteAfterDisconnect(t *testing.T) {
+	server, address := startServer(t, Config{SendQueueSize: 1})
+	client := dialClient(t, address)
+	client.sessionConnect("offline", true, 60)
+	client.conn.Close()
+	waitOffline(t, server, "offline")
+
+	server.clientsMutex.Lock()
+	session := server.clients["offline"]
+	server.clientsMutex.Unlock()
+
+	// Packets for a connection that ended are dropped instead of blocking
+	// once the send queue is full.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 3 {
+			session.Write([]byte{byte(packet.PINGRESP), 0})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Write blocked after the client disconnected")
+	}
+}
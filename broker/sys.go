@@ -0,0 +1,213 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/packet"
+	"github.com/DvdSpijker/GoBroker/protocol"
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+// Version is reported in $SYS/broker/version, it can be set at build time
+// with -ldflags "-X github.com/DvdSpijker/GoBroker/broker.Version=...".
+var Version = "dev"
+
+// DefaultSysInterval is the default number of seconds between updates of
+// the $SYS topics.
+const DefaultSysInterval = 10
+
+const sysTopicPrefix = "$SYS/"
+
+// sysLoadWindows are the periods the load topics are averaged over.
+var sysLoadWindows = []struct {
+	name   string
+	window time.Duration
+}{
+	{name: "1min", window: time.Minute},
+	{name: "5min", window: 5 * time.Minute},
+	{name: "15min", window: 15 * time.Minute},
+}
+
+type (
+	// sysLoad is the moving average of the rate of a counter in units per
+	// minute.
+	sysLoad struct {
+		topic    string
+		window   time.Duration
+		counter  func() uint64
+		previous uint64
+		average  float64
+		started  bool
+	}
+
+	// Stats are the statistics of the broker that are published in the
+	// $SYS topics.
+	Stats struct {
+		Version             string `json:"version"`
+		Uptime              int64  `json:"uptime"` // Seconds.
+		ClientsConnected    int    `json:"clients_connected"`
+		ClientsDisconnected int    `json:"clients_disconnected"` // Offline sessions.
+		Clients             int    `json:"clients"`              // Sessions, connected or not.
+		MessagesReceived    uint64 `json:"messages_received"`
+		MessagesSent        uint64 `json:"messages_sent"`
+		BytesReceived       uint64 `json:"bytes_received"`
+		BytesSent           uint64 `json:"bytes_sent"`
+		RetainedMessages    int    `json:"retained_messages"`
+		RetainedBytes       int    `json:"retained_bytes"`
+		Subscriptions       int    `json:"subscriptions"`
+	}
+
+	clientEvent struct {
+		ClientID   string    `json:"client_id"`
+		UserName   string    `json:"user_name,omitempty"`
+		RemoteAddr string    `json:"remote_addr,omitempty"`
+		KeepAlive  int       `json:"keep_alive,omitempty"` // Seconds.
+		CleanStart bool      `json:"clean_start,omitempty"`
+		Time       time.Time `json:"time"`
+	}
+)
+
+// isSysTopic reports whether topic is in the $SYS tree of the broker.
+func isSysTopic(topic string) bool {
+	return strings.HasPrefix(topic, sysTopicPrefix)
+}
+
+// publishSysTopics publishes the statistics of the broker to retained $SYS
+// topics every interval until the server is stopped.
+func (server *Server) publishSysTopics(interval time.Duration) {
+	var loads []*sysLoad
+	for _, counter := range []struct {
+		topic   string
+		counter func() uint64
+	}{
+		{topic: "messages/received", counter: server.metrics.packetsReceived.With(packet.PUBLISH.String()).Value},
+		{topic: "messages/sent", counter: server.metrics.packetsSent.With(packet.PUBLISH.String()).Value},
+		{topic: "bytes/received", counter: server.metrics.bytesReceived.Sum},
+		{topic: "bytes/sent", counter: server.metrics.bytesSent.Sum},
+	} {
+		for _, window := range sysLoadWindows {
+			loads = append(loads, &sysLoad{
+				topic:    "$SYS/broker/load/" + counter.topic + "/" + window.name,
+				window:   window.window,
+				counter:  counter.counter,
+				previous: counter.counter(),
+			})
+		}
+	}
+
+	server.publishSys("$SYS/broker/version", "gobroker version "+Version)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		server.publishSysStats()
+
+		select {
+		case <-ticker.C:
+		case <-server.done:
+			return
+		}
+
+		for _, load := range loads {
+			load.update(interval)
+			server.publishSys(load.topic, strconv.FormatFloat(load.average, 'f', 2, 64))
+		}
+	}
+}
+
+// Stats returns the current statistics of the broker.
+func (server *Server) Stats() Stats {
+	retained, retainedSize := server.retainedStats()
+	connected := server.countClients(func(client *Client) int {
+		if client.Conn == nil {
+			return 0
+		}
+		return 1
+	})
+	sessions := server.countClients(func(client *Client) int { return 1 })
+
+	return Stats{
+		Version:             Version,
+		Uptime:              int64(time.Since(server.started).Seconds()),
+		ClientsConnected:    connected,
+		ClientsDisconnected: sessions - connected,
+		Clients:             sessions,
+		MessagesReceived:    server.metrics.packetsReceived.With(packet.PUBLISH.String()).Value(),
+		MessagesSent:        server.metrics.packetsSent.With(packet.PUBLISH.String()).Value(),
+		BytesReceived:       server.metrics.bytesReceived.Sum(),
+		BytesSent:           server.metrics.bytesSent.Sum(),
+		RetainedMessages:    retained,
+		RetainedBytes:       retainedSize,
+		Subscriptions:       server.countSubscriptions(),
+	}
+}
+
+func (server *Server) publishSysStats() {
+	s := server.Stats()
+	stats := []struct {
+		topic string
+		value any
+	}{
+		{topic: "uptime", value: fmt.Sprintf("%d seconds", s.Uptime)},
+		{topic: "clients/connected", value: s.ClientsConnected},
+		{topic: "clients/disconnected", value: s.ClientsDisconnected},
+		{topic: "clients/total", value: s.Clients},
+		{topic: "messages/received", value: s.MessagesReceived},
+		{topic: "messages/sent", value: s.MessagesSent},
+		{topic: "bytes/received", value: s.BytesReceived},
+		{topic: "bytes/sent", value: s.BytesSent},
+		{topic: "retained messages/count", value: s.RetainedMessages},
+		{topic: "retained messages/bytes", value: s.RetainedBytes},
+		{topic: "subscriptions/count", value: s.Subscriptions},
+	}
+	for _, stat := range stats {
+		server.publishSys("$SYS/broker/"+stat.topic, fmt.Sprint(stat.value))
+	}
+}
+
+// publishSys retains and publishes a $SYS message. Hooks are not asked
+// whether it may be published.
+func (server *Server) publishSys(topic string, payload string) {
+	p := protocol.MakePublishPacket(topic, []byte(payload), types.QoS0, true)
+	server.addRetainedMessage(topic, p)
+	server.publish(p, topic, "$SYS")
+}
+
+// publishClientEvent publishes a non-retained connected or disconnected
+// event of a client to $SYS/broker/clients/<client ID>/<event>. Events of
+// clients whose ID is not a single topic level are not published.
+func (server *Server) publishClientEvent(clientID string, event string, payload clientEvent) {
+	if server.config.Sys.Interval <= 0 || server.isClosed() || strings.ContainsAny(clientID, "+#/\x00") {
+		return
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		server.logs.server.Error("failed to encode client event", "client_id", clientID, "error", err)
+		return
+	}
+	topic := "$SYS/broker/clients/" + clientID + "/" + event
+	server.publish(protocol.MakePublishPacket(topic, data, types.QoS0, false), topic, "$SYS")
+}
+
+// update adds the increase of the counter since the previous update, which
+// was interval ago, to the moving average.
+func (load *sysLoad) update(interval time.Duration) {
+	count := load.counter()
+	perMinute := float64(count-load.previous) / interval.Minutes()
+	load.previous = count
+
+	if !load.started {
+		load.average = perMinute
+		load.started = true
+		return
+	}
+	// Exponentially weighted, like the load averages of Unix.
+	weight := math.Exp(-interval.Seconds() / load.window.Seconds())
+	load.average = load.average*weight + perMinute*(1-weight)
+}
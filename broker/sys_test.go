@@ -0,0 +1,101 @@
+package broker
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/packet"
+)
+
+// readUntil reads PUBLISH packets until one on topic for which match
+// returns true, and returns its payload.
+func (client *testClient) readUntil(topic string, match func(payload []byte) bool) []byte {
+	client.t.Helper()
+
+	// The statistics are published once per interval, which is longer than
+	// the read deadline of readPublish.
+	client.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		fixedHeader, bytes, err := client.framer.readPacket()
+		if err != nil {
+			client.t.Fatalf("no matching message on %s: %v", topic, err)
+		}
+		if fixedHeader.PacketType != packet.PUBLISH {
+			continue
+		}
+		p := &packet.PublishPacket{}
+		_, err = p.Decode(bytes)
+		if err != nil {
+			client.t.Fatal(err)
+		}
+		if p.VariableHeader.TopicName.String() == topic && match(p.Payload.Data) {
+			return p.Payload.Data
+		}
+	}
+}
+
+func TestSysTopics(t *testing.T) {
+	_, address := startServer(t, Config{Sys: SysConfig{Interval: 1}})
+	wildcard := connectClient(t, address, "wildcard")
+	wildcard.subscribe("#")
+	sys := connectClient(t, address, "sys")
+	sys.subscribe("$SYS/#")
+
+	anyPayload := func([]byte) bool { return true }
+	version := sys.readUntil("$SYS/broker/version", anyPayload)
+	if string(version) != "gobroker version "+Version {
+		t.Fatalf("wanted version %v but got %s", Version, version)
+	}
+	sys.readUntil("$SYS/broker/clients/connected", func(payload []byte) bool {
+		return string(payload) == "2"
+	})
+
+	connectClient(t, address, "third")
+	payload := sys.readUntil("$SYS/broker/clients/third/connected", anyPayload)
+	var event clientEvent
+	err := json.Unmarshal(payload, &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.ClientID != "third" || event.KeepAlive != 60 {
+		t.Fatalf("wanted the connect event of third but got %+v", event)
+	}
+
+	// Clients can not publish to the $SYS topics.
+	got := wildcard.publishQoS1("$SYS/broker/version", "fake")
+	if got != packet.NotAuthorized {
+		t.Fatalf("wanted reason code %x but got %x", packet.NotAuthorized, got)
+	}
+
+	// MQTT-4.7.2-1: $SYS topics do not match the # filter.
+	sys.publish("normal", "message")
+	p := wildcard.readPublish()
+	if p.VariableHeader.TopicName.String() != "normal" {
+		t.Fatalf("wanted only the normal message but got %s", p.VariableHeader.TopicName.String())
+	}
+}
+
+func TestSysClientEventTopic(t *testing.T) {
+	server, _ := startServer(t, Config{Sys: SysConfig{Interval: 1}})
+	received := make(chan Message, 10)
+	server.Subscribe("$SYS/broker/clients/#", func(message Message) { received <- message })
+
+	for _, clientID := range []string{"a/b", "a/+", "#", "valid"} {
+		server.publishClientEvent(clientID, "connected", clientEvent{ClientID: clientID})
+	}
+
+	// Only the event of the client ID that is a single topic level is
+	// published, the statistics of the clients are skipped.
+	for {
+		message := receiveMessage(t, received)
+		if !strings.Contains(strings.TrimPrefix(message.Topic, "$SYS/broker/clients/"), "/") {
+			continue
+		}
+		if message.Topic != "$SYS/broker/clients/valid/connected" {
+			t.Fatalf("wanted the event of valid but got %s", message.Topic)
+		}
+		return
+	}
+}
@@ -0,0 +1,217 @@
+package broker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Files are checked for changes at most once per interval.
+const tlsReloadCheckInterval = time.Second
+
+type ClientAuthMode string
+
+const (
+	ClientAuthNone    ClientAuthMode = "none"    // Client certificates are not requested.
+	ClientAuthRequest ClientAuthMode = "request" // Client certificates are verified if sent.
+	ClientAuthRequire ClientAuthMode = "require" // Client certificates are required and verified.
+)
+
+var ErrNoCertificates = errors.New("no certificates found in CA bundle")
+
+// tlsLoader provides TLS configurations built from certificate, key and CA
+// files. The files are reloaded when they change on disk so certificates
+// can be rotated without restarting the broker.
+type tlsLoader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string // Optional CA bundle used to verify client certificates.
+	clientAuth   ClientAuthMode
+
+	mutex       sync.Mutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+	modTimes    map[string]time.Time
+	lastCheck   time.Time
+	log         *slog.Logger // Logs reloads of the files.
+}
+
+func newTLSLoader(certFile, keyFile, clientCAFile string, clientAuth ClientAuthMode) (*tlsLoader, error) {
+	switch clientAuth {
+	case ClientAuthNone, ClientAuthRequest, ClientAuthRequire:
+	case "":
+		clientAuth = ClientAuthNone
+	default:
+		return nil, fmt.Errorf("unknown client auth mode: %s", clientAuth)
+	}
+
+	if clientAuth != ClientAuthNone && clientCAFile == "" {
+		return nil, fmt.Errorf("client auth mode %s requires a client CA file", clientAuth)
+	}
+
+	loader := &tlsLoader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		clientAuth:   clientAuth,
+		log:          slog.Default(),
+		modTimes:     make(map[string]time.Time),
+	}
+
+	err := loader.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return loader, nil
+}
+
+// Config returns a TLS configuration that always uses the most recently
+// loaded certificate and client CA bundle.
+func (loader *tlsLoader) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			certificate, _ := loader.current()
+			return certificate, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return loader.clientConfig(), nil
+		},
+	}
+}
+
+func (loader *tlsLoader) clientConfig() *tls.Config {
+	certificate, clientCAs := loader.current()
+
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*certificate},
+		ClientCAs:    clientCAs,
+	}
+
+	switch loader.clientAuth {
+	case ClientAuthRequest:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		config.ClientAuth = tls.NoClientCert
+	}
+
+	return config
+}
+
+// current reloads the files if they changed and returns the loaded
+// certificate and client CA pool.
+func (loader *tlsLoader) current() (*tls.Certificate, *x509.CertPool) {
+	loader.mutex.Lock()
+	defer loader.mutex.Unlock()
+
+	if time.Since(loader.lastCheck) >= tlsReloadCheckInterval {
+		loader.lastCheck = time.Now()
+		if loader.changed() {
+			// Keep serving the previous certificate if the new files are
+			// invalid, e.g. because only one of them has been replaced so far.
+			err := loader.loadLocked()
+			if err != nil {
+				loader.log.Warn("failed to reload TLS files", "error", err)
+			} else {
+				loader.log.Info("reloaded TLS files", "cert_file", loader.certFile)
+			}
+		}
+	}
+
+	return loader.certificate, loader.clientCAs
+}
+
+func (loader *tlsLoader) files() []string {
+	files := []string{loader.certFile, loader.keyFile}
+	if loader.clientCAFile != "" {
+		files = append(files, loader.clientCAFile)
+	}
+	return files
+}
+
+func (loader *tlsLoader) changed() bool {
+	for _, file := range loader.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(loader.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (loader *tlsLoader) load() error {
+	loader.mutex.Lock()
+	defer loader.mutex.Unlock()
+
+	loader.lastCheck = time.Now()
+	return loader.loadLocked()
+}
+
+func (loader *tlsLoader) loadLocked() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range loader.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	certificate, err := tls.LoadX509KeyPair(loader.certFile, loader.keyFile)
+	if err != nil {
+		return err
+	}
+
+	var clientCAs *x509.CertPool
+	if loader.clientCAFile != "" {
+		bundle, err := os.ReadFile(loader.clientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(bundle) {
+			return fmt.Errorf("%w: %s", ErrNoCertificates, loader.clientCAFile)
+		}
+	}
+
+	loader.certificate = &certificate
+	loader.clientCAs = clientCAs
+	loader.modTimes = modTimes
+
+	return nil
+}
+
+// tlsConnectionStater is implemented by connections that were set up
+// over TLS, e.g. *tls.Conn.
+type tlsConnectionStater interface {
+	ConnectionState() tls.ConnectionState
+}
+
+// verifiedCertificate returns the client certificate of conn if the
+// connection uses TLS and the certificate was verified, otherwise nil.
+func verifiedCertificate(conn net.Conn) *x509.Certificate {
+	stater, ok := conn.(tlsConnectionStater)
+	if !ok {
+		return nil
+	}
+
+	state := stater.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	return state.VerifiedChains[0][0]
+}
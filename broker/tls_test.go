@@ -0,0 +1,196 @@
+package broker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	certPEM     []byte
+	keyPEM      []byte
+}
+
+// newTestCertificate creates a certificate signed by parent, or a self-signed
+// CA certificate if parent is nil.
+func newTestCertificate(t *testing.T, commonName string, parent *testCertificate) *testCertificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.certificate, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCertificate{
+		certificate: certificate,
+		key:         key,
+		certPEM:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:      pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func writeTestFile(t *testing.T, path string, data []byte, modTime time.Time) {
+	t.Helper()
+
+	err := os.WriteFile(path, data, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(path, modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSReloadOnChange(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+
+	modTime := time.Now().Add(-time.Minute)
+	first := newTestCertificate(t, "first", nil)
+	writeTestFile(t, certFile, first.certPEM, modTime)
+	writeTestFile(t, keyFile, first.keyPEM, modTime)
+
+	loader, err := newTLSLoader(certFile, keyFile, "", ClientAuthNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := newTestCertificate(t, "second", nil)
+	modTime = modTime.Add(time.Second)
+	writeTestFile(t, certFile, second.certPEM, modTime)
+	writeTestFile(t, keyFile, second.keyPEM, modTime)
+	loader.lastCheck = time.Time{}
+
+	certificate, _ := loader.current()
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.Subject.CommonName != "second" {
+		t.Fatalf("wanted reloaded certificate but got %s", leaf.Subject.CommonName)
+	}
+
+	// An invalid replacement keeps the previous certificate in use.
+	modTime = modTime.Add(time.Second)
+	writeTestFile(t, keyFile, []byte("invalid"), modTime)
+	loader.lastCheck = time.Time{}
+
+	certificate, _ = loader.current()
+	leaf, err = x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.Subject.CommonName != "second" {
+		t.Fatalf("wanted previous certificate but got %s", leaf.Subject.CommonName)
+	}
+}
+
+func TestTLSVerifiedClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	caFile := filepath.Join(dir, "ca.crt")
+
+	ca := newTestCertificate(t, "ca", nil)
+	server := newTestCertificate(t, "localhost", ca)
+	device := newTestCertificate(t, "device-1", ca)
+
+	modTime := time.Now()
+	writeTestFile(t, certFile, server.certPEM, modTime)
+	writeTestFile(t, keyFile, server.keyPEM, modTime)
+	writeTestFile(t, caFile, ca.certPEM, modTime)
+
+	loader, err := newTLSLoader(certFile, keyFile, caFile, ClientAuthRequire)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+
+	clientCertificate, err := tls.X509KeyPair(device.certPEM, device.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		conn := tls.Client(clientConn, &tls.Config{
+			ServerName:   "localhost",
+			RootCAs:      roots,
+			Certificates: []tls.Certificate{clientCertificate},
+		})
+		errs <- conn.Handshake()
+	}()
+
+	conn := tls.Server(serverConn, loader.Config())
+	err = conn.Handshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-errs
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate := verifiedCertificate(conn)
+	if certificate == nil {
+		t.Fatal("wanted a verified client certificate")
+	}
+	if certificate.Subject.CommonName != "device-1" {
+		t.Fatalf("wanted subject device-1 but got %s", certificate.Subject.CommonName)
+	}
+
+	if verifiedCertificate(serverConn) != nil {
+		t.Fatal("wanted no certificate for a plain connection")
+	}
+}
@@ -0,0 +1,159 @@
+package broker
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket sub protocols that can be negotiated (6.0.0-3).
+var websocketSubprotocols = []string{"mqtt", "mqttv3.1"}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	Subprotocols:    websocketSubprotocols,
+}
+
+var ErrNonBinaryMessage = errors.New("received non-binary WebSocket message")
+
+// websocketHandler upgrades HTTP requests to a WebSocket connection and
+// passes the connection to handle once the upgrade is done.
+func websocketHandler(handle func(net.Conn), log *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		offered := websocket.Subprotocols(r)
+		if !slices.ContainsFunc(offered, func(protocol string) bool {
+			return slices.Contains(websocketSubprotocols, protocol)
+		}) {
+			log.Info("no supported WebSocket sub protocol offered", "remote_addr", r.RemoteAddr,
+				"sub_protocols", offered)
+			http.Error(w, "unsupported WebSocket sub protocol", http.StatusBadRequest)
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Info("WebSocket upgrade failed", "remote_addr", r.RemoteAddr, "error", err)
+			return
+		}
+		log.Debug("upgraded to WebSocket", "remote_addr", r.RemoteAddr, "sub_protocol", conn.Subprotocol())
+
+		handle(&websocketConnWrapper{websocketConn: conn, tlsState: r.TLS})
+	}
+}
+
+// websocketConnWrapper implements net.Conn on top of a stream of
+// WebSocket messages.
+//
+// MQTT packets are not aligned with WebSocket messages, a packet can span
+// multiple messages and a message can contain multiple packets (6.0.0-2).
+// Reads therefore continue in the current message until it is exhausted
+// before moving on to the next one.
+type websocketConnWrapper struct {
+	websocketConn *websocket.Conn
+	reader        io.Reader // Reader of the current message, nil if there is none.
+	writeMutex    sync.Mutex
+	tlsState      *tls.ConnectionState // Set if the connection was upgraded from HTTPS.
+}
+
+func (wrapper *websocketConnWrapper) Close() error {
+	return wrapper.websocketConn.Close()
+}
+
+func (wrapper *websocketConnWrapper) Read(b []byte) (n int, err error) {
+	for {
+		if wrapper.reader == nil {
+			messageType, reader, err := wrapper.websocketConn.NextReader()
+			if err != nil {
+				return 0, websocketReadErr(err)
+			}
+			// 6.0.0-1: MQTT control packets must be sent in binary messages.
+			if messageType != websocket.BinaryMessage {
+				return 0, fmt.Errorf("%w: type %d", ErrNonBinaryMessage, messageType)
+			}
+			wrapper.reader = reader
+		}
+
+		n, err = wrapper.reader.Read(b)
+		if errors.Is(err, io.EOF) {
+			// The current message is exhausted, the next read
+			// continues with the next message.
+			wrapper.reader = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// Write sends b as a single binary message.
+func (wrapper *websocketConnWrapper) Write(b []byte) (n int, err error) {
+	wrapper.writeMutex.Lock()
+	defer wrapper.writeMutex.Unlock()
+
+	writer, err := wrapper.websocketConn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err = writer.Write(b)
+	if err != nil {
+		writer.Close()
+		return n, err
+	}
+
+	// Closing the writer flushes the frame to the connection.
+	return n, writer.Close()
+}
+
+// ConnectionState returns the TLS state of the underlying HTTPS connection,
+// the zero value is returned if the connection does not use TLS.
+func (wrapper *websocketConnWrapper) ConnectionState() tls.ConnectionState {
+	if wrapper.tlsState == nil {
+		return tls.ConnectionState{}
+	}
+	return *wrapper.tlsState
+}
+
+func (wrapper *websocketConnWrapper) LocalAddr() net.Addr {
+	return wrapper.websocketConn.LocalAddr()
+}
+
+func (wrapper *websocketConnWrapper) RemoteAddr() net.Addr {
+	return wrapper.websocketConn.RemoteAddr()
+}
+
+func (wrapper *websocketConnWrapper) SetDeadline(t time.Time) error {
+	return errors.Join(
+		wrapper.websocketConn.SetReadDeadline(t),
+		wrapper.websocketConn.SetWriteDeadline(t),
+	)
+}
+
+func (wrapper *websocketConnWrapper) SetReadDeadline(t time.Time) error {
+	return wrapper.websocketConn.SetReadDeadline(t)
+}
+
+func (wrapper *websocketConnWrapper) SetWriteDeadline(t time.Time) error {
+	return wrapper.websocketConn.SetWriteDeadline(t)
+}
+
+// websocketReadErr maps a normal closure of the WebSocket connection to io.EOF
+// so that it is handled the same way as a closed TCP connection.
+func websocketReadErr(err error) error {
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+		return io.EOF
+	}
+	return err
+}
@@ -0,0 +1,116 @@
+package broker
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// startWebsocketServer starts a server that reads packets from every
+// WebSocket connection and sends them back one message per packet.
+func startWebsocketServer(t *testing.T) string {
+	server := httptest.NewServer(websocketHandler(func(conn net.Conn) {
+		defer conn.Close()
+		f := newFramer(conn, 0)
+		for {
+			_, bytes, err := f.readPacket()
+			if err != nil {
+				return
+			}
+			_, err = conn.Write(bytes)
+			if err != nil {
+				return
+			}
+		}
+	}, slog.Default()))
+	t.Cleanup(server.Close)
+
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func TestWebsocketPacketsAcrossMessages(t *testing.T) {
+	url := startWebsocketServer(t)
+
+	dialer := websocket.Dialer{Subprotocols: []string{"mqtt"}}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if conn.Subprotocol() != "mqtt" {
+		t.Fatalf("wanted sub protocol mqtt but got %q", conn.Subprotocol())
+	}
+
+	// The first PUBLISH spans two messages, the second message also
+	// contains a PINGREQ and the start of another PUBLISH.
+	stream := bytes.Join([][]byte{publishBytes, pingreqBytes, publishBytes}, nil)
+	messages := [][]byte{
+		stream[:4],
+		stream[4 : len(publishBytes)+len(pingreqBytes)+3],
+		stream[len(publishBytes)+len(pingreqBytes)+3:],
+	}
+	for _, message := range messages {
+		err = conn.WriteMessage(websocket.BinaryMessage, message)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, want := range [][]byte{publishBytes, pingreqBytes, publishBytes} {
+		messageType, got, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if messageType != websocket.BinaryMessage {
+			t.Fatalf("packet %d: wanted binary message but got type %d", i, messageType)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("packet %d: wanted %x but got %x", i, want, got)
+		}
+	}
+}
+
+func TestWebsocketSubprotocolNegotiation(t *testing.T) {
+	url := startWebsocketServer(t)
+
+	subprotocolCases := []struct {
+		offered []string
+		want    string
+	}{
+		{offered: []string{"mqtt"}, want: "mqtt"},
+		{offered: []string{"mqttv3.1"}, want: "mqttv3.1"},
+		{offered: []string{"foo", "mqtt"}, want: "mqtt"},
+		{offered: []string{"foo"}, want: ""},
+		{offered: nil, want: ""},
+	}
+
+	for _, c := range subprotocolCases {
+		dialer := websocket.Dialer{Subprotocols: c.offered}
+		conn, resp, err := dialer.Dial(url, nil)
+		if c.want == "" {
+			if err == nil {
+				conn.Close()
+				t.Fatalf("offered %v: wanted upgrade to be rejected", c.offered)
+			}
+			if resp == nil || resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("offered %v: wanted status %d but got %v",
+					c.offered, http.StatusBadRequest, resp)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("offered %v: %v", c.offered, err)
+		}
+		if conn.Subprotocol() != c.want {
+			t.Fatalf("offered %v: wanted %q but got %q", c.offered, c.want, conn.Subprotocol())
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,598 @@
+// Package client is an MQTT v5 client built on the packet codecs of the
+// broker.
+//
+// A Client connects to a single broker. Publish, Subscribe and Unsubscribe
+// block until the broker acknowledged the packet or the context is done,
+// received messages are passed to the handler of the matching subscription.
+//
+// With Options.AutoReconnect the client connects again when the connection
+// is lost. Messages published in the meantime are buffered in the store of
+// the options and sent once the client is connected again.
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/packet"
+)
+
+var (
+	ErrNotConnected = errors.New("not connected")
+	// ErrConnected is returned by Connect if the client is connected or
+	// reconnecting.
+	ErrConnected      = errors.New("already connected")
+	ErrConnectionLost = errors.New("connection lost")
+	ErrPingTimeout    = errors.New("no PINGRESP within the ping timeout")
+	ErrProtocol       = errors.New("protocol error")
+	ErrInvalidTopic   = errors.New("invalid topic")
+	ErrInvalidQoS     = errors.New("invalid QoS")
+	// ErrNoPacketIdentifier is returned when all packet identifiers are
+	// in use by requests that were not acknowledged yet.
+	ErrNoPacketIdentifier = errors.New("no packet identifier available")
+)
+
+// errStopped is returned by a reconnect attempt after Disconnect was called.
+var errStopped = errors.New("reconnecting stopped")
+
+const (
+	Disconnected State = iota
+	Connected
+	// Reconnecting is the state of a client that lost its connection and
+	// waits to connect again.
+	Reconnecting
+)
+
+type (
+	// State is the state of the connection of a client.
+	State int
+
+	// ReasonCodeError is returned when the broker answers a request with a
+	// reason code that indicates failure, or closes the connection with a
+	// DISCONNECT.
+	ReasonCodeError struct {
+		PacketType packet.PacketType
+		ReasonCode packet.ReasonCode
+		Reason     string
+	}
+
+	// Client is an MQTT v5 client, it is safe for concurrent use.
+	Client struct {
+		options Options
+		log     *slog.Logger
+		store   Store
+
+		// connectMutex serializes connecting and disconnecting.
+		connectMutex sync.Mutex
+
+		mutex      sync.Mutex
+		state      State
+		connection *connection // Nil when not connected.
+		// stop is closed by Disconnect to stop reconnecting.
+		stop     chan struct{}
+		clientID string
+		// lastPacketIdentifier is the packet identifier that was used last.
+		lastPacketIdentifier uint16
+		// requests are the packets waiting for an acknowledgement by
+		// packet identifier.
+		requests map[uint16]*request
+		// queued are the messages published while reconnecting, in the
+		// order they were published.
+		queued []*request
+		// loaded is set once the messages of the store were loaded.
+		loaded bool
+		// sequence is the sequence number of the last stored message.
+		sequence uint64
+		// subscriptions are the filters passed to Subscribe.
+		subscriptions map[string]subscription
+		// received holds the packet identifiers of QoS 2 messages that
+		// were received but not released yet (4.3.3).
+		received map[uint16]bool
+	}
+)
+
+func (state State) String() string {
+	switch state {
+	case Disconnected:
+		return "disconnected"
+	case Connected:
+		return "connected"
+	case Reconnecting:
+		return "reconnecting"
+	}
+	return fmt.Sprintf("state(%d)", int(state))
+}
+
+func (err *ReasonCodeError) Error() string {
+	if err.Reason != "" {
+		return fmt.Sprintf("%s: reason code 0x%02x: %s", err.PacketType, byte(err.ReasonCode), err.Reason)
+	}
+	return fmt.Sprintf("%s: reason code 0x%02x", err.PacketType, byte(err.ReasonCode))
+}
+
+// New creates a client, it does not connect until Connect is called.
+func New(options Options) *Client {
+	if options.Logger == nil {
+		options.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	store := options.Store
+	if store == nil {
+		store = NewMemoryStore(DefaultStoreLimit)
+	}
+	return &Client{
+		options:       options,
+		log:           options.Logger,
+		store:         store,
+		clientID:      options.ClientID,
+		requests:      map[uint16]*request{},
+		subscriptions: map[string]subscription{},
+		received:      map[uint16]bool{},
+	}
+}
+
+// ClientID returns the client identifier, which is assigned by the broker
+// if the options did not set one.
+func (client *Client) ClientID() string {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.clientID
+}
+
+// State returns the state of the connection.
+func (client *Client) State() State {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.state
+}
+
+// Connected reports whether the client is connected.
+func (client *Client) Connected() bool {
+	return client.State() == Connected
+}
+
+// Connect connects to the broker and returns whether the broker resumed an
+// existing session of the client. Messages that were not acknowledged on an
+// earlier connection are sent again.
+func (client *Client) Connect(ctx context.Context) (bool, error) {
+	client.connectMutex.Lock()
+	if client.State() != Disconnected {
+		client.connectMutex.Unlock()
+		return false, ErrConnected
+	}
+	sessionPresent, err := client.connect(ctx)
+	client.connectMutex.Unlock()
+	if err != nil {
+		return false, err
+	}
+
+	client.onConnect(sessionPresent)
+	return sessionPresent, nil
+}
+
+// onConnect calls the OnConnect callback, outside of the connect mutex so
+// that it may call Disconnect.
+func (client *Client) onConnect(sessionPresent bool) {
+	if client.options.OnConnect != nil {
+		client.options.OnConnect(sessionPresent)
+	}
+}
+
+// connect opens a connection, the connect mutex must be held.
+func (client *Client) connect(ctx context.Context) (bool, error) {
+	err := client.load()
+	if err != nil {
+		return false, err
+	}
+
+	conn, err := dial(ctx, &client.options)
+	if err != nil {
+		return false, err
+	}
+
+	reader := bufio.NewReader(conn)
+	conack, err := client.handshake(ctx, conn, reader)
+	if err != nil {
+		conn.Close()
+		return false, err
+	}
+
+	keepAlive := client.options.keepAlive()
+	if conack.VariableHeader.ServerKeepAlive.Size > 0 {
+		keepAlive = time.Duration(conack.VariableHeader.ServerKeepAlive.Value) * time.Second
+	}
+	sessionPresent := conack.VariableHeader.ConnectAcknowledgeFlags&byte(packet.SessionPresent) != 0
+	connection := newConnection(conn, reader, keepAlive)
+
+	client.mutex.Lock()
+	if conack.VariableHeader.AssignedClientIdentifier.Str != "" {
+		client.clientID = conack.VariableHeader.AssignedClientIdentifier.Str
+	}
+	if !sessionPresent {
+		// The broker starts a new session, so releases of earlier QoS 2
+		// messages will not arrive.
+		client.received = map[uint16]bool{}
+	}
+	err = client.resend(ctx, connection, sessionPresent)
+	if err != nil {
+		client.mutex.Unlock()
+		connection.close(err)
+		return false, err
+	}
+	client.connection = connection
+	client.state = Connected
+	client.mutex.Unlock()
+
+	client.log.Info("connected", "client_id", client.ClientID(), "session_present", sessionPresent)
+	go client.read(connection)
+	go client.dispatch(connection)
+	if keepAlive > 0 {
+		go client.ping(connection)
+	}
+
+	if !sessionPresent {
+		err = client.restoreSubscriptions(ctx)
+		if err != nil {
+			client.log.Warn("failed to restore subscriptions", "error", err)
+		}
+	}
+	return sessionPresent, nil
+}
+
+// handshake sends the CONNECT packet and waits for the CONNACK.
+func (client *Client) handshake(ctx context.Context, conn net.Conn, reader *bufio.Reader) (*packet.ConackPacket, error) {
+	connect := client.connectPacket()
+	bin, err := connect.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+	// Unblock the handshake if the context is cancelled before the broker
+	// answers.
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	_, err = conn.Write(bin)
+	if err != nil {
+		return nil, contextErr(ctx, err)
+	}
+
+	fixedHeader, bytes, err := readPacket(reader)
+	if err != nil {
+		return nil, contextErr(ctx, err)
+	}
+	if fixedHeader.PacketType != packet.CONNACK {
+		return nil, fmt.Errorf("%w: wanted CONNACK but got %s", ErrProtocol, fixedHeader.PacketType)
+	}
+
+	conack := &packet.ConackPacket{}
+	_, err = conack.Decode(bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrProtocol, err)
+	}
+	if conack.VariableHeader.ConnectReasonCode >= packet.UnspecifiedError {
+		return nil, &ReasonCodeError{
+			PacketType: packet.CONNACK,
+			ReasonCode: conack.VariableHeader.ConnectReasonCode,
+			Reason:     conack.VariableHeader.ReasonString.Str,
+		}
+	}
+	return conack, nil
+}
+
+// contextErr returns the error of ctx if it caused err.
+func contextErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (client *Client) connectPacket() *packet.ConnectPacket {
+	options := &client.options
+	connect := &packet.ConnectPacket{}
+	header := &connect.VariableHeader
+	header.Version = 5
+	header.CleanStart = options.CleanStart
+	header.KeepAlive.Value = uint32(options.keepAlive() / time.Second)
+	header.SessionExpiryInterval.Value = uint32(options.SessionExpiryInterval / time.Second)
+
+	connect.Payload.ClientId.Str = client.ClientID()
+	if options.UserName != "" {
+		header.UserNameFlag = true
+		connect.Payload.UserName.Str = options.UserName
+	}
+	if options.Password != nil {
+		header.PasswordFlag = true
+		connect.Payload.Password.Data = options.Password
+	}
+
+	if will := options.Will; will != nil {
+		header.WillFlag = true
+		header.WillQos = will.QoS
+		header.WillRetain = will.Retain
+		connect.Payload.WillTopic.Str = will.Topic
+		connect.Payload.WillPayload.Data = will.Payload
+		connect.Payload.WillProperties.DelayInterval.Value = uint32(will.DelayInterval / time.Second)
+	}
+	return connect
+}
+
+// Disconnect sends a DISCONNECT and closes the connection, or stops
+// reconnecting. Requests that are still waiting for an acknowledgement fail
+// with ErrNotConnected, messages that were not acknowledged are kept in the
+// store and sent when the client connects again.
+func (client *Client) Disconnect(ctx context.Context) error {
+	client.connectMutex.Lock()
+	defer client.connectMutex.Unlock()
+
+	client.mutex.Lock()
+	state := client.state
+	connection := client.connection
+	if state == Reconnecting {
+		close(client.stop)
+	}
+	client.state = Disconnected
+	client.connection = nil
+	client.failRequests(ErrNotConnected)
+	client.mutex.Unlock()
+
+	if state == Disconnected {
+		return ErrNotConnected
+	}
+	client.log.Info("disconnected")
+	if connection == nil {
+		return nil
+	}
+
+	disconnect := &packet.DisconnectPacket{}
+	disconnect.VariableHeader.ReasonCode = packet.NormalDisconnection
+	err := connection.write(ctx, disconnect)
+	connection.close(ErrNotConnected)
+	return err
+}
+
+// connectionLost closes connection because of err and informs the
+// application, unless the connection was closed by Disconnect. The client
+// starts reconnecting if the options enable it.
+func (client *Client) connectionLost(connection *connection, err error) {
+	connection.close(err)
+
+	client.mutex.Lock()
+	current := client.connection == connection
+	var stop chan struct{}
+	if current {
+		client.connection = nil
+		client.state = Disconnected
+		if client.options.AutoReconnect {
+			client.state = Reconnecting
+			client.stop = make(chan struct{})
+			stop = client.stop
+		}
+		client.failRequests(fmt.Errorf("%w: %w", ErrConnectionLost, err))
+	}
+	client.mutex.Unlock()
+
+	if !current {
+		return
+	}
+	client.log.Warn("connection lost", "error", err)
+	if client.options.OnConnectionLost != nil {
+		client.options.OnConnectionLost(err)
+	}
+	if stop != nil {
+		go client.reconnect(stop, err)
+	}
+}
+
+// reconnect connects again until it succeeds or stop is closed. The delay
+// between the attempts doubles up to the maximum, a random part of it is
+// left out so that clients that lost their connection at the same time do
+// not all reconnect at the same time.
+func (client *Client) reconnect(stop chan struct{}, err error) {
+	delay := client.options.minReconnectDelay()
+	for attempt := 1; ; attempt++ {
+		if client.options.OnReconnecting != nil {
+			client.options.OnReconnecting(attempt, err)
+		}
+
+		timer := time.NewTimer(delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1)))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		err = client.reconnectOnce(stop)
+		if err == nil || errors.Is(err, errStopped) {
+			return
+		}
+		client.log.Info("failed to reconnect", "attempt", attempt, "error", err)
+		delay = min(2*delay, client.options.maxReconnectDelay())
+	}
+}
+
+func (client *Client) reconnectOnce(stop chan struct{}) error {
+	client.connectMutex.Lock()
+	select {
+	case <-stop:
+		client.connectMutex.Unlock()
+		return errStopped
+	default:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), client.options.connectTimeout())
+	defer cancel()
+	sessionPresent, err := client.connect(ctx)
+	client.connectMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	client.onConnect(sessionPresent)
+	return nil
+}
+
+// read handles the packets received on connection until it closes.
+func (client *Client) read(connection *connection) {
+	for {
+		fixedHeader, bytes, err := readPacket(connection.reader)
+		if err != nil {
+			client.connectionLost(connection, err)
+			return
+		}
+
+		err = client.handle(connection, fixedHeader, bytes)
+		if err != nil {
+			client.connectionLost(connection, err)
+			return
+		}
+	}
+}
+
+// handle handles a single packet received from the broker.
+func (client *Client) handle(connection *connection, fixedHeader packet.FixedHeader, bytes []byte) error {
+	client.log.Debug("received packet", "packet_type", fixedHeader.PacketType.String())
+	ctx := context.Background()
+
+	switch fixedHeader.PacketType {
+	case packet.PUBLISH:
+		return client.onPublish(connection, bytes)
+
+	case packet.PUBACK:
+		puback := packet.PubackPacket{}
+		_, err := puback.Decode(bytes)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrProtocol, err)
+		}
+		client.complete(puback.VariableHeader.PacketIdentifer.Value, reply{packetType: packet.PUBACK,
+			reasonCodes: []packet.ReasonCode{puback.VariableHeader.ReasonCode}})
+
+	case packet.PUBREC:
+		pubrec := packet.PubrecPacket{}
+		_, err := pubrec.Decode(bytes)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrProtocol, err)
+		}
+		return client.onPubrec(ctx, connection, &pubrec)
+
+	case packet.PUBREL:
+		pubrel := packet.PubrelPacket{}
+		_, err := pubrel.Decode(bytes)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrProtocol, err)
+		}
+		return client.onPubrel(ctx, connection, &pubrel)
+
+	case packet.PUBCOMP:
+		pubcomp := packet.PubcompPacket{}
+		_, err := pubcomp.Decode(bytes)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrProtocol, err)
+		}
+		client.complete(pubcomp.VariableHeader.PacketIdentifer.Value, reply{packetType: packet.PUBCOMP,
+			reasonCodes: []packet.ReasonCode{pubcomp.VariableHeader.ReasonCode}})
+
+	case packet.SUBACK:
+		suback := packet.SubackPacket{}
+		_, err := suback.Decode(bytes)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrProtocol, err)
+		}
+		client.complete(suback.VariableHeader.PacketIdentifier.Value, reply{packetType: packet.SUBACK,
+			reasonCodes: suback.Payload.ReasonCodes, reason: suback.VariableHeader.ReasonString.Str})
+
+	case packet.UNSUBACK:
+		unsuback := packet.UnsubackPacket{}
+		_, err := unsuback.Decode(bytes)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrProtocol, err)
+		}
+		client.complete(unsuback.VariableHeader.PacketIdentifier.Value, reply{packetType: packet.UNSUBACK,
+			reasonCodes: unsuback.Payload.ReasonCodes, reason: unsuback.VariableHeader.ReasonString.Str})
+
+	case packet.PINGRESP:
+		connection.pingSent.Store(false)
+
+	case packet.DISCONNECT:
+		disconnect := packet.DisconnectPacket{}
+		_, err := disconnect.Decode(bytes)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrProtocol, err)
+		}
+		return &ReasonCodeError{
+			PacketType: packet.DISCONNECT,
+			ReasonCode: disconnect.VariableHeader.ReasonCode,
+			Reason:     disconnect.VariableHeader.ReasonString.Str,
+		}
+
+	default:
+		return fmt.Errorf("%w: unexpected %s packet", ErrProtocol, fixedHeader.PacketType)
+	}
+	return nil
+}
+
+// ping sends a PINGREQ when nothing was sent for the keep alive, and closes
+// the connection if the broker does not answer within the ping timeout.
+func (client *Client) ping(connection *connection) {
+	timer := time.NewTimer(connection.keepAlive)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-connection.done:
+			return
+		case <-timer.C:
+		}
+
+		if connection.pingSent.Load() {
+			client.connectionLost(connection, ErrPingTimeout)
+			return
+		}
+
+		idle := time.Since(time.Unix(0, connection.lastWrite.Load()))
+		if idle < connection.keepAlive {
+			timer.Reset(connection.keepAlive - idle)
+			continue
+		}
+
+		connection.pingSent.Store(true)
+		err := connection.write(context.Background(), packet.PingReqPacket{})
+		if err != nil {
+			client.connectionLost(connection, err)
+			return
+		}
+		timer.Reset(client.options.pingTimeout())
+	}
+}
+
+// dispatch passes the received messages to the handlers until connection
+// closes, messages that are queued by then are still handled.
+func (client *Client) dispatch(connection *connection) {
+	for {
+		select {
+		case message := <-connection.messages:
+			client.deliver(message)
+		case <-connection.done:
+			for {
+				select {
+				case message := <-connection.messages:
+					client.deliver(message)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,538 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/broker"
+	"github.com/DvdSpijker/GoBroker/packet"
+	"github.com/DvdSpijker/GoBroker/protocol"
+	"github.com/DvdSpijker/GoBroker/storage"
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+// startBroker serves a broker on a local port with the listener settings of
+// config and returns the broker and its address.
+func startBroker(t *testing.T, config broker.ListenerConfig) (*broker.Server, string) {
+	t.Helper()
+	return serveBroker(t, "127.0.0.1:0", config)
+}
+
+// serveBroker serves a broker on address.
+func serveBroker(t *testing.T, address string, config broker.ListenerConfig) (*broker.Server, string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := broker.NewServer(broker.Config{})
+	go server.ServeListener(ln, config)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Close(ctx)
+	})
+
+	return server, ln.Addr().String()
+}
+
+// connect connects a new client with options to the broker at address.
+func connect(t *testing.T, address string, options Options) *Client {
+	t.Helper()
+
+	options.Server = address
+	client := New(options)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := client.Connect(ctx)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+	return client
+}
+
+// receive waits for a message on messages.
+func receive(t *testing.T, messages chan Message) Message {
+	t.Helper()
+
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a message")
+	}
+	return Message{}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	_, address := startBroker(t, broker.ListenerConfig{})
+	subscriber := connect(t, address, Options{ClientID: "subscriber"})
+	publisher := connect(t, address, Options{})
+	ctx := context.Background()
+
+	for _, qos := range []types.QoS{types.QoS0, types.QoS1, types.QoS2} {
+		messages := make(chan Message, 1)
+		err := subscriber.Subscribe(ctx, "test/#", qos, func(message Message) { messages <- message })
+		if err != nil {
+			t.Fatalf("subscribe with QoS %v: %v", qos, err)
+		}
+
+		err = publisher.Publish(ctx, "test/qos", []byte{byte(qos)}, qos, false)
+		if err != nil {
+			t.Fatalf("publish with QoS %v: %v", qos, err)
+		}
+		message := receive(t, messages)
+		if message.Topic != "test/qos" || message.QoS != qos || message.Payload[0] != byte(qos) {
+			t.Fatalf("wanted the message with QoS %v but got %+v", qos, message)
+		}
+	}
+}
+
+func TestWebsocket(t *testing.T) {
+	_, address := startBroker(t, broker.ListenerConfig{Type: broker.ListenerWebsocket})
+	client := connect(t, "ws://"+address, Options{})
+	ctx := context.Background()
+
+	messages := make(chan Message, 1)
+	err := client.Subscribe(ctx, "websocket", types.QoS2, func(message Message) { messages <- message })
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Publish(ctx, "websocket", []byte("over WebSocket"), types.QoS2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := receive(t, messages)
+	if string(message.Payload) != "over WebSocket" {
+		t.Fatalf("wanted the message over WebSocket but got %+v", message)
+	}
+}
+
+func TestProperties(t *testing.T) {
+	_, address := startBroker(t, broker.ListenerConfig{})
+	client := connect(t, address, Options{})
+	ctx := context.Background()
+
+	messages := make(chan Message, 1)
+	err := client.Subscribe(ctx, "properties", types.QoS1, func(message Message) { messages <- message })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	properties := Properties{
+		UTF8Payload:           true,
+		MessageExpiryInterval: time.Minute,
+		ContentType:           "text/plain",
+		ResponseTopic:         "responses",
+		CorrelationData:       []byte{1, 2},
+		UserProperties:        []UserProperty{{"a", "1"}, {"a", "2"}, {"b", ""}},
+	}
+	err = client.PublishMessage(ctx, Message{Topic: "properties", Payload: []byte("text"), QoS: types.QoS1, Properties: properties})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := receive(t, messages)
+	if !reflect.DeepEqual(message.Properties, properties) {
+		t.Fatalf("wanted %+v but got %+v", properties, message.Properties)
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	_, address := startBroker(t, broker.ListenerConfig{})
+	unmatched := make(chan Message, 1)
+	client := connect(t, address, Options{OnMessage: func(message Message) { unmatched <- message }})
+	ctx := context.Background()
+
+	messages := make(chan Message, 1)
+	err := client.Subscribe(ctx, "a/+", types.QoS1, func(message Message) { messages <- message })
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Subscribe(ctx, "b", types.QoS1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.Unsubscribe(ctx, "a/+", "never/subscribed")
+	if err != nil {
+		t.Fatalf("wanted no error but got %v", err)
+	}
+	client.Publish(ctx, "a/1", []byte("a"), types.QoS1, false)
+	client.Publish(ctx, "b", []byte("b"), types.QoS1, false)
+
+	// The message to b is handled by OnMessage, since its subscription has
+	// no handler. Messages are handled in order, so the message to a/1
+	// would have arrived first.
+	message := receive(t, unmatched)
+	if message.Topic != "b" {
+		t.Fatalf("wanted the message to b but got %+v", message)
+	}
+	select {
+	case message := <-messages:
+		t.Fatalf("wanted no message after unsubscribing but got %+v", message)
+	default:
+	}
+}
+
+func TestNoLocal(t *testing.T) {
+	_, address := startBroker(t, broker.ListenerConfig{})
+	client := connect(t, address, Options{})
+	other := connect(t, address, Options{})
+	ctx := context.Background()
+
+	messages := make(chan Message, 2)
+	err := client.SubscribeWithOptions(ctx, "local", SubscribeOptions{QoS: types.QoS1, NoLocal: true},
+		func(message Message) { messages <- message })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The own message is not sent back, so the message of the other client
+	// is the first to arrive.
+	client.Publish(ctx, "local", []byte("own"), types.QoS1, false)
+	other.Publish(ctx, "local", []byte("other"), types.QoS1, false)
+	message := receive(t, messages)
+	if string(message.Payload) != "other" {
+		t.Fatalf("wanted the message of the other client but got %+v", message)
+	}
+}
+
+func TestRetainedMessage(t *testing.T) {
+	server, address := startBroker(t, broker.ListenerConfig{})
+	server.SetRetainedMessage("retained", []byte("kept"), types.QoS1)
+	client := connect(t, address, Options{})
+
+	messages := make(chan Message, 1)
+	err := client.Subscribe(context.Background(), "retained", types.QoS1, func(message Message) { messages <- message })
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := receive(t, messages)
+	if !message.Retain || string(message.Payload) != "kept" {
+		t.Fatalf("wanted the retained message but got %+v", message)
+	}
+}
+
+func TestSessionPresent(t *testing.T) {
+	_, address := startBroker(t, broker.ListenerConfig{})
+	client := New(Options{Server: address, SessionExpiryInterval: time.Minute})
+	ctx := context.Background()
+
+	for i, want := range []bool{false, true} {
+		sessionPresent, err := client.Connect(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sessionPresent != want {
+			t.Fatalf("connection %d: wanted session present %v but got %v", i, want, sessionPresent)
+		}
+		if client.ClientID() == "" {
+			t.Fatalf("wanted an assigned client identifier")
+		}
+		err = client.Disconnect(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConnectRefused(t *testing.T) {
+	allow := false
+	_, address := startBroker(t, broker.ListenerConfig{Authentication: broker.AuthenticationConfig{AllowAnonymous: &allow}})
+	client := New(Options{Server: address})
+
+	_, err := client.Connect(context.Background())
+	var reasonCodeError *ReasonCodeError
+	if !errors.As(err, &reasonCodeError) || reasonCodeError.PacketType != packet.CONNACK {
+		t.Fatalf("wanted a CONNACK reason code error but got %v", err)
+	}
+	if client.Connected() {
+		t.Fatalf("wanted the client to be disconnected")
+	}
+
+	err = client.Publish(context.Background(), "topic", nil, types.QoS1, false)
+	if !errors.Is(err, ErrNotConnected) {
+		t.Fatalf("wanted %v but got %v", ErrNotConnected, err)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	_, address := startBroker(t, broker.ListenerConfig{})
+	client := connect(t, address, Options{KeepAlive: time.Second})
+
+	// The broker closes the connection after 1.5 times the keep alive
+	// without packets.
+	time.Sleep(2500 * time.Millisecond)
+	err := client.Publish(context.Background(), "alive", nil, types.QoS1, false)
+	if err != nil {
+		t.Fatalf("wanted the connection to be kept alive but got %v", err)
+	}
+}
+
+func TestConnectionLost(t *testing.T) {
+	server, address := startBroker(t, broker.ListenerConfig{})
+	lost := make(chan error, 1)
+	connect(t, address, Options{ClientID: "kicked", OnConnectionLost: func(err error) { lost <- err }})
+
+	err := server.Kick(context.Background(), "kicked")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-lost:
+		var reasonCodeError *ReasonCodeError
+		if !errors.As(err, &reasonCodeError) || reasonCodeError.ReasonCode != packet.AdministrativeAction {
+			t.Fatalf("wanted a DISCONNECT with administrative action but got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the connection to be lost")
+	}
+}
+
+// waitFor waits for a value on values.
+func waitFor[T any](t *testing.T, values chan T, what string) T {
+	t.Helper()
+
+	select {
+	case value := <-values:
+		return value
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+	var zero T
+	return zero
+}
+
+func TestReconnect(t *testing.T) {
+	server, address := startBroker(t, broker.ListenerConfig{})
+	connected := make(chan bool, 2)
+	reconnecting := make(chan int, 1)
+	client := connect(t, address, Options{
+		ClientID:          "reconnecting",
+		AutoReconnect:     true,
+		MinReconnectDelay: 10 * time.Millisecond,
+		OnConnect:         func(sessionPresent bool) { connected <- sessionPresent },
+		OnReconnecting:    func(attempt int, err error) { reconnecting <- attempt },
+	})
+	waitFor(t, connected, "the first connect")
+
+	messages := make(chan Message, 1)
+	err := client.Subscribe(context.Background(), "restored/#", types.QoS1, func(message Message) { messages <- message })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = server.Kick(context.Background(), "reconnecting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempt := waitFor(t, reconnecting, "a reconnect attempt"); attempt != 1 {
+		t.Fatalf("wanted attempt 1 but got %v", attempt)
+	}
+	if sessionPresent := waitFor(t, connected, "the reconnect"); sessionPresent {
+		t.Fatalf("wanted a new session after the reconnect")
+	}
+
+	// The subscription was restored in the new session.
+	server.Publish("restored/a", []byte("after reconnect"), types.QoS1, false)
+	message := waitFor(t, messages, "a message")
+	if string(message.Payload) != "after reconnect" {
+		t.Fatalf("wanted the message after the reconnect but got %+v", message)
+	}
+}
+
+func TestOfflineBuffering(t *testing.T) {
+	server, address := startBroker(t, broker.ListenerConfig{})
+	path := filepath.Join(t.TempDir(), "client.log")
+	store, err := OpenFileStore(path, 2, storage.FileStoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := connect(t, address, Options{
+		AutoReconnect:     true,
+		MinReconnectDelay: time.Hour,
+		Store:             store,
+	})
+
+	server.Close(context.Background())
+	for client.State() != Reconnecting {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx := context.Background()
+	for _, qos := range []types.QoS{types.QoS0, types.QoS2} {
+		err = client.Publish(ctx, "buffered", []byte{byte(qos)}, qos, false)
+		if err != nil {
+			t.Fatalf("wanted the message to be buffered but got %v", err)
+		}
+	}
+	err = client.Publish(ctx, "buffered", nil, types.QoS1, false)
+	if !errors.Is(err, ErrStoreFull) {
+		t.Fatalf("wanted %v but got %v", ErrStoreFull, err)
+	}
+	client.Disconnect(ctx)
+	store.Close()
+
+	// The buffered messages are sent by a new client with the same store.
+	server, _ = serveBroker(t, address, broker.ListenerConfig{})
+	received := make(chan broker.Message, 2)
+	server.Subscribe("buffered", func(message broker.Message) { received <- message })
+	store, err = OpenFileStore(path, 2, storage.FileStoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	connect(t, address, Options{Store: store})
+
+	for _, qos := range []types.QoS{types.QoS0, types.QoS2} {
+		message := waitFor(t, received, "a buffered message")
+		if message.Payload[0] != byte(qos) {
+			t.Fatalf("wanted the message with QoS %v but got %+v", qos, message)
+		}
+	}
+	// The QoS 2 message is deleted from the store once PUBCOMP arrives.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		stored := 0
+		store.Load(func(key string, value []byte) error {
+			stored++
+			return nil
+		})
+		if stored == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("wanted no stored messages after delivery but got %v", stored)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestResendInFlight lets a fake broker close the connection before it
+// acknowledges a PUBLISH, the client sends it again when it reconnects.
+func TestResendInFlight(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	publishes := make(chan *packet.PublishPacket, 2)
+	go func() {
+		for connection := 0; connection < 2; connection++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			readPacket(reader) // CONNECT
+
+			conack := packet.ConackPacket{}
+			if connection > 0 {
+				conack.VariableHeader.ConnectAcknowledgeFlags = byte(packet.SessionPresent)
+			}
+			bin, _ := conack.Encode()
+			conn.Write(bin)
+
+			_, bytes, err := readPacket(reader)
+			if err != nil {
+				return
+			}
+			publish := &packet.PublishPacket{}
+			publish.Decode(bytes)
+			publishes <- publish
+			if connection == 0 {
+				conn.Close()
+				continue
+			}
+			puback := protocol.MakePuback(publish, packet.Success)
+			bin, _ = puback.Encode()
+			conn.Write(bin)
+		}
+	}()
+
+	client := connect(t, ln.Addr().String(), Options{
+		ClientID:          "resending",
+		AutoReconnect:     true,
+		MinReconnectDelay: 10 * time.Millisecond,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err = client.Publish(ctx, "in/flight", []byte("payload"), types.QoS1, false)
+	if !errors.Is(err, ErrConnectionLost) {
+		t.Fatalf("wanted %v but got %v", ErrConnectionLost, err)
+	}
+
+	first := waitFor(t, publishes, "the PUBLISH")
+	resent := waitFor(t, publishes, "the resent PUBLISH")
+	if !resent.FixedHeader.Dup || resent.VariableHeader.PacketIdentifier.Value != first.VariableHeader.PacketIdentifier.Value {
+		t.Fatalf("wanted the PUBLISH to be resent with DUP set but got %v", resent)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		client.mutex.Lock()
+		inFlight := len(client.requests)
+		client.mutex.Unlock()
+		if inFlight == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("wanted the resent PUBLISH to be acknowledged")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMemoryStoreLimit(t *testing.T) {
+	store := NewMemoryStore(1)
+	err := store.Put("a", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Put("a", []byte("2"))
+	if err != nil {
+		t.Fatalf("wanted to replace the message but got %v", err)
+	}
+	err = store.Put("b", []byte("3"))
+	if !errors.Is(err, ErrStoreFull) {
+		t.Fatalf("wanted %v but got %v", ErrStoreFull, err)
+	}
+}
+
+var topicMatchesCases = []struct {
+	filter string
+	topic  string
+	want   bool
+}{
+	{filter: "a/b", topic: "a/b", want: true},
+	{filter: "a/+", topic: "a/b", want: true},
+	{filter: "a/+", topic: "a/b/c", want: false},
+	{filter: "a/#", topic: "a", want: true},
+	{filter: "a/#", topic: "a/b/c", want: true},
+	{filter: "#", topic: "$SYS/uptime", want: false},
+	{filter: "+/uptime", topic: "$SYS/uptime", want: false},
+	{filter: "$SYS/#", topic: "$SYS/uptime", want: true},
+	{filter: "$share/group/a/+", topic: "a/b", want: true},
+	{filter: "a/b", topic: "a", want: false},
+}
+
+func TestTopicMatches(t *testing.T) {
+	for _, c := range topicMatchesCases {
+		got := topicMatches(c.filter, c.topic)
+		if got != c.want {
+			t.Fatalf("%s %s: wanted %v but got %v", c.filter, c.topic, c.want, got)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/codec"
+	"github.com/DvdSpijker/GoBroker/packet"
+)
+
+// connection is a single network connection to the broker, a client that
+// connects again gets a new connection.
+type connection struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	keepAlive time.Duration
+
+	writeMutex sync.Mutex
+	lastWrite  atomic.Int64 // Unix nanoseconds
+	pingSent   atomic.Bool
+
+	// messages queues received messages for the handlers.
+	messages chan Message
+
+	closeOnce sync.Once
+	done      chan struct{}
+	err       error // Why the connection closed, set before done is closed.
+}
+
+func newConnection(conn net.Conn, reader *bufio.Reader, keepAlive time.Duration) *connection {
+	connection := &connection{
+		conn:      conn,
+		reader:    reader,
+		keepAlive: keepAlive,
+		messages:  make(chan Message, messageQueueSize),
+		done:      make(chan struct{}),
+	}
+	connection.lastWrite.Store(time.Now().UnixNano())
+	return connection
+}
+
+// write encodes and sends p. The connection is closed if writing fails,
+// since part of the packet may have been sent.
+func (connection *connection) write(ctx context.Context, p codec.Encoder) error {
+	bin, err := p.Encode()
+	if err != nil {
+		return err
+	}
+
+	connection.writeMutex.Lock()
+	defer connection.writeMutex.Unlock()
+
+	deadline, _ := ctx.Deadline()
+	connection.conn.SetWriteDeadline(deadline)
+	_, err = connection.conn.Write(bin)
+	if err != nil {
+		connection.close(err)
+		return fmt.Errorf("%w: %w", ErrConnectionLost, err)
+	}
+	connection.lastWrite.Store(time.Now().UnixNano())
+	return nil
+}
+
+// close closes the connection once, err tells why.
+func (connection *connection) close(err error) {
+	connection.closeOnce.Do(func() {
+		connection.err = err
+		close(connection.done)
+		connection.conn.Close()
+	})
+}
+
+// dial opens a network connection to the server of the options.
+func dial(ctx context.Context, options *Options) (net.Conn, error) {
+	server := options.Server
+	if !strings.Contains(server, "://") {
+		server = "tcp://" + server
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, fmt.Errorf("server address: %w", err)
+	}
+
+	dialer := &net.Dialer{}
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		return dialer.DialContext(ctx, "tcp", hostPort(u, "1883"))
+	case "tls", "ssl", "mqtts":
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: options.TLSConfig}
+		return tlsDialer.DialContext(ctx, "tcp", hostPort(u, "8883"))
+	case "unix":
+		return dialer.DialContext(ctx, "unix", u.Host+u.Path)
+	case "ws", "wss":
+		return dialWebsocket(ctx, u, options.TLSConfig)
+	}
+	return nil, fmt.Errorf("server address: unsupported scheme %q", u.Scheme)
+}
+
+// hostPort returns the host and port of u, with port if u has none.
+func hostPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// readPacket blocks until a complete packet has been read. The returned
+// bytes contain the whole packet including the fixed header.
+func readPacket(reader *bufio.Reader) (packet.FixedHeader, []byte, error) {
+	header := make([]byte, 1, 5)
+	first, err := reader.ReadByte()
+	if err != nil {
+		return packet.FixedHeader{}, nil, err
+	}
+	header[0] = first
+
+	// The remaining length is a Variable Byte Integer of at most four
+	// bytes (1.5.5).
+	remainingLength := 0
+	multiplier := 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return packet.FixedHeader{}, nil, errors.New("malformed remaining length")
+		}
+		b, err := reader.ReadByte()
+		if err != nil {
+			return packet.FixedHeader{}, nil, unexpectedEOF(err)
+		}
+		header = append(header, b)
+
+		remainingLength += int(b&127) * multiplier
+		multiplier *= 128
+		if b&128 == 0 {
+			break
+		}
+	}
+
+	fixedHeader := packet.FixedHeader{}
+	_, err = fixedHeader.Decode(header)
+	if err != nil {
+		return packet.FixedHeader{}, nil, err
+	}
+
+	bytes := make([]byte, len(header)+remainingLength)
+	copy(bytes, header)
+	_, err = io.ReadFull(reader, bytes[len(header):])
+	if err != nil {
+		return packet.FixedHeader{}, nil, unexpectedEOF(err)
+	}
+
+	return fixedHeader, bytes, nil
+}
+
+// unexpectedEOF converts io.EOF to io.ErrUnexpectedEOF, the end of the
+// stream halfway through a packet means the packet was truncated.
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
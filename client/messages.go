@@ -0,0 +1,746 @@
+package client
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/codec"
+	"github.com/DvdSpijker/GoBroker/packet"
+	"github.com/DvdSpijker/GoBroker/protocol"
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+type (
+	// Message is a message received from the broker, or a message to
+	// publish with PublishMessage.
+	Message struct {
+		Topic   string
+		Payload []byte
+		QoS     types.QoS
+		Retain  bool
+		// Duplicate is set if the broker may have sent the message before,
+		// it is ignored when publishing.
+		Duplicate  bool
+		Properties Properties
+	}
+
+	// Properties are the properties of a PUBLISH packet, properties with a
+	// zero value are not sent.
+	Properties struct {
+		// UTF8Payload sets the payload format indicator, which marks the
+		// payload as UTF-8 encoded text.
+		UTF8Payload bool
+		// MessageExpiryInterval is how long the broker keeps the message
+		// for subscribers that are offline, it is rounded up to seconds.
+		MessageExpiryInterval time.Duration
+		ContentType           string
+		ResponseTopic         string
+		CorrelationData       []byte
+		UserProperties        []UserProperty
+	}
+
+	// UserProperty is a name and value pair defined by the application.
+	// Names may occur more than once.
+	UserProperty struct {
+		Name  string
+		Value string
+	}
+
+	// MessageHandler is called for every received message that matches
+	// the filter it was subscribed with. Handlers are called one at a
+	// time, in the order the messages arrived.
+	MessageHandler func(Message)
+
+	// SubscribeOptions are the options of a subscription (3.8.3.1).
+	SubscribeOptions struct {
+		// QoS is the maximum QoS of the messages sent by the broker.
+		QoS types.QoS
+		// NoLocal asks the broker not to send the messages that the client
+		// published itself.
+		NoLocal bool
+		// RetainAsPublished asks the broker to keep the retain flag of
+		// forwarded messages as it was published.
+		RetainAsPublished bool
+	}
+
+	subscription struct {
+		options SubscribeOptions
+		handler MessageHandler
+	}
+
+	// request is a packet waiting for an acknowledgement by the broker, or
+	// a message waiting to be sent.
+	request struct {
+		packetIdentifier uint16
+		// publish is set for PUBLISH packets, it is nil for SUBSCRIBE and
+		// UNSUBSCRIBE.
+		publish *packet.PublishPacket
+		// sequence is the sequence number of a stored message.
+		sequence uint64
+		// released is set once the PUBREL of a QoS 2 PUBLISH was sent.
+		released bool
+		reply    chan reply
+	}
+
+	// reply is the acknowledgement of a request.
+	reply struct {
+		packetType  packet.PacketType
+		reasonCodes []packet.ReasonCode
+		reason      string
+		err         error
+	}
+)
+
+func newRequest(publish *packet.PublishPacket) *request {
+	return &request{
+		publish: publish,
+		reply:   make(chan reply, 1),
+	}
+}
+
+// Publish publishes payload to topic. A QoS 0 message is sent without
+// waiting, QoS 1 and 2 wait until the broker acknowledged the message.
+//
+// While the client is reconnecting the message is stored and Publish
+// returns without waiting, the message is sent once the client is connected
+// again. A QoS 1 or 2 message that is not acknowledged when the connection
+// is lost, or when ctx is done, stays stored and is sent again as well.
+func (client *Client) Publish(ctx context.Context, topic string, payload []byte, qos types.QoS, retain bool) error {
+	return client.PublishMessage(ctx, Message{Topic: topic, Payload: payload, QoS: qos, Retain: retain})
+}
+
+// PublishMessage publishes message with its properties, like Publish.
+func (client *Client) PublishMessage(ctx context.Context, message Message) error {
+	err := checkTopicName(message.Topic)
+	if err != nil {
+		return err
+	}
+	qos := message.QoS
+	if qos > types.QoS2 {
+		return fmt.Errorf("%w: %d", ErrInvalidQoS, qos)
+	}
+
+	publish, err := makePublish(message)
+	if err != nil {
+		return err
+	}
+	request := newRequest(publish)
+
+	client.mutex.Lock()
+	switch client.state {
+	case Disconnected:
+		client.mutex.Unlock()
+		return ErrNotConnected
+	case Reconnecting:
+		err = client.persist(request)
+		if err == nil {
+			client.queued = append(client.queued, request)
+		}
+		client.mutex.Unlock()
+		return err
+	}
+
+	connection := client.connection
+	if qos == types.QoS0 {
+		client.mutex.Unlock()
+		return connection.write(ctx, publish)
+	}
+	err = client.assign(request)
+	if err == nil {
+		err = client.persist(request)
+		if err != nil {
+			delete(client.requests, request.packetIdentifier)
+		}
+	}
+	client.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	reply, err := client.await(ctx, connection, request, publish)
+	if err != nil {
+		return err
+	}
+	if reply.reasonCodes[0] >= packet.UnspecifiedError {
+		return &ReasonCodeError{PacketType: reply.packetType, ReasonCode: reply.reasonCodes[0], Reason: reply.reason}
+	}
+	return nil
+}
+
+// Subscribe subscribes to filter and calls handler for the messages that
+// match it. The handler may be nil to receive the messages with the
+// OnMessage handler of the options.
+func (client *Client) Subscribe(ctx context.Context, filter string, qos types.QoS, handler MessageHandler) error {
+	return client.SubscribeWithOptions(ctx, filter, SubscribeOptions{QoS: qos}, handler)
+}
+
+// SubscribeWithOptions subscribes to filter with options, like Subscribe.
+func (client *Client) SubscribeWithOptions(ctx context.Context, filter string, options SubscribeOptions,
+	handler MessageHandler) error {
+	err := checkTopicFilter(filter)
+	if err != nil {
+		return err
+	}
+	if options.QoS > types.QoS2 {
+		return fmt.Errorf("%w: %d", ErrInvalidQoS, options.QoS)
+	}
+
+	// The handler is added before the SUBSCRIBE is sent, because retained
+	// messages may arrive right after the SUBACK.
+	client.mutex.Lock()
+	previous, subscribed := client.subscriptions[filter]
+	client.subscriptions[filter] = subscription{options: options, handler: handler}
+	client.mutex.Unlock()
+
+	err = client.subscribe(ctx, []packet.TopicFilterPair{{
+		TopicFilter:         types.UtfString{Str: filter},
+		SubscriptionOptions: options.encode(),
+	}})
+	if err != nil {
+		client.mutex.Lock()
+		if subscribed {
+			client.subscriptions[filter] = previous
+		} else {
+			delete(client.subscriptions, filter)
+		}
+		client.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// restoreSubscriptions subscribes to the filters of all subscriptions again,
+// after the broker started a new session.
+func (client *Client) restoreSubscriptions(ctx context.Context) error {
+	client.mutex.Lock()
+	filters := make([]packet.TopicFilterPair, 0, len(client.subscriptions))
+	for filter, subscription := range client.subscriptions {
+		filters = append(filters, packet.TopicFilterPair{
+			TopicFilter:         types.UtfString{Str: filter},
+			SubscriptionOptions: subscription.options.encode(),
+		})
+	}
+	client.mutex.Unlock()
+
+	if len(filters) == 0 {
+		return nil
+	}
+	client.log.Debug("restoring subscriptions", "subscriptions", len(filters))
+	return client.subscribe(ctx, filters)
+}
+
+// encode returns the subscription options byte of a SUBSCRIBE packet.
+func (options SubscribeOptions) encode() byte {
+	encoded := byte(options.QoS)
+	if options.NoLocal {
+		encoded |= 0b100
+	}
+	if options.RetainAsPublished {
+		encoded |= 0b1000
+	}
+	return encoded
+}
+
+// subscribe sends a SUBSCRIBE with filters and waits for the SUBACK.
+func (client *Client) subscribe(ctx context.Context, filters []packet.TopicFilterPair) error {
+	subscribe := &packet.SubscribePacket{}
+	subscribe.Payload.Filters = filters
+
+	request := newRequest(nil)
+	connection, err := client.register(request)
+	if err != nil {
+		return err
+	}
+	subscribe.VariableHeader.PacketIdentifier = types.UnsignedInt{Value: uint32(request.packetIdentifier), Size: 2}
+
+	reply, err := client.await(ctx, connection, request, subscribe)
+	if err != nil {
+		return err
+	}
+	if len(reply.reasonCodes) != len(filters) {
+		return fmt.Errorf("%w: SUBACK with %d reason codes for %d filters", ErrProtocol, len(reply.reasonCodes), len(filters))
+	}
+	for _, reasonCode := range reply.reasonCodes {
+		if reasonCode >= packet.UnspecifiedError {
+			return &ReasonCodeError{PacketType: packet.SUBACK, ReasonCode: reasonCode, Reason: reply.reason}
+		}
+	}
+	return nil
+}
+
+// Unsubscribe removes the subscriptions to filters. Unsubscribing from a
+// filter without a subscription is not an error.
+func (client *Client) Unsubscribe(ctx context.Context, filters ...string) error {
+	if len(filters) == 0 {
+		return nil
+	}
+
+	unsubscribe := &packet.UnsubscribePacket{}
+	for _, filter := range filters {
+		err := checkTopicFilter(filter)
+		if err != nil {
+			return err
+		}
+		unsubscribe.Payload.Filters = append(unsubscribe.Payload.Filters,
+			packet.TopicFilterPair{TopicFilter: types.UtfString{Str: filter}})
+	}
+
+	request := newRequest(nil)
+	connection, err := client.register(request)
+	if err != nil {
+		return err
+	}
+	unsubscribe.VariableHeader.PacketIdentifier = types.UnsignedInt{Value: uint32(request.packetIdentifier), Size: 2}
+
+	reply, err := client.await(ctx, connection, request, unsubscribe)
+	if err != nil {
+		return err
+	}
+	if len(reply.reasonCodes) != len(filters) {
+		return fmt.Errorf("%w: UNSUBACK with %d reason codes for %d filters", ErrProtocol, len(reply.reasonCodes), len(filters))
+	}
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	for i, filter := range filters {
+		if reply.reasonCodes[i] >= packet.UnspecifiedError {
+			err = &ReasonCodeError{PacketType: packet.UNSUBACK, ReasonCode: reply.reasonCodes[i], Reason: reply.reason}
+			continue
+		}
+		delete(client.subscriptions, filter)
+	}
+	return err
+}
+
+// register assigns a packet identifier to request if the client is
+// connected.
+func (client *Client) register(request *request) (*connection, error) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if client.connection == nil {
+		return nil, ErrNotConnected
+	}
+	err := client.assign(request)
+	if err != nil {
+		return nil, err
+	}
+	return client.connection, nil
+}
+
+// assign assigns a free packet identifier to request. The client mutex must
+// be held.
+func (client *Client) assign(request *request) error {
+	// MQTT-2.2.1-3: A packet identifier is not reused until the request
+	// that used it was acknowledged. Zero is not a valid identifier.
+	for range 65535 {
+		client.lastPacketIdentifier++
+		if client.lastPacketIdentifier == 0 {
+			client.lastPacketIdentifier = 1
+		}
+		_, used := client.requests[client.lastPacketIdentifier]
+		if !used {
+			request.packetIdentifier = client.lastPacketIdentifier
+			if request.publish != nil {
+				request.publish.VariableHeader.PacketIdentifier = types.UnsignedInt{Value: uint32(request.packetIdentifier), Size: 2}
+			}
+			client.requests[request.packetIdentifier] = request
+			return nil
+		}
+	}
+	return ErrNoPacketIdentifier
+}
+
+// await sends the packet of request and waits for its acknowledgement. A
+// PUBLISH is kept when sending it fails or ctx is done, it is sent again
+// when the client connects again.
+func (client *Client) await(ctx context.Context, connection *connection, request *request, p codec.Encoder) (reply, error) {
+	err := connection.write(ctx, p)
+	if err != nil && request.publish == nil {
+		client.forget(request)
+		return reply{}, err
+	}
+
+	select {
+	case reply := <-request.reply:
+		if reply.err != nil {
+			return reply, reply.err
+		}
+		if len(reply.reasonCodes) == 0 {
+			return reply, fmt.Errorf("%w: %s without reason codes", ErrProtocol, reply.packetType)
+		}
+		return reply, nil
+	case <-ctx.Done():
+		if request.publish == nil {
+			client.forget(request)
+		}
+		return reply{}, ctx.Err()
+	}
+}
+
+// forget releases the packet identifier of a request that will not be
+// acknowledged.
+func (client *Client) forget(request *request) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	if client.requests[request.packetIdentifier] == request {
+		delete(client.requests, request.packetIdentifier)
+	}
+}
+
+// complete passes the acknowledgement with packetIdentifier to the request
+// waiting for it.
+func (client *Client) complete(packetIdentifier uint32, reply reply) {
+	client.mutex.Lock()
+	request, ok := client.requests[uint16(packetIdentifier)]
+	if ok {
+		client.finish(request, reply)
+	}
+	client.mutex.Unlock()
+
+	if !ok {
+		client.log.Debug("acknowledgement of unknown packet identifier",
+			"packet_type", reply.packetType.String(), "packet_identifier", packetIdentifier)
+	}
+}
+
+// finish removes an acknowledged request and passes reply to the caller
+// waiting for it, if any. The client mutex must be held.
+func (client *Client) finish(request *request, reply reply) {
+	delete(client.requests, request.packetIdentifier)
+	if request.publish != nil {
+		client.unpersist(request)
+	}
+	notify(request, reply)
+}
+
+// failRequests passes err to the callers waiting for a request. Messages
+// stay stored, they are sent again when the client connects again. The
+// client mutex must be held.
+func (client *Client) failRequests(err error) {
+	for packetIdentifier, request := range client.requests {
+		notify(request, reply{err: err})
+		if request.publish == nil {
+			delete(client.requests, packetIdentifier)
+		}
+	}
+}
+
+// notify passes reply to the caller waiting for request. A request is
+// answered at most once, later replies are dropped.
+func notify(request *request, reply reply) {
+	select {
+	case request.reply <- reply:
+	default:
+	}
+}
+
+// load loads the messages of the store that were not sent or acknowledged
+// by an earlier client with the same store.
+func (client *Client) load() error {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if client.loaded {
+		return nil
+	}
+
+	var requests []*request
+	err := client.store.Load(func(key string, value []byte) error {
+		sequence, err := strconv.ParseUint(key, 16, 64)
+		if err != nil {
+			return fmt.Errorf("stored message key %q: %w", key, err)
+		}
+		request, err := decodeStored(value)
+		if err != nil {
+			return err
+		}
+		request.sequence = sequence
+		requests = append(requests, request)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	slices.SortFunc(requests, compareSequence)
+	for _, request := range requests {
+		client.sequence = max(client.sequence, request.sequence)
+		if request.packetIdentifier == 0 {
+			client.queued = append(client.queued, request)
+		} else {
+			client.requests[request.packetIdentifier] = request
+		}
+	}
+	if len(requests) > 0 {
+		client.log.Info("loaded stored messages", "messages", len(requests))
+	}
+	client.loaded = true
+	return nil
+}
+
+func compareSequence(a *request, b *request) int {
+	return cmp.Compare(a.sequence, b.sequence)
+}
+
+// persist stores the message of request, the client mutex must be held.
+func (client *Client) persist(request *request) error {
+	if request.sequence == 0 {
+		client.sequence++
+		request.sequence = client.sequence
+	}
+	value, err := encodeStored(request)
+	if err != nil {
+		return err
+	}
+	return client.store.Put(storeKey(request.sequence), value)
+}
+
+// unpersist removes the stored message of request, the client mutex must be
+// held.
+func (client *Client) unpersist(request *request) {
+	err := client.store.Delete(storeKey(request.sequence))
+	if err != nil {
+		client.log.Warn("failed to delete stored message", "error", err)
+	}
+}
+
+// resend sends the messages that were not acknowledged on an earlier
+// connection and the messages that were published while reconnecting, in
+// the order they were published. The client mutex must be held.
+func (client *Client) resend(ctx context.Context, connection *connection, sessionPresent bool) error {
+	inFlight := make([]*request, 0, len(client.requests))
+	for _, request := range client.requests {
+		if request.publish != nil {
+			inFlight = append(inFlight, request)
+		}
+	}
+	slices.SortFunc(inFlight, compareSequence)
+
+	for _, request := range inFlight {
+		var p codec.Encoder = request.publish
+		switch {
+		case request.released && !sessionPresent:
+			// The broker received the message before it discarded the
+			// session, so it was published already.
+			client.finish(request, reply{packetType: packet.PUBCOMP, reasonCodes: []packet.ReasonCode{packet.Success}})
+			continue
+		case request.released:
+			p = protocol.MakePubrel(request.packetIdentifier, packet.Success)
+		case sessionPresent:
+			// MQTT-3.3.1-1: The DUP flag is set when a PUBLISH is sent again.
+			publish := request.publish
+			publish.FixedHeader.Dup = true
+			publish.FixedHeader.CommonFixedHeader.Flags = packet.PublishPacketFlags(publish.FixedHeader.Qos, true, publish.FixedHeader.Retain)
+		}
+
+		err := connection.write(ctx, p)
+		if err != nil {
+			return err
+		}
+	}
+
+	for len(client.queued) > 0 {
+		request := client.queued[0]
+		if request.publish.FixedHeader.Qos > types.QoS0 {
+			err := client.assign(request)
+			if err != nil {
+				return err
+			}
+			// The message is in flight from now on, also if it can not be
+			// written.
+			client.queued = client.queued[1:]
+			err = client.persist(request)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := connection.write(ctx, request.publish)
+		if err != nil {
+			return err
+		}
+		if request.publish.FixedHeader.Qos == types.QoS0 {
+			client.queued = client.queued[1:]
+			client.unpersist(request)
+		}
+	}
+	if len(inFlight) > 0 {
+		client.log.Info("resent messages", "messages", len(inFlight))
+	}
+	return nil
+}
+
+// onPubrec releases a QoS 2 message that the broker received.
+func (client *Client) onPubrec(ctx context.Context, connection *connection, pubrec *packet.PubrecPacket) error {
+	packetIdentifier := pubrec.VariableHeader.PacketIdentifer.Value
+	if pubrec.VariableHeader.ReasonCode >= packet.UnspecifiedError {
+		// MQTT-4.3.3-4: The delivery ends with a PUBREC that failed.
+		client.complete(packetIdentifier, reply{packetType: packet.PUBREC,
+			reasonCodes: []packet.ReasonCode{pubrec.VariableHeader.ReasonCode}})
+		return nil
+	}
+
+	client.mutex.Lock()
+	request, ok := client.requests[uint16(packetIdentifier)]
+	if ok && request.publish != nil {
+		request.released = true
+		err := client.persist(request)
+		if err != nil {
+			client.log.Warn("failed to store released message", "error", err)
+		}
+	}
+	client.mutex.Unlock()
+
+	reasonCode := packet.Success
+	if !ok {
+		reasonCode = packet.PacketIdentifierNotFound
+	}
+	return connection.write(ctx, protocol.MakePubrel(uint16(packetIdentifier), reasonCode))
+}
+
+// onPubrel completes the delivery of a received QoS 2 message.
+func (client *Client) onPubrel(ctx context.Context, connection *connection, pubrel *packet.PubrelPacket) error {
+	packetIdentifier := uint16(pubrel.VariableHeader.PacketIdentifer.Value)
+
+	client.mutex.Lock()
+	_, ok := client.received[packetIdentifier]
+	delete(client.received, packetIdentifier)
+	client.mutex.Unlock()
+
+	reasonCode := packet.Success
+	if !ok {
+		reasonCode = packet.PacketIdentifierNotFound
+	}
+	return connection.write(ctx, protocol.MakePubcomp(packetIdentifier, reasonCode))
+}
+
+// onPublish queues a received message for the handlers and acknowledges it.
+func (client *Client) onPublish(connection *connection, bytes []byte) error {
+	publish := packet.PublishPacket{}
+	_, err := publish.Decode(bytes)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrProtocol, err)
+	}
+
+	message := makeMessage(&publish)
+	ctx := context.Background()
+
+	switch message.QoS {
+	case types.QoS0:
+		client.enqueue(connection, message)
+		return nil
+
+	case types.QoS1:
+		client.enqueue(connection, message)
+		return connection.write(ctx, protocol.MakePuback(&publish, packet.Success))
+
+	case types.QoS2:
+		// MQTT-4.3.3-10: A message that is sent again before it was
+		// released is only acknowledged again.
+		packetIdentifier := uint16(publish.VariableHeader.PacketIdentifier.Value)
+		client.mutex.Lock()
+		received := client.received[packetIdentifier]
+		client.received[packetIdentifier] = true
+		client.mutex.Unlock()
+
+		if !received {
+			client.enqueue(connection, message)
+		}
+		return connection.write(ctx, protocol.MakePubrec(&publish, packet.Success))
+	}
+	return fmt.Errorf("%w: PUBLISH with QoS %d", ErrProtocol, message.QoS)
+}
+
+// makePublish makes the PUBLISH packet of message.
+func makePublish(message Message) (*packet.PublishPacket, error) {
+	publish := protocol.MakePublishPacket(message.Topic, message.Payload, message.QoS, message.Retain)
+	header := &publish.VariableHeader
+	properties := &message.Properties
+
+	if properties.UTF8Payload {
+		header.PayloadFormatIndicator = packet.UtfCharacterData
+	}
+	if properties.MessageExpiryInterval > 0 {
+		seconds := (properties.MessageExpiryInterval + time.Second - 1) / time.Second
+		header.MessageExpiryInterval.Value = uint32(min(seconds, math.MaxUint32))
+	}
+	header.ContentType.Str = properties.ContentType
+	header.ResponseTopic.Str = properties.ResponseTopic
+	header.CorrelationData.Data = properties.CorrelationData
+	for _, userProperty := range properties.UserProperties {
+		header.UserProperties = append(header.UserProperties, types.UtfStringPair{
+			Name:  types.UtfString{Str: userProperty.Name},
+			Value: types.UtfString{Str: userProperty.Value},
+		})
+	}
+
+	err := header.EncodeProperties()
+	if err != nil {
+		return nil, fmt.Errorf("properties: %w", err)
+	}
+	return publish, nil
+}
+
+// makeMessage makes the message of a received PUBLISH packet.
+func makeMessage(publish *packet.PublishPacket) Message {
+	header := &publish.VariableHeader
+	message := Message{
+		Topic:     header.TopicName.String(),
+		Payload:   publish.Payload.Data,
+		QoS:       publish.FixedHeader.Qos,
+		Retain:    publish.FixedHeader.Retain,
+		Duplicate: publish.FixedHeader.Dup,
+		Properties: Properties{
+			UTF8Payload:           header.PayloadFormatIndicator == packet.UtfCharacterData,
+			MessageExpiryInterval: time.Duration(header.MessageExpiryInterval.Value) * time.Second,
+			ContentType:           header.ContentType.Str,
+			ResponseTopic:         header.ResponseTopic.Str,
+			CorrelationData:       header.CorrelationData.Data,
+		},
+	}
+	for _, userProperty := range header.UserProperties {
+		message.Properties.UserProperties = append(message.Properties.UserProperties, UserProperty{
+			Name:  userProperty.Name.Str,
+			Value: userProperty.Value.Str,
+		})
+	}
+	return message
+}
+
+// enqueue queues message for the handlers. It blocks while the queue is
+// full, so slow handlers slow down reading from the connection.
+func (client *Client) enqueue(connection *connection, message Message) {
+	select {
+	case connection.messages <- message:
+	case <-connection.done:
+	}
+}
+
+// deliver calls the handlers of the subscriptions matching the topic of
+// message, or the OnMessage handler if there are none.
+func (client *Client) deliver(message Message) {
+	client.mutex.Lock()
+	handlers := []MessageHandler{}
+	for filter, subscription := range client.subscriptions {
+		if subscription.handler != nil && topicMatches(filter, message.Topic) {
+			handlers = append(handlers, subscription.handler)
+		}
+	}
+	client.mutex.Unlock()
+
+	if len(handlers) == 0 {
+		if client.options.OnMessage != nil {
+			client.options.OnMessage(message)
+		}
+		return
+	}
+	for _, handler := range handlers {
+		handler(message)
+	}
+}
@@ -0,0 +1,149 @@
+package client
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+const (
+	// DefaultKeepAlive is used when Options.KeepAlive is zero.
+	DefaultKeepAlive = 60 * time.Second
+	// DefaultPingTimeout is used when Options.PingTimeout is zero.
+	DefaultPingTimeout = 10 * time.Second
+	// DefaultConnectTimeout is used when Options.ConnectTimeout is zero.
+	DefaultConnectTimeout = 10 * time.Second
+	// DefaultMinReconnectDelay and DefaultMaxReconnectDelay are used when
+	// the delays of the options are zero.
+	DefaultMinReconnectDelay = time.Second
+	DefaultMaxReconnectDelay = 2 * time.Minute
+
+	// messageQueueSize is the number of received messages that are queued
+	// for the handlers before the client stops reading from the connection.
+	messageQueueSize = 256
+)
+
+type (
+	// Options configures a Client.
+	Options struct {
+		// Server is the address of the broker as tcp://host:port,
+		// tls://host:port, ws://host:port/path, wss://host:port/path or
+		// unix://path. An address without a scheme is dialed over TCP, the
+		// port defaults to 1883 or 8883 for TLS and the WebSocket path to
+		// /mqtt.
+		Server string
+		// TLSConfig is used for tls:// and wss:// servers.
+		TLSConfig *tls.Config
+
+		// ClientID may be empty to let the broker assign one, the assigned
+		// identifier is reused when the client connects again.
+		ClientID string
+		UserName string
+		Password []byte
+
+		// CleanStart discards the session the broker kept for the client.
+		CleanStart bool
+		// SessionExpiryInterval is how long the broker keeps the session
+		// after the connection closes, zero ends it with the connection.
+		SessionExpiryInterval time.Duration
+		// KeepAlive is the longest time between two packets sent to the
+		// broker, a PINGREQ is sent when there is nothing else to send.
+		// Zero uses DefaultKeepAlive and a negative value disables it.
+		KeepAlive time.Duration
+		// PingTimeout is how long the client waits for a PINGRESP before it
+		// considers the connection lost.
+		PingTimeout time.Duration
+
+		// Will is published by the broker when the connection closes
+		// without a DISCONNECT.
+		Will *Will
+
+		// AutoReconnect connects again when the connection is lost. The
+		// delay before an attempt starts at MinReconnectDelay and doubles
+		// after every failed attempt, up to MaxReconnectDelay.
+		AutoReconnect     bool
+		MinReconnectDelay time.Duration
+		MaxReconnectDelay time.Duration
+		// ConnectTimeout bounds an attempt to reconnect.
+		ConnectTimeout time.Duration
+
+		// Store holds the messages published while reconnecting and the
+		// QoS 1 and 2 messages that were not acknowledged yet, nil uses a
+		// MemoryStore of DefaultStoreLimit messages. Publish returns
+		// ErrStoreFull when the store is full.
+		Store Store
+
+		// OnMessage is called for received messages that match no filter
+		// passed to Subscribe, for example messages of a session that was
+		// resumed.
+		OnMessage MessageHandler
+		// OnConnect is called after every successful connect, including
+		// reconnects. Subscriptions were restored by then if the broker
+		// did not resume the session.
+		OnConnect func(sessionPresent bool)
+		// OnConnectionLost is called when the connection closes for any
+		// other reason than Disconnect.
+		OnConnectionLost func(err error)
+		// OnReconnecting is called before every attempt to reconnect, err
+		// is why the connection was lost or why the previous attempt
+		// failed.
+		OnReconnecting func(attempt int, err error)
+
+		Logger *slog.Logger
+	}
+
+	// Will is the message the broker publishes on behalf of the client when
+	// the client disconnects unexpectedly.
+	Will struct {
+		Topic   string
+		Payload []byte
+		QoS     types.QoS
+		Retain  bool
+		// DelayInterval delays publishing the will, it is not published at
+		// all if the client reconnects in time.
+		DelayInterval time.Duration
+	}
+)
+
+// keepAlive returns the keep alive to request in the CONNECT packet.
+func (options *Options) keepAlive() time.Duration {
+	switch {
+	case options.KeepAlive < 0:
+		return 0
+	case options.KeepAlive == 0:
+		return DefaultKeepAlive
+	case options.KeepAlive > 65535*time.Second:
+		return 65535 * time.Second
+	}
+	return options.KeepAlive.Truncate(time.Second)
+}
+
+func (options *Options) pingTimeout() time.Duration {
+	if options.PingTimeout <= 0 {
+		return DefaultPingTimeout
+	}
+	return options.PingTimeout
+}
+
+func (options *Options) connectTimeout() time.Duration {
+	if options.ConnectTimeout <= 0 {
+		return DefaultConnectTimeout
+	}
+	return options.ConnectTimeout
+}
+
+func (options *Options) minReconnectDelay() time.Duration {
+	if options.MinReconnectDelay <= 0 {
+		return DefaultMinReconnectDelay
+	}
+	return options.MinReconnectDelay
+}
+
+func (options *Options) maxReconnectDelay() time.Duration {
+	if options.MaxReconnectDelay <= 0 {
+		return max(DefaultMaxReconnectDelay, options.minReconnectDelay())
+	}
+	return max(options.MaxReconnectDelay, options.minReconnectDelay())
+}
@@ -0,0 +1,205 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/DvdSpijker/GoBroker/packet"
+	"github.com/DvdSpijker/GoBroker/storage"
+)
+
+// DefaultStoreLimit is the limit of the memory store that is used when
+// Options.Store is nil.
+const DefaultStoreLimit = 1000
+
+// fileStoreBucket is the bucket of the storage.FileStore that holds the
+// messages of a FileStore.
+const fileStoreBucket = "outbound"
+
+var ErrStoreFull = errors.New("store full")
+
+type (
+	// Store holds the outbound messages of a client that were not sent or
+	// not acknowledged yet, keyed so that sorting the keys orders the
+	// messages by the time they were published. Stores are safe for
+	// concurrent use.
+	Store interface {
+		// Put stores value under key, replacing the value of an existing
+		// key. It returns ErrStoreFull if the key is new and the store
+		// holds its limit of messages.
+		Put(key string, value []byte) error
+		Delete(key string) error
+		// Load calls fn for every stored message, in no particular order.
+		Load(fn func(key string, value []byte) error) error
+	}
+
+	// MemoryStore is a Store that keeps the messages in memory, they are
+	// lost when the process exits.
+	MemoryStore struct {
+		limit int
+
+		mutex    sync.Mutex
+		messages map[string][]byte
+	}
+
+	// FileStore is a Store that keeps the messages in a storage.FileStore,
+	// so that messages that were not delivered survive a restart.
+	FileStore struct {
+		limit int
+		store *storage.FileStore
+
+		mutex sync.Mutex
+		keys  map[string]struct{}
+	}
+)
+
+// NewMemoryStore creates a store of at most limit messages.
+func NewMemoryStore(limit int) *MemoryStore {
+	return &MemoryStore{
+		limit:    limit,
+		messages: make(map[string][]byte),
+	}
+}
+
+func (store *MemoryStore) Put(key string, value []byte) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	_, exists := store.messages[key]
+	if !exists && len(store.messages) >= store.limit {
+		return fmt.Errorf("%w: %d messages", ErrStoreFull, store.limit)
+	}
+	store.messages[key] = append([]byte{}, value...)
+	return nil
+}
+
+func (store *MemoryStore) Delete(key string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.messages, key)
+	return nil
+}
+
+func (store *MemoryStore) Load(fn func(key string, value []byte) error) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	for key, value := range store.messages {
+		err := fn(key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OpenFileStore opens the log at path, or creates it if it does not exist,
+// as a store of at most limit messages.
+func OpenFileStore(path string, limit int, options storage.FileStoreOptions) (*FileStore, error) {
+	fileStore, err := storage.OpenFileStore(path, options)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &FileStore{
+		limit: limit,
+		store: fileStore,
+		keys:  make(map[string]struct{}),
+	}
+	err = store.Load(func(key string, value []byte) error {
+		store.keys[key] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		fileStore.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *FileStore) Put(key string, value []byte) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	_, exists := store.keys[key]
+	if !exists && len(store.keys) >= store.limit {
+		return fmt.Errorf("%w: %d messages", ErrStoreFull, store.limit)
+	}
+	err := store.store.Put(fileStoreBucket, key, value)
+	if err != nil {
+		return err
+	}
+	store.keys[key] = struct{}{}
+	return nil
+}
+
+func (store *FileStore) Delete(key string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	err := store.store.Delete(fileStoreBucket, key)
+	if err != nil {
+		return err
+	}
+	delete(store.keys, key)
+	return nil
+}
+
+func (store *FileStore) Load(fn func(key string, value []byte) error) error {
+	return store.store.Load(func(bucket string, key string, value []byte) error {
+		if bucket != fileStoreBucket {
+			return nil
+		}
+		return fn(key, value)
+	})
+}
+
+// Close closes the log, the client does not close the store itself.
+func (store *FileStore) Close() error {
+	return store.store.Close()
+}
+
+// storeKey returns the key of the message with sequence number sequence,
+// the keys of later messages sort after it.
+func storeKey(sequence uint64) string {
+	return fmt.Sprintf("%016x", sequence)
+}
+
+// encodeStored encodes an outbound message as the state of its delivery
+// followed by its PUBLISH packet. The state is one byte that is 1 once the
+// PUBREL of a QoS 2 message was sent, and the packet identifier in two
+// bytes, which is zero if the message was not sent yet.
+func encodeStored(request *request) ([]byte, error) {
+	bin, err := request.publish.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	value := make([]byte, 3, 3+len(bin))
+	if request.released {
+		value[0] = 1
+	}
+	binary.BigEndian.PutUint16(value[1:], request.packetIdentifier)
+	return append(value, bin...), nil
+}
+
+// decodeStored decodes a message stored by encodeStored.
+func decodeStored(value []byte) (*request, error) {
+	if len(value) < 3 {
+		return nil, fmt.Errorf("stored message of %d bytes", len(value))
+	}
+
+	publish := &packet.PublishPacket{}
+	_, err := publish.Decode(value[3:])
+	if err != nil {
+		return nil, fmt.Errorf("stored message: %w", err)
+	}
+
+	request := newRequest(publish)
+	request.released = value[0] == 1
+	request.packetIdentifier = binary.BigEndian.Uint16(value[1:])
+	return request, nil
+}
@@ -0,0 +1,64 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// checkTopicName verifies that topic can be published to.
+func checkTopicName(topic string) error {
+	if topic == "" || strings.ContainsAny(topic, "+#") || !utf8.ValidString(topic) {
+		return fmt.Errorf("%w: %q", ErrInvalidTopic, topic)
+	}
+	return nil
+}
+
+// checkTopicFilter verifies the wildcards of filter (4.7.1).
+func checkTopicFilter(filter string) error {
+	if filter == "" || !utf8.ValidString(filter) {
+		return fmt.Errorf("%w: %q", ErrInvalidTopic, filter)
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		// MQTT-4.7.1-1: The multi-level wildcard must be the last level.
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return fmt.Errorf("%w: %q", ErrInvalidTopic, filter)
+		}
+		// MQTT-4.7.1-2: The single-level wildcard must occupy a whole level.
+		if strings.Contains(level, "+") && level != "+" {
+			return fmt.Errorf("%w: %q", ErrInvalidTopic, filter)
+		}
+	}
+	return nil
+}
+
+// topicMatches reports whether the topic name matches filter, the group of
+// a shared subscription is ignored.
+func topicMatches(filter string, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	if filterLevels[0] == "$share" && len(filterLevels) > 2 {
+		filterLevels = filterLevels[2:]
+	}
+	topicLevels := strings.Split(topic, "/")
+
+	// MQTT-4.7.2-1: Topic names starting with $ are not matched by a
+	// wildcard at the first level.
+	if strings.HasPrefix(topic, "$") && (filterLevels[0] == "+" || filterLevels[0] == "#") {
+		return false
+	}
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i == len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// websocketPath is the HTTP path of ws:// and wss:// servers without one.
+const websocketPath = "/mqtt"
+
+// websocketConn implements net.Conn on top of a WebSocket connection.
+// Packets are written as one binary message each, reads continue in the
+// current message until it is exhausted since the broker may split packets
+// across messages (6.0.0-2).
+type websocketConn struct {
+	conn   *websocket.Conn
+	reader io.Reader // Reader of the current message, nil if there is none.
+}
+
+// dialWebsocket opens a WebSocket connection that negotiated the mqtt sub
+// protocol (6.0.0-3).
+func dialWebsocket(ctx context.Context, u *url.URL, tlsConfig *tls.Config) (net.Conn, error) {
+	target := *u
+	if target.Path == "" {
+		target.Path = websocketPath
+	}
+	dialer := websocket.Dialer{
+		Subprotocols:    []string{"mqtt"},
+		TLSClientConfig: tlsConfig,
+	}
+
+	conn, response, err := dialer.DialContext(ctx, target.String(), nil)
+	if err != nil {
+		if response != nil {
+			return nil, fmt.Errorf("%w: %s", err, response.Status)
+		}
+		return nil, err
+	}
+	if conn.Subprotocol() != "mqtt" {
+		conn.Close()
+		return nil, fmt.Errorf("server did not accept the mqtt WebSocket sub protocol")
+	}
+	return &websocketConn{conn: conn}, nil
+}
+
+func (wrapper *websocketConn) Read(b []byte) (int, error) {
+	for {
+		if wrapper.reader == nil {
+			messageType, reader, err := wrapper.conn.NextReader()
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return 0, io.EOF
+			}
+			if err != nil {
+				return 0, err
+			}
+			// 6.0.0-1: MQTT control packets are sent in binary messages.
+			if messageType != websocket.BinaryMessage {
+				return 0, fmt.Errorf("%w: WebSocket message of type %d", ErrProtocol, messageType)
+			}
+			wrapper.reader = reader
+		}
+
+		n, err := wrapper.reader.Read(b)
+		if errors.Is(err, io.EOF) {
+			wrapper.reader = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// Write sends b as one binary message, the connection serializes writes.
+func (wrapper *websocketConn) Write(b []byte) (int, error) {
+	err := wrapper.conn.WriteMessage(websocket.BinaryMessage, b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (wrapper *websocketConn) Close() error {
+	return wrapper.conn.Close()
+}
+
+func (wrapper *websocketConn) LocalAddr() net.Addr {
+	return wrapper.conn.LocalAddr()
+}
+
+func (wrapper *websocketConn) RemoteAddr() net.Addr {
+	return wrapper.conn.RemoteAddr()
+}
+
+func (wrapper *websocketConn) SetDeadline(t time.Time) error {
+	return errors.Join(wrapper.conn.SetReadDeadline(t), wrapper.conn.SetWriteDeadline(t))
+}
+
+func (wrapper *websocketConn) SetReadDeadline(t time.Time) error {
+	return wrapper.conn.SetReadDeadline(t)
+}
+
+func (wrapper *websocketConn) SetWriteDeadline(t time.Time) error {
+	return wrapper.conn.SetWriteDeadline(t)
+}
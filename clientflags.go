@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/client"
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+// clientFlags are the flags of the pub, sub and bench subcommands that
+// configure the connection to the broker.
+type clientFlags struct {
+	host        *string
+	port        *int
+	tls         *bool
+	websocket   *bool
+	tlsCAFile   *string
+	tlsCertFile *string
+	tlsKeyFile  *string
+	tlsInsecure *bool
+	userName    *string
+	password    *string
+	clientID    *string
+	keepAlive   *int
+	qos         *uint
+}
+
+// stringsFlag collects the values of a flag that can be repeated.
+type stringsFlag []string
+
+func (values *stringsFlag) String() string {
+	return strings.Join(*values, ",")
+}
+
+func (values *stringsFlag) Set(value string) error {
+	*values = append(*values, value)
+	return nil
+}
+
+// userPropertyFlag collects user properties given as name=value.
+type userPropertyFlag []client.UserProperty
+
+func (properties *userPropertyFlag) String() string {
+	values := make([]string, 0, len(*properties))
+	for _, property := range *properties {
+		values = append(values, property.Name+"="+property.Value)
+	}
+	return strings.Join(values, ",")
+}
+
+func (properties *userPropertyFlag) Set(value string) error {
+	name, value, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expected name=value but got %q", value)
+	}
+	*properties = append(*properties, client.UserProperty{Name: name, Value: value})
+	return nil
+}
+
+func addClientFlags(flags *flag.FlagSet) *clientFlags {
+	return &clientFlags{
+		host:        flags.String("host", "localhost", "`host` of the broker"),
+		port:        flags.Int("port", 0, "`port` of the broker, by default 8888, 8883 with -tls, 8887 with -websocket or 8884 with both"),
+		tls:         flags.Bool("tls", false, "connect over TLS"),
+		websocket:   flags.Bool("websocket", false, "connect over WebSocket, to the /mqtt path"),
+		tlsCAFile:   flags.String("tls-ca", "", "CA bundle `file` used to verify the broker, the system roots by default"),
+		tlsCertFile: flags.String("tls-cert", "", "client certificate `file`"),
+		tlsKeyFile:  flags.String("tls-key", "", "private key `file` of the client certificate"),
+		tlsInsecure: flags.Bool("tls-insecure", false, "do not verify the certificate of the broker"),
+		userName:    flags.String("user", "", "user `name`"),
+		password:    flags.String("password", "", "`password` of the user"),
+		clientID:    flags.String("client-id", "", "client `identifier`, assigned by the broker by default"),
+		keepAlive:   flags.Int("keep-alive", 60, "keep alive in `seconds`"),
+		qos:         flags.Uint("qos", 0, "`QoS` 0, 1 or 2"),
+	}
+}
+
+// options returns the client options of the flags.
+func (flags *clientFlags) options() (client.Options, error) {
+	if *flags.qos > uint(types.QoS2) {
+		return client.Options{}, fmt.Errorf("invalid QoS: %d", *flags.qos)
+	}
+
+	options := client.Options{
+		ClientID:   *flags.clientID,
+		UserName:   *flags.userName,
+		CleanStart: true,
+		KeepAlive:  time.Duration(*flags.keepAlive) * time.Second,
+	}
+	if *flags.keepAlive == 0 {
+		options.KeepAlive = -1
+	}
+	if *flags.password != "" {
+		options.Password = []byte(*flags.password)
+	}
+
+	// The default ports are those of the listeners of broker.DefaultConfig
+	// and of the TLS listeners the broker adds when it gets a certificate.
+	scheme, port := "tcp", 8888
+	switch {
+	case *flags.websocket && *flags.tls:
+		scheme, port = "wss", 8884
+	case *flags.websocket:
+		scheme, port = "ws", 8887
+	case *flags.tls:
+		scheme, port = "tls", 8883
+	}
+	if *flags.tls {
+		tlsConfig, err := flags.tlsConfig()
+		if err != nil {
+			return client.Options{}, err
+		}
+		options.TLSConfig = tlsConfig
+	}
+	if *flags.port != 0 {
+		port = *flags.port
+	}
+	options.Server = scheme + "://" + net.JoinHostPort(*flags.host, strconv.Itoa(port))
+
+	return options, nil
+}
+
+func (flags *clientFlags) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         *flags.host,
+		InsecureSkipVerify: *flags.tlsInsecure,
+	}
+
+	if *flags.tlsCAFile != "" {
+		pem, err := os.ReadFile(*flags.tlsCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", *flags.tlsCAFile)
+		}
+	}
+
+	if *flags.tlsCertFile != "" || *flags.tlsKeyFile != "" {
+		if *flags.tlsCertFile == "" || *flags.tlsKeyFile == "" {
+			return nil, errors.New("-tls-cert and -tls-key must be given together")
+		}
+		certificate, err := tls.LoadX509KeyPair(*flags.tlsCertFile, *flags.tlsKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+// connect connects a client with options to the broker.
+func connect(ctx context.Context, options client.Options) (*client.Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, client.DefaultConnectTimeout)
+	defer cancel()
+
+	c := client.New(options)
+	_, err := c.Connect(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", options.Server, err)
+	}
+	return c, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/DvdSpijker/GoBroker/broker"
+	"github.com/DvdSpijker/GoBroker/logging"
+)
+
+// listenerFlag collects listeners given as type://address on the command line.
+type listenerFlag []broker.ListenerConfig
+
+func (listeners *listenerFlag) String() string {
+	values := make([]string, 0, len(*listeners))
+	for _, listener := range *listeners {
+		values = append(values, string(listener.Type)+"://"+listener.Address)
+	}
+	return strings.Join(values, ",")
+}
+
+func (listeners *listenerFlag) Set(value string) error {
+	listenerType, address, ok := strings.Cut(value, "://")
+	if !ok {
+		return fmt.Errorf("expected type://address but got %q", value)
+	}
+	*listeners = append(*listeners, broker.ListenerConfig{
+		Type:    broker.ListenerType(listenerType),
+		Address: address,
+	})
+	return nil
+}
+
+// configFromFlags loads the config file given on the command line, if any,
+// and applies the flags that were set on top of it.
+func configFromFlags(flags *flag.FlagSet, args []string) (broker.Config, error) {
+	var (
+		listeners       listenerFlag
+		configFile      = flags.String("config", "", "YAML config `file`")
+		tlsCertFile     = flags.String("tls-cert", "", "certificate `file` of TLS listeners")
+		tlsKeyFile      = flags.String("tls-key", "", "private key `file` of the TLS certificate")
+		tlsClientCAFile = flags.String("tls-client-ca", "", "CA bundle `file` used to verify client certificates")
+		tlsClientAuth   = flags.String("tls-client-auth", string(broker.ClientAuthNone),
+			"client certificate verification: none, request or require")
+		keepAliveMin   = flags.Uint("keep-alive-min", 0, "minimum keep-alive in `seconds`")
+		keepAliveMax   = flags.Uint("keep-alive-max", 0, "maximum keep-alive in `seconds`")
+		sendQueueSize  = flags.Int("send-queue-size", broker.DefaultSendQueueSize, "number of packets queued per client")
+		retainedMax    = flags.Int("retained-max", 0, "maximum number of retained messages")
+		retainedMaxLen = flags.Int("retained-max-payload", 0, "maximum payload size of retained messages in `bytes`")
+		maxQueued      = flags.Int("max-queued", broker.DefaultMaxQueuedMessages, "messages queued per offline client, 0 is unlimited")
+		storagePath    = flags.String("storage", "", "`file` that sessions and retained messages are persisted in")
+		storageSync    = flags.Bool("storage-sync", false, "flush every change of the storage file to disk")
+		shutdownTime   = flags.Int("shutdown-timeout", broker.DefaultShutdownTimeout,
+			"`seconds` allowed for disconnecting clients gracefully on SIGTERM or SIGINT")
+		sysInterval = flags.Int("sys-interval", broker.DefaultSysInterval, "`seconds` between updates of the $SYS topics, 0 disables them")
+		metricsAddr = flags.String("metrics", "", "`address` of the HTTP server that serves Prometheus metrics")
+		adminAddr   = flags.String("admin", "", "`address` of the HTTP server of the admin API")
+		adminToken  = flags.String("admin-token-file", "", "`file` with the bearer token of the admin API")
+		logLevel    = flags.String("log-level", "info", "minimum log `level`: debug, info, warn or error")
+		logFormat   = flags.String("log-format", logging.FormatText, "log `format`: text or json")
+		logPayloads = flags.Bool("log-payloads", false, "log message payloads instead of redacting them")
+	)
+	flags.Var(&listeners, "listen",
+		"listener as type://address with type tcp, tls, ws, wss, unix, http or https, can be repeated; replaces the listeners of the config file")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return broker.Config{}, err
+	}
+
+	config := broker.DefaultConfig()
+	if *configFile != "" {
+		config, err = broker.LoadConfig(*configFile)
+		if err != nil {
+			return broker.Config{}, err
+		}
+	} else if *tlsCertFile != "" || *tlsKeyFile != "" {
+		// Keep the TLS listeners enabled by passing a certificate.
+		config.Listeners = append(config.Listeners,
+			broker.ListenerConfig{Type: broker.ListenerTLS, Address: ":8883"},
+			broker.ListenerConfig{Type: broker.ListenerWSS, Address: ":8884"},
+		)
+	}
+
+	if len(listeners) > 0 {
+		config.Listeners = listeners
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "keep-alive-min":
+			config.KeepAlive.Min = uint16(*keepAliveMin)
+		case "keep-alive-max":
+			config.KeepAlive.Max = uint16(*keepAliveMax)
+		case "send-queue-size":
+			config.SendQueueSize = *sendQueueSize
+		case "retained-max":
+			config.Retained.MaxMessages = *retainedMax
+		case "retained-max-payload":
+			config.Retained.MaxPayloadSize = *retainedMaxLen
+		case "max-queued":
+			config.Sessions.MaxQueuedMessages = *maxQueued
+		case "storage":
+			config.Storage.Path = *storagePath
+		case "storage-sync":
+			config.Storage.Sync = *storageSync
+		case "shutdown-timeout":
+			config.ShutdownTimeout = *shutdownTime
+		case "sys-interval":
+			config.Sys.Interval = *sysInterval
+		case "metrics":
+			config.Metrics.Address = *metricsAddr
+		case "admin":
+			config.Admin.Address = *adminAddr
+		case "admin-token-file":
+			config.Admin.TokenFile = *adminToken
+		case "log-level":
+			config.Log.Level = *logLevel
+		case "log-format":
+			config.Log.Format = *logFormat
+		case "log-payloads":
+			config.Log.Payloads = *logPayloads
+		}
+	})
+
+	for i := range config.Listeners {
+		listener := &config.Listeners[i]
+		if !listener.IsTLS() {
+			continue
+		}
+		flags.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "tls-cert":
+				listener.TLS.CertFile = *tlsCertFile
+			case "tls-key":
+				listener.TLS.KeyFile = *tlsKeyFile
+			case "tls-client-ca":
+				listener.TLS.ClientCAFile = *tlsClientCAFile
+			case "tls-client-auth":
+				listener.TLS.ClientAuth = broker.ClientAuthMode(*tlsClientAuth)
+			}
+		})
+	}
+
+	config.SetDefaults()
+	err = config.Validate()
+	if err != nil {
+		return broker.Config{}, err
+	}
+
+	return config, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"testing"
+
+	"github.com/DvdSpijker/GoBroker/broker"
+)
+
+func TestConfigFromFile(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	config, err := configFromFlags(flags, []string{
+		"-config", "config.example.yaml",
+		"-keep-alive-max", "300",
+		"-tls-client-auth", "require",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.Listeners) != 6 {
+		t.Fatalf("wanted 6 listeners but got %d", len(config.Listeners))
+	}
+
+	tlsListener := config.Listeners[2]
+	if tlsListener.Type != broker.ListenerTLS || tlsListener.Address != ":8883" {
+		t.Fatalf("wanted tls listener on :8883 but got %s %s", tlsListener.Type, tlsListener.Address)
+	}
+	if tlsListener.TLS.ClientAuth != broker.ClientAuthRequire {
+		t.Fatalf("wanted client auth overridden by flag but got %s", tlsListener.TLS.ClientAuth)
+	}
+	if tlsListener.Limits.MaxPacketSize != 1048576 {
+		t.Fatalf("wanted max packet size 1048576 but got %d", tlsListener.Limits.MaxPacketSize)
+	}
+
+	unixListener := config.Listeners[3]
+	if len(unixListener.ProtocolVersions) != 1 || unixListener.ProtocolVersions[0] != 5 {
+		t.Fatalf("wanted protocol versions [5] but got %v", unixListener.ProtocolVersions)
+	}
+	if *unixListener.Authentication.AllowAnonymous {
+		t.Fatal("wanted anonymous clients to be refused")
+	}
+	if !*config.Listeners[0].Authentication.AllowAnonymous {
+		t.Fatal("wanted anonymous clients to be allowed by default")
+	}
+	jwtListener := config.Listeners[4]
+	if !jwtListener.Authentication.JWT.Enabled() || *jwtListener.Authentication.AllowAnonymous {
+		t.Fatal("wanted JWT authentication without anonymous clients")
+	}
+	if config.Listeners[1].Path != "/mqtt" {
+		t.Fatalf("wanted path /mqtt but got %s", config.Listeners[1].Path)
+	}
+
+	if config.KeepAlive.Min != 10 || config.KeepAlive.Max != 300 {
+		t.Fatalf("wanted keep-alive bounds 10-300 but got %d-%d", config.KeepAlive.Min, config.KeepAlive.Max)
+	}
+	if config.Retained.MaxMessages != 10000 {
+		t.Fatalf("wanted 10000 retained messages but got %d", config.Retained.MaxMessages)
+	}
+	if config.Storage.Path != "gobroker.log" || config.Sessions.MaxQueuedMessages != 1000 {
+		t.Fatalf("wanted storage in gobroker.log with 1000 queued messages but got %v %v", config.Storage, config.Sessions)
+	}
+	if len(config.Bridges) != 1 || len(config.Bridges[0].Topics) != 2 ||
+		config.Bridges[0].Topics[1].Direction != broker.BridgeIn || config.Bridges[0].Topics[1].LocalPrefix != "cloud/" {
+		t.Fatalf("wanted the cloud bridge with 2 topics but got %+v", config.Bridges)
+	}
+	if config.Cluster.NodeName != "node-1" || len(config.Cluster.Peers) != 1 {
+		t.Fatalf("wanted node-1 with 1 peer but got %+v", config.Cluster)
+	}
+	if config.Log.Level != "info" || config.Log.Subsystems["connection"] != "warn" {
+		t.Fatalf("wanted log level info with connection warn but got %v", config.Log)
+	}
+}
+
+func TestConfigListenerFlags(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	config, err := configFromFlags(flags, []string{
+		"-config", "config.example.yaml",
+		"-listen", "tcp://127.0.0.1:1883",
+		"-listen", "unix:///tmp/broker.sock",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.Listeners) != 2 {
+		t.Fatalf("wanted the listeners from the flags only but got %v", config.Listeners)
+	}
+	if config.Listeners[1].Type != broker.ListenerUnix || config.Listeners[1].Address != "/tmp/broker.sock" {
+		t.Fatalf("wanted unix listener on /tmp/broker.sock but got %v", config.Listeners[1])
+	}
+}
+
+func TestConfigInvalid(t *testing.T) {
+	invalidArgs := [][]string{
+		{"-listen", "udp://:1883"},
+		{"-listen", "tls://:8883"},
+		{"-keep-alive-min", "60", "-keep-alive-max", "30"},
+		{"-log-level", "verbose"},
+		{"-log-format", "xml"},
+		{"-admin", "127.0.0.1:9101"},
+	}
+
+	for _, args := range invalidArgs {
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		_, err := configFromFlags(flags, args)
+		if !errors.Is(err, broker.ErrInvalidConfig) {
+			t.Fatalf("%v: wanted invalid config error but got %v", args, err)
+		}
+	}
+}
@@ -2,6 +2,12 @@ module github.com/DvdSpijker/GoBroker
 
 go 1.22.0
 
-require github.com/coder/websocket v1.8.13
+require github.com/gorilla/websocket v1.5.3
 
-require github.com/gorilla/websocket v1.5.3 // indirect
+require (
+	golang.org/x/crypto v0.31.0
+	golang.org/x/term v0.27.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.28.0 // indirect
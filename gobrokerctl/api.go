@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// apiClient sends requests to the admin API of a broker.
+type apiClient struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+func newAPIClient(baseURL string, token string) *apiClient {
+	return &apiClient{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		token:   token,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// do sends a request to path with the query and body, and decodes the JSON
+// response into v if it is not nil. Error responses are returned as error.
+func (api *apiClient) do(method string, path string, query url.Values, body []byte, v any) error {
+	u := api.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	request, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+api.token)
+
+	response, err := api.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		var apiError struct {
+			Error string `json:"error"`
+		}
+		data, _ := io.ReadAll(response.Body)
+		if json.Unmarshal(data, &apiError) != nil || apiError.Error == "" {
+			return fmt.Errorf("%s %s: %s", method, path, response.Status)
+		}
+		return fmt.Errorf("%s %s: %s: %s", method, path, response.Status, apiError.Error)
+	}
+
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+// escapeTopic escapes the levels of a topic for use in a path.
+func escapeTopic(topic string) string {
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
+		levels[i] = url.PathEscape(level)
+	}
+	return strings.Join(levels, "/")
+}
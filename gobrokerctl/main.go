@@ -0,0 +1,471 @@
+// Command gobrokerctl manages a running broker through its admin API.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"unicode/utf8"
+
+	"github.com/DvdSpijker/GoBroker/broker"
+)
+
+const usage = `Usage: %s [flags] <command> [arguments]
+
+Manages a running broker through its admin API.
+
+Commands:
+  clients ls [-state connected|offline] [-user name] [-prefix prefix]
+                                  list sessions
+  clients show <client ID>        show a session with its subscriptions
+  clients kick <client ID>        disconnect a client, its session is kept
+  sessions rm <client ID>         kick a client if it is connected and delete its session
+  subs ls [-topic topic]          list subscriptions, of the filters matching topic if given
+  retained ls [-filter filter]    list retained messages
+  retained get <topic>            write the retained payload of a topic to standard output
+  retained rm <topic>             delete the retained message of a topic
+  retained rm -filter <filter>    delete the retained messages of the topics matching filter
+  pub [-qos n] [-retain] <topic> [payload]
+                                  publish a message, the payload is read from standard input if it is not given
+  stats                           show the statistics of the broker
+
+The token is read from -token-file, or from the GOBROKER_ADMIN_TOKEN environment variable.
+
+Flags:
+`
+
+const (
+	defaultServer = "http://127.0.0.1:9101"
+	// payloadColumnWidth is the number of characters of a payload shown in
+	// tables.
+	payloadColumnWidth = 40
+)
+
+var errUsage = errors.New("usage")
+
+// cli runs the commands and writes their output.
+type cli struct {
+	api    *apiClient
+	json   bool
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs the command in args and returns the exit code.
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("gobrokerctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	server := flags.String("server", envOr("GOBROKER_ADMIN_URL", defaultServer), "`URL` of the admin API, or GOBROKER_ADMIN_URL")
+	tokenFile := flags.String("token-file", "", "`file` with the token of the admin API")
+	jsonOutput := flags.Bool("json", false, "write JSON instead of tables")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), usage, "gobrokerctl")
+		flags.PrintDefaults()
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	token := os.Getenv("GOBROKER_ADMIN_TOKEN")
+	if *tokenFile != "" {
+		data, err := os.ReadFile(*tokenFile)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	c := &cli{
+		api:    newAPIClient(*server, token),
+		json:   *jsonOutput,
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+	err = c.run(flags.Arg(0), flags.Args()[1:])
+	if errors.Is(err, errUsage) {
+		fmt.Fprintln(stderr, err)
+		flags.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func (c *cli) run(command string, args []string) error {
+	subcommand := ""
+	if len(args) > 0 {
+		subcommand = args[0]
+	}
+
+	switch {
+	case command == "clients" && subcommand == "ls":
+		return c.listClients(args[1:])
+	case command == "clients" && subcommand == "show":
+		return c.showClient(args[1:])
+	case command == "clients" && subcommand == "kick":
+		return c.kickClient(args[1:])
+	case command == "sessions" && subcommand == "rm":
+		return c.removeSession(args[1:])
+	case command == "subs" && subcommand == "ls":
+		return c.listSubscriptions(args[1:])
+	case command == "retained" && subcommand == "ls":
+		return c.listRetained(args[1:])
+	case command == "retained" && subcommand == "get":
+		return c.getRetained(args[1:])
+	case command == "retained" && subcommand == "rm":
+		return c.removeRetained(args[1:])
+	case command == "pub":
+		return c.publish(args)
+	case command == "stats":
+		return c.stats(args)
+	}
+	return fmt.Errorf("%w: unknown command: %s", errUsage, strings.TrimSpace(command+" "+subcommand))
+}
+
+func (c *cli) listClients(args []string) error {
+	flags := c.flagSet("clients ls")
+	state := flags.String("state", "", "only list connected or offline sessions")
+	userName := flags.String("user", "", "only list sessions of the user")
+	prefix := flags.String("prefix", "", "only list sessions whose client ID starts with `prefix`")
+	err := parseFlags(flags, args, 0)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	setQuery(query, "state", *state)
+	setQuery(query, "user_name", *userName)
+	setQuery(query, "prefix", *prefix)
+	var sessions []broker.SessionInfo
+	err = c.api.do("GET", "/api/clients", query, nil, &sessions)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.writeJSON(sessions)
+	}
+
+	table := c.table("CLIENT ID", "USER", "STATE", "REMOTE ADDRESS", "SUBSCRIPTIONS", "QUEUED", "IN FLIGHT")
+	for _, session := range sessions {
+		table.row(session.ClientID, session.UserName, sessionState(session), session.RemoteAddr,
+			len(session.Subscriptions), session.QueuedMessages, session.InFlightMessages)
+	}
+	return table.flush()
+}
+
+func (c *cli) showClient(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("%w: clients show needs a client ID", errUsage)
+	}
+
+	var session broker.SessionInfo
+	err := c.api.do("GET", "/api/clients/"+url.PathEscape(args[0]), nil, nil, &session)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.writeJSON(session)
+	}
+
+	expiry := "never"
+	if session.SessionExpiryInterval >= 0 {
+		expiry = fmt.Sprintf("%ds", session.SessionExpiryInterval)
+	}
+	table := c.table()
+	table.row("Client ID:", session.ClientID)
+	table.row("User:", session.UserName)
+	table.row("State:", sessionState(session))
+	table.row("Remote address:", session.RemoteAddr)
+	table.row("Session expiry:", expiry)
+	table.row("Queued messages:", session.QueuedMessages)
+	table.row("In-flight messages:", session.InFlightMessages)
+	table.row("Send queue packets:", session.SendQueuePackets)
+	table.row("Subscriptions:")
+	for _, subscription := range session.Subscriptions {
+		table.row("", subscription.Filter, fmt.Sprintf("QoS %d", subscription.QoS))
+	}
+	return table.flush()
+}
+
+func (c *cli) kickClient(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("%w: clients kick needs a client ID", errUsage)
+	}
+	return c.api.do("POST", "/api/clients/"+url.PathEscape(args[0])+"/kick", nil, nil, nil)
+}
+
+func (c *cli) removeSession(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("%w: sessions rm needs a client ID", errUsage)
+	}
+	return c.api.do("DELETE", "/api/clients/"+url.PathEscape(args[0]), nil, nil, nil)
+}
+
+func (c *cli) listSubscriptions(args []string) error {
+	flags := c.flagSet("subs ls")
+	topic := flags.String("topic", "", "only list subscriptions whose filter matches `topic`")
+	err := parseFlags(flags, args, 0)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	setQuery(query, "topic", *topic)
+	var subscriptions []broker.SubscriptionInfo
+	err = c.api.do("GET", "/api/subscriptions", query, nil, &subscriptions)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.writeJSON(subscriptions)
+	}
+
+	table := c.table("CLIENT ID", "FILTER", "QOS")
+	for _, subscription := range subscriptions {
+		table.row(subscription.ClientID, subscription.Filter, subscription.QoS)
+	}
+	return table.flush()
+}
+
+func (c *cli) listRetained(args []string) error {
+	flags := c.flagSet("retained ls")
+	filter := flags.String("filter", "#", "only list the messages of topics matching `filter`")
+	err := parseFlags(flags, args, 0)
+	if err != nil {
+		return err
+	}
+
+	var messages []broker.Message
+	err = c.api.do("GET", "/api/retained", url.Values{"filter": {*filter}}, nil, &messages)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.writeJSON(messages)
+	}
+
+	table := c.table("TOPIC", "QOS", "BYTES", "PAYLOAD")
+	for _, message := range messages {
+		table.row(message.Topic, message.Qos, len(message.Payload), payloadSummary(message.Payload))
+	}
+	return table.flush()
+}
+
+func (c *cli) getRetained(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("%w: retained get needs a topic", errUsage)
+	}
+
+	var message broker.Message
+	err := c.api.do("GET", "/api/retained/"+escapeTopic(args[0]), nil, nil, &message)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.writeJSON(message)
+	}
+	_, err = c.stdout.Write(message.Payload)
+	return err
+}
+
+func (c *cli) removeRetained(args []string) error {
+	flags := c.flagSet("retained rm")
+	filter := flags.String("filter", "", "delete the messages of all topics matching `filter`")
+	err := flags.Parse(args)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+
+	if *filter == "" {
+		if flags.NArg() != 1 {
+			return fmt.Errorf("%w: retained rm needs a topic or a filter", errUsage)
+		}
+		return c.api.do("DELETE", "/api/retained/"+escapeTopic(flags.Arg(0)), nil, nil, nil)
+	}
+	if flags.NArg() != 0 {
+		return fmt.Errorf("%w: retained rm takes a topic or a filter, not both", errUsage)
+	}
+
+	var result struct {
+		Deleted int `json:"deleted"`
+	}
+	err = c.api.do("DELETE", "/api/retained", url.Values{"filter": {*filter}}, nil, &result)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.writeJSON(result)
+	}
+	fmt.Fprintf(c.stdout, "deleted %d retained messages\n", result.Deleted)
+	return nil
+}
+
+func (c *cli) publish(args []string) error {
+	flags := c.flagSet("pub")
+	qos := flags.Uint("qos", 0, "QoS of the message")
+	retain := flags.Bool("retain", false, "retain the message")
+	err := flags.Parse(args)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return fmt.Errorf("%w: pub needs a topic and optionally a payload", errUsage)
+	}
+
+	var payload []byte
+	if flags.NArg() == 2 {
+		payload = []byte(flags.Arg(1))
+	} else {
+		payload, err = io.ReadAll(c.stdin)
+		if err != nil {
+			return err
+		}
+	}
+
+	query := url.Values{
+		"topic":  {flags.Arg(0)},
+		"qos":    {strconv.FormatUint(uint64(*qos), 10)},
+		"retain": {strconv.FormatBool(*retain)},
+	}
+	return c.api.do("POST", "/api/publish", query, payload, nil)
+}
+
+func (c *cli) stats(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("%w: stats takes no arguments", errUsage)
+	}
+
+	var stats broker.Stats
+	err := c.api.do("GET", "/api/stats", nil, nil, &stats)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.writeJSON(stats)
+	}
+
+	table := c.table()
+	table.row("Version:", stats.Version)
+	table.row("Uptime:", fmt.Sprintf("%ds", stats.Uptime))
+	table.row("Clients connected:", stats.ClientsConnected)
+	table.row("Clients disconnected:", stats.ClientsDisconnected)
+	table.row("Subscriptions:", stats.Subscriptions)
+	table.row("Messages received:", stats.MessagesReceived)
+	table.row("Messages sent:", stats.MessagesSent)
+	table.row("Bytes received:", stats.BytesReceived)
+	table.row("Bytes sent:", stats.BytesSent)
+	table.row("Retained messages:", stats.RetainedMessages)
+	table.row("Retained bytes:", stats.RetainedBytes)
+	return table.flush()
+}
+
+func (c *cli) writeJSON(v any) error {
+	encoder := json.NewEncoder(c.stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// table writes aligned columns.
+type table struct {
+	writer *tabwriter.Writer
+}
+
+// table starts a table with a header row, if any columns are given.
+func (c *cli) table(columns ...string) *table {
+	t := &table{writer: tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)}
+	if len(columns) > 0 {
+		fmt.Fprintln(t.writer, strings.Join(columns, "\t"))
+	}
+	return t
+}
+
+func (t *table) row(values ...any) {
+	cells := make([]string, len(values))
+	for i, value := range values {
+		cells[i] = fmt.Sprint(value)
+	}
+	fmt.Fprintln(t.writer, strings.Join(cells, "\t"))
+}
+
+func (t *table) flush() error {
+	return t.writer.Flush()
+}
+
+// flagSet creates the flag set of a subcommand.
+func (c *cli) flagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(c.stderr)
+	return flags
+}
+
+// parseFlags parses the flags of a subcommand that takes n arguments.
+func parseFlags(flags *flag.FlagSet, args []string, n int) error {
+	err := flags.Parse(args)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errUsage, err)
+	}
+	if flags.NArg() != n {
+		return fmt.Errorf("%w: %s takes %d arguments", errUsage, flags.Name(), n)
+	}
+	return nil
+}
+
+func setQuery(query url.Values, key string, value string) {
+	if value != "" {
+		query.Set(key, value)
+	}
+}
+
+func sessionState(session broker.SessionInfo) string {
+	if session.Connected {
+		return "connected"
+	}
+	return "offline"
+}
+
+// payloadSummary returns the start of a payload that is text, binary
+// payloads are not shown.
+func payloadSummary(payload []byte) string {
+	if !utf8.Valid(payload) || strings.ContainsFunc(string(payload), isControl) {
+		return "<binary>"
+	}
+	summary := string(payload)
+	if utf8.RuneCountInString(summary) > payloadColumnWidth {
+		summary = string([]rune(summary)[:payloadColumnWidth-3]) + "..."
+	}
+	return summary
+}
+
+func isControl(r rune) bool {
+	return r < ' ' || r == 0x7f
+}
+
+func envOr(key string, fallback string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	return value
+}
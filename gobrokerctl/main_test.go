@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DvdSpijker/GoBroker/broker"
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+// startAdminServer serves the admin API of a new broker and returns the
+// broker and the arguments that point gobrokerctl at it.
+func startAdminServer(t *testing.T) (*broker.Server, []string) {
+	t.Helper()
+
+	server := broker.NewServer(broker.Config{})
+	httpServer := httptest.NewServer(server.AdminHandler("secret"))
+	t.Cleanup(httpServer.Close)
+	t.Setenv("GOBROKER_ADMIN_TOKEN", "secret")
+
+	return server, []string{"-server", httpServer.URL}
+}
+
+// runCommand runs gobrokerctl and returns its exit code and output.
+func runCommand(args []string, stdin string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+var commandCases = []struct {
+	args   []string
+	stdin  string
+	code   int
+	output string
+}{
+	{args: []string{"retained", "ls"}, code: 0, output: "TOPIC    QOS  BYTES  PAYLOAD\nctl/a    1    5      hello\nctl/bin  0    2      <binary>\n"},
+	{args: []string{"retained", "ls", "-filter", "ctl/a"}, code: 0, output: "TOPIC  QOS  BYTES  PAYLOAD\nctl/a  1    5      hello\n"},
+	{args: []string{"retained", "get", "ctl/a"}, code: 0, output: "hello"},
+	{args: []string{"retained", "get", "ctl/none"}, code: 1},
+	{args: []string{"-json", "retained", "ls", "-filter", "ctl/bin"}, code: 0,
+		output: "[\n  {\n    \"topic\": \"ctl/bin\",\n    \"payload\": \"AAE=\",\n    \"qos\": 0,\n    \"retain\": true\n  }\n]\n"},
+	{args: []string{"pub", "-retain", "ctl/c", "from args"}, code: 0},
+	{args: []string{"pub", "-qos", "1", "-retain", "ctl/d"}, stdin: "from stdin", code: 0},
+	{args: []string{"retained", "get", "ctl/d"}, code: 0, output: "from stdin"},
+	{args: []string{"pub", "ctl/#", "wildcard"}, code: 1},
+	{args: []string{"retained", "rm", "-filter", "ctl/+"}, code: 0, output: "deleted 4 retained messages\n"},
+	{args: []string{"retained", "ls"}, code: 0, output: "TOPIC  QOS  BYTES  PAYLOAD\n"},
+	{args: []string{"clients", "ls"}, code: 0, output: "CLIENT ID  USER  STATE  REMOTE ADDRESS  SUBSCRIPTIONS  QUEUED  IN FLIGHT\n"},
+	{args: []string{"clients", "kick", "nobody"}, code: 1},
+	{args: []string{"sessions", "rm"}, code: 2},
+	{args: []string{"clients", "ls", "extra"}, code: 2},
+	{args: []string{"unknown"}, code: 2},
+}
+
+func TestCommands(t *testing.T) {
+	server, serverArgs := startAdminServer(t)
+	server.SetRetainedMessage("ctl/a", []byte("hello"), types.QoS1)
+	server.SetRetainedMessage("ctl/bin", []byte{0, 1}, types.QoS0)
+
+	for _, c := range commandCases {
+		code, stdout, stderr := runCommand(append(serverArgs, c.args...), c.stdin)
+		if code != c.code {
+			t.Fatalf("%v: wanted exit code %v but got %v: %s", c.args, c.code, code, stderr)
+		}
+		if c.code == 0 && stdout != c.output {
+			t.Fatalf("%v: wanted %q but got %q", c.args, c.output, stdout)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	_, serverArgs := startAdminServer(t)
+
+	code, stdout, stderr := runCommand(append(serverArgs, "stats"), "")
+	if code != 0 {
+		t.Fatalf("wanted exit code 0 but got %v: %s", code, stderr)
+	}
+	fields := strings.Fields(stdout)
+	if len(fields) < 2 || fields[0] != "Version:" || fields[1] != broker.Version {
+		t.Fatalf("wanted the version in the stats but got %s", stdout)
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	_, serverArgs := startAdminServer(t)
+	t.Setenv("GOBROKER_ADMIN_TOKEN", "wrong")
+
+	code, _, stderr := runCommand(append(serverArgs, "stats"), "")
+	if code != 1 || !strings.Contains(stderr, "401 Unauthorized: unauthorized") {
+		t.Fatalf("wanted an unauthorized error but got %v: %s", code, stderr)
+	}
+}
@@ -0,0 +1,166 @@
+// Package logging creates structured, leveled loggers in which every
+// subsystem can have its own level.
+package logging
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"unicode/utf8"
+)
+
+// SubsystemKey is the attribute that names the subsystem of a logger, see
+// Subsystem.
+const SubsystemKey = "subsystem"
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+var ErrInvalidConfig = errors.New("invalid log config")
+
+type (
+	Config struct {
+		// Minimum level of messages that are logged: debug, info, warn or
+		// error. Defaults to info.
+		Level string `yaml:"level"`
+		// Output format, text or json. Defaults to text.
+		Format string `yaml:"format"`
+		// Levels of subsystems that differ from Level.
+		Subsystems map[string]string `yaml:"subsystems"`
+		// Log message payloads, they are redacted if false.
+		Payloads bool `yaml:"payloads"`
+	}
+
+	// levelHandler filters records on the level of the subsystem of the
+	// logger.
+	levelHandler struct {
+		handler    slog.Handler
+		level      slog.Level
+		subsystems map[string]slog.Level
+	}
+)
+
+// New creates a logger that writes records to w in the configured format.
+func New(w io.Writer, config Config) (*slog.Logger, error) {
+	level, subsystems, err := config.levels()
+	if err != nil {
+		return nil, err
+	}
+
+	// The inner handler gets all records, the levels are applied by the
+	// level handler.
+	options := &slog.HandlerOptions{Level: slog.Level(-100)}
+	var handler slog.Handler
+	switch config.Format {
+	case "", FormatText:
+		handler = slog.NewTextHandler(w, options)
+	case FormatJSON:
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		return nil, fmt.Errorf("%w: unknown format: %q", ErrInvalidConfig, config.Format)
+	}
+
+	return slog.New(&levelHandler{handler: handler, level: level, subsystems: subsystems}), nil
+}
+
+// Validate checks the config for invalid levels and formats.
+func (config *Config) Validate() error {
+	_, _, err := config.levels()
+	if err != nil {
+		return err
+	}
+	if config.Format != "" && config.Format != FormatText && config.Format != FormatJSON {
+		return fmt.Errorf("%w: unknown format: %q", ErrInvalidConfig, config.Format)
+	}
+	return nil
+}
+
+func (config *Config) levels() (slog.Level, map[string]slog.Level, error) {
+	level, err := ParseLevel(config.Level)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	subsystems := make(map[string]slog.Level, len(config.Subsystems))
+	for subsystem, value := range config.Subsystems {
+		subsystems[subsystem], err = ParseLevel(value)
+		if err != nil {
+			return 0, nil, fmt.Errorf("subsystem %s: %w", subsystem, err)
+		}
+	}
+	return level, subsystems, nil
+}
+
+// ParseLevel parses a level name, an empty name is the info level.
+func ParseLevel(name string) (slog.Level, error) {
+	if name == "" {
+		return slog.LevelInfo, nil
+	}
+
+	var level slog.Level
+	err := level.UnmarshalText([]byte(strings.ToUpper(name)))
+	if err != nil {
+		return 0, fmt.Errorf("%w: unknown level: %q", ErrInvalidConfig, name)
+	}
+	return level, nil
+}
+
+// Subsystem returns a logger for a subsystem of the program, its level is
+// configured with Config.Subsystems.
+func Subsystem(logger *slog.Logger, name string) *slog.Logger {
+	return logger.With(SubsystemKey, name)
+}
+
+// Payload returns an attribute with the payload of a message if payloads
+// are logged, or with only its size if they are redacted. Payloads that are
+// not UTF-8 are logged in hexadecimal.
+func Payload(data []byte, log bool) slog.Attr {
+	if !log {
+		return slog.String("payload", fmt.Sprintf("[%d bytes redacted]", len(data)))
+	}
+	if utf8.Valid(data) {
+		return slog.String("payload", string(data))
+	}
+	return slog.String("payload", hex.EncodeToString(data))
+}
+
+func (handler *levelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= handler.level
+}
+
+func (handler *levelHandler) Handle(ctx context.Context, record slog.Record) error {
+	return handler.handler.Handle(ctx, record)
+}
+
+func (handler *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	level := handler.level
+	for _, attr := range attrs {
+		if attr.Key != SubsystemKey {
+			continue
+		}
+		subsystemLevel, ok := handler.subsystems[attr.Value.String()]
+		if ok {
+			level = subsystemLevel
+		}
+	}
+
+	return &levelHandler{
+		handler:    handler.handler.WithAttrs(attrs),
+		level:      level,
+		subsystems: handler.subsystems,
+	}
+}
+
+func (handler *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{
+		handler:    handler.handler.WithGroup(name),
+		level:      handler.level,
+		subsystems: handler.subsystems,
+	}
+}
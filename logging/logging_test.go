@@ -0,0 +1,89 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSubsystemLevels(t *testing.T) {
+	var output bytes.Buffer
+	logger, err := New(&output, Config{
+		Level:      "warn",
+		Subsystems: map[string]string{"session": "debug"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Subsystem(logger, "connection").Info("hidden")
+	Subsystem(logger, "connection").Warn("connection warning")
+	Subsystem(logger, "session").Debug("session debug", "client_id", "a")
+	logger.Info("hidden")
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("wanted 2 lines but got %q", lines)
+	}
+	if !strings.Contains(lines[0], "subsystem=connection") || !strings.Contains(lines[0], `msg="connection warning"`) {
+		t.Fatalf("wanted the connection warning but got %q", lines[0])
+	}
+	if !strings.Contains(lines[1], "level=DEBUG") || !strings.Contains(lines[1], "client_id=a") {
+		t.Fatalf("wanted the session debug message but got %q", lines[1])
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	var output bytes.Buffer
+	logger, err := New(&output, Config{Format: FormatJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Subsystem(logger, "server").Info("started", "listeners", 2)
+
+	var record map[string]any
+	err = json.Unmarshal(output.Bytes(), &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record["msg"] != "started" || record[SubsystemKey] != "server" || record["listeners"] != float64(2) {
+		t.Fatalf("wanted the structured record but got %v", record)
+	}
+}
+
+func TestPayload(t *testing.T) {
+	payloadCases := []struct {
+		data []byte
+		log  bool
+		want string
+	}{
+		{data: []byte("secret"), log: false, want: "[6 bytes redacted]"},
+		{data: []byte("hello"), log: true, want: "hello"},
+		{data: []byte{0xff, 0x00}, log: true, want: "ff00"},
+	}
+
+	for _, c := range payloadCases {
+		got := Payload(c.data, c.log).Value.String()
+		if got != c.want {
+			t.Fatalf("wanted %v but got %v", c.want, got)
+		}
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	invalidConfigs := []Config{
+		{Level: "verbose"},
+		{Format: "xml"},
+		{Subsystems: map[string]string{"session": "loud"}},
+	}
+
+	for _, config := range invalidConfigs {
+		err := config.Validate()
+		if !errors.Is(err, ErrInvalidConfig) {
+			t.Fatalf("wanted %v for %+v but got %v", ErrInvalidConfig, config, err)
+		}
+	}
+}
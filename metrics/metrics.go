@@ -0,0 +1,303 @@
+// Package metrics collects counters, gauges and histograms and exposes them
+// in the Prometheus text format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ContentType is the content type of the Prometheus text format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are the upper bounds in seconds of the buckets of a
+// latency histogram.
+var DefaultBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+type (
+	// Registry holds the metrics of a program in the order they were
+	// registered.
+	Registry struct {
+		mutex   sync.Mutex
+		metrics []metric
+	}
+
+	metric interface {
+		write(w io.Writer) error
+	}
+
+	header struct {
+		name   string
+		help   string
+		kind   string
+		labels []string
+	}
+
+	// Counter is a value that only goes up.
+	Counter struct {
+		value atomic.Uint64
+	}
+
+	// CounterVec is a set of counters that are told apart by their label
+	// values.
+	CounterVec struct {
+		header
+		mutex    sync.Mutex
+		counters map[string]*labeledCounter
+	}
+
+	labeledCounter struct {
+		Counter
+		values []string
+	}
+
+	// GaugeFunc is a gauge whose value is computed when it is collected.
+	GaugeFunc struct {
+		header
+		value func() float64
+	}
+
+	// Histogram counts observations in buckets.
+	Histogram struct {
+		header
+		buckets []float64
+		mutex   sync.Mutex
+		counts  []uint64 // Observations per bucket, the last one is +Inf.
+		sum     float64
+		count   uint64
+	}
+)
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Counter registers a counter vector with the label names, use With to get
+// the counter of a set of label values.
+func (registry *Registry) Counter(name string, help string, labels ...string) *CounterVec {
+	counter := &CounterVec{
+		header:   header{name: name, help: help, kind: "counter", labels: labels},
+		counters: make(map[string]*labeledCounter),
+	}
+	registry.register(counter)
+	return counter
+}
+
+// GaugeFunc registers a gauge that calls value every time it is collected.
+// value may be called concurrently.
+func (registry *Registry) GaugeFunc(name string, help string, value func() float64) *GaugeFunc {
+	gauge := &GaugeFunc{
+		header: header{name: name, help: help, kind: "gauge"},
+		value:  value,
+	}
+	registry.register(gauge)
+	return gauge
+}
+
+// Histogram registers a histogram with the upper bounds of its buckets in
+// ascending order.
+func (registry *Registry) Histogram(name string, help string, buckets []float64) *Histogram {
+	histogram := &Histogram{
+		header:  header{name: name, help: help, kind: "histogram"},
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)+1),
+	}
+	registry.register(histogram)
+	return histogram
+}
+
+func (registry *Registry) register(m metric) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	registry.metrics = append(registry.metrics, m)
+}
+
+// Write writes all metrics to w in the Prometheus text format.
+func (registry *Registry) Write(w io.Writer) error {
+	registry.mutex.Lock()
+	metrics := slices.Clone(registry.metrics)
+	registry.mutex.Unlock()
+
+	for _, m := range metrics {
+		err := m.write(w)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeHTTP serves the metrics to a Prometheus scrape.
+func (registry *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	registry.Write(w)
+}
+
+func (counter *Counter) Inc() {
+	counter.value.Add(1)
+}
+
+func (counter *Counter) Add(n uint64) {
+	counter.value.Add(n)
+}
+
+func (counter *Counter) Value() uint64 {
+	return counter.value.Load()
+}
+
+// With returns the counter of the label values, which are given in the
+// order of the label names.
+func (vec *CounterVec) With(values ...string) *Counter {
+	if len(values) != len(vec.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels but got %d values", vec.name, len(vec.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+
+	counter, ok := vec.counters[key]
+	if !ok {
+		counter = &labeledCounter{values: values}
+		vec.counters[key] = counter
+	}
+	return &counter.Counter
+}
+
+// Sum returns the sum of the counters of all label values.
+func (vec *CounterVec) Sum() uint64 {
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+
+	var sum uint64
+	for _, counter := range vec.counters {
+		sum += counter.Value()
+	}
+	return sum
+}
+
+func (vec *CounterVec) write(w io.Writer) error {
+	vec.mutex.Lock()
+	counters := make([]*labeledCounter, 0, len(vec.counters))
+	for _, counter := range vec.counters {
+		counters = append(counters, counter)
+	}
+	vec.mutex.Unlock()
+
+	slices.SortFunc(counters, func(a, b *labeledCounter) int {
+		return slices.Compare(a.values, b.values)
+	})
+
+	err := vec.writeHeader(w)
+	if err != nil {
+		return err
+	}
+	for _, counter := range counters {
+		_, err = fmt.Fprintf(w, "%s%s %d\n", vec.name, labelPairs(vec.labels, counter.values), counter.Value())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (gauge *GaugeFunc) write(w io.Writer) error {
+	err := gauge.writeHeader(w)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s %s\n", gauge.name, formatFloat(gauge.value()))
+	return err
+}
+
+// Observe adds a value to the bucket it falls in.
+func (histogram *Histogram) Observe(value float64) {
+	i, _ := slices.BinarySearch(histogram.buckets, value)
+
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	histogram.counts[i]++
+	histogram.sum += value
+	histogram.count++
+}
+
+func (histogram *Histogram) write(w io.Writer) error {
+	histogram.mutex.Lock()
+	counts := slices.Clone(histogram.counts)
+	sum := histogram.sum
+	count := histogram.count
+	histogram.mutex.Unlock()
+
+	err := histogram.writeHeader(w)
+	if err != nil {
+		return err
+	}
+
+	// Buckets are cumulative, every bucket counts the observations that are
+	// less than or equal to its upper bound.
+	var cumulative uint64
+	for i, count := range counts {
+		cumulative += count
+		upperBound := math.Inf(1)
+		if i < len(histogram.buckets) {
+			upperBound = histogram.buckets[i]
+		}
+		_, err = fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", histogram.name, formatFloat(upperBound), cumulative)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", histogram.name, formatFloat(sum), histogram.name, count)
+	return err
+}
+
+func (header *header) writeHeader(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", header.name, escapeHelp(header.help), header.name, header.kind)
+	return err
+}
+
+func labelPairs(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=\"%s\"", name, escapeLabelValue(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	registry := NewRegistry()
+	packets := registry.Counter("packets_total", "Packets by type.", "type")
+	registry.GaugeFunc("clients", "Connected clients.", func() float64 { return 3 })
+	latency := registry.Histogram("latency_seconds", "Latency.", []float64{0.1, 1})
+
+	packets.With("PUBLISH").Add(2)
+	packets.With("CONNECT").Inc()
+	packets.With("PUBLISH").Inc()
+	packets.With(`a"b`).Inc()
+	latency.Observe(0.05)
+	latency.Observe(0.1)
+	latency.Observe(5)
+
+	var output bytes.Buffer
+	err := registry.Write(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP packets_total Packets by type.
+# TYPE packets_total counter
+packets_total{type="CONNECT"} 1
+packets_total{type="PUBLISH"} 3
+packets_total{type="a\"b"} 1
+# HELP clients Connected clients.
+# TYPE clients gauge
+clients 3
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 2
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 5.15
+latency_seconds_count 3
+`
+	if output.String() != want {
+		t.Fatalf("wanted %v but got %v", want, output.String())
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	registry := NewRegistry()
+	registry.Counter("requests_total", "Requests.").With().Inc()
+
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	if recorder.Header().Get("Content-Type") != ContentType {
+		t.Fatalf("wanted %v but got %v", ContentType, recorder.Header().Get("Content-Type"))
+	}
+	want := "# HELP requests_total Requests.\n# TYPE requests_total counter\nrequests_total 1\n"
+	if recorder.Body.String() != want {
+		t.Fatalf("wanted %v but got %v", want, recorder.Body.String())
+	}
+}
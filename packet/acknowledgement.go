@@ -0,0 +1,143 @@
+package packet
+
+import (
+	"fmt"
+
+	"github.com/DvdSpijker/GoBroker/codec"
+)
+
+// PacketIdentifierNotFound is sent in a PUBREL or PUBCOMP for an unknown
+// packet identifier (3.6.2.1, 3.7.2.1).
+const PacketIdentifierNotFound ReasonCode = 0x92
+
+type (
+	// PUBREC, PUBREL and PUBCOMP acknowledge the steps of a QoS 2 delivery
+	// (4.3.3). They have the same layout as PUBACK.
+	PubrecPacket struct {
+		FixedHeader    FixedHeader
+		VariableHeader PubackVariableHeader
+	}
+
+	PubrelPacket struct {
+		FixedHeader    FixedHeader
+		VariableHeader PubackVariableHeader
+	}
+
+	PubcompPacket struct {
+		FixedHeader    FixedHeader
+		VariableHeader PubackVariableHeader
+	}
+)
+
+func (packet *PubrecPacket) Encode() ([]byte, error) {
+	return encodeAcknowledgement(&packet.FixedHeader, PUBREC, PUBRECFLAGS, &packet.VariableHeader)
+}
+
+func (packet *PubrecPacket) Decode(input []byte) (int, error) {
+	return decodeAcknowledgement(packet, input, &packet.FixedHeader, &packet.VariableHeader)
+}
+
+func (packet *PubrecPacket) String() string {
+	return acknowledgementString("PUBREC", &packet.VariableHeader)
+}
+
+func (packet *PubrelPacket) Encode() ([]byte, error) {
+	return encodeAcknowledgement(&packet.FixedHeader, PUBREL, PUBRELFLAGS, &packet.VariableHeader)
+}
+
+func (packet *PubrelPacket) Decode(input []byte) (int, error) {
+	return decodeAcknowledgement(packet, input, &packet.FixedHeader, &packet.VariableHeader)
+}
+
+func (packet *PubrelPacket) String() string {
+	return acknowledgementString("PUBREL", &packet.VariableHeader)
+}
+
+func (packet *PubcompPacket) Encode() ([]byte, error) {
+	return encodeAcknowledgement(&packet.FixedHeader, PUBCOMP, PUBCOMPFLAGS, &packet.VariableHeader)
+}
+
+func (packet *PubcompPacket) Decode(input []byte) (int, error) {
+	return decodeAcknowledgement(packet, input, &packet.FixedHeader, &packet.VariableHeader)
+}
+
+func (packet *PubcompPacket) String() string {
+	return acknowledgementString("PUBCOMP", &packet.VariableHeader)
+}
+
+func encodeAcknowledgement(fixedHeader *FixedHeader, packetType PacketType, flags PacketFlag, header *PubackVariableHeader) ([]byte, error) {
+	header.PacketIdentifer.Size = 2
+	bytes, err := header.PacketIdentifer.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	// The reason code and property length can be omitted if the reason code
+	// is Success and there are no properties.
+	if header.ReasonCode != Success || header.PropertyLength.Value > 0 {
+		bytes = append(bytes, byte(header.ReasonCode))
+
+		b, err := header.PropertyLength.Encode()
+		if err != nil {
+			return nil, err
+		}
+		bytes = append(bytes, b...)
+	}
+
+	fixedHeader.PacketType = packetType
+	fixedHeader.Flags = flags
+	fixedHeader.RemainingLength.Value = int32(len(bytes))
+
+	b, err := fixedHeader.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(b, bytes...), nil
+}
+
+func decodeAcknowledgement(packet any, input []byte, fixedHeader *FixedHeader, header *PubackVariableHeader) (int, error) {
+	n, err := fixedHeader.Decode(input)
+	if err != nil {
+		return 0, err
+	}
+	input = input[n:]
+	totalRead := n
+
+	header.PacketIdentifer.Size = 2
+	n, err = header.PacketIdentifer.Decode(input)
+	if err != nil {
+		return 0, err
+	}
+	input = input[n:]
+	totalRead += n
+
+	// A missing reason code means Success.
+	if len(input) > 0 {
+		header.ReasonCode = ReasonCode(input[0])
+		input = input[1:]
+		totalRead++
+	}
+
+	if len(input) > 0 {
+		n, err = header.PropertyLength.Decode(input)
+		if err != nil {
+			return 0, err
+		}
+		if int(header.PropertyLength.Value) > len(input)-n {
+			return 0, codec.DecodeErr(packet, "property length exceeds packet length")
+		}
+		totalRead += n + int(header.PropertyLength.Value)
+	}
+
+	return totalRead, nil
+}
+
+func acknowledgementString(name string, header *PubackVariableHeader) string {
+	return fmt.Sprintf(`%s
+    PacketIdentifier: %d
+    ReasonCode: %x`,
+		name,
+		header.PacketIdentifer.Value,
+		header.ReasonCode)
+}
@@ -0,0 +1,144 @@
+package packet
+
+import (
+	"fmt"
+
+	"github.com/DvdSpijker/GoBroker/codec"
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+const (
+	ContinueAuthentication ReasonCode = 0x18
+	ReAuthenticate         ReasonCode = 0x19
+)
+
+type (
+	AuthVariableHeader struct {
+		ReasonCode           ReasonCode
+		PropertyLength       types.VariableByteInteger
+		AuthenticationMethod types.UtfString
+		AuthenticationData   types.BinaryData
+		ReasonString         types.UtfString
+	}
+
+	// AuthPacket carries the challenges and responses of enhanced
+	// authentication (3.15).
+	AuthPacket struct {
+		FixedHeader    FixedHeader
+		VariableHeader AuthVariableHeader
+	}
+)
+
+func (packet *AuthPacket) String() string {
+	return fmt.Sprintf("auth\n\tfixed header: %s\n\treason code: %x | method: %s | data: %d bytes\n",
+		packet.FixedHeader.String(),
+		packet.VariableHeader.ReasonCode,
+		packet.VariableHeader.AuthenticationMethod.String(),
+		len(packet.VariableHeader.AuthenticationData.Data))
+}
+
+func (packet *AuthPacket) Encode() ([]byte, error) {
+	bytes := []byte{}
+	header := &packet.VariableHeader
+
+	properties := []byte{}
+	var err error
+	if header.AuthenticationMethod.Str != "" {
+		properties, err = encodeProperty(properties, AuthenticationMethodProperty, &header.AuthenticationMethod)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(header.AuthenticationData.Data) > 0 {
+		properties, err = encodeProperty(properties, AuthenticationDataProperty, &header.AuthenticationData)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if header.ReasonString.Str != "" {
+		properties, err = encodeProperty(properties, ReasonStringProperty, &header.ReasonString)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 3.15.2.1: The reason code and properties can be omitted if the
+	// reason code is Success and there are no properties.
+	if header.ReasonCode != Success || len(properties) > 0 {
+		bytes = append(bytes, byte(header.ReasonCode))
+
+		b, err := encodeProperties(properties)
+		if err != nil {
+			return nil, err
+		}
+		header.PropertyLength.Value = int32(len(properties))
+		bytes = append(bytes, b...)
+	}
+
+	packet.FixedHeader.PacketType = AUTH
+	packet.FixedHeader.Flags = AUTHFLAGS
+	packet.FixedHeader.RemainingLength.Value = int32(len(bytes))
+
+	b, err := packet.FixedHeader.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(b, bytes...), nil
+}
+
+func (packet *AuthPacket) Decode(input []byte) (int, error) {
+	n, err := packet.FixedHeader.Decode(input)
+	if err != nil {
+		return 0, err
+	}
+	// MQTT-3.15.1-1: The flags of an AUTH packet are reserved.
+	if packet.FixedHeader.Flags != AUTHFLAGS {
+		return 0, codec.DecodeErr(packet, "invalid flags")
+	}
+
+	totalRead := n
+	input = input[n:]
+
+	header := &packet.VariableHeader
+	header.ReasonCode = Success
+	if len(input) == 0 {
+		return totalRead, nil
+	}
+
+	header.ReasonCode = ReasonCode(input[0])
+	totalRead += 1
+	input = input[1:]
+	if len(input) == 0 {
+		return totalRead, nil
+	}
+
+	n, err = header.PropertyLength.Decode(input)
+	if err != nil {
+		return 0, err
+	}
+	totalRead += n
+	input = input[n:]
+
+	propertyLength := int(header.PropertyLength.Value)
+	if propertyLength > len(input) {
+		return 0, codec.DecodeErr(packet, "property length exceeds packet length")
+	}
+	err = decodeProperties(input[:propertyLength], func(identifier PropertyIdentifier, value []byte) error {
+		var err error
+		switch identifier {
+		case AuthenticationMethodProperty:
+			_, err = header.AuthenticationMethod.Decode(value)
+		case AuthenticationDataProperty:
+			_, err = header.AuthenticationData.Decode(value)
+		case ReasonStringProperty:
+			_, err = header.ReasonString.Decode(value)
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return totalRead + propertyLength, nil
+}
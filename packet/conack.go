@@ -1,6 +1,7 @@
 package packet
 
 import (
+	"github.com/DvdSpijker/GoBroker/codec"
 	"github.com/DvdSpijker/GoBroker/types"
 )
 
@@ -9,6 +10,11 @@ type (
 		VariableHeaderBase      VariableHeaderBase
 		ConnectAcknowledgeFlags byte
 		ConnectReasonCode      ReasonCode
+		ServerKeepAlive         types.UnsignedInt // Only sent if Size is set.
+		AssignedClientIdentifier types.UtfString  // Only sent if not empty.
+		AuthenticationMethod    types.UtfString   // Only sent if not empty.
+		AuthenticationData      types.BinaryData
+		ReasonString            types.UtfString   // Only sent if not empty.
 	}
 
 	ConackPacket struct {
@@ -20,7 +26,8 @@ type (
 )
 
 const (
-	SessionPresent ConnectAcknowledgeFlag = 0b10000000
+	// 3.2.2.1.1: Session Present is bit 0 of the Connect Acknowledge Flags.
+	SessionPresent ConnectAcknowledgeFlag = 0b00000001
 )
 
 func (packet ConackPacket) Encode() (bin []byte, err error) {
@@ -31,26 +38,75 @@ func (packet ConackPacket) Encode() (bin []byte, err error) {
 		return nil, err
 	}
 
+	packet.FixedHeader.RemainingLength.Value = int32(len(variabledHdrBin))
 	fixedHdrBin, err := packet.FixedHeader.Encode()
 	if err != nil {
 		return nil, err
 	}
 
-	remainingLen := types.VariableByteInteger{
-		Value: int32(len(variabledHdrBin)),
-	}
-	remainingLenBin, err := remainingLen.Encode()
-	if err != nil {
-		return nil, err
-	}
-
 	bin = append(bin, fixedHdrBin...)
-	bin = append(bin, remainingLenBin...)
 	bin = append(bin, variabledHdrBin...)
 
 	return bin, nil
 }
 
+func (packet *ConackPacket) Decode(input []byte) (int, error) {
+	n, err := packet.FixedHeader.Decode(input)
+	if err != nil {
+		return 0, err
+	}
+	input = input[n:]
+
+	remainingLength := int(packet.FixedHeader.RemainingLength.Value)
+	if remainingLength > len(input) || remainingLength < 2 {
+		return 0, codec.DecodeErr(packet, "invalid remaining length")
+	}
+	input = input[:remainingLength]
+
+	header := &packet.VariableHeader
+	header.ConnectAcknowledgeFlags = input[0]
+	header.ConnectReasonCode = ReasonCode(input[1])
+	input = input[2:]
+
+	// 3.2.2.3: The properties may be left out if the remaining length is 2.
+	if len(input) > 0 {
+		propertyLength := types.VariableByteInteger{}
+		m, err := propertyLength.Decode(input)
+		if err != nil {
+			return 0, err
+		}
+		input = input[m:]
+
+		if int(propertyLength.Value) > len(input) {
+			return 0, codec.DecodeErr(packet, "property length exceeds packet length")
+		}
+		err = decodeProperties(input[:propertyLength.Value], header.decodeProperty)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return n + remainingLength, nil
+}
+
+func (header *ConackVariableHeader) decodeProperty(identifier PropertyIdentifier, value []byte) error {
+	var err error
+	switch identifier {
+	case ServerKeepAliveProperty:
+		header.ServerKeepAlive.Size = 2
+		_, err = header.ServerKeepAlive.Decode(value)
+	case AssignedClientIdentifierProperty:
+		_, err = header.AssignedClientIdentifier.Decode(value)
+	case AuthenticationMethodProperty:
+		_, err = header.AuthenticationMethod.Decode(value)
+	case AuthenticationDataProperty:
+		_, err = header.AuthenticationData.Decode(value)
+	case ReasonStringProperty:
+		_, err = header.ReasonString.Decode(value)
+	}
+	return err
+}
+
 func (hdr ConackVariableHeader) Encode() (bin []byte, err error) {
 	// bin, err := hdr.VariableHeaderBase.Encode()
 	// if err != nil {
@@ -59,16 +115,50 @@ func (hdr ConackVariableHeader) Encode() (bin []byte, err error) {
 	bin = append(bin, hdr.ConnectAcknowledgeFlags)
 	bin = append(bin, byte(hdr.ConnectReasonCode))
 
-  propertiesLength := types.VariableByteInteger{Value: 2}
   properties := []byte{byte(SharedSubscriptionAvailable), 0x01}
 
-  b, err := propertiesLength.Encode()
+  if hdr.ServerKeepAlive.Size > 0 {
+    b, err := hdr.ServerKeepAlive.Encode()
+    if err != nil {
+      return nil, err
+    }
+    properties = append(properties, byte(ServerKeepAliveProperty))
+    properties = append(properties, b...)
+  }
+
+  if hdr.AssignedClientIdentifier.Str != "" {
+    properties, err = encodeProperty(properties, AssignedClientIdentifierProperty, &hdr.AssignedClientIdentifier)
+    if err != nil {
+      return nil, err
+    }
+  }
+
+  if hdr.AuthenticationMethod.Str != "" {
+    properties, err = encodeProperty(properties, AuthenticationMethodProperty, &hdr.AuthenticationMethod)
+    if err != nil {
+      return nil, err
+    }
+    if len(hdr.AuthenticationData.Data) > 0 {
+      properties, err = encodeProperty(properties, AuthenticationDataProperty, &hdr.AuthenticationData)
+      if err != nil {
+        return nil, err
+      }
+    }
+  }
+
+  if hdr.ReasonString.Str != "" {
+    properties, err = encodeProperty(properties, ReasonStringProperty, &hdr.ReasonString)
+    if err != nil {
+      return nil, err
+    }
+  }
+
+  b, err := encodeProperties(properties)
   if err != nil {
     return nil, err
   }
 
-	bin = append(bin, b...)
-  bin = append(bin, properties...)
+  bin = append(bin, b...)
 
 	return bin, nil
 }
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 
+	"github.com/DvdSpijker/GoBroker/codec"
 	"github.com/DvdSpijker/GoBroker/types"
 )
 
@@ -19,23 +20,34 @@ type (
 		UserProperty           types.UtfStringPair
 	}
 
+	ConnectVariableHeader struct {
+		ProtocolName types.UtfString
+		Version      byte
+
+		UserNameFlag bool
+		PasswordFlag bool
+		WillRetain   bool
+		WillQos      types.QoS
+		WillFlag     bool
+		CleanStart   bool
+
+		KeepAlive      types.UnsignedInt // In seconds
+		PropertyLength types.VariableByteInteger
+
+		// 3.1.2.11.2: Seconds the session is kept after the connection
+		// closes, 0 ends the session when the connection closes.
+		SessionExpiryInterval types.UnsignedInt
+
+		// Enhanced authentication (4.12), the method is empty if
+		// the client does not use it.
+		AuthenticationMethod types.UtfString
+		AuthenticationData   types.BinaryData
+	}
+
 	ConnectPacket struct {
 		FixedHeader    FixedHeader
-		VariableHeader struct {
-			ProtocolName types.UtfString
-			Version      byte
-
-			UserNameFlag bool
-			PasswordFlag bool
-			WillRetain   bool
-			WillQos      types.QoS
-			WillFlag     bool
-			CleanStart   bool
-
-			KeepAlive      types.UnsignedInt // In seconds
-			PropertyLength types.VariableByteInteger
-		}
-		Payload struct {
+		VariableHeader ConnectVariableHeader
+		Payload        struct {
 			ClientId types.UtfString
 
 			WillProperties WillProperties
@@ -74,7 +86,7 @@ func (packet *ConnectPacket) String() string {
     WillTopic: %s
     WillPayload: %v
     UserName: %s
-    Password: %v
+    Password: %d bytes
     `,
 		&packet.Payload.ClientId,
 		packet.VariableHeader.Version,
@@ -97,7 +109,172 @@ func (packet *ConnectPacket) String() string {
 		&packet.Payload.WillTopic,
 		packet.Payload.WillPayload,
 		&packet.Payload.UserName,
-		packet.Payload.Password.Data)
+		len(packet.Payload.Password.Data))
+}
+
+// Encode encodes a CONNECT packet with the flags as they are set in the
+// variable header, the protocol name is always "MQTT".
+func (packet *ConnectPacket) Encode() ([]byte, error) {
+	header := &packet.VariableHeader
+	payload := &packet.Payload
+
+	header.ProtocolName.Str = "MQTT"
+	bytes, err := header.ProtocolName.Encode()
+	if err != nil {
+		return nil, err
+	}
+	bytes = append(bytes, header.Version)
+
+	var connectFlags byte
+	if header.UserNameFlag {
+		connectFlags |= 0b10000000
+	}
+	if header.PasswordFlag {
+		connectFlags |= 0b01000000
+	}
+	if header.WillRetain {
+		connectFlags |= 0b00100000
+	}
+	connectFlags |= byte(header.WillQos) << 3 & 0b00011000
+	if header.WillFlag {
+		connectFlags |= 0b00000100
+	}
+	if header.CleanStart {
+		connectFlags |= 0b00000010
+	}
+	bytes = append(bytes, connectFlags)
+
+	header.KeepAlive.Size = 2
+	b, err := header.KeepAlive.Encode()
+	if err != nil {
+		return nil, err
+	}
+	bytes = append(bytes, b...)
+
+	properties := []byte{}
+	if header.SessionExpiryInterval.Value > 0 {
+		header.SessionExpiryInterval.Size = 4
+		properties, err = encodeProperty(properties, SessionExpiryIntervalProperty, &header.SessionExpiryInterval)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if header.AuthenticationMethod.Str != "" {
+		properties, err = encodeProperty(properties, AuthenticationMethodProperty, &header.AuthenticationMethod)
+		if err != nil {
+			return nil, err
+		}
+		if len(header.AuthenticationData.Data) > 0 {
+			properties, err = encodeProperty(properties, AuthenticationDataProperty, &header.AuthenticationData)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	header.PropertyLength.Value = int32(len(properties))
+	b, err = encodeProperties(properties)
+	if err != nil {
+		return nil, err
+	}
+	bytes = append(bytes, b...)
+
+	b, err = payload.ClientId.Encode()
+	if err != nil {
+		return nil, fmt.Errorf("client identifier: %w", err)
+	}
+	bytes = append(bytes, b...)
+
+	if header.WillFlag {
+		b, err = payload.WillProperties.Encode()
+		if err != nil {
+			return nil, fmt.Errorf("will properties: %w", err)
+		}
+		bytes = append(bytes, b...)
+
+		b, err = payload.WillTopic.Encode()
+		if err != nil {
+			return nil, fmt.Errorf("will topic: %w", err)
+		}
+		bytes = append(bytes, b...)
+
+		b, err = payload.WillPayload.Encode()
+		if err != nil {
+			return nil, fmt.Errorf("will payload: %w", err)
+		}
+		bytes = append(bytes, b...)
+	}
+
+	if header.UserNameFlag {
+		b, err = payload.UserName.Encode()
+		if err != nil {
+			return nil, fmt.Errorf("user name: %w", err)
+		}
+		bytes = append(bytes, b...)
+	}
+
+	if header.PasswordFlag {
+		b, err = payload.Password.Encode()
+		if err != nil {
+			return nil, fmt.Errorf("password: %w", err)
+		}
+		bytes = append(bytes, b...)
+	}
+
+	packet.FixedHeader.PacketType = CONNECT
+	packet.FixedHeader.Flags = 0
+	packet.FixedHeader.RemainingLength.Value = int32(len(bytes))
+	b, err = packet.FixedHeader.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(b, bytes...), nil
+}
+
+// Encode encodes the will properties that are set, prefixed with their
+// length.
+func (properties *WillProperties) Encode() ([]byte, error) {
+	bytes := []byte{}
+	var err error
+
+	if properties.DelayInterval.Value > 0 {
+		properties.DelayInterval.Size = 4
+		bytes, err = encodeProperty(bytes, WillDelayIntervalProperty, &properties.DelayInterval)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if properties.PayloadFormatIndicator != UnspecifiedBytes {
+		bytes = append(bytes, byte(PayloadFormatIndicatorProperty), byte(properties.PayloadFormatIndicator))
+	}
+	if properties.MessageExpiryInterval.Value > 0 {
+		properties.MessageExpiryInterval.Size = 4
+		bytes, err = encodeProperty(bytes, MessageExpiryIntervalProperty, &properties.MessageExpiryInterval)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if properties.ContentType.Str != "" {
+		bytes, err = encodeProperty(bytes, ContentTypeProperty, &properties.ContentType)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if properties.ResponseTopic.Str != "" {
+		bytes, err = encodeProperty(bytes, ResponseTopicProperty, &properties.ResponseTopic)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(properties.CorrelationData.Data) > 0 {
+		bytes, err = encodeProperty(bytes, CorrelationDataProperty, &properties.CorrelationData)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	properties.PropertiesLength.Value = int32(len(bytes))
+	return encodeProperties(bytes)
 }
 
 func (packet *ConnectPacket) Decode(input []byte) (int, error) {
@@ -144,13 +321,26 @@ func (packet *ConnectPacket) Decode(input []byte) (int, error) {
 	totalRead += n
 	input = input[n:]
 
-	n, err = packet.VariableHeader.PropertyLength.Decode(input)
-	if err != nil {
-		return 0, err
-	}
-	if packet.VariableHeader.PropertyLength.Value > 0 {
+	// Properties were introduced in version 5, older versions
+	// continue with the payload directly.
+	if packet.VariableHeader.Version >= 5 {
+		n, err = packet.VariableHeader.PropertyLength.Decode(input)
+		if err != nil {
+			return 0, err
+		}
 		totalRead += n
-		input = input[n+int(packet.VariableHeader.PropertyLength.Value):]
+		input = input[n:]
+
+		propertyLength := int(packet.VariableHeader.PropertyLength.Value)
+		if propertyLength > len(input) {
+			return 0, codec.DecodeErr(packet, "property length exceeds packet length")
+		}
+		err = decodeProperties(input[:propertyLength], packet.VariableHeader.decodeProperty)
+		if err != nil {
+			return 0, err
+		}
+		totalRead += propertyLength
+		input = input[propertyLength:]
 	}
 
 	n, err = packet.Payload.ClientId.Decode(input)
@@ -194,18 +384,19 @@ func (packet *ConnectPacket) Decode(input []byte) (int, error) {
 				n, err = packet.Payload.WillProperties.CorrelationData.Decode(input[1:])
 
 			case UserPropertyProperty:
-				panic("cannot process user property")
-				// TODO: Enable this when Decode is implemeneted.
-				// n, err = packet.Payload.WillProperties.UserProperty.Decode(input)
+				n, err = packet.Payload.WillProperties.UserProperty.Decode(input[1:])
 
 			default:
-				fmt.Printf("unknown property identifier in CONNECT payload: %x\n", propertyIdentifier)
+				err = fmt.Errorf("unknown will property identifier: %x", propertyIdentifier)
 			}
 
 			// +1 for the read property identifier
 			input = input[n+1:]
 			remainingPropLength -= int32(n + 1)
 		}
+		if err != nil {
+			return 0, err
+		}
 
 		n, err = packet.Payload.WillTopic.Decode(input)
 		if err != nil {
@@ -229,12 +420,13 @@ func (packet *ConnectPacket) Decode(input []byte) (int, error) {
 		}
 
 		input = input[n:]
+	}
 
-		if packet.VariableHeader.PasswordFlag {
-			n, err = packet.Payload.Password.Decode(input)
-			if err != nil {
-				return 0, err
-			}
+	// 3.1.2.9: MQTT v5 allows a password without a user name.
+	if packet.VariableHeader.PasswordFlag {
+		n, err = packet.Payload.Password.Decode(input)
+		if err != nil {
+			return 0, err
 		}
 	}
 
@@ -243,6 +435,20 @@ func (packet *ConnectPacket) Decode(input []byte) (int, error) {
 	return totalRead, nil
 }
 
+func (header *ConnectVariableHeader) decodeProperty(identifier PropertyIdentifier, value []byte) error {
+	var err error
+	switch identifier {
+	case SessionExpiryIntervalProperty:
+		header.SessionExpiryInterval.Size = 4
+		_, err = header.SessionExpiryInterval.Decode(value)
+	case AuthenticationMethodProperty:
+		_, err = header.AuthenticationMethod.Decode(value)
+	case AuthenticationDataProperty:
+		_, err = header.AuthenticationData.Decode(value)
+	}
+	return err
+}
+
 func (packet *ConnectPacket) verifyProtocolName(input []byte) (int, error) {
 	if len(input) < 6 {
 		return 0, errors.New("need at least 6 bytes to verify 'MQTT' in connect packet")
@@ -0,0 +1,137 @@
+package packet
+
+import (
+	"fmt"
+
+	"github.com/DvdSpijker/GoBroker/codec"
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+const (
+	NormalDisconnection       ReasonCode = 0x00
+	DisconnectWithWillMessage ReasonCode = 0x04
+	ServerShuttingDown        ReasonCode = 0x8B
+	KeepAliveTimeout          ReasonCode = 0x8D
+	SessionTakenOver          ReasonCode = 0x8E
+	AdministrativeAction      ReasonCode = 0x98
+	MaximumConnectTime        ReasonCode = 0xA0
+)
+
+type (
+	DisconnectVariableHeader struct {
+		ReasonCode     ReasonCode
+		PropertyLength types.VariableByteInteger
+		ReasonString   types.UtfString
+		// SessionExpiryInterval is only present if its size is set, a
+		// client can change the interval it set in the CONNECT with it.
+		SessionExpiryInterval types.UnsignedInt
+	}
+
+	DisconnectPacket struct {
+		FixedHeader    FixedHeader
+		VariableHeader DisconnectVariableHeader
+	}
+)
+
+func (packet *DisconnectPacket) String() string {
+	return fmt.Sprintf("disconnect\n\tfixed header: %s\n\treason code: %x | reason: %s\n",
+		packet.FixedHeader.String(),
+		packet.VariableHeader.ReasonCode,
+		packet.VariableHeader.ReasonString.String())
+}
+
+func (packet *DisconnectPacket) Encode() ([]byte, error) {
+	bytes := []byte{}
+	header := &packet.VariableHeader
+
+	properties := []byte{}
+	var err error
+	if header.ReasonString.Str != "" {
+		properties, err = encodeProperty(properties, ReasonStringProperty, &header.ReasonString)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if header.SessionExpiryInterval.Size != 0 {
+		header.SessionExpiryInterval.Size = 4
+		properties, err = encodeProperty(properties, SessionExpiryIntervalProperty, &header.SessionExpiryInterval)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 3.14.2.1: The reason code and properties can be omitted for a
+	// normal disconnection without properties.
+	if header.ReasonCode != NormalDisconnection || len(properties) > 0 {
+		bytes = append(bytes, byte(header.ReasonCode))
+
+		b, err := encodeProperties(properties)
+		if err != nil {
+			return nil, err
+		}
+		header.PropertyLength.Value = int32(len(properties))
+		bytes = append(bytes, b...)
+	}
+
+	packet.FixedHeader.PacketType = DISCONNECT
+	packet.FixedHeader.Flags = DISCONNECTFLAGS
+	packet.FixedHeader.RemainingLength.Value = int32(len(bytes))
+
+	b, err := packet.FixedHeader.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(b, bytes...), nil
+}
+
+func (packet *DisconnectPacket) Decode(input []byte) (int, error) {
+	n, err := packet.FixedHeader.Decode(input)
+	if err != nil {
+		return 0, err
+	}
+
+	totalRead := n
+	input = input[n:]
+
+	header := &packet.VariableHeader
+	header.ReasonCode = NormalDisconnection
+	if len(input) == 0 {
+		return totalRead, nil
+	}
+
+	header.ReasonCode = ReasonCode(input[0])
+	totalRead += 1
+	input = input[1:]
+	if len(input) == 0 {
+		return totalRead, nil
+	}
+
+	n, err = header.PropertyLength.Decode(input)
+	if err != nil {
+		return 0, err
+	}
+	totalRead += n
+	input = input[n:]
+
+	propertyLength := int(header.PropertyLength.Value)
+	if propertyLength > len(input) {
+		return 0, codec.DecodeErr(packet, "property length exceeds packet length")
+	}
+	err = decodeProperties(input[:propertyLength], func(identifier PropertyIdentifier, value []byte) error {
+		var err error
+		switch identifier {
+		case ReasonStringProperty:
+			_, err = header.ReasonString.Decode(value)
+		case SessionExpiryIntervalProperty:
+			header.SessionExpiryInterval.Size = 4
+			_, err = header.SessionExpiryInterval.Decode(value)
+		}
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return totalRead + propertyLength, nil
+}
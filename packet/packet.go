@@ -45,10 +45,10 @@ const (
 	CONNECT
 	CONNACK
 	PUBLISH
-	PUBACK  // Publish Acknowledge Qos 1 Not implemented
-	PUBREC  // Publish Received Qos 2 Not implemented
-	PUBREL  // Publish Release Qos 2 Not implemented
-	PUBCOMP // Publish Complete Qos 2 Not implemented
+	PUBACK  // Publish Acknowledge Qos 1
+	PUBREC  // Publish Received Qos 2
+	PUBREL  // Publish Release Qos 2
+	PUBCOMP // Publish Complete Qos 2
 	SUBSCRIBE
 	SUBACK
 	UNSUBSCRIBE
@@ -83,20 +83,44 @@ const (
 	REQUIRED PayloadExpectation = "Required"
 )
 
+var packetTypeNames = map[PacketType]string{
+	CONNECT:     "CONNECT",
+	CONNACK:     "CONNACK",
+	PUBLISH:     "PUBLISH",
+	PUBACK:      "PUBACK",
+	PUBREC:      "PUBREC",
+	PUBREL:      "PUBREL",
+	PUBCOMP:     "PUBCOMP",
+	SUBSCRIBE:   "SUBSCRIBE",
+	SUBACK:      "SUBACK",
+	UNSUBSCRIBE: "UNSUBSCRIBE",
+	UNSUBACK:    "UNSUBACK",
+	PINGREQ:     "PINGREQ",
+	PINGRESP:    "PINGRESP",
+	DISCONNECT:  "DISCONNECT",
+	AUTH:        "AUTH",
+}
+
+func (packetType PacketType) String() string {
+	name, ok := packetTypeNames[packetType]
+	if !ok {
+		return fmt.Sprintf("reserved (%x)", byte(packetType))
+	}
+	return name
+}
+
 func (fixedHeader *FixedHeader) Encode() ([]byte, error) {
   encoded := make([]byte, 1)
 	encoded[0] = byte(fixedHeader.PacketType)
 	encoded[0] |= byte(fixedHeader.Flags)
 
-  if fixedHeader.RemainingLength.Value > 0 {
-    b, err := fixedHeader.RemainingLength.Encode()
-    if err != nil {
-      return nil, err
-    }
-    return append(encoded, b...), nil
+  // The remaining length is always present, also when it is 0.
+  b, err := fixedHeader.RemainingLength.Encode()
+  if err != nil {
+    return nil, err
   }
 
-  return encoded, nil
+  return append(encoded, b...), nil
 }
 
 func (fixedHeader *FixedHeader) Decode(input []byte) (int, error) {
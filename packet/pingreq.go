@@ -6,6 +6,12 @@ type (
 	}
 )
 
+func (packet PingReqPacket) Encode() ([]byte, error) {
+	packet.FixedHeader.PacketType = PINGREQ
+	packet.FixedHeader.Flags = PINGREQFLAGS
+	return packet.FixedHeader.Encode()
+}
+
 func (packet PingReqPacket) Decode(input []byte) (int, error) {
 	n, err := packet.FixedHeader.Decode(input)
 	if err != nil {
@@ -6,6 +6,10 @@ type (
 	}
 )
 
+func (packet PingRespPacket) Decode(input []byte) (int, error) {
+	return packet.FixedHeader.Decode(input)
+}
+
 func (packet PingRespPacket) Encode() (bin []byte, err error) {
 	packet.FixedHeader.PacketType = PINGRESP
 
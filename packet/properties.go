@@ -1,5 +1,12 @@
 package packet
 
+import (
+	"fmt"
+
+	"github.com/DvdSpijker/GoBroker/codec"
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
 type (
   PropertyIdentifier byte
 	PayloadFormatIndicator byte
@@ -19,5 +26,102 @@ const (
   ResponseTopicProperty PropertyIdentifier = 0x08
   CorrelationDataProperty PropertyIdentifier = 0x09
   UserPropertyProperty PropertyIdentifier = 0x26
+  SubscriptionIdentifierProperty PropertyIdentifier = 0x0B
+  TopicAliasProperty PropertyIdentifier = 0x23
+  ServerKeepAliveProperty PropertyIdentifier = 0x13
   SharedSubscriptionAvailable PropertyIdentifier = 0x2A
+  AuthenticationMethodProperty PropertyIdentifier = 0x15
+  AuthenticationDataProperty PropertyIdentifier = 0x16
+  ReasonStringProperty PropertyIdentifier = 0x1F
+  AssignedClientIdentifierProperty PropertyIdentifier = 0x12
+  SessionExpiryIntervalProperty PropertyIdentifier = 0x11
 )
+
+// propertyValueSize returns the size of the value of a property (2.2.2.2)
+// that starts at the beginning of input.
+func propertyValueSize(identifier PropertyIdentifier, input []byte) (int, error) {
+	var size int
+	switch identifier {
+	case 0x01, 0x17, 0x19, 0x24, 0x25, 0x28, 0x29, 0x2A: // Byte
+		size = 1
+	case 0x13, 0x21, 0x22, 0x23: // Two byte integer
+		size = 2
+	case 0x02, 0x11, 0x18, 0x27: // Four byte integer
+		size = 4
+	case 0x0B: // Variable byte integer
+		vbi := types.VariableByteInteger{}
+		n, err := vbi.Decode(input)
+		if err != nil {
+			return 0, err
+		}
+		size = n
+	case 0x03, 0x08, 0x09, 0x12, 0x15, 0x16, 0x1A, 0x1C, 0x1F: // UTF-8 string or binary data
+		length := types.UnsignedInt{Size: 2}
+		_, err := length.Decode(input)
+		if err != nil {
+			return 0, err
+		}
+		size = 2 + int(length.Value)
+	case 0x26: // UTF-8 string pair
+		name := types.UtfString{}
+		n, err := name.Decode(input)
+		if err != nil {
+			return 0, err
+		}
+		value := types.UtfString{}
+		m, err := value.Decode(input[n:])
+		if err != nil {
+			return 0, err
+		}
+		size = n + m
+	default:
+		return 0, codec.DecodeErr(identifier, fmt.Sprintf("unknown property identifier: %x", byte(identifier)))
+	}
+
+	if size > len(input) {
+		return 0, codec.DecodeErr(identifier, "property exceeds properties length")
+	}
+	return size, nil
+}
+
+// decodeProperties calls decode with the identifier and value of every
+// property in properties, the value holds exactly the bytes of the property.
+func decodeProperties(properties []byte, decode func(PropertyIdentifier, []byte) error) error {
+	for len(properties) > 0 {
+		identifier := PropertyIdentifier(properties[0])
+		properties = properties[1:]
+
+		size, err := propertyValueSize(identifier, properties)
+		if err != nil {
+			return err
+		}
+
+		err = decode(identifier, properties[:size])
+		if err != nil {
+			return err
+		}
+		properties = properties[size:]
+	}
+
+	return nil
+}
+
+// encodeProperty appends a property with an encoded value to properties.
+func encodeProperty(properties []byte, identifier PropertyIdentifier, value codec.Encoder) ([]byte, error) {
+	b, err := value.Encode()
+	if err != nil {
+		return nil, err
+	}
+	properties = append(properties, byte(identifier))
+	return append(properties, b...), nil
+}
+
+// encodeProperties prefixes properties with their length.
+func encodeProperties(properties []byte) ([]byte, error) {
+	length := types.VariableByteInteger{Value: int32(len(properties))}
+	b, err := length.Encode()
+	if err != nil {
+		return nil, err
+	}
+	return append(b, properties...), nil
+}
@@ -24,7 +24,9 @@ func (packet *PubackPacket) Encode() ([]byte, error) {
 
   bytes = append(bytes, b...)
 
-  if packet.VariableHeader.ReasonCode != Success &&
+  // 3.4.2.1: The reason code and property length can be omitted if the
+  // reason code is Success and there are no properties.
+  if packet.VariableHeader.ReasonCode != Success ||
     packet.VariableHeader.PropertyLength.Value > 0 {
     bytes = append(bytes, byte(packet.VariableHeader.ReasonCode))
 
@@ -4,6 +4,7 @@ import (
 	"encoding/hex"
 	"fmt"
 
+	"github.com/DvdSpijker/GoBroker/codec"
 	"github.com/DvdSpijker/GoBroker/types"
 )
 
@@ -15,16 +16,20 @@ type (
 		Retain            bool
 	}
 	PublishVariableHeader struct {
-		TopicName              types.UtfString
-		PacketIdentifier       types.UnsignedInt
-		PropertyLength         types.VariableByteInteger
-		PropertiesRaw          []byte // Temporarily used to store the properties until they are parsed.
+		TopicName        types.UtfString
+		PacketIdentifier types.UnsignedInt
+		PropertyLength   types.VariableByteInteger
+		// PropertiesRaw holds the encoded properties, Encode writes them as
+		// they are so that forwarded messages keep their properties.
+		// Decode sets the property fields below from them and
+		// EncodeProperties sets them from the fields.
+		PropertiesRaw          []byte
 		PayloadFormatIndicator PayloadFormatIndicator
-		MessageExpirtyInterval types.UnsignedInt
+		MessageExpiryInterval  types.UnsignedInt
 		TopicAlias             types.UnsignedInt
 		ResponseTopic          types.UtfString
 		CorrelationData        types.BinaryData
-		UserProperty           types.UtfStringPair
+		UserProperties         []types.UtfStringPair
 		SubscriptionIdentifier types.VariableByteInteger
 		ContentType            types.UtfString
 	}
@@ -47,7 +52,7 @@ func PublishPacketFlags(qos types.QoS, dup bool, retain bool) PacketFlag {
 		dupInt = 1
 	}
 	qosInt = int(qos)
-	return PacketFlag(dupInt<<4 | qosInt<<1 | retainInt)
+	return PacketFlag(dupInt<<3 | qosInt<<1 | retainInt)
 }
 
 func (packet *PublishPacket) Decode(input []byte) (int, error) {
@@ -55,12 +60,11 @@ func (packet *PublishPacket) Decode(input []byte) (int, error) {
 
 	n, err := packet.FixedHeader.CommonFixedHeader.Decode(input)
 	if err != nil {
-		fmt.Println("failed to decode fixed header")
-		return 0, err
+		return 0, fmt.Errorf("fixed header: %w", err)
 	}
 
 	packet.FixedHeader.Dup = packet.FixedHeader.CommonFixedHeader.Flags&0b00001000 > 0
-	packet.FixedHeader.Qos = types.QoS(packet.FixedHeader.CommonFixedHeader.Flags & 0b00000110)
+	packet.FixedHeader.Qos = types.QoS(packet.FixedHeader.CommonFixedHeader.Flags&0b00000110) >> 1
 	packet.FixedHeader.Retain = packet.FixedHeader.CommonFixedHeader.Flags&0b00000001 > 0
 
 	input = input[n:]
@@ -68,8 +72,7 @@ func (packet *PublishPacket) Decode(input []byte) (int, error) {
 
 	n, err = packet.VariableHeader.TopicName.Decode(input)
 	if err != nil {
-		fmt.Println("failed to decode topic name")
-		return 0, err
+		return 0, fmt.Errorf("topic name: %w", err)
 	}
 
 	input = input[n:]
@@ -79,8 +82,7 @@ func (packet *PublishPacket) Decode(input []byte) (int, error) {
 		packet.VariableHeader.PacketIdentifier.Size = 2
 		n, err := packet.VariableHeader.PacketIdentifier.Decode(input)
 		if err != nil {
-			fmt.Println("failed to decode packet identifier")
-			return 0, err
+			return 0, fmt.Errorf("packet identifier: %w", err)
 		}
 		input = input[n:]
 		totalRead += n
@@ -88,17 +90,23 @@ func (packet *PublishPacket) Decode(input []byte) (int, error) {
 
 	n, err = packet.VariableHeader.PropertyLength.Decode(input)
 	if err != nil {
-		fmt.Println("failed to decode property length")
-		return 0, err
+		return 0, fmt.Errorf("property length: %w", err)
 	}
 
-	n = int(packet.VariableHeader.PropertyLength.Value)
 	input = input[n:]
-	if packet.VariableHeader.PropertyLength.Value > 0 {
-		packet.VariableHeader.PropertiesRaw = input[:n]                  // TODO: Actually parse properties
-		totalRead += n + int(packet.VariableHeader.PropertyLength.Value) // Pretend properties have been read
-		input = input[n:]
+	totalRead += n
+
+	propertyLength := int(packet.VariableHeader.PropertyLength.Value)
+	if propertyLength > len(input) {
+		return 0, codec.DecodeErr(packet, "property length exceeds packet length")
 	}
+	packet.VariableHeader.PropertiesRaw = input[:propertyLength]
+	err = decodeProperties(packet.VariableHeader.PropertiesRaw, packet.VariableHeader.decodeProperty)
+	if err != nil {
+		return 0, fmt.Errorf("properties: %w", err)
+	}
+	totalRead += propertyLength
+	input = input[propertyLength:]
 
 	packet.Payload.Data = input
 	totalRead += len(input)
@@ -106,6 +114,93 @@ func (packet *PublishPacket) Decode(input []byte) (int, error) {
 	return totalRead, nil
 }
 
+func (header *PublishVariableHeader) decodeProperty(identifier PropertyIdentifier, value []byte) error {
+	var err error
+	switch identifier {
+	case PayloadFormatIndicatorProperty:
+		header.PayloadFormatIndicator = PayloadFormatIndicator(value[0])
+	case MessageExpiryIntervalProperty:
+		header.MessageExpiryInterval.Size = 4
+		_, err = header.MessageExpiryInterval.Decode(value)
+	case TopicAliasProperty:
+		header.TopicAlias.Size = 2
+		_, err = header.TopicAlias.Decode(value)
+	case ResponseTopicProperty:
+		_, err = header.ResponseTopic.Decode(value)
+	case CorrelationDataProperty:
+		_, err = header.CorrelationData.Decode(value)
+	case UserPropertyProperty:
+		userProperty := types.UtfStringPair{}
+		_, err = userProperty.Decode(value)
+		header.UserProperties = append(header.UserProperties, userProperty)
+	case SubscriptionIdentifierProperty:
+		_, err = header.SubscriptionIdentifier.Decode(value)
+	case ContentTypeProperty:
+		_, err = header.ContentType.Decode(value)
+	default:
+		err = codec.DecodeErr(header, fmt.Sprintf("property not allowed in PUBLISH: %x", byte(identifier)))
+	}
+	return err
+}
+
+// EncodeProperties sets PropertiesRaw from the property fields, properties
+// with a zero value are left out.
+func (header *PublishVariableHeader) EncodeProperties() error {
+	properties := []byte{}
+	var err error
+
+	if header.PayloadFormatIndicator != UnspecifiedBytes {
+		properties = append(properties, byte(PayloadFormatIndicatorProperty), byte(header.PayloadFormatIndicator))
+	}
+	if header.MessageExpiryInterval.Value > 0 {
+		header.MessageExpiryInterval.Size = 4
+		properties, err = encodeProperty(properties, MessageExpiryIntervalProperty, &header.MessageExpiryInterval)
+		if err != nil {
+			return err
+		}
+	}
+	if header.TopicAlias.Value > 0 {
+		header.TopicAlias.Size = 2
+		properties, err = encodeProperty(properties, TopicAliasProperty, &header.TopicAlias)
+		if err != nil {
+			return err
+		}
+	}
+	if header.ResponseTopic.Str != "" {
+		properties, err = encodeProperty(properties, ResponseTopicProperty, &header.ResponseTopic)
+		if err != nil {
+			return err
+		}
+	}
+	if len(header.CorrelationData.Data) > 0 {
+		properties, err = encodeProperty(properties, CorrelationDataProperty, &header.CorrelationData)
+		if err != nil {
+			return err
+		}
+	}
+	for i := range header.UserProperties {
+		properties, err = encodeProperty(properties, UserPropertyProperty, &header.UserProperties[i])
+		if err != nil {
+			return err
+		}
+	}
+	if header.SubscriptionIdentifier.Value > 0 {
+		properties, err = encodeProperty(properties, SubscriptionIdentifierProperty, &header.SubscriptionIdentifier)
+		if err != nil {
+			return err
+		}
+	}
+	if header.ContentType.Str != "" {
+		properties, err = encodeProperty(properties, ContentTypeProperty, &header.ContentType)
+		if err != nil {
+			return err
+		}
+	}
+
+	header.PropertiesRaw = properties
+	return nil
+}
+
 func (packet *PublishPacket) Encode() ([]byte, error) {
 	bytes := []byte{}
 
@@ -124,14 +219,14 @@ func (packet *PublishPacket) Encode() ([]byte, error) {
 		bytes = append(bytes, b...)
 	}
 
-	if packet.VariableHeader.PropertyLength.Value > 0 || len(packet.Payload.Data) > 0 {
-		b, err = packet.VariableHeader.PropertyLength.Encode()
-		if err != nil {
-			return nil, err
-		}
-		bytes = append(bytes, b...)
-		bytes = append(bytes, packet.VariableHeader.PropertiesRaw...)
+	// The property length is always present, also when there are no properties.
+	packet.VariableHeader.PropertyLength.Value = int32(len(packet.VariableHeader.PropertiesRaw))
+	b, err = packet.VariableHeader.PropertyLength.Encode()
+	if err != nil {
+		return nil, err
 	}
+	bytes = append(bytes, b...)
+	bytes = append(bytes, packet.VariableHeader.PropertiesRaw...)
 
 	if len(packet.Payload.Data) > 0 {
 		bytes = append(bytes, packet.Payload.Data...)
@@ -3,6 +3,7 @@ package packet
 import (
 	"fmt"
 
+	"github.com/DvdSpijker/GoBroker/codec"
 	"github.com/DvdSpijker/GoBroker/types"
 )
 
@@ -45,31 +46,36 @@ func (packet *SubackPacket) String() string {
 }
 
 func (packet *SubackPacket) Encode() ([]byte, error) {
+	return encodeSuback(&packet.FixedHeader, SUBACK, SUBACKFLAGS, &packet.VariableHeader, &packet.Payload)
+}
+
+func (packet *SubackPacket) Decode(input []byte) (int, error) {
+	return decodeSuback(packet, input, &packet.FixedHeader, &packet.VariableHeader, &packet.Payload)
+}
+
+func encodeSuback(fixedHeader *FixedHeader, packetType PacketType, flags PacketFlag, header *SubackVariableHeader, payload *SubackPayload) ([]byte, error) {
 	bytes := []byte{}
-	packet.FixedHeader.PacketType = SUBACK
-	packet.FixedHeader.Flags = 0
+	fixedHeader.PacketType = packetType
+	fixedHeader.Flags = flags
 
-	packet.VariableHeader.PropertyLength.Value = 0
-	b, err := packet.VariableHeader.Encode()
+	header.PropertyLength.Value = 0
+	b, err := header.Encode()
 	if err != nil {
 		return nil, err
 	}
 
 	bytes = append(bytes, b...)
 
-	b, err = packet.Payload.Encode()
+	b, err = payload.Encode()
 	if err != nil {
 		return nil, err
 	}
 
 	bytes = append(bytes, b...)
 
-	packet.FixedHeader.RemainingLength.Value = int32(len(bytes))
+	fixedHeader.RemainingLength.Value = int32(len(bytes))
 
-	fmt.Printf("suback payload: %x\n", b)
-	fmt.Println("rem length", packet.FixedHeader.RemainingLength.Value)
-
-	b, err = packet.FixedHeader.Encode()
+	b, err = fixedHeader.Encode()
 	if err != nil {
 		return nil, err
 	}
@@ -77,6 +83,58 @@ func (packet *SubackPacket) Encode() ([]byte, error) {
 	return append(b, bytes...), nil
 }
 
+// decodeSuback decodes a SUBACK or UNSUBACK packet, the payload holds a
+// reason code for every filter of the request.
+func decodeSuback(packet any, input []byte, fixedHeader *FixedHeader, header *SubackVariableHeader, payload *SubackPayload) (int, error) {
+	n, err := fixedHeader.Decode(input)
+	if err != nil {
+		return 0, err
+	}
+	input = input[n:]
+
+	remainingLength := int(fixedHeader.RemainingLength.Value)
+	if remainingLength > len(input) {
+		return 0, codec.DecodeErr(packet, "remaining length exceeds packet length")
+	}
+	input = input[:remainingLength]
+
+	header.PacketIdentifier.Size = 2
+	m, err := header.PacketIdentifier.Decode(input)
+	if err != nil {
+		return 0, fmt.Errorf("packet identifier: %w", err)
+	}
+	input = input[m:]
+
+	m, err = header.PropertyLength.Decode(input)
+	if err != nil {
+		return 0, fmt.Errorf("property length: %w", err)
+	}
+	input = input[m:]
+
+	propertyLength := int(header.PropertyLength.Value)
+	if propertyLength > len(input) {
+		return 0, codec.DecodeErr(packet, "property length exceeds packet length")
+	}
+	err = decodeProperties(input[:propertyLength], func(identifier PropertyIdentifier, value []byte) error {
+		if identifier == ReasonStringProperty {
+			_, err := header.ReasonString.Decode(value)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	input = input[propertyLength:]
+
+	payload.ReasonCodes = make([]ReasonCode, len(input))
+	for i, reasonCode := range input {
+		payload.ReasonCodes[i] = ReasonCode(reasonCode)
+	}
+
+	return n + remainingLength, nil
+}
+
 func (header *SubackVariableHeader) Encode() ([]byte, error) {
 	bytes := []byte{}
 
@@ -88,14 +146,13 @@ func (header *SubackVariableHeader) Encode() ([]byte, error) {
 
 	bytes = append(bytes, b...)
 
+	// 3.9.2.1: The property length is always present.
 	header.PropertyLength.Value = 0 // TODO: Allow properties to be set.
-	if header.PropertyLength.Value > 0 {
-		b, err = header.PropertyLength.Encode()
-		if err != nil {
-			return nil, err
-		}
-		bytes = append(bytes, b...)
+	b, err = header.PropertyLength.Encode()
+	if err != nil {
+		return nil, err
 	}
+	bytes = append(bytes, b...)
 
 	return bytes, nil
 }
@@ -3,6 +3,7 @@ package packet
 import (
 	"fmt"
 
+	"github.com/DvdSpijker/GoBroker/codec"
 	"github.com/DvdSpijker/GoBroker/types"
 )
 
@@ -28,6 +29,53 @@ type (
 	}
 )
 
+func (packet *SubscribePacket) Encode() ([]byte, error) {
+	packet.VariableHeader.PacketIdentifier.Size = 2
+	bytes, err := packet.VariableHeader.PacketIdentifier.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	properties := []byte{}
+	if packet.VariableHeader.SubscriptionIdentifier.Value > 0 {
+		properties, err = encodeProperty(properties, SubscriptionIdentifierProperty, &packet.VariableHeader.SubscriptionIdentifier)
+		if err != nil {
+			return nil, fmt.Errorf("subscription identifier: %w", err)
+		}
+	}
+	if packet.VariableHeader.UserProperty.Name.Str != "" {
+		properties, err = encodeProperty(properties, UserPropertyProperty, &packet.VariableHeader.UserProperty)
+		if err != nil {
+			return nil, fmt.Errorf("user property: %w", err)
+		}
+	}
+	packet.VariableHeader.PropertyLength.Value = int32(len(properties))
+	b, err := encodeProperties(properties)
+	if err != nil {
+		return nil, err
+	}
+	bytes = append(bytes, b...)
+
+	for _, filter := range packet.Payload.Filters {
+		b, err = filter.TopicFilter.Encode()
+		if err != nil {
+			return nil, fmt.Errorf("topic filter: %w", err)
+		}
+		bytes = append(bytes, b...)
+		bytes = append(bytes, filter.SubscriptionOptions)
+	}
+
+	packet.FixedHeader.PacketType = SUBSCRIBE
+	packet.FixedHeader.Flags = SUBSCRIBEFLAGS
+	packet.FixedHeader.RemainingLength.Value = int32(len(bytes))
+	b, err = packet.FixedHeader.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(b, bytes...), nil
+}
+
 func (packet *SubscribePacket) Decode(input []byte) (int, error) {
 	n, err := packet.FixedHeader.Decode(input)
 	if err != nil {
@@ -39,28 +87,47 @@ func (packet *SubscribePacket) Decode(input []byte) (int, error) {
 	packet.VariableHeader.PacketIdentifier.Size = 2
 	n, err = packet.VariableHeader.PacketIdentifier.Decode(input)
 	if err != nil {
-		fmt.Println("failed to parse packet identifier")
-		return 0, err
+		return 0, fmt.Errorf("packet identifier: %w", err)
 	}
 
 	input = input[n:]
 
 	n, err = packet.VariableHeader.PropertyLength.Decode(input)
-	// TODO: Parse properties
-	fmt.Printf("property length: %d\n", packet.VariableHeader.PropertyLength.Value)
-	input = input[n+int(packet.VariableHeader.PropertyLength.Value):]
+	if err != nil {
+		return 0, fmt.Errorf("property length: %w", err)
+	}
+
+	input = input[n:]
+
+	propertyLength := int(packet.VariableHeader.PropertyLength.Value)
+	if propertyLength > len(input) {
+		return 0, codec.DecodeErr(packet, "property length exceeds packet length")
+	}
+	err = decodeProperties(input[:propertyLength], func(identifier PropertyIdentifier, value []byte) error {
+		var err error
+		switch identifier {
+		case SubscriptionIdentifierProperty:
+			_, err = packet.VariableHeader.SubscriptionIdentifier.Decode(value)
+		case UserPropertyProperty:
+			_, err = packet.VariableHeader.UserProperty.Decode(value)
+		default:
+			err = codec.DecodeErr(packet, fmt.Sprintf("property not allowed in SUBSCRIBE: %x", byte(identifier)))
+		}
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("properties: %w", err)
+	}
+
+	input = input[propertyLength:]
 
-	fmt.Printf("input: %x\n", input)
 	tpfs, n, err := parseSubscribePayload(input)
 	if err != nil {
-		fmt.Println("failed to parse subscribe payload")
-		return 0, err
+		return 0, fmt.Errorf("subscribe payload: %w", err)
 	}
 
 	packet.Payload.Filters = tpfs
 
-	fmt.Printf("subscribe packet topic filter: %v\n", tpfs)
-
 	return 0, nil
 }
 
@@ -71,8 +138,7 @@ func parseSubscribePayload(input []byte) ([]TopicFilterPair, int, error) {
 		tpf := TopicFilterPair{}
 		n, err := tpf.TopicFilter.Decode(input)
 		if err != nil {
-			fmt.Println("failed to parse topic filter")
-			return nil, 0, err
+			return nil, 0, fmt.Errorf("topic filter: %w", err)
 		}
 
 		input = input[n:]
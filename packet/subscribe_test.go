@@ -0,0 +1,63 @@
+package packet
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+func TestSubscribeRoundTrip(t *testing.T) {
+	subscribeCases := []struct {
+		name                   string
+		subscriptionIdentifier int32
+		userProperty           types.UtfStringPair
+	}{
+		{name: "no properties"},
+		{name: "subscription identifier", subscriptionIdentifier: 268435455},
+		{name: "user property", userProperty: types.UtfStringPair{
+			Name:  types.UtfString{Str: "region"},
+			Value: types.UtfString{Str: "eu"},
+		}},
+		{name: "all properties", subscriptionIdentifier: 42, userProperty: types.UtfStringPair{
+			Name:  types.UtfString{Str: "region"},
+			Value: types.UtfString{Str: "eu"},
+		}},
+	}
+
+	for _, c := range subscribeCases {
+		t.Run(c.name, func(t *testing.T) {
+			subscribePacket := SubscribePacket{}
+			subscribePacket.VariableHeader.PacketIdentifier.Value = 7
+			subscribePacket.VariableHeader.SubscriptionIdentifier.Value = c.subscriptionIdentifier
+			subscribePacket.VariableHeader.UserProperty = c.userProperty
+			subscribePacket.Payload.Filters = []TopicFilterPair{
+				{TopicFilter: types.UtfString{Str: "a/+"}, SubscriptionOptions: 1},
+				{TopicFilter: types.UtfString{Str: "b/#"}, SubscriptionOptions: 2},
+			}
+			bytes, err := subscribePacket.Encode()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decoded := SubscribePacket{}
+			_, err = decoded.Decode(bytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded.VariableHeader.PacketIdentifier.Value != 7 {
+				t.Fatalf("wanted packet identifier 7 but got %d", decoded.VariableHeader.PacketIdentifier.Value)
+			}
+			if decoded.VariableHeader.SubscriptionIdentifier.Value != c.subscriptionIdentifier {
+				t.Fatalf("wanted subscription identifier %d but got %d", c.subscriptionIdentifier, decoded.VariableHeader.SubscriptionIdentifier.Value)
+			}
+			if decoded.VariableHeader.UserProperty.Name.Str != c.userProperty.Name.Str ||
+				decoded.VariableHeader.UserProperty.Value.Str != c.userProperty.Value.Str {
+				t.Fatalf("wanted user property %v but got %v", c.userProperty, decoded.VariableHeader.UserProperty)
+			}
+			if !reflect.DeepEqual(decoded.Payload.Filters, subscribePacket.Payload.Filters) {
+				t.Fatalf("wanted filters %v but got %v", subscribePacket.Payload.Filters, decoded.Payload.Filters)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package packet
+
+// NoSubscriptionExisted is sent in an UNSUBACK for a filter the client was
+// not subscribed to (3.11.3).
+const NoSubscriptionExisted ReasonCode = 0x11
+
+type (
+	// UnsubackPacket acknowledges an UNSUBSCRIBE with a reason code for
+	// every filter (3.11). It has the same layout as SUBACK.
+	UnsubackPacket struct {
+		FixedHeader    FixedHeader
+		VariableHeader SubackVariableHeader
+		Payload        SubackPayload
+	}
+)
+
+func (packet *UnsubackPacket) Encode() ([]byte, error) {
+	return encodeSuback(&packet.FixedHeader, UNSUBACK, UNSUBACKFLAGS, &packet.VariableHeader, &packet.Payload)
+}
+
+func (packet *UnsubackPacket) Decode(input []byte) (int, error) {
+	return decodeSuback(packet, input, &packet.FixedHeader, &packet.VariableHeader, &packet.Payload)
+}
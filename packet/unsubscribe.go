@@ -22,6 +22,39 @@ type (
 	}
 )
 
+func (packet *UnsubscribePacket) Encode() ([]byte, error) {
+	packet.VariableHeader.PacketIdentifier.Size = 2
+	bytes, err := packet.VariableHeader.PacketIdentifier.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	packet.VariableHeader.PropertyLength.Value = 0
+	b, err := encodeProperties(nil)
+	if err != nil {
+		return nil, err
+	}
+	bytes = append(bytes, b...)
+
+	for _, filter := range packet.Payload.Filters {
+		b, err = filter.TopicFilter.Encode()
+		if err != nil {
+			return nil, fmt.Errorf("topic filter: %w", err)
+		}
+		bytes = append(bytes, b...)
+	}
+
+	packet.FixedHeader.PacketType = UNSUBSCRIBE
+	packet.FixedHeader.Flags = UNSUBSCRIBEFLAGS
+	packet.FixedHeader.RemainingLength.Value = int32(len(bytes))
+	b, err = packet.FixedHeader.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(b, bytes...), nil
+}
+
 func (packet *UnsubscribePacket) Decode(input []byte) (int, error) {
 	n, err := packet.FixedHeader.Decode(input)
 	if err != nil {
@@ -33,28 +66,22 @@ func (packet *UnsubscribePacket) Decode(input []byte) (int, error) {
 	packet.VariableHeader.PacketIdentifier.Size = 2
 	n, err = packet.VariableHeader.PacketIdentifier.Decode(input)
 	if err != nil {
-		fmt.Println("failed to parse packet identifier")
-		return 0, err
+		return 0, fmt.Errorf("packet identifier: %w", err)
 	}
 
 	input = input[n:]
 
 	n, err = packet.VariableHeader.PropertyLength.Decode(input)
 	// TODO: Parse properties
-	fmt.Printf("property length: %d\n", packet.VariableHeader.PropertyLength.Value)
 	input = input[n+int(packet.VariableHeader.PropertyLength.Value):]
 
-	fmt.Printf("input: %x\n", input)
 	tpfs, n, err := parseUnsubscribePayload(input)
 	if err != nil {
-		fmt.Println("failed to parse subscribe payload")
-		return 0, err
+		return 0, fmt.Errorf("unsubscribe payload: %w", err)
 	}
 
 	packet.Payload.Filters = tpfs
 
-	fmt.Printf("unsubscribe packet topic filter: %v\n", tpfs)
-
 	return 0, nil
 }
 
@@ -65,8 +92,7 @@ func parseUnsubscribePayload(input []byte) ([]TopicFilterPair, int, error) {
 		tpf := TopicFilterPair{}
 		n, err := tpf.TopicFilter.Decode(input)
 		if err != nil {
-			fmt.Println("failed to parse topic filter")
-			return nil, 0, err
+			return nil, 0, fmt.Errorf("topic filter: %w", err)
 		}
 
 		input = input[n:]
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/DvdSpijker/GoBroker/auth"
+	"golang.org/x/term"
+)
+
+const passwdUsage = `Usage: %s passwd [flags] <password file> <command>
+
+Manages a password file used for username/password authentication.
+
+Commands:
+  add <user>  add a user or change the password of an existing user
+  rm <user>   remove a user
+  rehash      hash plain text passwords, written as user:password, in the file
+
+The password is read from the terminal, or from standard input if it is not a terminal.
+With -scram passwords are stored as SCRAM-SHA-256 credentials instead of bcrypt hashes,
+which lets users authenticate with SCRAM as well as with a password.
+
+Flags:
+`
+
+// runPasswd implements the passwd subcommand and returns the exit code.
+func runPasswd(args []string) int {
+	flags := flag.NewFlagSet("passwd", flag.ExitOnError)
+	cost := flags.Int("cost", auth.DefaultCost, "bcrypt cost")
+	scram := flags.Bool("scram", false, "store SCRAM-SHA-256 credentials instead of bcrypt hashes")
+	iterations := flags.Int("iterations", auth.DefaultSCRAMIterations, "SCRAM iteration count")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), passwdUsage, os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() < 2 {
+		flags.Usage()
+		return 2
+	}
+
+	path := flags.Arg(0)
+	command := flags.Arg(1)
+
+	hasher := auth.BcryptHasher(*cost)
+	if *scram {
+		hasher = auth.SCRAMHasher(*iterations)
+	}
+
+	err := passwd(path, command, flags.Args()[2:], hasher)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func passwd(path string, command string, args []string, hasher auth.Hasher) error {
+	entries, err := auth.ReadPasswordEntries(path)
+	if errors.Is(err, fs.ErrNotExist) && command == "add" {
+		entries = []auth.PasswordEntry{}
+	} else if err != nil {
+		return err
+	}
+
+	switch command {
+	case "add":
+		if len(args) != 1 {
+			return errors.New("add needs a user name")
+		}
+		password, err := readPassword(os.Stdin)
+		if err != nil {
+			return err
+		}
+		entries, err = auth.SetPassword(entries, args[0], password, hasher)
+		if err != nil {
+			return err
+		}
+
+	case "rm":
+		if len(args) != 1 {
+			return errors.New("rm needs a user name")
+		}
+		entries, err = auth.RemoveUser(entries, args[0])
+		if err != nil {
+			return err
+		}
+
+	case "rehash":
+		rehashed, err := auth.Rehash(entries, hasher)
+		if err != nil {
+			return err
+		}
+		for _, userName := range rehashed {
+			fmt.Println("hashed password of", userName)
+		}
+
+	default:
+		return fmt.Errorf("unknown command: %s", command)
+	}
+
+	return auth.WritePasswordEntries(path, entries)
+}
+
+// readPassword asks for the password twice on a terminal, otherwise it reads
+// the first line of r.
+func readPassword(r *os.File) ([]byte, error) {
+	fd := int(r.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(r).ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		password := bytes.TrimRight(line, "\r\n")
+		if len(password) == 0 {
+			return nil, errors.New("empty password")
+		}
+		return password, nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if len(password) == 0 {
+		return nil, errors.New("empty password")
+	}
+
+	fmt.Fprint(os.Stderr, "Repeat password: ")
+	repeated, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(password, repeated) {
+		return nil, errors.New("passwords do not match")
+	}
+
+	return password, nil
+}
@@ -34,25 +34,39 @@ func NewPacketIdentifier() types.UnsignedInt {
 	return id
 }
 
-func MakeSuback(subscribePacket *packet.SubscribePacket) *packet.SubackPacket {
+// MakeSuback creates a SUBACK with a reason code for every filter of the
+// SUBSCRIBE packet, in the same order.
+func MakeSuback(subscribePacket *packet.SubscribePacket, reasonCodes []packet.ReasonCode) *packet.SubackPacket {
 	subackPacket := packet.SubackPacket{
 		VariableHeader: packet.SubackVariableHeader{
 			PacketIdentifier: subscribePacket.VariableHeader.PacketIdentifier,
 		},
 		Payload: packet.SubackPayload{
-			ReasonCodes: []packet.ReasonCode{
-				packet.GrantedQoS0,
-			},
+			ReasonCodes: reasonCodes,
 		},
 	}
 
 	return &subackPacket
 }
 
-func MakePuback(publishPacket *packet.PublishPacket) *packet.PubackPacket {
+func MakeUnsuback(unsubscribePacket *packet.UnsubscribePacket, reasonCodes []packet.ReasonCode) *packet.UnsubackPacket {
+	unsubackPacket := packet.UnsubackPacket{
+		VariableHeader: packet.SubackVariableHeader{
+			PacketIdentifier: unsubscribePacket.VariableHeader.PacketIdentifier,
+		},
+		Payload: packet.SubackPayload{
+			ReasonCodes: reasonCodes,
+		},
+	}
+
+	return &unsubackPacket
+}
+
+func MakePuback(publishPacket *packet.PublishPacket, reasonCode packet.ReasonCode) *packet.PubackPacket {
 	pubackPacket := packet.PubackPacket{
 		VariableHeader: packet.PubackVariableHeader{
 			PacketIdentifer: publishPacket.VariableHeader.PacketIdentifier,
+			ReasonCode:      reasonCode,
 		},
 	}
 
@@ -61,6 +75,58 @@ func MakePuback(publishPacket *packet.PublishPacket) *packet.PubackPacket {
 	return &pubackPacket
 }
 
+// MakePubrec acknowledges the receipt of a QoS 2 PUBLISH packet.
+func MakePubrec(publishPacket *packet.PublishPacket, reasonCode packet.ReasonCode) *packet.PubrecPacket {
+	return &packet.PubrecPacket{
+		VariableHeader: packet.PubackVariableHeader{
+			PacketIdentifer: publishPacket.VariableHeader.PacketIdentifier,
+			ReasonCode:      reasonCode,
+		},
+	}
+}
+
+// MakePubrel releases the packet identifier of an acknowledged QoS 2 PUBLISH packet.
+func MakePubrel(packetIdentifier uint16, reasonCode packet.ReasonCode) *packet.PubrelPacket {
+	return &packet.PubrelPacket{
+		VariableHeader: packet.PubackVariableHeader{
+			PacketIdentifer: types.UnsignedInt{Value: uint32(packetIdentifier), Size: 2},
+			ReasonCode:      reasonCode,
+		},
+	}
+}
+
+// MakePubcomp completes the QoS 2 delivery of a released packet identifier.
+func MakePubcomp(packetIdentifier uint16, reasonCode packet.ReasonCode) *packet.PubcompPacket {
+	return &packet.PubcompPacket{
+		VariableHeader: packet.PubackVariableHeader{
+			PacketIdentifer: types.UnsignedInt{Value: uint32(packetIdentifier), Size: 2},
+			ReasonCode:      reasonCode,
+		},
+	}
+}
+
+func MakePublishPacket(topic string, payload []byte, qos types.QoS, retain bool) *packet.PublishPacket {
+	pub := packet.PublishPacket{
+		FixedHeader: packet.PublishFixedHeader{
+			CommonFixedHeader: packet.FixedHeader{
+				PacketType: packet.PUBLISH,
+				Flags:      packet.PublishPacketFlags(qos, false, retain),
+			},
+			Qos:    qos,
+			Retain: retain,
+		},
+		VariableHeader: packet.PublishVariableHeader{
+			TopicName:        types.UtfString{Str: topic},
+			PacketIdentifier: NewPacketIdentifier(),
+			PropertyLength:   types.VariableByteInteger{Value: 0},
+			PropertiesRaw:    []byte{},
+		},
+		Payload: packet.PublishPayload{Data: payload},
+	}
+
+	return &pub
+}
+
 func MakeLastWillPublishPacket(lastWill *LastWill) *packet.PublishPacket {
 	pub := packet.PublishPacket{
 		FixedHeader: packet.PublishFixedHeader{
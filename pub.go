@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	"github.com/DvdSpijker/GoBroker/client"
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+const pubUsage = `Usage: %s pub [flags] -topic <topic> (-message <payload> | -file <file> | -stdin)
+
+Publishes a message to one or more topics and waits until the broker acknowledged it.
+
+Flags:
+`
+
+// runPub implements the pub subcommand and returns the exit code.
+func runPub(args []string, stdin io.Reader, stderr io.Writer) int {
+	var (
+		topics         stringsFlag
+		userProperties userPropertyFlag
+	)
+	flags := flag.NewFlagSet("pub", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	clientFlags := addClientFlags(flags)
+	flags.Var(&topics, "topic", "`topic` to publish to, can be repeated")
+	message := flags.String("message", "", "`payload` of the message")
+	file := flags.String("file", "", "`file` with the payload of the message")
+	readStdin := flags.Bool("stdin", false, "read the payload from standard input")
+	retain := flags.Bool("retain", false, "retain the message")
+	expiry := flags.Duration("expiry", 0, "message expiry `interval`, the message does not expire by default")
+	contentType := flags.String("content-type", "", "content `type` of the payload")
+	utf8Payload := flags.Bool("utf8", false, "mark the payload as UTF-8 text")
+	flags.Var(&userProperties, "user-property", "user property as `name=value`, can be repeated")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), pubUsage, os.Args[0])
+		flags.PrintDefaults()
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+
+	payloads := 0
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "message", "file", "stdin":
+			payloads++
+		}
+	})
+	if len(topics) == 0 || payloads != 1 || flags.NArg() > 0 {
+		flags.Usage()
+		return 2
+	}
+
+	options, err := clientFlags.options()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	var payload []byte
+	switch {
+	case *file != "":
+		payload, err = os.ReadFile(*file)
+	case *readStdin:
+		payload, err = io.ReadAll(stdin)
+	default:
+		payload = []byte(*message)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err = publish(ctx, options, topics, client.Message{
+		Payload: payload,
+		QoS:     types.QoS(*clientFlags.qos),
+		Retain:  *retain,
+		Properties: client.Properties{
+			UTF8Payload:           *utf8Payload,
+			MessageExpiryInterval: *expiry,
+			ContentType:           *contentType,
+			UserProperties:        userProperties,
+		},
+	})
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// publish publishes message to every topic in topics.
+func publish(ctx context.Context, options client.Options, topics []string, message client.Message) error {
+	c, err := connect(ctx, options)
+	if err != nil {
+		return err
+	}
+
+	for _, topic := range topics {
+		message.Topic = topic
+		err = c.PublishMessage(ctx, message)
+		if err != nil {
+			err = fmt.Errorf("publish to %s: %w", topic, err)
+			break
+		}
+	}
+
+	return errors.Join(err, c.Disconnect(ctx))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DvdSpijker/GoBroker/broker"
+)
+
+// startBroker serves a broker with a listener of listenerType on a local
+// port and returns the broker and its host and port.
+func startBroker(t *testing.T, listenerType broker.ListenerType) (*broker.Server, string, string) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := broker.NewServer(broker.Config{})
+	go server.ServeListener(ln, broker.ListenerConfig{Type: listenerType})
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Close(ctx)
+	})
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	return server, host, port
+}
+
+// startSub runs the sub subcommand with args until it subscribed to
+// filters filters. The exit code is sent on the returned channel.
+func startSub(t *testing.T, server *broker.Server, args []string, filters int, stdout *bytes.Buffer) chan int {
+	t.Helper()
+
+	stderr := &bytes.Buffer{}
+	exited := make(chan int, 1)
+	go func() { exited <- runSub(args, stdout, stderr) }()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(server.Subscriptions("")) < filters {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the subscriptions: %s", stderr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return exited
+}
+
+func waitForExit(t *testing.T, exited chan int) int {
+	t.Helper()
+
+	select {
+	case code := <-exited:
+		return code
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for sub to exit")
+	}
+	return 0
+}
+
+func TestPubSubJSON(t *testing.T) {
+	server, host, port := startBroker(t, broker.ListenerTCP)
+	stdout := &bytes.Buffer{}
+	exited := startSub(t, server, []string{
+		"-host", host, "-port", port, "-qos", "1",
+		"-topic", "a/#", "-topic", "b", "-format", "json", "-C", "2",
+	}, 2, stdout)
+
+	stderr := &bytes.Buffer{}
+	code := runPub([]string{
+		"-host", host, "-port", port, "-qos", "1",
+		"-topic", "a/1", "-topic", "b", "-message", "hello",
+		"-expiry", "1m", "-content-type", "text/plain", "-user-property", "k=v",
+	}, nil, stderr)
+	if code != 0 {
+		t.Fatalf("wanted pub to exit with 0 but got %d: %s", code, stderr)
+	}
+	if code := waitForExit(t, exited); code != 0 {
+		t.Fatalf("wanted sub to exit with 0 but got %d", code)
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for _, topic := range []string{"a/1", "b"} {
+		if !scanner.Scan() {
+			t.Fatalf("wanted the message to %s", topic)
+		}
+		message := jsonMessage{}
+		err := json.Unmarshal(scanner.Bytes(), &message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if message.Topic != topic || message.Payload == nil || *message.Payload != "hello" || message.QoS != 1 {
+			t.Fatalf("wanted the message to %s but got %s", topic, scanner.Bytes())
+		}
+		if message.MessageExpiryInterval != 60 || message.ContentType != "text/plain" ||
+			len(message.UserProperties) != 1 || message.UserProperties[0] != (jsonUserProperty{"k", "v"}) {
+			t.Fatalf("wanted the properties of the message but got %s", scanner.Bytes())
+		}
+	}
+}
+
+func TestPubSubStdinHex(t *testing.T) {
+	server, host, port := startBroker(t, broker.ListenerTCP)
+	stdout := &bytes.Buffer{}
+	exited := startSub(t, server, []string{
+		"-host", host, "-port", port, "-topic", "binary", "-format", "hex", "-verbose", "-C", "1",
+	}, 1, stdout)
+
+	stderr := &bytes.Buffer{}
+	code := runPub([]string{"-host", host, "-port", port, "-topic", "binary", "-stdin"},
+		bytes.NewReader([]byte{0x00, 0x01, 0xff}), stderr)
+	if code != 0 {
+		t.Fatalf("wanted pub to exit with 0 but got %d: %s", code, stderr)
+	}
+	if code := waitForExit(t, exited); code != 0 {
+		t.Fatalf("wanted sub to exit with 0 but got %d", code)
+	}
+
+	if stdout.String() != "binary 0001ff\n" {
+		t.Fatalf("wanted %q but got %q", "binary 0001ff\n", stdout)
+	}
+}
+
+var pubUsageErrorCases = [][]string{
+	{"-message", "no topic"},
+	{"-topic", "no/payload"},
+	{"-topic", "two/payloads", "-message", "a", "-stdin"},
+	{"-topic", "invalid/qos", "-message", "a", "-qos", "3"},
+	{"-topic", "invalid/property", "-message", "a", "-user-property", "name"},
+}
+
+func TestPubUsageErrors(t *testing.T) {
+	for _, args := range pubUsageErrorCases {
+		stderr := &bytes.Buffer{}
+		code := runPub(args, strings.NewReader(""), stderr)
+		if code != 2 {
+			t.Fatalf("%v: wanted exit code 2 but got %d", args, code)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// DefaultCompactionThreshold is the minimum number of stale records in the log
+// before it is compacted.
+const DefaultCompactionThreshold = 1000
+
+const (
+	logMagic = "GOBROKER LOG 1\n"
+
+	recordPut    byte = 1
+	recordDelete byte = 2
+
+	// Every record starts with the length and checksum of its body.
+	recordHeaderSize = 8
+)
+
+var ErrInvalidLog = errors.New("invalid log file")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type (
+	FileStoreOptions struct {
+		// Flush every write to disk before returning, so that no records are
+		// lost when the machine crashes. Without it only a crash of the
+		// process is survived.
+		Sync bool
+		// Number of stale records after which the log is compacted, as long
+		// as there are more stale than live records. 0 uses
+		// DefaultCompactionThreshold.
+		CompactionThreshold int
+	}
+
+	// FileStore is a Store that appends every change to a log file and keeps
+	// all records in memory. The log is compacted by rewriting it with only
+	// the live records once it mostly holds stale ones.
+	//
+	// Records are checksummed, a record that was partially written when the
+	// process crashed is discarded when the log is opened.
+	FileStore struct {
+		path    string
+		options FileStoreOptions
+
+		mutex   sync.Mutex
+		file    *os.File
+		size    int64 // Length of the log up to the end of the last record.
+		records map[string]map[string][]byte
+		live    int // Records in the log that are still current.
+		stale   int // Records in the log that were replaced or deleted.
+		closed  bool
+	}
+)
+
+// OpenFileStore opens the log at path, or creates it if it does not exist,
+// and reads all records from it.
+func OpenFileStore(path string, options FileStoreOptions) (*FileStore, error) {
+	if options.CompactionThreshold <= 0 {
+		options.CompactionThreshold = DefaultCompactionThreshold
+	}
+
+	// Left behind if the process crashed during a compaction, the log itself
+	// is only replaced once the compacted log is complete.
+	os.Remove(compactionPath(path))
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &FileStore{
+		path:    path,
+		options: options,
+		file:    file,
+		records: make(map[string]map[string][]byte),
+	}
+	err = store.read()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return store, nil
+}
+
+// read applies all records of the log. It truncates the log after the last
+// complete record.
+func (store *FileStore) read() error {
+	data, err := io.ReadAll(store.file)
+	if err != nil {
+		return err
+	}
+
+	if len(data) == 0 {
+		_, err = store.file.Write([]byte(logMagic))
+		if err != nil {
+			return err
+		}
+		store.size = int64(len(logMagic))
+		return store.sync()
+	}
+	if len(data) < len(logMagic) || string(data[:len(logMagic)]) != logMagic {
+		return ErrInvalidLog
+	}
+
+	offset := len(logMagic)
+	for offset+recordHeaderSize <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[offset:]))
+		checksum := binary.BigEndian.Uint32(data[offset+4:])
+		end := offset + recordHeaderSize + length
+		if end > len(data) {
+			break
+		}
+
+		body := data[offset+recordHeaderSize : end]
+		if crc32.Checksum(body, castagnoli) != checksum {
+			break
+		}
+		op, bucket, key, value, err := decodeRecord(body)
+		if err != nil {
+			break
+		}
+		store.apply(op, bucket, key, value)
+		offset = end
+	}
+
+	store.size = int64(offset)
+	if offset < len(data) {
+		return store.file.Truncate(store.size)
+	}
+	return nil
+}
+
+func (store *FileStore) Put(bucket string, key string, value []byte) error {
+	return store.write(recordPut, bucket, key, value)
+}
+
+func (store *FileStore) Delete(bucket string, key string) error {
+	return store.write(recordDelete, bucket, key, nil)
+}
+
+func (store *FileStore) write(op byte, bucket string, key string, value []byte) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.closed {
+		return ErrClosed
+	}
+
+	// Records are written with a single write, so that a crash leaves at
+	// most one partial record at the end of the log.
+	record := encodeRecord(op, bucket, key, value)
+	_, err := store.file.Write(record)
+	if err != nil {
+		// A partial record in the middle of the log would discard all
+		// records after it when the log is read, so it is removed.
+		truncateErr := store.file.Truncate(store.size)
+		if truncateErr != nil {
+			// Without a valid log nothing can be written anymore.
+			store.closed = true
+			store.file.Close()
+			return errors.Join(err, truncateErr)
+		}
+		return err
+	}
+	store.size += int64(len(record))
+	if store.options.Sync {
+		err = store.sync()
+		if err != nil {
+			return err
+		}
+	}
+	store.apply(op, bucket, key, value)
+
+	if store.stale >= store.options.CompactionThreshold && store.stale > store.live {
+		return store.compact()
+	}
+	return nil
+}
+
+// apply updates the records with a record from the log.
+func (store *FileStore) apply(op byte, bucket string, key string, value []byte) {
+	records := store.records[bucket]
+	_, exists := records[key]
+
+	switch op {
+	case recordPut:
+		if records == nil {
+			records = make(map[string][]byte)
+			store.records[bucket] = records
+		}
+		records[key] = append([]byte{}, value...)
+		if exists {
+			store.stale++
+		} else {
+			store.live++
+		}
+	case recordDelete:
+		// The delete record itself is stale as well.
+		store.stale++
+		if exists {
+			delete(records, key)
+			store.live--
+			store.stale++
+		}
+	}
+}
+
+func (store *FileStore) Load(fn func(bucket string, key string, value []byte) error) error {
+	type record struct {
+		bucket string
+		key    string
+		value  []byte
+	}
+
+	// fn is called without holding the lock, so that it can use the store.
+	store.mutex.Lock()
+	if store.closed {
+		store.mutex.Unlock()
+		return ErrClosed
+	}
+	records := make([]record, 0, store.live)
+	for bucket, values := range store.records {
+		for key, value := range values {
+			records = append(records, record{bucket: bucket, key: key, value: value})
+		}
+	}
+	store.mutex.Unlock()
+
+	for _, r := range records {
+		err := fn(r.bucket, r.key, r.value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compact rewrites the log with only the live records.
+func (store *FileStore) Compact() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.closed {
+		return ErrClosed
+	}
+	return store.compact()
+}
+
+func (store *FileStore) compact() error {
+	path := compactionPath(store.path)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	data := []byte(logMagic)
+	for bucket, values := range store.records {
+		for key, value := range values {
+			data = append(data, encodeRecord(recordPut, bucket, key, value)...)
+		}
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	// The rename atomically replaces the log with the compacted log.
+	err = os.Rename(path, store.path)
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	syncDir(filepath.Dir(store.path))
+
+	file, err = os.OpenFile(store.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		// Without a log nothing can be written anymore.
+		store.closed = true
+		store.file.Close()
+		return err
+	}
+	store.file.Close()
+	store.file = file
+	store.size = int64(len(data))
+	store.stale = 0
+
+	return nil
+}
+
+func (store *FileStore) Close() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if store.closed {
+		return ErrClosed
+	}
+	store.closed = true
+
+	err := store.sync()
+	return errors.Join(err, store.file.Close())
+}
+
+func (store *FileStore) sync() error {
+	return store.file.Sync()
+}
+
+func compactionPath(path string) string {
+	return path + ".tmp"
+}
+
+// syncDir flushes a directory to disk, so that a rename in it is durable.
+func syncDir(path string) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	dir.Sync()
+	dir.Close()
+}
+
+// encodeRecord encodes a record with its header. The body consists of the
+// operation, the length prefixed bucket and key, and the value.
+func encodeRecord(op byte, bucket string, key string, value []byte) []byte {
+	body := []byte{op}
+	body = binary.AppendUvarint(body, uint64(len(bucket)))
+	body = append(body, bucket...)
+	body = binary.AppendUvarint(body, uint64(len(key)))
+	body = append(body, key...)
+	body = append(body, value...)
+
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(body))
+	binary.BigEndian.PutUint32(record, uint32(len(body)))
+	binary.BigEndian.PutUint32(record[4:], crc32.Checksum(body, castagnoli))
+	return append(record, body...)
+}
+
+func decodeRecord(body []byte) (byte, string, string, []byte, error) {
+	if len(body) == 0 || (body[0] != recordPut && body[0] != recordDelete) {
+		return 0, "", "", nil, ErrInvalidLog
+	}
+	op := body[0]
+	body = body[1:]
+
+	fields := make([]string, 2)
+	for i := range fields {
+		length, n := binary.Uvarint(body)
+		if n <= 0 || uint64(len(body)-n) < length {
+			return 0, "", "", nil, ErrInvalidLog
+		}
+		fields[i] = string(body[n : n+int(length)])
+		body = body[n+int(length):]
+	}
+
+	return op, fields[0], fields[1], body, nil
+}
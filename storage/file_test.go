@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// load returns all records of a store as bucket/key: value.
+func load(t *testing.T, store Store) map[string]string {
+	t.Helper()
+
+	records := make(map[string]string)
+	err := store.Load(func(bucket string, key string, value []byte) error {
+		records[bucket+"/"+key] = string(value)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func openFileStore(t *testing.T, path string, options FileStoreOptions) *FileStore {
+	t.Helper()
+
+	store, err := OpenFileStore(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func expectRecords(t *testing.T, got map[string]string, want map[string]string) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("wanted %v but got %v", want, got)
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Fatalf("wanted %v but got %v", want, got)
+		}
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broker.log")
+	store := openFileStore(t, path, FileStoreOptions{Sync: true})
+
+	operations := []struct {
+		bucket string
+		key    string
+		value  string
+		delete bool
+	}{
+		{bucket: "retained", key: "a/b", value: "1"},
+		{bucket: "retained", key: "a/c", value: "2"},
+		{bucket: "sessions", key: "a/b", value: "session"},
+		{bucket: "retained", key: "a/b", value: "3"},
+		{bucket: "retained", key: "a/c", delete: true},
+		{bucket: "retained", key: "unknown", delete: true},
+		{bucket: "sessions", key: "", value: ""},
+	}
+	for _, operation := range operations {
+		var err error
+		if operation.delete {
+			err = store.Delete(operation.bucket, operation.key)
+		} else {
+			err = store.Put(operation.bucket, operation.key, []byte(operation.value))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string]string{"retained/a/b": "3", "sessions/a/b": "session", "sessions/": ""}
+	expectRecords(t, load(t, store), want)
+
+	err := store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Put("retained", "x", nil)
+	if !errors.Is(err, ErrClosed) {
+		t.Fatalf("wanted %v but got %v", ErrClosed, err)
+	}
+
+	store = openFileStore(t, path, FileStoreOptions{})
+	defer store.Close()
+	expectRecords(t, load(t, store), want)
+}
+
+func TestFileStorePartialRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broker.log")
+	store := openFileStore(t, path, FileStoreOptions{})
+	store.Put("retained", "a", []byte("complete"))
+	store.Close()
+
+	// A crash in the middle of writing a record.
+	record := encodeRecord(recordPut, "retained", "b", []byte("partial"))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(record[:len(record)-3])
+	file.Close()
+
+	store = openFileStore(t, path, FileStoreOptions{})
+	expectRecords(t, load(t, store), map[string]string{"retained/a": "complete"})
+
+	// The partial record is removed, so new records can be read.
+	store.Put("retained", "c", []byte("after"))
+	store.Close()
+
+	store = openFileStore(t, path, FileStoreOptions{})
+	defer store.Close()
+	expectRecords(t, load(t, store), map[string]string{"retained/a": "complete", "retained/c": "after"})
+}
+
+func TestFileStoreFailedWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broker.log")
+	store := openFileStore(t, path, FileStoreOptions{})
+	store.Put("retained", "a", []byte("before"))
+
+	// Writes to a read-only log fail, and so does removing what they wrote.
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.file.Close()
+	store.file = file
+
+	err = store.Put("retained", "b", []byte("failed"))
+	if err == nil {
+		t.Fatal("wanted the write to fail")
+	}
+	err = store.Put("retained", "c", []byte("after"))
+	if !errors.Is(err, ErrClosed) {
+		t.Fatalf("wanted %v but got %v", ErrClosed, err)
+	}
+
+	store = openFileStore(t, path, FileStoreOptions{})
+	defer store.Close()
+	expectRecords(t, load(t, store), map[string]string{"retained/a": "before"})
+}
+
+func TestFileStoreCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broker.log")
+	store := openFileStore(t, path, FileStoreOptions{})
+	store.Put("retained", "a", []byte("first"))
+	store.Put("retained", "b", []byte("second"))
+	store.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xFF
+	err = os.WriteFile(path, data, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store = openFileStore(t, path, FileStoreOptions{})
+	defer store.Close()
+	expectRecords(t, load(t, store), map[string]string{"retained/a": "first"})
+}
+
+func TestFileStoreCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broker.log")
+	store := openFileStore(t, path, FileStoreOptions{CompactionThreshold: 10})
+
+	for i := 0; i < 100; i++ {
+		err := store.Put("queue", "client", []byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Put("queue", "other", []byte("kept"))
+	store.Delete("queue", "client")
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 100 records of at least 20 bytes would not fit without compaction.
+	if info.Size() > 1000 {
+		t.Fatalf("wanted the log to be compacted but it is %d bytes", info.Size())
+	}
+	store.Close()
+
+	store = openFileStore(t, path, FileStoreOptions{})
+	defer store.Close()
+	expectRecords(t, load(t, store), map[string]string{"queue/other": "kept"})
+}
+
+func TestFileStoreInvalidLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broker.log")
+	err := os.WriteFile(path, []byte("not a log"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenFileStore(path, FileStoreOptions{})
+	if !errors.Is(err, ErrInvalidLog) {
+		t.Fatalf("wanted %v but got %v", ErrInvalidLog, err)
+	}
+}
@@ -0,0 +1,19 @@
+// Package storage persists broker state, such as sessions and retained
+// messages, so that it survives a restart.
+package storage
+
+import "errors"
+
+var ErrClosed = errors.New("store closed")
+
+// Store persists records identified by a bucket and a key. Writing a record
+// with an existing bucket and key replaces it. Stores are safe for
+// concurrent use.
+type Store interface {
+	Put(bucket string, key string, value []byte) error
+	Delete(bucket string, key string) error
+	// Load calls fn for every stored record, in no particular order. Loading
+	// stops at the first error returned by fn.
+	Load(fn func(bucket string, key string, value []byte) error) error
+	Close() error
+}
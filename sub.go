@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"time"
+	"unicode/utf8"
+
+	"github.com/DvdSpijker/GoBroker/client"
+	"github.com/DvdSpijker/GoBroker/types"
+)
+
+const subUsage = `Usage: %s sub [flags] -topic <filter>
+
+Subscribes to one or more topic filters and writes the received messages to standard output,
+until -C messages were received or it is interrupted.
+
+Output formats:
+  raw   the payload followed by a newline
+  hex   the payload in hexadecimal followed by a newline
+  json  one JSON object per line with the topic, payload and properties of the message;
+        the payload is text if it is valid UTF-8, otherwise it is base64 encoded as payload_base64
+
+Flags:
+`
+
+// Output formats of the sub subcommand.
+const (
+	formatRaw  = "raw"
+	formatHex  = "hex"
+	formatJSON = "json"
+)
+
+// errCountReached stops the sub subcommand after -C messages.
+var errCountReached = errors.New("message count reached")
+
+type (
+	// jsonMessage is a received message in the JSON output format.
+	jsonMessage struct {
+		Time                  time.Time          `json:"time"`
+		Topic                 string             `json:"topic"`
+		QoS                   types.QoS          `json:"qos"`
+		Retain                bool               `json:"retain"`
+		Duplicate             bool               `json:"duplicate,omitempty"`
+		Payload               *string            `json:"payload,omitempty"`
+		PayloadBase64         []byte             `json:"payload_base64,omitempty"`
+		UTF8Payload           bool               `json:"utf8_payload,omitempty"`
+		MessageExpiryInterval int64              `json:"message_expiry_interval,omitempty"` // Seconds.
+		ContentType           string             `json:"content_type,omitempty"`
+		ResponseTopic         string             `json:"response_topic,omitempty"`
+		CorrelationData       []byte             `json:"correlation_data,omitempty"`
+		UserProperties        []jsonUserProperty `json:"user_properties,omitempty"`
+	}
+
+	jsonUserProperty struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+)
+
+// runSub implements the sub subcommand and returns the exit code.
+func runSub(args []string, stdout io.Writer, stderr io.Writer) int {
+	var topics stringsFlag
+	flags := flag.NewFlagSet("sub", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	clientFlags := addClientFlags(flags)
+	flags.Var(&topics, "topic", "topic `filter` to subscribe to, can be repeated")
+	count := flags.Int("C", 0, "exit after `count` messages, 0 runs until interrupted")
+	format := flags.String("format", formatRaw, "output `format`: raw, hex or json")
+	verbose := flags.Bool("verbose", false, "write the topic before the payload in the raw and hex formats")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), subUsage, os.Args[0])
+		flags.PrintDefaults()
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if len(topics) == 0 || *count < 0 || flags.NArg() > 0 {
+		flags.Usage()
+		return 2
+	}
+
+	options, err := clientFlags.options()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	write, err := messageWriter(stdout, *format, *verbose)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err = subscribe(ctx, options, topics, types.QoS(*clientFlags.qos), *count, write)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// subscribe subscribes to filters and writes the received messages until
+// count messages were written, if count is not zero, or ctx is done.
+func subscribe(ctx context.Context, options client.Options, filters []string, qos types.QoS, count int,
+	write func(client.Message) error) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	// The subscriptions have no handlers, so every message is handled once
+	// by OnMessage, also if it matches more than one filter.
+	written := 0
+	options.OnMessage = func(message client.Message) {
+		if count > 0 && written == count {
+			return
+		}
+		err := write(message)
+		if err != nil {
+			cancel(err)
+			return
+		}
+		written++
+		if written == count {
+			cancel(errCountReached)
+		}
+	}
+	options.OnConnectionLost = func(err error) { cancel(err) }
+
+	c, err := connect(ctx, options)
+	if err != nil {
+		return err
+	}
+	for _, filter := range filters {
+		err = c.Subscribe(ctx, filter, qos, nil)
+		if err != nil {
+			cancel(fmt.Errorf("subscribe to %s: %w", filter, err))
+			break
+		}
+	}
+
+	<-ctx.Done()
+	err = context.Cause(ctx)
+	if errors.Is(err, errCountReached) || errors.Is(err, context.Canceled) {
+		err = nil
+	}
+
+	if c.Connected() {
+		disconnectCtx, cancel := context.WithTimeout(context.Background(), client.DefaultConnectTimeout)
+		defer cancel()
+		err = errors.Join(err, c.Disconnect(disconnectCtx))
+	}
+	return err
+}
+
+// messageWriter returns a function that writes messages to w in format.
+func messageWriter(w io.Writer, format string, verbose bool) (func(client.Message) error, error) {
+	var encode func(payload []byte) []byte
+	switch format {
+	case formatRaw:
+		encode = func(payload []byte) []byte { return payload }
+	case formatHex:
+		encode = func(payload []byte) []byte { return hex.AppendEncode(nil, payload) }
+	case formatJSON:
+		encoder := json.NewEncoder(w)
+		return func(message client.Message) error {
+			return encoder.Encode(makeJSONMessage(message))
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format: %s", format)
+	}
+
+	return func(message client.Message) error {
+		line := []byte{}
+		if verbose {
+			line = append(line, message.Topic...)
+			line = append(line, ' ')
+		}
+		line = append(line, encode(message.Payload)...)
+		_, err := w.Write(append(line, '\n'))
+		return err
+	}, nil
+}
+
+func makeJSONMessage(message client.Message) jsonMessage {
+	properties := message.Properties
+	output := jsonMessage{
+		Time:                  time.Now(),
+		Topic:                 message.Topic,
+		QoS:                   message.QoS,
+		Retain:                message.Retain,
+		Duplicate:             message.Duplicate,
+		UTF8Payload:           properties.UTF8Payload,
+		MessageExpiryInterval: int64(properties.MessageExpiryInterval / time.Second),
+		ContentType:           properties.ContentType,
+		ResponseTopic:         properties.ResponseTopic,
+		CorrelationData:       properties.CorrelationData,
+	}
+
+	if utf8.Valid(message.Payload) {
+		payload := string(message.Payload)
+		output.Payload = &payload
+	} else {
+		output.PayloadBase64 = message.Payload
+	}
+
+	for _, property := range properties.UserProperties {
+		output.UserProperties = append(output.UserProperties, jsonUserProperty{Name: property.Name, Value: property.Value})
+	}
+	return output
+}
@@ -92,6 +92,9 @@ func (integer *UnsignedInt) Decode(input []byte) (int, error) {
 			fmt.Sprintf("unsupported size: %d", integer.Size))
 	}
 
+  if len(input) < integer.Size {
+		return 0, codec.DecodeErr(integer, "input shorter than integer size")
+  }
   input = input[:integer.Size]
   switch integer.Size {
   case 1:
@@ -135,10 +138,10 @@ func (utfString *UtfString) Decode(input []byte) (int, error) {
 	length := binary.BigEndian.Uint16(input[:2])
 
 	input = input[2:]
-	utfString.Str = ""
-	for i := 0; i < int(length); i++ {
-		utfString.Str += string(input[i])
+	if len(input) < int(length) {
+		return 0, codec.DecodeErr(utfString, "input shorter than string length")
 	}
+	utfString.Str = string(input[:length])
 
 	return int(length)+ 2, nil
 }
@@ -169,8 +172,17 @@ func (utfStringPair *UtfStringPair) Encode() ([]byte, error) {
 }
 
 func (utfStringPair *UtfStringPair) Decode(input []byte) (int, error) {
-	// TODO: Decode utf string pair
-	return 0, nil
+	n, err := utfStringPair.Name.Decode(input)
+	if err != nil {
+		return 0, err
+	}
+
+	m, err := utfStringPair.Value.Decode(input[n:])
+	if err != nil {
+		return 0, err
+	}
+
+	return n + m, nil
 }
 
 // Encodes binary data as:
@@ -185,8 +197,8 @@ func (binaryData *BinaryData) Encode() ([]byte, error) {
 			errors.Join(codec.EncodeErr(binaryData, "length encoding error"), err)
 	}
 
-	copy(encoded, encLength)
-	copy(encoded[length.Value:], binaryData.Data)
+	encoded = append(encoded, encLength...)
+	encoded = append(encoded, binaryData.Data...)
 
 	return encoded, nil
 }
@@ -217,6 +229,9 @@ func (binaryData *BinaryData) Decode(input []byte) (int, error) {
   }
   input = input[n:]
 
+  if len(input) < int(length.Value) {
+    return 0, codec.DecodeErr(binaryData, "input shorter than data length")
+  }
   binaryData.Data = input[:length.Value]
 
   return n+int(length.Value), nil
@@ -231,6 +246,9 @@ func (vbi *VariableByteInteger) Decode(input []byte) (int, error) {
 	value := 0
 	i := 0
 	for i = 0; i < 4; i++ {
+		if i >= len(input) {
+			return 0, codec.DecodeErr(vbi, "input ends within variable byte integer")
+		}
 		value += int(input[i]&127) * multiplier
 		if multiplier > 128*128*128 {
 			return 0, codec.DecodeErr(vbi, "malformed variable byte integer")